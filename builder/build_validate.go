@@ -110,9 +110,10 @@ type fileInfo struct {
 
 // CheckManifestCorrectness validates that the changes in manifest files between
 // two versions aligns to the corresponding RPM changes. Any mismatched files
-// between the manifests and RPMs will be printed as errors. When there are no
-// errors, package and file statistics for each modified bundle will be displayed.
-func (b *Builder) CheckManifestCorrectness(fromVer, toVer, downloadRetries, tableWidth int, fromRepoURLOverrides, toRepoURLOverrides map[string]string) error {
+// between the manifests and RPMs will be printed as errors, unless waived. When
+// there are no errors, package and file statistics for each modified bundle will
+// be displayed. The findings can also be reported as JSON or JUnit.
+func (b *Builder) CheckManifestCorrectness(fromVer, toVer, downloadRetries, tableWidth int, fromRepoURLOverrides, toRepoURLOverrides map[string]string, opts McaOptions) error {
 	if fromVer < 0 || toVer < 0 {
 		return fmt.Errorf("Negative version not supported")
 	}
@@ -121,6 +122,22 @@ func (b *Builder) CheckManifestCorrectness(fromVer, toVer, downloadRetries, tabl
 		return fmt.Errorf("From version must be less than to version")
 	}
 
+	switch opts.Format {
+	case "":
+		opts.Format = McaFormatText
+	case McaFormatText, McaFormatJSON, McaFormatJUnit:
+	default:
+		return errors.Errorf("unknown report format %q, expected text, json or junit", opts.Format)
+	}
+
+	if opts.WaiverFile == "" {
+		opts.WaiverFile = b.Config.Mixer.McaWaiverFile
+	}
+	waivers, err := loadMcaWaivers(opts.WaiverFile)
+	if err != nil {
+		return err
+	}
+
 	// Suppress Stdout so that it doesn't clutter the results
 	stdOut := os.Stdout
 	os.Stdout, _ = os.Open(os.DevNull)
@@ -128,21 +145,24 @@ func (b *Builder) CheckManifestCorrectness(fromVer, toVer, downloadRetries, tabl
 		os.Stdout = stdOut
 	}()
 
-	if err := b.NewDNFConfIfNeeded(); err != nil {
-		return err
-	}
+	// The package snapshots don't need DNF
+	if !opts.Snapshot {
+		if err := b.NewDNFConfIfNeeded(); err != nil {
+			return err
+		}
 
-	// Load initial repo map
-	if err := b.ListRepos(); err != nil {
-		return err
+		// Load initial repo map
+		if err := b.ListRepos(); err != nil {
+			return err
+		}
 	}
 
 	// Get manifest file lists and subtracted RPM pkg/file lists
-	fromInfo, err := b.mcaInfo(fromVer, downloadRetries, fromRepoURLOverrides)
+	fromInfo, err := b.mcaInfo(fromVer, downloadRetries, fromRepoURLOverrides, opts.Snapshot)
 	if err != nil {
 		return err
 	}
-	toInfo, err := b.mcaInfo(toVer, downloadRetries, toRepoURLOverrides)
+	toInfo, err := b.mcaInfo(toVer, downloadRetries, toRepoURLOverrides, opts.Snapshot)
 	if err != nil {
 		return err
 	}
@@ -156,16 +176,30 @@ func (b *Builder) CheckManifestCorrectness(fromVer, toVer, downloadRetries, tabl
 
 	// Compare the manifest file changes against the RPM file changes to determine
 	// any errors.
-	errorList, warningList, err := analyzeMcaResults(b, results, fromInfo, toInfo, fromVer, toVer)
+	findings, err := analyzeMcaResults(b, results, fromInfo, toInfo, fromVer, toVer)
 	if err != nil {
 		return err
 	}
+	waivers.apply(findings)
 
 	// Re-enable Stdout for the results
 	os.Stdout = stdOut
 
+	if opts.Format != McaFormatText {
+		if err = writeMcaReport(opts, results, findings, fromVer, toVer); err != nil {
+			return err
+		}
+		// The report replaces the text output when written to stdout
+		if opts.Output == "" {
+			if countMcaFindings(findings)[mcaSeverityError] > 0 {
+				return errors.New("manifest errors were identified")
+			}
+			return nil
+		}
+	}
+
 	// Display errors and package/file statistics
-	err = printMcaResults(results, fromInfo, toInfo, fromVer, toVer, tableWidth, errorList, warningList)
+	err = printMcaResults(results, fromInfo, toInfo, fromVer, toVer, tableWidth, findings)
 	if err != nil {
 		return err
 	}
@@ -175,8 +209,9 @@ func (b *Builder) CheckManifestCorrectness(fromVer, toVer, downloadRetries, tabl
 
 // mcaInfo collects manifest/RPM metadata and uses it to create a list
 // of manifest files, subtracted packages, and subtracted package files for each
-// bundle in the provided version.
-func (b *Builder) mcaInfo(version, downloadRetries int, repoURLOverrides map[string]string) (map[string]*mcaBundleInfo, error) {
+// bundle in the provided version. The RPM metadata is read from the package
+// snapshot of the version when snapshot is set.
+func (b *Builder) mcaInfo(version, downloadRetries int, repoURLOverrides map[string]string, snapshot bool) (map[string]*mcaBundleInfo, error) {
 	allBundleInfo := make(map[string]*mcaBundleInfo)
 
 	// Get manifest info for valid bundle entries in the MoM.
@@ -186,7 +221,12 @@ func (b *Builder) mcaInfo(version, downloadRetries int, repoURLOverrides map[str
 	}
 
 	// Download and collect metadata for all packages
-	pInfo, err := b.mcaPkgInfo(mInfo, version, downloadRetries, repoURLOverrides)
+	var pInfo map[string]*mcaBundlePkgInfo
+	if snapshot {
+		pInfo, err = b.mcaSnapshotPkgInfo(mInfo, version)
+	} else {
+		pInfo, err = b.mcaPkgInfo(mInfo, version, downloadRetries, repoURLOverrides)
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -457,8 +497,7 @@ func (b *Builder) resolvePkgFiles(pkg *pkgInfo, downloadRetries int) ([]*fileInf
 	var err error
 	var out *bytes.Buffer
 
-	queryCmd := "[%{filenames}\a%{filesizes}\a%{filedigests}\a%{filemodes:perms}\a%{filelinktos}\a%{fileusername}\a%{filegroupname}\n]"
-	rpmCmd := []string{"rpm", "-qp", "--qf=" + queryCmd}
+	rpmCmd := []string{"rpm", "-qp", "--qf=" + pkgFilesQuery}
 
 	// Query RPM for file metadata lists
 	args := merge(rpmCmd, pkg.uri)
@@ -485,43 +524,56 @@ func (b *Builder) resolvePkgFiles(pkg *pkgInfo, downloadRetries int) ([]*fileInf
 			continue
 		}
 
-		fileMetadata := strings.Split(line, "\a")
-		path := fileMetadata[0]
-
-		// Paths that are banned from manifests are skipped by MCA
-		if isBannedPath(path) {
-			continue
+		if pkgFile := newPkgFileInfo(pkg.name, strings.Split(line, "\a")); pkgFile != nil {
+			pkgFiles = append(pkgFiles, pkgFile)
 		}
+	}
+	return pkgFiles, nil
+}
 
-		// Files with blacklisted characters are skipped
-		if swupd.FilenameBlacklisted(filepath.Base(path)) {
-			continue
-		}
+// pkgFilesQuery is the rpm query format of the file metadata used by MCA, one
+// line per file with the fields separated by '\a'.
+const pkgFilesQuery = "[%{filenames}\a%{filesizes}\a%{filedigests}\a%{filemodes:perms}\a%{filelinktos}\a%{fileusername}\a%{filegroupname}\n]"
 
-		// Directories are omitted from MCA because they may be missed from rpm output.
-		mode := fileMetadata[3]
-		if mode[:1] == "d" {
-			continue
-		}
+// newPkgFileInfo returns the MCA file metadata of a package file from the
+// fields of pkgFilesQuery, or nil when the file is not checked by MCA.
+func newPkgFileInfo(pkgName string, fileMetadata []string) *fileInfo {
+	if len(fileMetadata) != 7 {
+		return nil
+	}
+	path := fileMetadata[0]
 
-		// Some Clear Linux packages install files with path components that are
-		// symlinks. MCA must resolve file paths to align with the manifests.
-		path = resolveFileName(path)
+	// Paths that are banned from manifests are skipped by MCA
+	if isBannedPath(path) {
+		return nil
+	}
 
-		pkgFile := &fileInfo{
-			name:    path,
-			size:    fileMetadata[1],
-			hash:    fileMetadata[2],
-			modes:   fileMetadata[3],
-			links:   fileMetadata[4],
-			user:    fileMetadata[5],
-			group:   fileMetadata[6],
-			hashLen: len(fileMetadata[2]),
-			pkg:     pkg.name,
-		}
-		pkgFiles = append(pkgFiles, pkgFile)
+	// Files with blacklisted characters are skipped
+	if swupd.FilenameBlacklisted(filepath.Base(path)) {
+		return nil
+	}
+
+	// Directories are omitted from MCA because they may be missed from rpm output.
+	mode := fileMetadata[3]
+	if mode == "" || mode[:1] == "d" {
+		return nil
+	}
+
+	// Some Clear Linux packages install files with path components that are
+	// symlinks. MCA must resolve file paths to align with the manifests.
+	path = resolveFileName(path)
+
+	return &fileInfo{
+		name:    path,
+		size:    fileMetadata[1],
+		hash:    fileMetadata[2],
+		modes:   fileMetadata[3],
+		links:   fileMetadata[4],
+		user:    fileMetadata[5],
+		group:   fileMetadata[6],
+		hashLen: len(fileMetadata[2]),
+		pkg:     pkgName,
 	}
-	return pkgFiles, nil
 }
 
 // resolveRpmURIs resolves the rpm URIs for the pkgList and updates the pkgInfoCache
@@ -929,9 +981,9 @@ func isMinversion(from, to *swupd.File) bool {
 
 // analyzeMcaResults compares manifest file changes against package file changes.
 // When there are inconsistencies between the manifest and package file lists,
-// a slice of error strings is returned.
-func analyzeMcaResults(builder *Builder, results *mcaDiffResults, fromInfo, toInfo map[string]*mcaBundleInfo, fromVer, toVer int) ([]string, []string, error) {
-	var errorList = []string{}
+// the findings describing them are returned.
+func analyzeMcaResults(builder *Builder, results *mcaDiffResults, fromInfo, toInfo map[string]*mcaBundleInfo, fromVer, toVer int) ([]mcaFinding, error) {
+	var findings []mcaFinding
 
 	// Compare manifest files against package files. Inconsistencies are added to the errorList.
 	for _, b := range results.bundleDiff {
@@ -952,27 +1004,27 @@ func analyzeMcaResults(builder *Builder, results *mcaDiffResults, fromInfo, toIn
 				}
 			}
 			if !releaseFileMod {
-				errorList = append(errorList, "ERROR: /usr/lib/os-release is not modified in manifest 'os-core'\n")
+				findings = append(findings, newMcaFinding(mcaRuleNotModified, "os-core", "/usr/lib/os-release", "", ""))
 			}
 		}
 
-		errorList = append(errorList, diffResultLists(b, toInfo[b.name].subPkgFiles, "added")...)
-		errorList = append(errorList, diffResultLists(b, toInfo[b.name].subPkgFiles, "modified")...)
+		findings = append(findings, diffResultLists(b, toInfo[b.name].subPkgFiles, "added")...)
+		findings = append(findings, diffResultLists(b, toInfo[b.name].subPkgFiles, "modified")...)
 
 		// Added bundles will not exist in the fromInfo object and added bundles cannot have deleted files.
 		if fromInfo[b.name] != nil {
-			errorList = append(errorList, diffResultLists(b, fromInfo[b.name].subPkgFiles, "deleted")...)
+			findings = append(findings, diffResultLists(b, fromInfo[b.name].subPkgFiles, "deleted")...)
 		}
 	}
 
-	// Remove errors generated by special case manifest files that have no package
+	// Waive findings generated by special case manifest files that have no package
 	// equivalent. Any missing special case files will generate additional errors.
-	return checkMcaFbErrors(builder, errorList, fromVer, toVer)
+	return checkMcaFbErrors(builder, findings, fromVer, toVer)
 }
 
 // diffResultLists compares manifest files against package files and generates
-// an error string when they don't match.
-func diffResultLists(bundleDiff *mcaBundleDiff, info map[string]*fileInfo, mode string) []string {
+// a finding when they don't match.
+func diffResultLists(bundleDiff *mcaBundleDiff, info map[string]*fileInfo, mode string) []mcaFinding {
 	var pkgFiles []string
 	var manFiles []string
 
@@ -991,13 +1043,13 @@ func diffResultLists(bundleDiff *mcaBundleDiff, info map[string]*fileInfo, mode
 	sort.Strings(pkgFiles)
 	sort.Strings(manFiles)
 
-	var errorList = []string{}
+	var findings []mcaFinding
 
 	trackingFileFound := false
 	trackingFile := "/usr/share/clear/bundles/" + bundleDiff.name
 
-	// Compare manifest and package file lists. When they don't match, add an
-	// error string to the error slice.
+	// Compare manifest and package file lists. When they don't match, add a
+	// finding.
 	i := 0
 	j := 0
 	for i < len(pkgFiles) || j < len(manFiles) {
@@ -1018,14 +1070,12 @@ func diffResultLists(bundleDiff *mcaBundleDiff, info map[string]*fileInfo, mode
 				// included in a package
 				trackingFileFound = true
 			} else {
-				errorMsg := fmt.Sprintf("ERROR: %s is %s in manifest '%s', but not in a package\n", manFiles[j], mode, bundleDiff.name)
-				errorList = append(errorList, errorMsg)
+				findings = append(findings, newMcaFinding(mcaRuleNotInPackage, bundleDiff.name, manFiles[j], "", mode))
 			}
 			j++
 		case -1:
 			// File in package list, but not manifest
-			errorMsg := fmt.Sprintf("ERROR: %s is %s in package '%s', but not %s in manifest '%s'\n", pkgFiles[i], mode, info[pkgFiles[i]].pkg, mode, bundleDiff.name)
-			errorList = append(errorList, errorMsg)
+			findings = append(findings, newMcaFinding(mcaRuleNotInManifest, bundleDiff.name, pkgFiles[i], info[pkgFiles[i]].pkg, mode))
 			i++
 		case 0:
 			i++
@@ -1035,98 +1085,100 @@ func diffResultLists(bundleDiff *mcaBundleDiff, info map[string]*fileInfo, mode
 
 	// Create error when new bundle doesn't add a bundle tracking file.
 	if !trackingFileFound && mode == "added" && bundleDiff.status == added {
-		errorMsg := fmt.Sprintf("ERROR: %s is missing from manifest '%s'\n", trackingFile, bundleDiff.name)
-		errorList = append(errorList, errorMsg)
+		findings = append(findings, newMcaFinding(mcaRuleMissingTrackingFile, bundleDiff.name, trackingFile, "", ""))
 	}
 
-	return errorList
+	return findings
 }
 
-// checkMcaFbErrors checks for error messages generated by special case manifest
-// files that are not modified by packages.
-func checkMcaFbErrors(b *Builder, diffErrors []string, fromVer, toVer int) ([]string, []string, error) {
-	var errorList = []string{}
-	var warningList = []string{}
+// checkMcaFbErrors checks for findings generated by special case manifest
+// files that are not modified by packages. They are waived when expected, and
+// errors are added when they are missing.
+func checkMcaFbErrors(b *Builder, diffFindings []mcaFinding, fromVer, toVer int) ([]mcaFinding, error) {
+	var findings []mcaFinding
 
 	fromPlus10, err := b.isPlus10Version(fromVer)
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
 	toPlus10, err := b.isPlus10Version(toVer)
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
 
 	formatMatch, err := b.checkFormatsMatch(fromVer, toVer)
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
 
 	// The release file should be modified with the exception of the +10 to +20
 	// comparison. This value will be overridden when the file is unchanged.
 	releaseFileMod := true
 
-	// Special case files that can be modified in a manifest, but have no package
-	// equivalent will generate false positive errors. Remove the false positive
-	// errors and generate error/warning messages when expected special case errors
-	// are missing.
-	var versionFile, versionstampFile, formatFile bool
-	for _, err := range diffErrors {
-		switch err {
+	// Mixer updates files that have no package equivalent in every version.
+	// Their false positive findings are waived by the default waivers, and
+	// error/warning findings are generated when they are missing.
+	modified := make(map[string]bool)
+	for _, f := range diffFindings {
 		// Mixer modifies the version field in the /usr/lib/os-release file, but the
 		// file also exists in the filesystem package. When the filesystem package
-		// is modified, the false positive error will not be generated. To verify that
-		// os-release is modified when not comparing the +10 to the +20, the below error
-		// message is tracked in addition to the false positives.
-		case "ERROR: /usr/lib/os-release is not modified in manifest 'os-core'\n":
+		// is modified, the false positive finding will not be generated. To verify that
+		// os-release is modified when not comparing the +10 to the +20, the below
+		// finding is tracked in addition to the false positives.
+		if f.is(mcaRuleNotModified, "os-core", "/usr/lib/os-release") {
 			releaseFileMod = false
-		case "ERROR: /usr/lib/os-release is modified in manifest 'os-core', but not in a package\n":
 			continue
-		case "ERROR: /usr/share/clear/version is modified in manifest 'os-core', but not in a package\n":
-			versionFile = true
-		case "ERROR: /usr/share/clear/versionstamp is modified in manifest 'os-core', but not in a package\n":
-			versionstampFile = true
-		case "ERROR: /usr/share/defaults/swupd/format is modified in manifest 'os-core-update', but not in a package\n":
-			if toPlus10 || !formatMatch {
-				formatFile = true
-			}
-		default:
-			errorList = append(errorList, err)
 		}
+		if f.Rule == mcaRuleNotInPackage && (f.Change == "" || f.Change == "modified") {
+			modified[f.Bundle+":"+f.Path] = true
+		}
+		findings = append(findings, f)
 	}
+	versionFile := modified["os-core:/usr/share/clear/version"]
+	versionstampFile := modified["os-core:/usr/share/clear/versionstamp"]
+	formatFile := (toPlus10 || !formatMatch) && modified["os-core-update:/usr/share/defaults/swupd/format"]
 	if fromPlus10 {
 		// A comparison between +10 -> +20 versions is the only valid case when no changes
 		// are expected in os-core/os-core-update, but the +20 version cannot be detected since Mixer does
 		// not track the first file in a format. As a result, assume this case is a +10 -> +20
 		// comparison and print a warning message.
 		if !releaseFileMod && !versionFile && !versionstampFile && !formatFile {
-			warningList = append(warningList, "WARNING: If this is not a +10 to +20 comparison, expected file changes are missing from os-core/os-core-update\n")
-			return errorList, warningList, nil
+			findings = append(findings, mcaFinding{
+				Rule:     mcaRuleComparison,
+				Severity: mcaSeverityWarning,
+				Message:  "If this is not a +10 to +20 comparison, expected file changes are missing from os-core/os-core-update",
+			})
+			return findings, nil
 		}
-		warningList = append(warningList, "WARNING: If this is a +10 to +20 comparison, os-core/os-core-update have file exception errors\n")
+		findings = append(findings, mcaFinding{
+			Rule:     mcaRuleComparison,
+			Severity: mcaSeverityWarning,
+			Message:  "If this is a +10 to +20 comparison, os-core/os-core-update have file exception errors",
+		})
 	}
 
 	// When the comparison is not between +10 -> +20 versions, re-add an error when /usr/lib/os-release
 	// is not modified
 	if !releaseFileMod {
-		errorList = append(errorList, "ERROR: /usr/lib/os-release is not modified in manifest 'os-core'\n")
+		findings = append(findings, newMcaFinding(mcaRuleNotModified, "os-core", "/usr/lib/os-release", "", ""))
 	}
 	if !versionFile {
-		errorList = append(errorList, "ERROR: /usr/share/clear/version is not modified in manifest 'os-core'\n")
+		findings = append(findings, newMcaFinding(mcaRuleNotModified, "os-core", "/usr/share/clear/version", "", ""))
 	}
 	if !versionstampFile {
-		errorList = append(errorList, "ERROR: /usr/share/clear/versionstamp is not modified in manifest 'os-core'\n")
+		findings = append(findings, newMcaFinding(mcaRuleNotModified, "os-core", "/usr/share/clear/versionstamp", "", ""))
 	}
 
 	if (toPlus10 || !formatMatch) && !formatFile {
+		f := newMcaFinding(mcaRuleNotModified, "os-core-update", "/usr/share/defaults/swupd/format", "", "")
 		if fromPlus10 {
-			warningList = append(warningList, "WARNING: If comparing +10 to a version across multiple format boundaries, the format file in 'os-core-update' must be modified\n")
-		} else {
-			errorList = append(errorList, "ERROR: /usr/share/defaults/swupd/format is not modified in manifest 'os-core-update'\n")
+			f.Severity = mcaSeverityWarning
+			f.Message = "If comparing +10 to a version across multiple format boundaries, the format file in 'os-core-update' must be modified"
 		}
+		findings = append(findings, f)
 	}
 
-	return errorList, warningList, nil
+	return findings, nil
 }
 
 // isPlus10Version determines whether the version is the last version in a format.
@@ -1168,21 +1220,31 @@ func (b *Builder) checkFormatsMatch(fromVer, toVer int) (bool, error) {
 }
 
 // printMcaResults displays any MCA errors and prints bundle diff statistics when there are no errors.
-func printMcaResults(results *mcaDiffResults, fromInfo, toInfo map[string]*mcaBundleInfo, fromVer, toVer, tableWidth int, errorList, warningList []string) error {
+func printMcaResults(results *mcaDiffResults, fromInfo, toInfo map[string]*mcaBundleInfo, fromVer, toVer, tableWidth int, findings []mcaFinding) error {
 	// Print any warnings
-	for _, msg := range warningList {
-		log.Warning(log.Mca, "%s", msg)
+	for _, f := range findings {
+		switch f.Severity {
+		case mcaSeverityWarning:
+			log.Warning(log.Mca, "%s", f.Message)
+		case mcaSeverityWaived:
+			log.Debug(log.Mca, "Waived: %s (%s)", f.Message, f.Reason)
+		}
 	}
 	// An overwhelming number of errors can be generated when this test
 	// identifies a manifest bug, so limit the error output to 50.
-	if len(errorList) > 0 {
-		for i, err := range errorList {
-			if i == 50 {
-				log.Warning(log.Mca, " Error reporting is limited to 50, so additional errors were skipped.")
-				break
-			}
-			log.Error(log.Mca, err)
+	errorCount := 0
+	for _, f := range findings {
+		if f.Severity != mcaSeverityError {
+			continue
 		}
+		if errorCount == 50 {
+			log.Warning(log.Mca, " Error reporting is limited to 50, so additional errors were skipped.")
+			break
+		}
+		log.Error(log.Mca, "%s: %s", f.Rule, f.Message)
+		errorCount++
+	}
+	if errorCount > 0 {
 		return errors.New("manifest errors were identified")
 	}
 
@@ -23,9 +23,9 @@ import (
 	"math"
 	"os"
 	"os/exec"
-	"path"
 	"path/filepath"
 	"runtime"
+	"sort"
 	"strings"
 	"sync"
 
@@ -66,6 +66,18 @@ type Builder struct {
 	NumDeltaWorkers    int
 	NumBundleWorkers   int
 
+	// DeltaMemory is the memory budget, in bytes, of the concurrent delta
+	// creation jobs, zero meaning no limit.
+	DeltaMemory uint64
+
+	// JobQueueDir is the directory of the job queue handing fullfile and
+	// delta jobs to 'mixer worker' processes, empty to run them all locally.
+	JobQueueDir string
+
+	// Resume skips the build phases already completed for the mix version
+	// with the same inputs, as recorded in its checkpoint.
+	Resume bool
+
 	// Parsed versions.
 	MixVerUint32      uint32
 	UpstreamVerUint32 uint32
@@ -84,6 +96,12 @@ type UpdateParameters struct {
 	SkipFullfiles bool
 	// Skip zero packs generation
 	SkipPacks bool
+	// Check that the shared libraries needed by each bundle are available
+	CheckLibraries bool
+	// Check that the symlinks in each bundle point to available content
+	CheckLinks bool
+	// Fail the build when a content check finds problems
+	StrictChecks bool
 }
 
 var localPackages = make(map[string]bool)
@@ -265,27 +283,61 @@ func (b *Builder) BuildBundles(template *x509.Certificate, privkey *rsa.PrivateK
 		}
 	}
 
-	// Clean existing image and output directories
-	mixImageDir := path.Join(b.Config.Builder.ServerStateDir, "image", b.MixVer)
-	if _, err := os.Stat(mixImageDir); err == nil {
-		log.Warning(log.Mixer, "Wiping away existing image directory for mix version %s...", b.MixVer)
-		if err = os.RemoveAll(mixImageDir); err != nil {
-			return err
-		}
-	} else if !os.IsNotExist(err) {
+	// Get the set of bundles to build
+	set, err := b.getFullMixBundleSet()
+	if err != nil {
+		return err
+	}
+	inputs, err := b.bundlesInputs(set)
+	if err != nil {
+		return err
+	}
+	checkpoint, err := b.readCheckpoint(b.MixVer)
+	if err != nil {
 		return err
 	}
+	if b.resumePhase(checkpoint, phaseBundles, inputs) {
+		timer.Stop()
+		return nil
+	}
 
-	mixOutputDir := path.Join(b.Config.Builder.ServerStateDir, "www", b.MixVer)
-	if _, err := os.Stat(mixOutputDir); err == nil {
-		log.Warning(log.Mixer, "Wiping away existing output directory for mix version %s...", b.MixVer)
-		if err = os.RemoveAll(mixOutputDir); err != nil {
-			return err
+	// The image and output directories are built in the transaction, and
+	// the existing ones are restored if the build fails
+	t, err := b.beginTransaction()
+	if err != nil {
+		return err
+	}
+	for _, dir := range []string{"image", "www"} {
+		if err = t.stageDir(filepath.Join(b.Config.Builder.ServerStateDir, dir, b.MixVer), true); err != nil {
+			return b.abortTransaction(t, err)
 		}
-	} else if !os.IsNotExist(err) {
+	}
+	// The phases recorded were completed in the replaced directories
+	if err = os.Remove(b.checkpointPath(b.MixVer)); err != nil && !os.IsNotExist(err) {
+		return b.abortTransaction(t, err)
+	}
+	if err = b.buildMixBundles(timer, set, template, privkey, signflag, downloadRetries); err != nil {
+		return b.abortTransaction(t, err)
+	}
+	// A policy violation keeps the bundles, so the chroots can be inspected.
+	// The phase isn't recorded, so they are built again after a fix.
+	if err = b.checkPolicy(b.MixVer); err != nil {
+		log.Error(log.Mixer, "The bundles of version %s are kept in %s, run mixer build rollback to remove them", b.MixVer, filepath.Join(b.Config.Builder.ServerStateDir, "image", b.MixVer))
 		return err
 	}
+	checkpoint = &buildCheckpoint{Version: b.MixVer, filename: b.checkpointPath(b.MixVer)}
+	if err = checkpoint.record(phaseBundles, inputs); err != nil {
+		return b.abortTransaction(t, err)
+	}
+
+	timer.Stop()
+
+	return nil
+}
 
+// buildMixBundles builds the bundles of the mix version in its image
+// directory, after BuildBundles cleaned it.
+func (b *Builder) buildMixBundles(timer *stopWatch, set bundleSet, template *x509.Certificate, privkey *rsa.PrivateKey, signflag bool, downloadRetries int) error {
 	// Generate the certificate needed for signing verification if it does not exist
 	if !signflag && template != nil {
 		err := helpers.GenerateCertificate(b.Config.Builder.Cert, template, template, &privkey.PublicKey, privkey)
@@ -294,14 +346,18 @@ func (b *Builder) BuildBundles(template *x509.Certificate, privkey *rsa.PrivateK
 		}
 	}
 
-	// Get the set of bundles to build
-	set, err := b.getFullMixBundleSet()
+	// Validate set and compute AllPackages
+	err := validateAndFillBundleSet(set)
 	if err != nil {
 		return err
 	}
 
-	// Validate set and compute AllPackages
-	if err = validateAndFillBundleSet(set); err != nil {
+	setNames := make([]string, 0, len(set))
+	for name := range set {
+		setNames = append(setNames, name)
+	}
+	sort.Strings(setNames)
+	if err = b.runPhaseHooks(phaseBundles, false, timer, setNames); err != nil {
 		return err
 	}
 
@@ -311,6 +367,10 @@ func (b *Builder) BuildBundles(template *x509.Certificate, privkey *rsa.PrivateK
 		return err
 	}
 
+	if err = b.runPhaseHooks(phaseBundles, true, timer, nil); err != nil {
+		return err
+	}
+
 	// TODO: Move this logic to code that uses this.
 	// If LAST_VER don't exists, it means this is the first bundle we build,
 	// so initialize it to version "0".
@@ -322,8 +382,6 @@ func (b *Builder) BuildBundles(template *x509.Certificate, privkey *rsa.PrivateK
 		}
 	}
 
-	timer.Stop()
-
 	return nil
 }
 
@@ -349,7 +407,32 @@ func (b *Builder) BuildUpdate(params UpdateParameters) error {
 	timer := &stopWatch{w: os.Stdout}
 	defer timer.WriteSummary(os.Stdout)
 
-	err = b.buildUpdateContent(params, timer)
+	// The bundles may have been built before the policy was changed
+	if err := b.checkPolicy(b.MixVer); err != nil {
+		return err
+	}
+
+	t, err := b.beginTransaction()
+	if err != nil {
+		return err
+	}
+	for _, dir := range []string{"image", "www"} {
+		if err = t.stageDir(filepath.Join(b.Config.Builder.ServerStateDir, dir, b.MixVer), false); err != nil {
+			return b.abortTransaction(t, err)
+		}
+	}
+	if err = b.buildMixUpdate(params, timer, t); err != nil {
+		return b.abortTransaction(t, err)
+	}
+	return nil
+}
+
+// buildMixUpdate creates the update content of the mix version, then publishes
+// it by committing the transaction. The files pointing to the latest version
+// are written and signed in the staging directory of the transaction, so they
+// are only replaced once everything else succeeded.
+func (b *Builder) buildMixUpdate(params UpdateParameters, timer *stopWatch, t *buildTransaction) error {
+	err := b.buildUpdateContent(params, timer)
 	if err != nil {
 		return err
 	}
@@ -370,13 +453,21 @@ func (b *Builder) BuildUpdate(params UpdateParameters) error {
 		}
 	}
 
+	stagingDir, err := t.stagingDir()
+	if err != nil {
+		return err
+	}
+	formatDir := filepath.Join(b.Config.Builder.ServerStateDir, "www", "version", "format"+b.State.Mix.Format)
+	staged := make(map[string]string)
+
 	log.Info(log.Mixer, "Setting latest version to %s", b.MixVer)
 
-	latestVerFilePath := filepath.Join(b.Config.Builder.ServerStateDir, "www", "version", "latest_version")
+	latestVerFilePath := filepath.Join(stagingDir, "latest_version")
 	err = ioutil.WriteFile(latestVerFilePath, []byte(b.MixVer), 0644)
 	if err != nil {
 		return errors.Wrapf(err, "couldn't update the latest_version file")
 	}
+	staged[latestVerFilePath] = filepath.Join(b.Config.Builder.ServerStateDir, "www", "version", "latest_version")
 
 	// sign the latest_version file
 	if !params.SkipSigning {
@@ -385,28 +476,39 @@ func (b *Builder) BuildUpdate(params UpdateParameters) error {
 		if err != nil {
 			return errors.Wrapf(err, "couldn't sign the latest_version file")
 		}
+		staged[latestVerFilePath+".sig"] = staged[latestVerFilePath] + ".sig"
 	}
-	err = ioutil.WriteFile(filepath.Join(formatDir, "latest"), []byte(b.MixVer), 0644)
+
+	latestFilePath := filepath.Join(stagingDir, "latest")
+	err = ioutil.WriteFile(latestFilePath, []byte(b.MixVer), 0644)
 	if err != nil {
 		return errors.Wrapf(err, "couldn't update the latest version")
 	}
+	staged[latestFilePath] = filepath.Join(formatDir, "latest")
 
 	// sign the latest file in place based on the Mixed format
 	// read from builder.conf.
 	if !params.SkipSigning {
 		log.Info(log.Mixer, "Signing latest file")
-		err = b.signFile(filepath.Join(formatDir, "latest"))
+		err = b.signFile(latestFilePath)
 		if err != nil {
 			return errors.Wrapf(err, "couldn't sign the latest file")
 		}
+		staged[latestFilePath+".sig"] = staged[latestFilePath] + ".sig"
 	}
 
-	err = ioutil.WriteFile(filepath.Join(b.Config.Builder.ServerStateDir, "image", "LAST_VER"), []byte(b.MixVer), 0644)
+	lastVerFilePath := filepath.Join(stagingDir, "LAST_VER")
+	err = ioutil.WriteFile(lastVerFilePath, []byte(b.MixVer), 0644)
 	if err != nil {
 		return errors.Wrapf(err, "couldn't update the latest version")
 	}
+	staged[lastVerFilePath] = filepath.Join(b.Config.Builder.ServerStateDir, "image", "LAST_VER")
 
-	return nil
+	if err = b.stageHistory(t, timer, stagingDir, staged); err != nil {
+		return err
+	}
+
+	return t.commit(staged)
 }
 
 const migrationConfig = "release-image-config.json"
@@ -544,6 +646,25 @@ func (b *Builder) generateImageConfig(configFile string) error {
 	return err
 }
 
+// deltaMemoryLimiter returns the limiter admitting delta creation jobs against
+// the DeltaMemory budget, shared by all the versions deltas are created from.
+func (b *Builder) deltaMemoryLimiter() *swupd.MemoryLimiter {
+	if b.DeltaMemory == 0 {
+		return nil
+	}
+	log.Info(log.Mixer, "Limiting delta creation to %s of memory", formatSize(b.DeltaMemory))
+	return swupd.NewMemoryLimiter(b.DeltaMemory)
+}
+
+// jobQueue returns the job queue in JobQueueDir, or nil if not set.
+func (b *Builder) jobQueue() (*swupd.JobQueue, error) {
+	if b.JobQueueDir == "" {
+		return nil, nil
+	}
+	log.Info(log.Mixer, "Handing jobs to workers through the job queue %s", b.JobQueueDir)
+	return swupd.NewJobQueue(b.JobQueueDir)
+}
+
 // BuildDeltaPacks between two versions of the mix.
 func (b *Builder) BuildDeltaPacks(from, to uint32, printReport bool) error {
 	var err error
@@ -573,16 +694,44 @@ func (b *Builder) BuildDeltaPacks(from, to uint32, printReport bool) error {
 		return errors.Wrapf(err, "couldn't find manifest of from version")
 	}
 
+	checkpoint, err := b.readCheckpoint(fmt.Sprint(to))
+	if err != nil {
+		return err
+	}
+	inputs, err := b.deltaPacksInputs(from, to)
+	if err != nil {
+		return err
+	}
+	if b.resumePhase(checkpoint, deltaPacksPhase(from), inputs) {
+		return nil
+	}
+
 	bundleDir := filepath.Join(b.Config.Builder.ServerStateDir, "image")
+	if err = b.runPhaseHooks(phaseDeltaPacks, false, nil, nil, from); err != nil {
+		return err
+	}
+
 	// Create all deltas first
 
-	err = swupd.CreateAllDeltas(outputDir, int(fromManifest.Header.Version), int(toManifest.Header.Version), b.NumDeltaWorkers)
+	queue, err := b.jobQueue()
+	if err != nil {
+		return err
+	}
+	opts := swupd.DeltaOptions{NumWorkers: b.NumDeltaWorkers, Limiter: b.deltaMemoryLimiter(), Queue: queue}
+	err = swupd.CreateAllDeltasWithOptions(outputDir, int(fromManifest.Header.Version), int(toManifest.Header.Version), opts)
 	if err != nil {
 		return err
 	}
 
 	// Create packs filling in any missing deltas
-	return createDeltaPacks(fromManifest, toManifest, printReport, outputDir, bundleDir, b.NumDeltaWorkers)
+	err = createDeltaPacks(fromManifest, toManifest, printReport, outputDir, bundleDir, b.NumDeltaWorkers)
+	if err != nil {
+		return err
+	}
+	if err = b.runPhaseHooks(phaseDeltaPacks, true, nil, nil, from); err != nil {
+		return err
+	}
+	return checkpoint.record(deltaPacksPhase(from), inputs)
 }
 
 // BuildDeltaPacksPreviousVersions builds packs to version from up to
@@ -628,9 +777,35 @@ func (b *Builder) BuildDeltaPacksPreviousVersions(prev, to uint32, printReport b
 	}
 
 	log.Info(log.Mixer, "Found %d previous versions", len(previousManifests))
+
+	// Skip the versions whose delta packs were already completed
+	checkpoint, err := b.readCheckpoint(fmt.Sprint(to))
+	if err != nil {
+		return err
+	}
+	inputs := make(map[uint32]string)
+	remaining := previousManifests[:0]
+	for _, m := range previousManifests {
+		from := m.Header.Version
+		if inputs[from], err = b.deltaPacksInputs(from, to); err != nil {
+			return err
+		}
+		if !b.resumePhase(checkpoint, deltaPacksPhase(from), inputs[from]) {
+			remaining = append(remaining, m)
+		}
+	}
+	previousManifests = remaining
 	if len(previousManifests) == 0 {
 		return nil
 	}
+	fromVersions := make([]uint32, 0, len(previousManifests))
+	for _, m := range previousManifests {
+		fromVersions = append(fromVersions, m.Header.Version)
+	}
+	if err = b.runPhaseHooks(phaseDeltaPacks, false, nil, nil, fromVersions...); err != nil {
+		return err
+	}
+
 	bundleDir := filepath.Join(b.Config.Builder.ServerStateDir, "image")
 	// Create all deltas for all previous versions first based on full manifests
 	var versionQueue = make(chan *swupd.Manifest)
@@ -647,6 +822,11 @@ func (b *Builder) BuildDeltaPacksPreviousVersions(prev, to uint32, printReport b
 	}
 	wg.Add(versionWorkers)
 	log.Info(log.Mixer, "Using %d version threads and %d delta threads in each", versionWorkers, b.NumDeltaWorkers)
+	queue, err := b.jobQueue()
+	if err != nil {
+		return err
+	}
+	opts := swupd.DeltaOptions{NumWorkers: b.NumDeltaWorkers, Limiter: b.deltaMemoryLimiter(), Queue: queue}
 
 	// If possible, run a thread for each version back so we don't get locked up
 	// at the end of a version doing some large/slow delta pack in serial. This way
@@ -655,7 +835,7 @@ func (b *Builder) BuildDeltaPacksPreviousVersions(prev, to uint32, printReport b
 		go func() {
 			defer wg.Done()
 			for fromManifest := range versionQueue {
-				deltaErr := swupd.CreateAllDeltas(outputDir, int(fromManifest.Header.Version), int(toManifest.Header.Version), b.NumDeltaWorkers)
+				deltaErr := swupd.CreateAllDeltasWithOptions(outputDir, int(fromManifest.Header.Version), int(toManifest.Header.Version), opts)
 				if deltaErr != nil {
 					mux.Lock()
 					deltaErrors = append(deltaErrors, deltaErr)
@@ -685,6 +865,14 @@ func (b *Builder) BuildDeltaPacksPreviousVersions(prev, to uint32, printReport b
 			return err
 		}
 	}
+	if err = b.runPhaseHooks(phaseDeltaPacks, true, nil, nil, fromVersions...); err != nil {
+		return err
+	}
+	for _, from := range fromVersions {
+		if err = checkpoint.record(deltaPacksPhase(from), inputs[from]); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -0,0 +1,401 @@
+package builder
+
+import (
+	"bytes"
+	"debug/dwarf"
+	"debug/elf"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/clearlinux/mixer-tools/helpers"
+	"github.com/clearlinux/mixer-tools/log"
+	"github.com/clearlinux/mixer-tools/swupd"
+	"github.com/pkg/errors"
+)
+
+// debuginfodDirName is the directory in the server state dir holding the
+// debuginfod tree, i.e. buildid/<id>/{executable,debuginfo,source/...}, and
+// the build ID index.
+const debuginfodDirName = "debuginfod"
+
+// buildIDIndexName is the name of the build ID index in the debuginfod dir.
+const buildIDIndexName = "buildid-index.json"
+
+// ntGNUBuildID is the ELF note type used for GNU build IDs.
+const ntGNUBuildID = 3
+
+// BuildIDEntry describes a published ELF file with a given build ID.
+type BuildIDEntry struct {
+	Version   uint32
+	Path      string
+	Hash      string
+	Bundles   []string
+	SourceRPM string
+}
+
+// BuildIDIndex maps build IDs to all the published files carrying them, across
+// every indexed version.
+type BuildIDIndex map[string][]BuildIDEntry
+
+// readGNUBuildID returns the hex encoded GNU build ID of an ELF file or an empty
+// string if the file has none.
+func readGNUBuildID(f *elf.File) string {
+	for _, s := range f.Sections {
+		if s.Type != elf.SHT_NOTE {
+			continue
+		}
+		data, err := s.Data()
+		if err != nil {
+			continue
+		}
+		if id := parseGNUBuildIDNote(data, f.ByteOrder); id != "" {
+			return id
+		}
+	}
+	return ""
+}
+
+// parseGNUBuildIDNote walks the notes in data looking for a GNU build ID note.
+// The sizes are computed in uint64, so oversized fields of a malformed note
+// can't wrap around.
+func parseGNUBuildIDNote(data []byte, order binary.ByteOrder) string {
+	align := func(n uint64) uint64 { return (n + 3) &^ 3 }
+	for len(data) >= 12 {
+		nameSize := uint64(order.Uint32(data[0:4]))
+		descSize := uint64(order.Uint32(data[4:8]))
+		noteType := order.Uint32(data[8:12])
+		data = data[12:]
+		descStart := align(nameSize)
+		descEnd := descStart + descSize
+		if nameSize > uint64(len(data)) || descEnd > uint64(len(data)) {
+			return ""
+		}
+		name := data[:nameSize]
+		desc := data[descStart:descEnd]
+		if noteType == ntGNUBuildID && string(bytes.TrimRight(name, "\x00")) == "GNU" {
+			return hex.EncodeToString(desc)
+		}
+		next := align(descEnd)
+		if next > uint64(len(data)) {
+			return ""
+		}
+		data = data[next:]
+	}
+	return ""
+}
+
+// dwarfSourceFiles returns the source files referenced by the line tables of
+// an ELF file that has DWARF information.
+func dwarfSourceFiles(f *elf.File) []string {
+	d, err := f.DWARF()
+	if err != nil {
+		return nil
+	}
+	seen := make(map[string]bool)
+	r := d.Reader()
+	for {
+		entry, err := r.Next()
+		if err != nil || entry == nil {
+			break
+		}
+		if entry.Tag != dwarf.TagCompileUnit {
+			r.SkipChildren()
+			continue
+		}
+		lr, err := d.LineReader(entry)
+		if err == nil && lr != nil {
+			for _, lf := range lr.Files() {
+				if lf != nil && lf.Name != "" {
+					seen[filepath.Clean(lf.Name)] = true
+				}
+			}
+		}
+		r.SkipChildren()
+	}
+	files := make([]string, 0, len(seen))
+	for name := range seen {
+		files = append(files, name)
+	}
+	sort.Strings(files)
+	return files
+}
+
+// linkOrCopy hardlinks src to dst, falling back to a copy when the files are on
+// different filesystems. Existing destinations are left untouched.
+func linkOrCopy(dst, src string) error {
+	if _, err := os.Lstat(dst); err == nil {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	if err := os.Link(src, dst); err == nil {
+		return nil
+	}
+	return helpers.CopyFile(dst, src)
+}
+
+// publishBuildID populates the debuginfod tree for a single build ID using the
+// content of the full chroot.
+func publishBuildID(buildIDDir, fullDir, file, id, debugLib, debugSrc string) error {
+	idDir := filepath.Join(buildIDDir, id)
+	if err := linkOrCopy(filepath.Join(idDir, "executable"), filepath.Join(fullDir, file)); err != nil {
+		return err
+	}
+
+	debugFile := filepath.Join(fullDir, debugLib, ".build-id", id[:2], id[2:]+".debug")
+	sourceFile := filepath.Join(fullDir, file)
+	if _, err := os.Stat(debugFile); err == nil {
+		if err = linkOrCopy(filepath.Join(idDir, "debuginfo"), debugFile); err != nil {
+			return err
+		}
+		sourceFile = debugFile
+	}
+
+	f, err := elf.Open(sourceFile)
+	if err != nil {
+		return nil
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+
+	srcPrefix := filepath.Clean(debugSrc) + "/"
+	for _, src := range dwarfSourceFiles(f) {
+		if !strings.HasPrefix(src, srcPrefix) {
+			continue
+		}
+		fi, err := os.Lstat(filepath.Join(fullDir, src))
+		if err != nil || !fi.Mode().IsRegular() {
+			continue
+		}
+		if err = linkOrCopy(filepath.Join(idDir, "source", src), filepath.Join(fullDir, src)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readBundleFiles maps each file in the full chroot of a version to the bundles
+// that contain it, based on the bundle info files.
+func readBundleFiles(versionDir string) (map[string][]string, error) {
+	infos, err := filepath.Glob(filepath.Join(versionDir, "*-info"))
+	if err != nil {
+		return nil, err
+	}
+	owners := make(map[string][]string)
+	for _, path := range infos {
+		var bi swupd.BundleInfo
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if err = json.Unmarshal(content, &bi); err != nil {
+			return nil, errors.Wrapf(err, "couldn't parse bundle info %s", path)
+		}
+		for f := range bi.Files {
+			owners[f] = append(owners[f], bi.Name)
+		}
+	}
+	for f := range owners {
+		sort.Strings(owners[f])
+	}
+	return owners, nil
+}
+
+// readBuildIDIndex loads the build ID index, returning an empty index if none
+// was written yet.
+func readBuildIDIndex(path string) (BuildIDIndex, error) {
+	index := make(BuildIDIndex)
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return index, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(content, &index); err != nil {
+		return nil, errors.Wrapf(err, "couldn't parse build ID index %s", path)
+	}
+	return index, nil
+}
+
+// update replaces all the entries of a version in the index with entries.
+func (index BuildIDIndex) update(version uint32, entries map[string][]BuildIDEntry) {
+	for id, list := range index {
+		kept := list[:0]
+		for _, e := range list {
+			if e.Version != version {
+				kept = append(kept, e)
+			}
+		}
+		if len(kept) == 0 {
+			delete(index, id)
+		} else {
+			index[id] = kept
+		}
+	}
+	for id, list := range entries {
+		index[id] = append(index[id], list...)
+		sort.Slice(index[id], func(i, j int) bool {
+			a, b := index[id][i], index[id][j]
+			if a.Version != b.Version {
+				return a.Version < b.Version
+			}
+			return a.Path < b.Path
+		})
+	}
+}
+
+// BuildDebuginfod scans the ELF files published in the given version for GNU
+// build IDs and publishes them, together with their debuginfo and sources when
+// available in the full chroot, in a debuginfod compatible tree next to the
+// update content. The build ID index is updated to map each build ID to the
+// swupd file hashes, bundles and source rpms of the files carrying it.
+func (b *Builder) BuildDebuginfod(version uint32) error {
+	ver := fmt.Sprint(version)
+	versionDir := filepath.Join(b.Config.Builder.ServerStateDir, "image", ver)
+	fullDir := filepath.Join(versionDir, "full")
+	if _, err := os.Stat(fullDir); err != nil {
+		return errors.Wrapf(err, "couldn't access the full chroot for version %s", ver)
+	}
+
+	full, err := swupd.ParseManifestFile(filepath.Join(b.Config.Builder.ServerStateDir, "www", ver, "Manifest.full"))
+	if err != nil {
+		return errors.Wrapf(err, "couldn't read Manifest.full for version %s", ver)
+	}
+
+	bundleFiles, err := readBundleFiles(versionDir)
+	if err != nil {
+		return err
+	}
+
+	lists, err := readRpmFiles(versionDir)
+	if err != nil {
+		return err
+	}
+	sourceRPMs := make(map[string]string)
+	for _, l := range lists {
+		for _, f := range l.Files {
+			sourceRPMs[f] = l.SourceRPM
+		}
+	}
+
+	debuginfodDir := filepath.Join(b.Config.Builder.ServerStateDir, debuginfodDirName)
+	buildIDDir := filepath.Join(debuginfodDir, "buildid")
+	if err = os.MkdirAll(buildIDDir, 0755); err != nil {
+		return err
+	}
+
+	log.Info(log.Mixer, "Indexing build IDs for version %s", ver)
+
+	numWorkers := b.NumFullfileWorkers
+	if numWorkers < 1 {
+		numWorkers = 1
+	}
+	var wg sync.WaitGroup
+	var mux sync.Mutex
+	wg.Add(numWorkers)
+	fileCh := make(chan *swupd.File)
+	errorCh := make(chan error, numWorkers)
+	defer close(errorCh)
+
+	entries := make(map[string][]BuildIDEntry)
+	published := make(map[string]bool)
+
+	worker := func() {
+		defer wg.Done()
+		for file := range fileCh {
+			f, fErr := elf.Open(filepath.Join(fullDir, file.Name))
+			if fErr != nil {
+				// Not an ELF file.
+				continue
+			}
+			id := readGNUBuildID(f)
+			_ = f.Close()
+			if len(id) < 4 {
+				continue
+			}
+
+			mux.Lock()
+			first := !published[id]
+			published[id] = true
+			entries[id] = append(entries[id], BuildIDEntry{
+				Version:   version,
+				Path:      file.Name,
+				Hash:      file.Hash.String(),
+				Bundles:   bundleFiles[file.Name],
+				SourceRPM: sourceRPMs[file.Name],
+			})
+			mux.Unlock()
+
+			if !first {
+				continue
+			}
+			fErr = publishBuildID(buildIDDir, fullDir, file.Name, id, b.Config.Server.DebugInfoLib, b.Config.Server.DebugInfoSrc)
+			if fErr != nil {
+				errorCh <- errors.Wrapf(fErr, "couldn't publish build ID %s for %s", id, file.Name)
+				return
+			}
+		}
+	}
+	for i := 0; i < numWorkers; i++ {
+		go worker()
+	}
+
+	// Separate debuginfo files share the build ID of the file they describe, so
+	// they are only published as the debuginfo of that file.
+	debugPrefix := filepath.Clean(b.Config.Server.DebugInfoLib) + "/"
+	for _, f := range full.Files {
+		if f.Type != swupd.TypeFile || f.Status == swupd.StatusDeleted || f.Status == swupd.StatusGhosted {
+			continue
+		}
+		if strings.HasPrefix(f.Name, debugPrefix) {
+			continue
+		}
+		select {
+		case fileCh <- f:
+		case err = <-errorCh:
+			// break as soon as there is a failure.
+			break
+		}
+		if err != nil {
+			break
+		}
+	}
+	close(fileCh)
+	wg.Wait()
+
+	if err != nil {
+		return err
+	}
+	if len(errorCh) > 0 {
+		return <-errorCh
+	}
+
+	indexFile := filepath.Join(debuginfodDir, buildIDIndexName)
+	index, err := readBuildIDIndex(indexFile)
+	if err != nil {
+		return err
+	}
+	index.update(version, entries)
+
+	content, err := json.MarshalIndent(index, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err = ioutil.WriteFile(indexFile, content, 0644); err != nil {
+		return errors.Wrapf(err, "couldn't write build ID index")
+	}
+
+	log.Info(log.Mixer, "Published %d build IDs to %s", len(entries), debuginfodDir)
+	return nil
+}
@@ -0,0 +1,222 @@
+package builder
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// mustWriteELFWithBuildID writes a minimal ELF file with a single
+// .note.gnu.build-id section containing id.
+func mustWriteELFWithBuildID(t *testing.T, path string, id []byte) {
+	t.Helper()
+
+	var note bytes.Buffer
+	_ = binary.Write(&note, binary.LittleEndian, []uint32{4, uint32(len(id)), ntGNUBuildID})
+	note.WriteString("GNU\x00")
+	note.Write(id)
+	for note.Len()%4 != 0 {
+		note.WriteByte(0)
+	}
+	strtab := []byte("\x00.note.gnu.build-id\x00.shstrtab\x00")
+
+	hdrSize := uint64(binary.Size(elf.Header64{}))
+	noteOff := hdrSize
+	strtabOff := noteOff + uint64(note.Len())
+	shOff := strtabOff + uint64(len(strtab))
+
+	hdr := elf.Header64{
+		Type:      uint16(elf.ET_EXEC),
+		Machine:   uint16(elf.EM_X86_64),
+		Version:   uint32(elf.EV_CURRENT),
+		Shoff:     shOff,
+		Ehsize:    uint16(hdrSize),
+		Shentsize: uint16(binary.Size(elf.Section64{})),
+		Shnum:     3,
+		Shstrndx:  2,
+	}
+	copy(hdr.Ident[:], elf.ELFMAG)
+	hdr.Ident[elf.EI_CLASS] = byte(elf.ELFCLASS64)
+	hdr.Ident[elf.EI_DATA] = byte(elf.ELFDATA2LSB)
+	hdr.Ident[elf.EI_VERSION] = byte(elf.EV_CURRENT)
+
+	sections := []elf.Section64{
+		{},
+		{Name: 1, Type: uint32(elf.SHT_NOTE), Off: noteOff, Size: uint64(note.Len()), Addralign: 4},
+		{Name: 20, Type: uint32(elf.SHT_STRTAB), Off: strtabOff, Size: uint64(len(strtab)), Addralign: 1},
+	}
+
+	var out bytes.Buffer
+	_ = binary.Write(&out, binary.LittleEndian, hdr)
+	out.Write(note.Bytes())
+	out.Write(strtab)
+	_ = binary.Write(&out, binary.LittleEndian, sections)
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, out.Bytes(), 0755); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReadGNUBuildID(t *testing.T) {
+	testDir, err := ioutil.TempDir("", "buildid-test-")
+	if err != nil {
+		t.Fatalf("couldn't create temporary directory: %s", err)
+	}
+	defer cleanup(testDir)
+
+	path := filepath.Join(testDir, "file")
+	mustWriteELFWithBuildID(t, path, []byte{0xde, 0xad, 0xbe, 0xef, 0x01})
+
+	f, err := elf.Open(path)
+	if err != nil {
+		t.Fatalf("couldn't open test ELF file: %s", err)
+	}
+	defer func() { _ = f.Close() }()
+
+	if id := readGNUBuildID(f); id != "deadbeef01" {
+		t.Errorf("got build ID %q, expected %q", id, "deadbeef01")
+	}
+
+	if id := parseGNUBuildIDNote([]byte{1, 2, 3}, binary.LittleEndian); id != "" {
+		t.Errorf("got build ID %q from truncated note", id)
+	}
+}
+
+// buildIDNote returns a GNU build ID note with the given size fields.
+func buildIDNote(nameSize, descSize uint32, content []byte) []byte {
+	var note bytes.Buffer
+	_ = binary.Write(&note, binary.LittleEndian, []uint32{nameSize, descSize, ntGNUBuildID})
+	note.Write(content)
+	return note.Bytes()
+}
+
+func TestParseGNUBuildIDNoteMalformed(t *testing.T) {
+	valid := buildIDNote(4, 2, []byte("GNU\x00\xab\xcd\x00\x00"))
+	if id := parseGNUBuildIDNote(valid, binary.LittleEndian); id != "abcd" {
+		t.Errorf("got build ID %q, expected %q", id, "abcd")
+	}
+
+	malformed := map[string][]byte{
+		"truncated desc":     valid[:len(valid)-3],
+		"truncated name":     buildIDNote(4, 2, []byte("GN")),
+		"oversized name":     buildIDNote(0xFFFFFFFF, 2, []byte("GNU\x00\xab\xcd\x00\x00")),
+		"oversized desc":     buildIDNote(4, 0xFFFFFFFF, []byte("GNU\x00\xab\xcd\x00\x00")),
+		"wrapping name":      buildIDNote(0xFFFFFFFD, 0, []byte("GNU\x00")),
+		"wrapping desc":      buildIDNote(4, 0xFFFFFFFE, []byte("GNU\x00\xab\xcd")),
+		"oversized both":     buildIDNote(0xFFFFFFFF, 0xFFFFFFFF, nil),
+		"truncated 2nd note": append(buildIDNote(0, 0, nil), buildIDNote(4, 8, []byte("GNU\x00"))...),
+	}
+	for name, data := range malformed {
+		if id := parseGNUBuildIDNote(data, binary.LittleEndian); id != "" {
+			t.Errorf("%s: got build ID %q from a malformed note", name, id)
+		}
+	}
+}
+
+func FuzzParseGNUBuildIDNote(f *testing.F) {
+	f.Add(buildIDNote(4, 2, []byte("GNU\x00\xab\xcd\x00\x00")))
+	f.Add(buildIDNote(0xFFFFFFFD, 0xFFFFFFFF, []byte("GNU\x00")))
+	f.Add([]byte{1, 2, 3})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		_ = parseGNUBuildIDNote(data, binary.LittleEndian)
+		_ = parseGNUBuildIDNote(data, binary.BigEndian)
+	})
+}
+
+func TestBuildIDIndexUpdate(t *testing.T) {
+	index := BuildIDIndex{
+		"aa": {{Version: 10, Path: "/a"}, {Version: 20, Path: "/a"}},
+		"bb": {{Version: 20, Path: "/b"}},
+	}
+	index.update(20, map[string][]BuildIDEntry{
+		"cc": {{Version: 20, Path: "/c"}},
+	})
+
+	expected := BuildIDIndex{
+		"aa": {{Version: 10, Path: "/a"}},
+		"cc": {{Version: 20, Path: "/c"}},
+	}
+	if !reflect.DeepEqual(index, expected) {
+		t.Errorf("got index %v, expected %v", index, expected)
+	}
+}
+
+func TestBuildDebuginfod(t *testing.T) {
+	testDir, err := ioutil.TempDir("", "buildid-test-")
+	if err != nil {
+		t.Fatalf("couldn't create temporary directory: %s", err)
+	}
+	defer cleanup(testDir)
+
+	b := New()
+	b.Config.Builder.ServerStateDir = testDir
+	b.Config.Server.DebugInfoLib = "/usr/lib/debug"
+	b.Config.Server.DebugInfoSrc = "/usr/src/debug"
+	b.NumFullfileWorkers = 2
+
+	versionDir := filepath.Join(testDir, "image", "10")
+	fullDir := filepath.Join(versionDir, "full")
+	id := []byte{0x12, 0x34, 0x56, 0x78}
+	mustWriteELFWithBuildID(t, filepath.Join(fullDir, "usr/bin/foo"), id)
+	mustWriteELFWithBuildID(t, filepath.Join(fullDir, "usr/lib/debug/.build-id/12/345678.debug"), id)
+	if err = ioutil.WriteFile(filepath.Join(fullDir, "usr/bin/script"), []byte("#!/bin/sh\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := json.Marshal(bundle{Name: "foo", Files: map[string]bool{"/usr/bin/foo": true, "/usr/bin/script": true}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(filepath.Join(versionDir, "foo-info"), info, 0644); err != nil {
+		t.Fatal(err)
+	}
+	rpms, err := json.Marshal(map[string]*rpmFileList{
+		"foo-1-1.x86_64.rpm": {SourceRPM: "foo-1-1.src.rpm", Files: []string{"/usr/bin/foo"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(filepath.Join(versionDir, rpmFilesName), rpms, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	hash := strings.Repeat("1", 64)
+	manifest := fmt.Sprintf("MANIFEST\t30\nversion:\t10\nprevious:\t0\nfilecount:\t3\ntimestamp:\t1\ncontentsize:\t1\n\n"+
+		"F...\t%[1]s\t10\t/usr/bin/foo\nF...\t%[1]s\t10\t/usr/bin/script\nF...\t%[1]s\t10\t/usr/lib/debug/.build-id/12/345678.debug\n", hash)
+	if err = os.MkdirAll(filepath.Join(testDir, "www", "10"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(filepath.Join(testDir, "www", "10", "Manifest.full"), []byte(manifest), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = b.BuildDebuginfod(10); err != nil {
+		t.Fatalf("unexpected error building debuginfod tree: %s", err)
+	}
+
+	idDir := filepath.Join(testDir, debuginfodDirName, "buildid", "12345678")
+	mustExist(t, filepath.Join(idDir, "executable"))
+	mustExist(t, filepath.Join(idDir, "debuginfo"))
+
+	index, err := readBuildIDIndex(filepath.Join(testDir, debuginfodDirName, buildIDIndexName))
+	if err != nil {
+		t.Fatalf("couldn't read build ID index: %s", err)
+	}
+	expected := BuildIDIndex{
+		"12345678": {{Version: 10, Path: "/usr/bin/foo", Hash: hash, Bundles: []string{"foo"}, SourceRPM: "foo-1-1.src.rpm"}},
+	}
+	if !reflect.DeepEqual(index, expected) {
+		t.Errorf("got index %v, expected %v", index, expected)
+	}
+}
@@ -749,10 +749,14 @@ const bundleTemplateFormat = `# [TITLE]: %s
 # [MAINTAINER]: 
 # 
 # List packages one per line.
+# version constraints have format: package >= 1.0, < 2.0
 # includes have format:            include(bundle)
 # also-adds have format:           also-add(bundle)
 # content chroots have format:     content(path)
 # un-exportable files have format: un-export(path)
+# excluded paths have format:      exclude(glob)
+# picked files have format:        file(package:glob)
+# post-install hooks have format:   hook(ldconfig|systemd-presets|/path/to/script)
 `
 
 func createBundleFile(bundle string, path string) error {
@@ -0,0 +1,277 @@
+package builder
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/clearlinux/mixer-tools/log"
+	"github.com/pkg/errors"
+)
+
+// Status of a bundle in a build plan.
+const (
+	planNew       = "new"
+	planRemoved   = "removed"
+	planChanged   = "changed"
+	planUnchanged = "unchanged"
+)
+
+// packageChange is a package whose version changes between two versions.
+type packageChange struct {
+	Name        string
+	FromVersion string
+	ToVersion   string
+}
+
+// bundlePlan is the change of the packages of a bundle relative to the
+// previous version. Packages are described as "name version", with an empty
+// version when it is unknown.
+type bundlePlan struct {
+	Name     string
+	Status   string
+	Added    []string
+	Removed  []string
+	Upgraded []packageChange
+
+	// LocalContent is set when the content of the bundle also comes from
+	// content(), file() or hook() directives, which may change it even when
+	// its packages don't.
+	LocalContent bool
+}
+
+// packageVersions maps package names to their "version-release".
+type packageVersions map[string]string
+
+func formatPackage(name, version string) string {
+	if version == "" {
+		return name
+	}
+	return name + " " + version
+}
+
+// planBundleChanges compares the packages of the bundles of the previous
+// version with the resolved packages of the next version.
+func planBundleChanges(prev, next map[string]packageVersions) []bundlePlan {
+	var names []string
+	for name := range next {
+		names = append(names, name)
+	}
+	for name := range prev {
+		if _, ok := next[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	plans := make([]bundlePlan, 0, len(names))
+	for _, name := range names {
+		plan := bundlePlan{Name: name}
+		before, hadBundle := prev[name]
+		after, hasBundle := next[name]
+		switch {
+		case !hadBundle:
+			plan.Status = planNew
+		case !hasBundle:
+			plan.Status = planRemoved
+		}
+
+		for pkg, version := range after {
+			prevVersion, ok := before[pkg]
+			if !ok {
+				plan.Added = append(plan.Added, formatPackage(pkg, version))
+			} else if prevVersion != "" && version != "" && !sameEVR(prevVersion, version) {
+				plan.Upgraded = append(plan.Upgraded, packageChange{Name: pkg, FromVersion: prevVersion, ToVersion: version})
+			}
+		}
+		for pkg, version := range before {
+			if _, ok := after[pkg]; !ok {
+				plan.Removed = append(plan.Removed, formatPackage(pkg, version))
+			}
+		}
+		sort.Strings(plan.Added)
+		sort.Strings(plan.Removed)
+		sort.Slice(plan.Upgraded, func(i, j int) bool { return plan.Upgraded[i].Name < plan.Upgraded[j].Name })
+
+		if plan.Status == "" {
+			plan.Status = planUnchanged
+			if len(plan.Added) > 0 || len(plan.Removed) > 0 || len(plan.Upgraded) > 0 {
+				plan.Status = planChanged
+			}
+		}
+		plans = append(plans, plan)
+	}
+	return plans
+}
+
+// sameEVR reports whether two [epoch:]version-release strings are the same
+// version. The versions read from rpm file names have no epoch, unlike the
+// versions resolved by dnf, so the epochs are only compared when both have one.
+func sameEVR(a, b string) bool {
+	epochA, verA, relA := splitEVR(a)
+	epochB, verB, relB := splitEVR(b)
+	if epochA != "" && epochB != "" && rpmVerCmp(epochA, epochB) != 0 {
+		return false
+	}
+	return rpmVerCmp(verA, verB) == 0 && rpmVerCmp(relA, relB) == 0
+}
+
+// splitRpmFilename returns the name and "version-release" of an rpm from its
+// file name, "name-version-release.arch.rpm".
+func splitRpmFilename(rpm string) (string, string, bool) {
+	s := strings.TrimSuffix(rpm, ".rpm")
+	i := strings.LastIndex(s, ".")
+	if i < 0 {
+		return "", "", false
+	}
+	s = s[:i]
+	r := strings.LastIndex(s, "-")
+	if r < 0 {
+		return "", "", false
+	}
+	v := strings.LastIndex(s[:r], "-")
+	if v <= 0 {
+		return "", "", false
+	}
+	return s[:v], s[v+1:], true
+}
+
+// readBundlePackages returns the packages of each bundle built for a version,
+// with the versions recorded in its rpm-files when available.
+func readBundlePackages(versionDir string) (map[string]packageVersions, error) {
+	bundles, err := readBuiltBundles(versionDir)
+	if err != nil {
+		return nil, err
+	}
+
+	versions := make(packageVersions)
+	// Versions built before rpm-files was recorded have no package versions,
+	// so their upgrades can't be reported.
+	if _, err = os.Stat(filepath.Join(versionDir, rpmFilesName)); os.IsNotExist(err) {
+		log.Warning(log.Mixer, "Package versions of %s are unknown, it has no %s file: only added and removed packages are reported", versionDir, rpmFilesName)
+	}
+	lists, err := readRpmFiles(versionDir)
+	if err != nil {
+		log.Warning(log.Mixer, "Package versions of %s are unknown: %s", versionDir, err)
+	}
+	for rpm := range lists {
+		if name, version, ok := splitRpmFilename(rpm); ok {
+			versions[name] = version
+		}
+	}
+
+	result := make(map[string]packageVersions)
+	for _, bundle := range bundles {
+		pkgs := make(packageVersions)
+		for pkg := range bundle.AllPackages {
+			pkgs[pkg] = versions[pkg]
+		}
+		result[bundle.Name] = pkgs
+	}
+	return result, nil
+}
+
+// PlanBundles resolves the packages of the bundles of the mix and prints, for
+// each bundle, the packages added, removed and upgraded relative to the
+// previous version, without building anything.
+func (b *Builder) PlanBundles() error {
+	if err := b.getUpstreamBundles(); err != nil {
+		return err
+	}
+	if err := b.NewDNFConfIfNeeded(); err != nil {
+		return err
+	}
+
+	set, err := b.getFullMixBundleSet()
+	if err != nil {
+		return err
+	}
+	if err = validateAndFillBundleSet(set); err != nil {
+		return err
+	}
+
+	prevVer := b.State.Mix.PreviousMixVer
+	prev := make(map[string]packageVersions)
+	if prevVer != "" && prevVer != "0" {
+		prevDir := filepath.Join(b.Config.Builder.ServerStateDir, "image", prevVer)
+		if _, err = os.Stat(prevDir); err != nil {
+			return errors.Wrapf(err, "couldn't find previous version %s", prevVer)
+		}
+		if prev, err = readBundlePackages(prevDir); err != nil {
+			return err
+		}
+	}
+
+	packagerCmd := []string{
+		"dnf",
+		"--config=" + b.Config.Builder.DNFConf,
+		"-y",
+		"--releasever=" + b.UpstreamVer,
+	}
+	if err = clearDNFCache(packagerCmd); err != nil {
+		return err
+	}
+	repoPkgs, err := resolvePackagesValidation(b.NumBundleWorkers, set, packagerCmd)
+	if err != nil {
+		return err
+	}
+
+	next := make(map[string]packageVersions)
+	repoPkgs.Range(func(name, value interface{}) bool {
+		pkgs := make(packageVersions)
+		for _, repoPkgs := range value.(repoPkgMap) {
+			for _, pkg := range repoPkgs {
+				pkgs[pkg.name] = pkg.version
+			}
+		}
+		next[name.(string)] = pkgs
+		return true
+	})
+
+	plans := planBundleChanges(prev, next)
+	for i := range plans {
+		if bundle, ok := set[plans[i].Name]; ok {
+			plans[i].LocalContent = len(bundle.ContentChroots) > 0 || len(bundle.FilePicks) > 0 || len(bundle.Hooks) > 0
+		}
+	}
+	printBundlePlan(b.MixVer, prevVer, plans)
+	return nil
+}
+
+func printBundlePlan(version, prevVer string, plans []bundlePlan) {
+	if prevVer == "" || prevVer == "0" {
+		fmt.Printf("Plan for version %s (no previous version)\n\n", version)
+	} else {
+		fmt.Printf("Plan for version %s from version %s\n\n", version, prevVer)
+	}
+
+	counts := make(map[string]int)
+	for _, plan := range plans {
+		counts[plan.Status]++
+		if plan.Status == planUnchanged && !plan.LocalContent {
+			continue
+		}
+		if plan.LocalContent {
+			fmt.Printf("%s: %s, local content may also change\n", plan.Name, plan.Status)
+		} else {
+			fmt.Printf("%s: %s\n", plan.Name, plan.Status)
+		}
+		for _, p := range plan.Added {
+			fmt.Printf("  + %s\n", p)
+		}
+		for _, p := range plan.Removed {
+			fmt.Printf("  - %s\n", p)
+		}
+		for _, c := range plan.Upgraded {
+			change := "upgrade"
+			if compareEVR(c.ToVersion, c.FromVersion) < 0 {
+				change = "downgrade"
+			}
+			fmt.Printf("  ~ %s %s -> %s (%s)\n", c.Name, c.FromVersion, c.ToVersion, change)
+		}
+	}
+	fmt.Printf("\n%d changed, %d new, %d removed, %d unchanged bundles\n",
+		counts[planChanged], counts[planNew], counts[planRemoved], counts[planUnchanged])
+}
@@ -0,0 +1,69 @@
+package builder
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplitRpmFilename(t *testing.T) {
+	tests := []struct {
+		rpm, name, version string
+		ok                 bool
+	}{
+		{"openssl-3.0.13-5.x86_64.rpm", "openssl", "3.0.13-5", true},
+		{"python3-dev-3.12.1-20.noarch.rpm", "python3-dev", "3.12.1-20", true},
+		{"foo-1.0.x86_64.rpm", "", "", false},
+		{"foo.rpm", "", "", false},
+	}
+	for _, tt := range tests {
+		name, version, ok := splitRpmFilename(tt.rpm)
+		if name != tt.name || version != tt.version || ok != tt.ok {
+			t.Errorf("splitRpmFilename(%q) = %q, %q, %t, expected %q, %q, %t", tt.rpm, name, version, ok, tt.name, tt.version, tt.ok)
+		}
+	}
+}
+
+func TestPlanBundleChanges(t *testing.T) {
+	prev := map[string]packageVersions{
+		"os-core": {"filesystem": "1-1", "bash": "5.1-2", "perl": "5.36-1"},
+		"editors": {"vim": "9.0-1", "nano": "7.0-2", "emacs": ""},
+		"old":     {"foo": "1-1"},
+	}
+	// The versions resolved by dnf have an epoch, unlike the ones read from
+	// the rpm file names of the previous version.
+	next := map[string]packageVersions{
+		"os-core": {"filesystem": "1-1", "bash": "5.1-2", "perl": "4:5.36-1"},
+		"editors": {"vim": "9.1-1", "joe": "4.6-1", "emacs": "29.1-1"},
+		"new":     {"bar": "2-1"},
+	}
+
+	expected := []bundlePlan{
+		{Name: "editors", Status: planChanged, Added: []string{"joe 4.6-1"}, Removed: []string{"nano 7.0-2"},
+			Upgraded: []packageChange{{Name: "vim", FromVersion: "9.0-1", ToVersion: "9.1-1"}}},
+		{Name: "new", Status: planNew, Added: []string{"bar 2-1"}},
+		{Name: "old", Status: planRemoved, Removed: []string{"foo 1-1"}},
+		{Name: "os-core", Status: planUnchanged},
+	}
+	if plans := planBundleChanges(prev, next); !reflect.DeepEqual(plans, expected) {
+		t.Errorf("got plans\n%+v\nexpected\n%+v", plans, expected)
+	}
+}
+
+func TestSameEVR(t *testing.T) {
+	tests := []struct {
+		a, b     string
+		expected bool
+	}{
+		{"5.36-1", "4:5.36-1", true},
+		{"4:5.36-1", "5.36-1", true},
+		{"1:5.36-1", "4:5.36-1", false},
+		{"5.36-1", "4:5.36-2", false},
+		{"5.36-1", "5.37-1", false},
+		{"0:1.0-1", "1.0-1", true},
+	}
+	for _, tt := range tests {
+		if got := sameEVR(tt.a, tt.b); got != tt.expected {
+			t.Errorf("sameEVR(%q, %q) = %t, expected %t", tt.a, tt.b, got, tt.expected)
+		}
+	}
+}
@@ -0,0 +1,321 @@
+package builder
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/clearlinux/mixer-tools/log"
+	"github.com/clearlinux/mixer-tools/swupd"
+	"github.com/olekukonko/tablewriter"
+	"github.com/pkg/errors"
+)
+
+// bundleSize holds the sizes, in bytes, of a bundle together with its
+// recursive includes. It is also used for the budgets declared in the BUDGET
+// field of a bundle header, where a zero size means no limit.
+type bundleSize struct {
+	// Installed is the size of the content installed on the client.
+	Installed uint64
+	// Download is the size of the fullfiles needed to install the content.
+	Download uint64
+	// ZeroPack is the size of the zero packs of the bundle and its includes.
+	ZeroPack uint64
+}
+
+var sizeSuffixes = map[string]uint64{
+	"":  1,
+	"K": 1 << 10,
+	"M": 1 << 20,
+	"G": 1 << 30,
+}
+
+// ParseSize parses a size in bytes with an optional K, M or G suffix.
+func ParseSize(s string) (uint64, error) {
+	s = strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(s)), "B")
+	i := strings.IndexFunc(s, func(r rune) bool { return !unicode.IsDigit(r) })
+	if i == -1 {
+		i = len(s)
+	}
+	mult, ok := sizeSuffixes[s[i:]]
+	if !ok || i == 0 {
+		return 0, errors.Errorf("invalid size %q", s)
+	}
+	n, err := strconv.ParseUint(s[:i], 10, 64)
+	if err != nil {
+		return 0, errors.Errorf("invalid size %q", s)
+	}
+	return n * mult, nil
+}
+
+// formatSize returns a human readable representation of a size in bytes.
+func formatSize(n uint64) string {
+	switch {
+	case n >= 1<<30:
+		return fmt.Sprintf("%.1fG", float64(n)/(1<<30))
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1fM", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.1fK", float64(n)/(1<<10))
+	}
+	return fmt.Sprintf("%dB", n)
+}
+
+// formatGrowth returns a human readable representation of the change between
+// two sizes.
+func formatGrowth(from, to uint64) string {
+	if to >= from {
+		return "+" + formatSize(to-from)
+	}
+	return "-" + formatSize(from-to)
+}
+
+// parseSizeBudget parses the value of the BUDGET field of a bundle header, a
+// list of installed, download and zeropack limits separated by spaces or
+// commas, e.g. "installed=500M, download=200M".
+func parseSizeBudget(s string) (*bundleSize, error) {
+	fields := strings.FieldsFunc(s, func(r rune) bool { return r == ',' || unicode.IsSpace(r) })
+	if len(fields) == 0 {
+		return nil, errors.New("empty size budget")
+	}
+
+	budget := &bundleSize{}
+	for _, field := range fields {
+		kv := strings.SplitN(field, "=", 2)
+		if len(kv) != 2 {
+			return nil, errors.Errorf("invalid size budget entry %q, expected <kind>=<size>", field)
+		}
+		size, err := ParseSize(kv[1])
+		if err != nil {
+			return nil, err
+		}
+		switch kv[0] {
+		case "installed":
+			budget.Installed = size
+		case "download":
+			budget.Download = size
+		case "zeropack":
+			budget.ZeroPack = size
+		default:
+			return nil, errors.Errorf("invalid size budget kind %q, expected installed, download or zeropack", kv[0])
+		}
+	}
+	return budget, nil
+}
+
+// exceeded returns a description of each size over the budget.
+func (budget *bundleSize) exceeded(size *bundleSize) []string {
+	var over []string
+	check := func(kind string, limit, actual uint64) {
+		if limit > 0 && actual > limit {
+			over = append(over, fmt.Sprintf("%s size %s exceeds budget of %s", kind, formatSize(actual), formatSize(limit)))
+		}
+	}
+	check("installed", budget.Installed, size.Installed)
+	check("download", budget.Download, size.Download)
+	check("zero pack", budget.ZeroPack, size.ZeroPack)
+	return over
+}
+
+// readBundleSizes computes the sizes of every bundle published in a version
+// from its manifests, fullfiles and zero packs. Content that was not generated,
+// like skipped fullfiles or zero packs, is not accounted. The previous version
+// of the published version is also returned.
+func readBundleSizes(stateDir string, version uint32) (map[string]*bundleSize, uint32, error) {
+	wwwDir := filepath.Join(stateDir, "www")
+	mom, err := swupd.ParseManifestFile(filepath.Join(wwwDir, fmt.Sprint(version), "Manifest.MoM"))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	manifests := make(map[string]*swupd.Manifest)
+	for _, f := range mom.Files {
+		if f.Name == swupd.IndexBundle || f.Status == swupd.StatusDeleted {
+			continue
+		}
+		m, err := swupd.ParseManifestFile(filepath.Join(wwwDir, fmt.Sprint(f.Version), "Manifest."+f.Name))
+		if err != nil {
+			return nil, 0, err
+		}
+		manifests[f.Name] = m
+	}
+
+	sizes := make(map[string]*bundleSize)
+	for name := range manifests {
+		size := &bundleSize{}
+		hashes := make(map[swupd.Hashval]bool)
+
+		// Walk the bundle and its recursive includes.
+		visited := map[string]bool{name: true}
+		queue := []string{name}
+		for len(queue) > 0 {
+			m := manifests[queue[0]]
+			queue = queue[1:]
+			if m == nil {
+				continue
+			}
+			for _, inc := range m.Header.Includes {
+				if !visited[inc.Name] {
+					visited[inc.Name] = true
+					queue = append(queue, inc.Name)
+				}
+			}
+
+			size.Installed += m.Header.ContentSize
+			if fi, err := os.Stat(filepath.Join(wwwDir, fmt.Sprint(m.Header.Version), swupd.GetPackFilename(m.Name, 0))); err == nil {
+				size.ZeroPack += uint64(fi.Size())
+			}
+			for _, f := range m.Files {
+				if f.Status == swupd.StatusDeleted || f.Status == swupd.StatusGhosted || hashes[f.Hash] {
+					continue
+				}
+				hashes[f.Hash] = true
+				if fi, err := os.Stat(filepath.Join(wwwDir, fmt.Sprint(f.Version), "files", f.Hash.String()+".tar")); err == nil {
+					size.Download += uint64(fi.Size())
+				}
+			}
+		}
+		sizes[name] = size
+	}
+	return sizes, mom.Header.Previous, nil
+}
+
+// readSizeBudgets returns the size budgets declared in the headers of the
+// bundles built for a version.
+func readSizeBudgets(stateDir, version string) (map[string]*bundleSize, error) {
+	infos, err := filepath.Glob(filepath.Join(stateDir, "image", version, "*-info"))
+	if err != nil {
+		return nil, err
+	}
+
+	budgets := make(map[string]*bundleSize)
+	for _, path := range infos {
+		m := &swupd.Manifest{}
+		if err = m.GetBundleInfo(stateDir, path); err != nil {
+			return nil, err
+		}
+		if m.BundleInfo.Header.Budget == "" {
+			continue
+		}
+		budget, err := parseSizeBudget(m.BundleInfo.Header.Budget)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid size budget for bundle %s", m.BundleInfo.Name)
+		}
+		budgets[m.BundleInfo.Name] = budget
+	}
+	return budgets, nil
+}
+
+// checkSizeBudgets verifies that the bundles of the current version fit in the
+// size budgets declared in their headers.
+func (b *Builder) checkSizeBudgets() error {
+	budgets, err := readSizeBudgets(b.Config.Builder.ServerStateDir, b.MixVer)
+	if err != nil {
+		return err
+	}
+	if len(budgets) == 0 {
+		log.Info(log.Mixer, "No bundle declares a size budget")
+		return nil
+	}
+
+	sizes, _, err := readBundleSizes(b.Config.Builder.ServerStateDir, b.MixVerUint32)
+	if err != nil {
+		return err
+	}
+
+	names := make([]string, 0, len(budgets))
+	for name := range budgets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	count := 0
+	for _, name := range names {
+		size, ok := sizes[name]
+		if !ok {
+			continue
+		}
+		for _, msg := range budgets[name].exceeded(size) {
+			log.Error(log.Mixer, "Bundle %s: %s", name, msg)
+			count++
+		}
+	}
+	if count > 0 {
+		return errors.Errorf("found %d bundle sizes over budget", count)
+	}
+	log.Info(log.Mixer, "All %d bundles with a size budget are within it", len(budgets))
+	return nil
+}
+
+// ReportBundleSizes prints the installed, fullfile download and zero pack
+// sizes of the given bundles in a version, including their recursive
+// includes, and the growth from the previous version. When no bundles are
+// passed all bundles in the version are reported.
+func (b *Builder) ReportBundleSizes(version uint32, bundles []string) error {
+	sizes, previous, err := readBundleSizes(b.Config.Builder.ServerStateDir, version)
+	if err != nil {
+		return err
+	}
+
+	var prevSizes map[string]*bundleSize
+	if previous > 0 {
+		prevSizes, _, err = readBundleSizes(b.Config.Builder.ServerStateDir, previous)
+		if err != nil {
+			log.Warning(log.Mixer, "Couldn't read sizes of previous version %d: %s", previous, err)
+			prevSizes = nil
+		}
+	}
+
+	budgets, err := readSizeBudgets(b.Config.Builder.ServerStateDir, fmt.Sprint(version))
+	if err != nil {
+		return err
+	}
+
+	if len(bundles) == 0 {
+		for name := range sizes {
+			bundles = append(bundles, name)
+		}
+	}
+	sort.Strings(bundles)
+
+	table := tablewriter.NewWriter(os.Stdout)
+	table.SetAutoWrapText(false)
+	header := []string{"BUNDLE", "INSTALLED", "DOWNLOAD", "ZERO PACK"}
+	if prevSizes != nil {
+		header = append(header, fmt.Sprintf("GROWTH FROM %d", previous))
+	}
+	table.SetHeader(append(header, "BUDGET"))
+
+	for _, name := range bundles {
+		size, ok := sizes[name]
+		if !ok {
+			return errors.Errorf("bundle %s is not part of version %d", name, version)
+		}
+		row := []string{name, formatSize(size.Installed), formatSize(size.Download), formatSize(size.ZeroPack)}
+		if prevSizes != nil {
+			if prev, ok := prevSizes[name]; ok {
+				row = append(row, fmt.Sprintf("%s / %s / %s",
+					formatGrowth(prev.Installed, size.Installed),
+					formatGrowth(prev.Download, size.Download),
+					formatGrowth(prev.ZeroPack, size.ZeroPack)))
+			} else {
+				row = append(row, "new")
+			}
+		}
+		budget := ""
+		if bb, ok := budgets[name]; ok {
+			if over := bb.exceeded(size); len(over) > 0 {
+				budget = "EXCEEDED: " + strings.Join(over, "; ")
+			} else {
+				budget = "ok"
+			}
+		}
+		table.Append(append(row, budget))
+	}
+	table.Render()
+	return nil
+}
@@ -0,0 +1,127 @@
+package builder
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/clearlinux/mixer-tools/swupd"
+)
+
+func TestParseSizeBudget(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected *bundleSize
+	}{
+		{"installed=100", &bundleSize{Installed: 100}},
+		{"installed=2K download=1M", &bundleSize{Installed: 2048, Download: 1 << 20}},
+		{"installed=1G, download=10MB,zeropack=5m", &bundleSize{Installed: 1 << 30, Download: 10 << 20, ZeroPack: 5 << 20}},
+
+		// Error cases.
+		{"", nil},
+		{"installed", nil},
+		{"installed=", nil},
+		{"installed=10T", nil},
+		{"installed=M", nil},
+		{"disk=10M", nil},
+	}
+
+	for _, tt := range tests {
+		budget, err := parseSizeBudget(tt.value)
+		if tt.expected == nil {
+			if err == nil {
+				t.Errorf("unexpected success parsing budget %q", tt.value)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("unexpected error parsing budget %q: %s", tt.value, err)
+			continue
+		}
+		if !reflect.DeepEqual(budget, tt.expected) {
+			t.Errorf("got budget %+v for %q, expected %+v", budget, tt.value, tt.expected)
+		}
+	}
+
+	budget := &bundleSize{Installed: 100, ZeroPack: 10}
+	if over := budget.exceeded(&bundleSize{Installed: 100, Download: 1000, ZeroPack: 11}); len(over) != 1 || !strings.HasPrefix(over[0], "zero pack") {
+		t.Errorf("got exceeded sizes %q, expected only zero pack", over)
+	}
+}
+
+// mustWriteTestManifest writes a manifest with the given header lines and
+// file entries to path.
+func mustWriteTestManifest(t *testing.T, path string, version uint32, header []string, entries ...string) {
+	t.Helper()
+	content := fmt.Sprintf("MANIFEST\t30\nversion:\t%d\nprevious:\t0\nfilecount:\t%d\ntimestamp:\t1\n", version, len(entries))
+	for _, h := range header {
+		content += h + "\n"
+	}
+	content += "\n" + strings.Join(entries, "\n") + "\n"
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReadBundleSizes(t *testing.T) {
+	testDir, err := ioutil.TempDir("", "bundlesize-test-")
+	if err != nil {
+		t.Fatalf("couldn't create temporary directory: %s", err)
+	}
+	defer cleanup(testDir)
+
+	wwwDir := filepath.Join(testDir, "www")
+	hash1 := strings.Repeat("1", 64)
+	hash2 := strings.Repeat("2", 64)
+	hash3 := strings.Repeat("3", 64)
+
+	mustWriteTestManifest(t, filepath.Join(wwwDir, "20", "Manifest.MoM"), 20, []string{"contentsize:\t0"},
+		"M...\t"+hash1+"\t10\tos-core",
+		"M...\t"+hash2+"\t20\tfoo",
+	)
+	mustWriteTestManifest(t, filepath.Join(wwwDir, "10", "Manifest.os-core"), 10, []string{"contentsize:\t100"},
+		"F...\t"+hash1+"\t10\t/usr/bin/core",
+	)
+	mustWriteTestManifest(t, filepath.Join(wwwDir, "20", "Manifest.foo"), 20, []string{"contentsize:\t50", "includes:\tos-core"},
+		"F...\t"+hash2+"\t20\t/usr/bin/foo",
+		"F...\t"+hash1+"\t10\t/usr/bin/foo-copy",
+		".d..\t"+hash3+"\t20\t/usr/bin/gone",
+	)
+
+	files := map[string]int{
+		filepath.Join(wwwDir, "10", "files", hash1+".tar"):               10,
+		filepath.Join(wwwDir, "20", "files", hash2+".tar"):               20,
+		filepath.Join(wwwDir, "10", swupd.GetPackFilename("os-core", 0)): 30,
+		filepath.Join(wwwDir, "20", swupd.GetPackFilename("foo", 0)):     40,
+	}
+	for path, size := range files {
+		if err = os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err = ioutil.WriteFile(path, make([]byte, size), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	sizes, previous, err := readBundleSizes(testDir, 20)
+	if err != nil {
+		t.Fatalf("unexpected error reading bundle sizes: %s", err)
+	}
+	if previous != 0 {
+		t.Errorf("got previous version %d, expected 0", previous)
+	}
+	expected := map[string]*bundleSize{
+		"os-core": {Installed: 100, Download: 10, ZeroPack: 30},
+		"foo":     {Installed: 150, Download: 30, ZeroPack: 70},
+	}
+	if !reflect.DeepEqual(sizes, expected) {
+		t.Errorf("got sizes %v, expected %v", sizes, expected)
+	}
+}
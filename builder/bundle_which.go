@@ -0,0 +1,88 @@
+package builder
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// readBuiltBundles reads the bundle info files written by the build of a
+// version.
+func readBuiltBundles(versionDir string) ([]*bundle, error) {
+	infos, err := filepath.Glob(filepath.Join(versionDir, "*-info"))
+	if err != nil {
+		return nil, err
+	}
+	if len(infos) == 0 {
+		return nil, errors.Errorf("no bundle info files found in %s, build bundles first", versionDir)
+	}
+
+	bundles := make([]*bundle, 0, len(infos))
+	for _, path := range infos {
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		var bundle bundle
+		if err = json.Unmarshal(content, &bundle); err != nil {
+			return nil, errors.Wrapf(err, "couldn't parse bundle info %s", path)
+		}
+		bundles = append(bundles, &bundle)
+	}
+	sort.Slice(bundles, func(i, j int) bool { return bundles[i].Name < bundles[j].Name })
+	return bundles, nil
+}
+
+// WhichBundles prints, for each path, the bundles of a built version that
+// contain it, the package providing it and the bundles excluding it with an
+// exclude() directive.
+func (b *Builder) WhichBundles(version string, paths []string) error {
+	versionDir := filepath.Join(b.Config.Builder.ServerStateDir, "image", version)
+	bundles, err := readBuiltBundles(versionDir)
+	if err != nil {
+		return err
+	}
+	lists, err := readRpmFiles(versionDir)
+	if err != nil {
+		return err
+	}
+	packages := make(map[string]string)
+	for rpm, l := range lists {
+		for _, f := range l.Files {
+			packages[f] = strings.TrimSuffix(rpm, ".rpm")
+		}
+	}
+
+	for _, p := range paths {
+		path := resolveFileName(filepath.Clean("/" + p))
+		var in, excluded []string
+		for _, bundle := range bundles {
+			if _, ok := bundle.Files[path]; ok {
+				in = append(in, bundle.Name)
+			}
+			if pattern, ok := bundle.ExcludedFiles[path]; ok {
+				excluded = append(excluded, fmt.Sprintf("%s by exclude(%s)", bundle.Name, pattern))
+			}
+		}
+
+		fmt.Println(path)
+		if len(in) == 0 && len(excluded) == 0 {
+			fmt.Println("  not in any bundle")
+		}
+		if len(in) > 0 {
+			fmt.Printf("  bundles:  %s\n", strings.Join(in, ", "))
+		}
+		if pkg, ok := packages[path]; ok {
+			fmt.Printf("  package:  %s\n", pkg)
+		}
+		for _, e := range excluded {
+			fmt.Printf("  excluded: %s\n", e)
+		}
+	}
+	return nil
+}
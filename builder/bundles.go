@@ -382,7 +382,15 @@ func resolvePackagesWithOptions(numWorkers int, set bundleSet, packagerCmd []str
 				"install",
 			)
 			for p := range bundle.AllPackages {
-				queryString = append(queryString, p)
+				if len(bundle.AllConstraints[p]) == 0 {
+					queryString = append(queryString, p)
+					continue
+				}
+				// Each constraint is passed as a separate spec, so dnf
+				// picks a version satisfying all of them.
+				for _, c := range bundle.AllConstraints[p] {
+					queryString = append(queryString, c.dnfSpec(p))
+				}
 			}
 			bundle.AllRpms = make(map[string]packageMetadata)
 			// Ignore error from the --assumeno install, but save the output for later
@@ -399,11 +407,24 @@ func resolvePackagesWithOptions(numWorkers int, set bundleSet, packagerCmd []str
 					log.Error(log.Dnf, errStr.Error())
 					log.Debug(log.Dnf, outBuf.String())
 				}
+				for p, constraints := range bundle.AllConstraints {
+					for _, c := range constraints {
+						log.Error(log.Mixer, "%s: bundle %s requires %q", c.location(), bundle.Name, c.dnfSpec(p))
+					}
+				}
 				e = errors.Wrapf(e, bundle.Name)
 				errorCh <- e
 				return
 			}
 
+			if violations := checkPackageConstraints(bundle.Name, bundle.AllConstraints, rpm); len(violations) > 0 {
+				for _, v := range violations {
+					log.Error(log.Mixer, v)
+				}
+				errorCh <- errors.Errorf("%s: %d package version constraints not satisfied", bundle.Name, len(violations))
+				return
+			}
+
 			if bundle.Header.Maintainer == "pundle" {
 				singlePkgMap := make(repoPkgMap)
 				for _, pkgs := range rpm {
@@ -446,6 +467,11 @@ func resolvePackagesWithOptions(numWorkers int, set bundleSet, packagerCmd []str
 					errorCh <- e
 					return
 				}
+				e = resolveFilePicks(bundle, packagerCmd, emptyDir)
+				if e != nil {
+					errorCh <- e
+					return
+				}
 			}
 		}
 	}
@@ -538,6 +564,9 @@ func installFilesystem(chrootDir string, packagerCmd []string, downloadRetries i
 		}
 		break
 	}
+	if err == nil {
+		recordRpmFiles(rpmFullPath, nil)
+	}
 	return err
 }
 
@@ -693,6 +722,7 @@ func installBundleToFull(packagerCmd []string, baseDir string, bundle *bundle, d
 				errorCh <- e
 				return
 			}
+			recordRpmFiles(rpm, nil)
 		}
 	}
 
@@ -719,6 +749,7 @@ func installBundleToFull(packagerCmd []string, baseDir string, bundle *bundle, d
 	}
 
 	// feed the channel
+	partialRpms := make(map[string]string)
 	for rpm, pkgInfo := range bundle.AllRpms {
 		if rpmMap[rpm] {
 			continue
@@ -747,6 +778,12 @@ func installBundleToFull(packagerCmd []string, baseDir string, bundle *bundle, d
 				return err
 			}
 		}
+		// Rpms of file() directives are extracted after the others, and
+		// can still be fully extracted for another bundle.
+		if _, ok := bundle.PartialRpms[rpm]; ok {
+			partialRpms[rpm] = rpmFullPath
+			continue
+		}
 		rpmMap[rpm] = true
 
 		select {
@@ -772,6 +809,24 @@ func installBundleToFull(packagerCmd []string, baseDir string, bundle *bundle, d
 		return <-errorCh
 	}
 
+	for rpm, rpmFullPath := range partialRpms {
+		var extracted []string
+		for i := 0; i < extractRetries; i++ {
+			extracted, err = extractRpmFiles(baseDir, rpmFullPath, bundle.PartialRpms[rpm])
+			if err == nil {
+				break
+			}
+			log.Debug(log.Mixer, "RPM Extraction attempt %d failed. Maximum of %d attempts.\n", i+1, extractRetries)
+		}
+		if err != nil {
+			return err
+		}
+		// Only the extracted files are installed from the rpm
+		if len(extracted) > 0 {
+			recordRpmFiles(rpmFullPath, extracted)
+		}
+	}
+
 	return nil
 }
 
@@ -838,6 +893,7 @@ func buildFullChroot(b *Builder, set *bundleSet, packagerCmd []string, buildVers
 
 	i := 0
 	rpmMap = make(map[string]bool)
+	resetRpmFiles()
 
 	if fileSystemInfo != (packageMetadata{}) {
 		if err := installFilesystem(fullDir, packagerCmd, downloadRetries, b.repos); err != nil {
@@ -852,6 +908,13 @@ func buildFullChroot(b *Builder, set *bundleSet, packagerCmd []string, buildVers
 			return err
 		}
 	}
+	// The downloaded rpms are removed once the chroot is built
+	queryRpmFiles()
+
+	// Unpack the archive and git content chroots to the content cache.
+	if err = stageContentSources(set, filepath.Join(b.Config.Builder.ServerStateDir, "content-cache")); err != nil {
+		return err
+	}
 
 	// Resolve bundle content chroots against the full chroot. New files are copied
 	// to the full chroot and the bundle file lists are updated to contain the files
@@ -901,7 +964,15 @@ func addBundleContentChroots(set *bundleSet, fullDir string) error {
 				return err
 			}
 
-			err := filepath.Walk(chrootPath, func(path string, fi os.FileInfo, err error) error {
+			// The ownership and mode of the files can be overridden by a spec
+			// file next to the content chroot.
+			spec, err := readContentSpec(chrootPath)
+			if err != nil {
+				return err
+			}
+			found := make(map[string]bool)
+
+			err = filepath.Walk(chrootPath, func(path string, fi os.FileInfo, err error) error {
 				if err != nil {
 					return err
 				}
@@ -914,6 +985,12 @@ func addBundleContentChroots(set *bundleSet, fullDir string) error {
 					return nil
 				}
 
+				attrs := spec.attrs(filePath)
+				found[filePath] = true
+				if attrs.Type != "" && attrs.Type != contentFileType(fi) {
+					return errors.Errorf("%s:%d: %s is not of type %s", spec.Filename, attrs.Line, filePath, attrs.Type)
+				}
+
 				// Add file to bundle-info file list
 				bundle.Files[filePath] = isExportable(filePath, bundle.UnExport)
 
@@ -921,7 +998,7 @@ func addBundleContentChroots(set *bundleSet, fullDir string) error {
 				// are the same.
 				if fullInfo, err := os.Lstat(fullChrootFile); err == nil {
 					if fullInfo.IsDir() && fi.IsDir() {
-						if fullInfo.Mode() != fi.Mode() {
+						if fullInfo.Mode() != attrs.fileMode(fi) {
 							return errors.Errorf("Directory permission mismatch: %s, %s", fullChrootFile, path)
 						}
 
@@ -933,29 +1010,30 @@ func addBundleContentChroots(set *bundleSet, fullDir string) error {
 						if !ok {
 							return errors.Errorf("Cannot get directory ownership: %s", fullChrootFile)
 						}
-						if srcDir.Uid != targDir.Uid || srcDir.Gid != targDir.Gid {
+						uid, gid := attrs.owner(srcDir)
+						if uint32(uid) != targDir.Uid || uint32(gid) != targDir.Gid {
 							return errors.Errorf("Directory ownership mismatch: %s, %s", fullChrootFile, path)
 						}
 
 						return nil
 					}
 
-					h1, err := swupd.Hashcalc(fullChrootFile)
+					h1, err := swupd.GetHashForFile(fullChrootFile)
 					if err != nil {
 						return err
 					}
-					h2, err := swupd.Hashcalc(path)
+					h2, err := attrs.hash(path, fi)
 					if err != nil {
 						return err
 					}
-					if !swupd.HashEquals(h1, h2) {
+					if h1 != h2 {
 						return errors.Errorf("Chroot File conflict: %s, %s", fullChrootFile, path)
 					}
 					return nil
 				}
 
 				if fi.IsDir() {
-					if err = os.Mkdir(fullChrootFile, fi.Mode()); err != nil {
+					if err = os.Mkdir(fullChrootFile, attrs.fileMode(fi)); err != nil {
 						return err
 					}
 
@@ -963,24 +1041,32 @@ func addBundleContentChroots(set *bundleSet, fullDir string) error {
 					if !ok {
 						return errors.Errorf("Cannot get directory ownership: %s", path)
 					}
-					err = os.Chown(fullChrootFile, int(dirStat.Uid), int(dirStat.Gid))
+					uid, gid := attrs.owner(dirStat)
+					err = os.Chown(fullChrootFile, uid, gid)
 					if err != nil {
 						return err
 					}
 
 					// umask prevents setting the permissions correctly when creating the target directory,
 					// so the permissions are set after the directory is created.
-					return os.Chmod(fullChrootFile, fi.Mode())
+					return os.Chmod(fullChrootFile, attrs.fileMode(fi))
 				}
 
 				// Do not resolve symlinks so that the links can be copied, do not
 				// sync to disk which significantly improves I/O performance, and
 				// use the source file's permissions for the target.
-				return helpers.CopyFileWithOptions(fullChrootFile, path, false, false, true)
+				err = helpers.CopyFileWithOptions(fullChrootFile, path, false, false, true)
+				if err != nil {
+					return err
+				}
+				return attrs.apply(fullChrootFile, fi)
 			})
 			if err != nil {
 				return err
 			}
+			if err = spec.check(found); err != nil {
+				return err
+			}
 		}
 	}
 	return nil
@@ -1028,18 +1114,22 @@ func (b *Builder) buildBundles(set bundleSet, downloadRetries int) error {
 	}
 
 	// Write INI files. These are used to communicate to the next step of mixing (build update).
+	var deltaCache string
+	if b.Config.Server.DeltaCacheDir != "" {
+		deltaCache = fmt.Sprintf("deltacachedir=%s\n", b.Config.Server.DeltaCacheDir)
+	}
 	var serverINI bytes.Buffer
 	_, _ = fmt.Fprintf(&serverINI, `[Server]
 emptydir=%s/empty
 imagebase=%s/image/
 outputdir=%s/www/
-
+%s
 [Debuginfo]
 banned=%s
 lib=%s
 src=%s
 `, b.Config.Builder.ServerStateDir, b.Config.Builder.ServerStateDir,
-		b.Config.Builder.ServerStateDir, b.Config.Server.DebugInfoBanned,
+		b.Config.Builder.ServerStateDir, deltaCache, b.Config.Server.DebugInfoBanned,
 		b.Config.Server.DebugInfoLib, b.Config.Server.DebugInfoSrc)
 
 	err = ioutil.WriteFile(filepath.Join(b.Config.Builder.ServerStateDir, "server.ini"), serverINI.Bytes(), 0644)
@@ -1127,6 +1217,13 @@ src=%s
 		return err
 	}
 
+	// run the post-install hooks, which take the place of the package scriptlets
+	err = runInstallHooks(set, b.Config.Mixer.PostInstallHooks, filepath.Join(buildVersionDir, "full"), version)
+	if err != nil {
+		return err
+	}
+
+	excludeBundleFiles(set, rpmFileProviders())
 	for _, bundle := range set {
 		err = writeBundleInfo(bundle, filepath.Join(buildVersionDir, bundle.Name+"-info"))
 		if err != nil {
@@ -1134,11 +1231,22 @@ src=%s
 		}
 	}
 
+	err = removeExcludedFiles(set, filepath.Join(buildVersionDir, "full"))
+	if err != nil {
+		return err
+	}
+
+	err = writeRpmFiles(filepath.Join(buildVersionDir, rpmFilesName))
+	if err != nil {
+		return err
+	}
+
 	// now that all dnf/yum/rpm operations have completed
 	// remove all packager state files from chroot
 	// This is not a critical step, just to prevent these files from
 	// making it into the Manifest.full
 	rmDNFStatePaths(filepath.Join(buildVersionDir, "full"))
+
 	return nil
 }
 
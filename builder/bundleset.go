@@ -31,10 +31,29 @@ type bundle struct {
 
 	Files map[string]bool
 
+	// ExcludedFiles maps the files removed from the bundle by an exclude()
+	// directive to the pattern matching them.
+	ExcludedFiles map[string]string `json:",omitempty"`
+
+	// ContentSources maps the archive and git content() sources of the bundle
+	// to the checksum of the content staged from them.
+	ContentSources map[string]string `json:",omitempty"`
+
 	/* hidden property, not to be included in file usr/share/clear/allbundles */
 	AllRpms        map[string]packageMetadata `json:"-"`
 	ContentChroots map[string]bool            `json:"-"`
 	UnExport       map[string]bool            `json:"-"`
+	Excludes       []string                   `json:"-"`
+	FilePicks      []filePick                 `json:"-"`
+	Hooks          []string                   `json:"-"`
+
+	// PartialRpms maps the rpms of file() directives, which are not fully part
+	// of the bundle, to the files extracted from them.
+	PartialRpms map[string][]string `json:"-"`
+
+	// Version constraints of the packages in DirectPackages and AllPackages.
+	DirectConstraints map[string][]versionConstraint `json:"-"`
+	AllConstraints    map[string][]versionConstraint `json:"-"`
 }
 
 type bundleSet map[string]*bundle
@@ -57,6 +76,10 @@ func validateAndFillBundleSet(bundles bundleSet) error {
 		for k, v := range b.DirectPackages {
 			b.AllPackages[k] = v
 		}
+		b.AllConstraints = make(map[string][]versionConstraint)
+		for k, v := range b.DirectConstraints {
+			b.AllConstraints[k] = append(b.AllConstraints[k], v...)
+		}
 	}
 	for _, b := range sortedBundles {
 		if b.Header.Maintainer != "pundle" {
@@ -64,6 +87,9 @@ func validateAndFillBundleSet(bundles bundleSet) error {
 				for k, v := range bundles[include].AllPackages {
 					b.AllPackages[k] = v
 				}
+				for k, v := range bundles[include].AllConstraints {
+					b.AllConstraints[k] = append(b.AllConstraints[k], v...)
+				}
 			}
 		}
 	}
@@ -334,6 +360,14 @@ func parseBundleFile(filename string) (*bundle, error) {
 
 	bundle.Name = name
 	bundle.Filename = filename
+	for _, constraints := range bundle.DirectConstraints {
+		for i := range constraints {
+			constraints[i].Filename = filename
+		}
+	}
+	for i := range bundle.FilePicks {
+		bundle.FilePicks[i].Filename = filename
+	}
 
 	return bundle, nil
 }
@@ -349,6 +383,7 @@ func parseBundle(contents []byte) (*bundle, error) {
 
 	b.ContentChroots = make(map[string]bool)
 	b.UnExport = make(map[string]bool)
+	b.DirectConstraints = make(map[string][]versionConstraint)
 
 	line := 0
 	for scanner.Scan() {
@@ -370,6 +405,11 @@ func parseBundle(contents []byte) (*bundle, error) {
 					b.Header.Capabilities = value
 				case "MAINTAINER":
 					b.Header.Maintainer = value
+				case "BUDGET":
+					if _, err := parseSizeBudget(value); err != nil {
+						return nil, fmt.Errorf("Invalid size budget in line %d: %s", line, err)
+					}
+					b.Header.Budget = value
 				}
 				continue
 			}
@@ -408,10 +448,42 @@ func parseBundle(contents []byte) (*bundle, error) {
 				text = strings.TrimSuffix(text, "/")
 			}
 
-			if _, err := os.Stat(text); err != nil {
-				return nil, fmt.Errorf("Invalid content path %q in line %d", text, line)
+			// Archives and git refs are staged when building the bundles.
+			if _, ok, err := parseContentSource(text); err != nil {
+				return nil, fmt.Errorf("Invalid content source %q in line %d: %s", text, line, err)
+			} else if !ok {
+				if _, err := os.Stat(text); err != nil {
+					return nil, fmt.Errorf("Invalid content path %q in line %d", text, line)
+				}
 			}
 			b.ContentChroots[text] = true
+		} else if strings.HasPrefix(text, "exclude(") {
+			if !strings.HasSuffix(text, ")") {
+				return nil, fmt.Errorf("Missing end parenthesis in line %d: %q", line, text)
+			}
+			text = strings.TrimSpace(text[8 : len(text)-1])
+			if _, err := filepath.Match(text, ""); err != nil || text == "" {
+				return nil, fmt.Errorf("Invalid exclude pattern %q in line %d", text, line)
+			}
+			b.Excludes = append(b.Excludes, text)
+		} else if strings.HasPrefix(text, "hook(") {
+			if !strings.HasSuffix(text, ")") {
+				return nil, fmt.Errorf("Missing end parenthesis in line %d: %q", line, text)
+			}
+			text = strings.TrimSpace(text[5 : len(text)-1])
+			if err := validateInstallHook(text); err != nil {
+				return nil, fmt.Errorf("Invalid hook in line %d: %s", line, err)
+			}
+			b.Hooks = append(b.Hooks, text)
+		} else if strings.HasPrefix(text, "file(") {
+			if !strings.HasSuffix(text, ")") {
+				return nil, fmt.Errorf("Missing end parenthesis in line %d: %q", line, text)
+			}
+			pick, err := parseFilePick(text[5:len(text)-1], line)
+			if err != nil {
+				return nil, err
+			}
+			b.FilePicks = append(b.FilePicks, pick)
 		} else if strings.HasPrefix(text, "un-export(") {
 			if !strings.HasSuffix(text, ")") {
 				return nil, fmt.Errorf("Missing end parenthesis in line %d: %q", line, text)
@@ -419,10 +491,14 @@ func parseBundle(contents []byte) (*bundle, error) {
 			text = text[10 : len(text)-1]
 			b.UnExport[text] = true
 		} else {
-			if !validPackageNameRegex.MatchString(text) {
-				return nil, fmt.Errorf("Invalid package name %q in line %d", text, line)
+			name, constraints, err := parsePackageLine(text, line)
+			if err != nil {
+				return nil, err
+			}
+			packages = append(packages, name)
+			if len(constraints) > 0 {
+				b.DirectConstraints[name] = append(b.DirectConstraints[name], constraints...)
 			}
-			packages = append(packages, text)
 		}
 	}
 
@@ -122,9 +122,25 @@ content(%s///)
 			ExpectedPackages: map[string]bool{},
 			ExpectedChroots:  map[string]bool{dir1: true, dir2: true},
 		},
+		{
+			Contents: []byte(`# Bundle with a size budget
+# [TITLE]: fake
+# [DESCRIPTION]: a description
+# [BUDGET]: installed=500M, download=200M
+pkg1
+`),
+			ExpectedHeader: swupd.BundleHeader{
+				Title:       "fake",
+				Description: "a description",
+				Budget:      "installed=500M, download=200M",
+			},
+			ExpectedPackages: map[string]bool{"pkg1": true},
+			ExpectedChroots:  map[string]bool{},
+		},
 
 		// Error cases.
 		{Contents: []byte(`include(`), ShouldFail: true},
+		{Contents: []byte("# [BUDGET]: installed=lots\npkg1\n"), ShouldFail: true},
 		{Contents: []byte(`()`), ShouldFail: true},
 		{Contents: []byte(`Include(`), ShouldFail: true},
 		{Contents: []byte(`include())`), ShouldFail: true},
@@ -0,0 +1,301 @@
+package builder
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/clearlinux/mixer-tools/log"
+	"github.com/clearlinux/mixer-tools/swupd"
+	"github.com/pkg/errors"
+)
+
+// channelsDir is the directory of the www directory with the version URL
+// directory of each update channel. Clients of a channel use
+// www/channels/<name> as their version URL, and www as their content URL.
+const channelsDir = "channels"
+
+func (b *Builder) channelVersionDir(name string) string {
+	return filepath.Join(b.Config.Builder.ServerStateDir, "www", channelsDir, name, "version")
+}
+
+// channelHistoryDir is the directory of the state directory with the versions
+// promoted to each channel, one per line. It is kept outside of www, as clients
+// don't need it.
+const channelHistoryDir = ".channels"
+
+func (b *Builder) channelHistoryPath(name string) string {
+	return filepath.Join(b.Config.Builder.ServerStateDir, channelHistoryDir, name)
+}
+
+// channelPromoted reports whether version was ever promoted to a channel.
+func (b *Builder) channelPromoted(name, version string) (bool, error) {
+	content, err := ioutil.ReadFile(b.channelHistoryPath(name))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	for _, line := range strings.Split(string(content), "\n") {
+		if strings.TrimSpace(line) == version {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// recordPromoted adds version to the versions promoted to a channel.
+func (b *Builder) recordPromoted(name, version string) error {
+	path := b.channelHistoryPath(name)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = fmt.Fprintln(f, version); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// checkChannel returns an error if the channel isn't declared in CHANNELS.
+func (b *Builder) checkChannel(name string) error {
+	for _, c := range b.Config.Mixer.Channels {
+		if c == name {
+			if name == "" || name == "." || name == ".." || strings.ContainsRune(name, filepath.Separator) {
+				return errors.Errorf("invalid channel name %q", name)
+			}
+			return nil
+		}
+	}
+	return errors.Errorf("unknown channel %q, channels are declared with CHANNELS in the [Mixer] section of the configuration", name)
+}
+
+// readChannelLatest returns the latest version of a channel and its format, or
+// empty strings if no version was promoted to it.
+func (b *Builder) readChannelLatest(name string) (string, string, error) {
+	content, err := ioutil.ReadFile(filepath.Join(b.channelVersionDir(name), "latest_version"))
+	if os.IsNotExist(err) {
+		return "", "", nil
+	}
+	if err != nil {
+		return "", "", err
+	}
+	version := strings.TrimSpace(string(content))
+	format, err := b.getFormatForVersion(version)
+	if err != nil {
+		return "", "", errors.Wrapf(err, "couldn't read the format of version %s of channel %s", version, name)
+	}
+	return version, format, nil
+}
+
+// readChannelFormatLatest returns the latest version of a format in a channel,
+// or an empty string if none.
+func (b *Builder) readChannelFormatLatest(name, format string) (string, error) {
+	content, err := ioutil.ReadFile(filepath.Join(b.channelVersionDir(name), "format"+format, "latest"))
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	return strings.TrimSpace(string(content)), err
+}
+
+// checkFullyBuilt returns an error unless the update content clients need to
+// update to a version was built: its committed build, the compressed manifests
+// of its bundles, the fullfiles of the files it changed and the zero packs of
+// its bundles.
+func (b *Builder) checkFullyBuilt(version string) error {
+	committed, err := b.versionCommitted(version)
+	if err != nil {
+		return err
+	}
+	if !committed {
+		return errors.Errorf("version %s wasn't built, or its build wasn't completed", version)
+	}
+
+	wwwDir := filepath.Join(b.Config.Builder.ServerStateDir, "www")
+	var missing []string
+	check := func(path string) {
+		if _, err := os.Stat(filepath.Join(wwwDir, path)); err != nil {
+			missing = append(missing, path)
+		}
+	}
+
+	check(filepath.Join(version, "Manifest.MoM.tar"))
+	mom, err := swupd.ParseManifestFile(filepath.Join(wwwDir, version, "Manifest.MoM"))
+	if err != nil {
+		return err
+	}
+	for _, f := range mom.Files {
+		if f.Status == swupd.StatusDeleted {
+			continue
+		}
+		ver := fmt.Sprint(f.Version)
+		check(filepath.Join(ver, "Manifest."+f.Name+".tar"))
+		check(filepath.Join(ver, swupd.GetPackFilename(f.Name, 0)))
+	}
+
+	full, err := swupd.ParseManifestFile(filepath.Join(wwwDir, version, "Manifest.full"))
+	if err != nil {
+		return err
+	}
+	done := make(map[string]bool)
+	for _, f := range full.Files {
+		if fmt.Sprint(f.Version) != version || f.Status == swupd.StatusDeleted || f.Status == swupd.StatusGhosted {
+			continue
+		}
+		hash := f.Hash.String()
+		if !done[hash] {
+			done[hash] = true
+			check(filepath.Join(version, "files", hash+".tar"))
+		}
+	}
+
+	if len(missing) > 0 {
+		for _, path := range missing {
+			log.Error(log.Mixer, "Missing %s", filepath.Join(wwwDir, path))
+		}
+		return errors.Errorf("version %s is not fully built, %d update files are missing", version, len(missing))
+	}
+	return nil
+}
+
+// writeChannelFile replaces a file of the version directory of a channel,
+// signing it unless skipSigning is set.
+func (b *Builder) writeChannelFile(path, content string, skipSigning bool) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(content), 0644); err != nil {
+		return err
+	}
+	if !skipSigning {
+		if err := b.signFile(tmp); err != nil {
+			return err
+		}
+		if err := os.Rename(tmp+".sig", path+".sig"); err != nil {
+			return err
+		}
+	}
+	return os.Rename(tmp, path)
+}
+
+// PromoteVersion moves the latest version of the channel to to the version,
+// once it is verified to be fully built. With from, the version must also have
+// been promoted to the channel from, its latest version not being older. A
+// channel can't go back to an older version, and can only cross into the next
+// format once the last version of its current format was promoted, so its
+// clients go through every format bump.
+func (b *Builder) PromoteVersion(version, from, to string, skipSigning bool) error {
+	if err := b.checkChannel(to); err != nil {
+		return err
+	}
+	ver, err := strconv.ParseUint(version, 10, 32)
+	if err != nil {
+		return errors.Errorf("invalid version %q", version)
+	}
+
+	if from != "" {
+		if err = b.checkChannel(from); err != nil {
+			return err
+		}
+		fromLatest, _, err := b.readChannelLatest(from)
+		if err != nil {
+			return err
+		}
+		if fromLatest == "" {
+			return errors.Errorf("no version was promoted to channel %s", from)
+		}
+		if latest, _ := strconv.ParseUint(fromLatest, 10, 32); ver > latest {
+			return errors.Errorf("version %s is newer than version %s of channel %s", version, fromLatest, from)
+		}
+		promoted, err := b.channelPromoted(from, version)
+		if err != nil {
+			return errors.Wrapf(err, "couldn't read the versions promoted to channel %s", from)
+		}
+		if !promoted {
+			return errors.Errorf("version %s was never promoted to channel %s", version, from)
+		}
+	}
+
+	if err = b.checkFullyBuilt(version); err != nil {
+		return err
+	}
+	format, err := b.getFormatForVersion(version)
+	if err != nil {
+		return errors.Wrapf(err, "couldn't read the format of version %s", version)
+	}
+
+	current, currentFormat, err := b.readChannelLatest(to)
+	if err != nil {
+		return err
+	}
+	if current != "" {
+		if cur, _ := strconv.ParseUint(current, 10, 32); ver <= cur {
+			return errors.Errorf("channel %s is already at version %s", to, current)
+		}
+		if currentFormat != format {
+			// Clients can only go through one format bump at a time
+			cf, _ := strconv.Atoi(currentFormat)
+			if f, _ := strconv.Atoi(format); f != cf+1 {
+				return errors.Errorf("version %s is in format %s, promote the versions of format %d to channel %s first", version, format, cf+1, to)
+			}
+			last, err := b.getLatestForFormat(currentFormat)
+			if err != nil {
+				return errors.Wrapf(err, "couldn't read the latest version of format %s", currentFormat)
+			}
+			channelLast, err := b.readChannelFormatLatest(to, currentFormat)
+			if err != nil {
+				return err
+			}
+			if channelLast != last {
+				return errors.Errorf("version %s is in format %s, promote version %s, the last version of format %s, to channel %s first", version, format, last, currentFormat, to)
+			}
+		}
+	}
+
+	dir := b.channelVersionDir(to)
+	if err = b.writeChannelFile(filepath.Join(dir, "format"+format, "latest"), version, skipSigning); err != nil {
+		return errors.Wrap(err, "couldn't update the latest version of the format")
+	}
+	if err = b.writeChannelFile(filepath.Join(dir, "latest_version"), version, skipSigning); err != nil {
+		return errors.Wrap(err, "couldn't update the latest version")
+	}
+	if err = b.recordPromoted(to, version); err != nil {
+		return errors.Wrapf(err, "couldn't record the promotion of version %s to channel %s", version, to)
+	}
+
+	if current == "" {
+		log.Info(log.Mixer, "Promoted version %s to channel %s", version, to)
+	} else {
+		log.Info(log.Mixer, "Promoted version %s to channel %s, previously at version %s", version, to, current)
+	}
+	return nil
+}
+
+// ListChannels prints the latest version of each channel.
+func (b *Builder) ListChannels() error {
+	if len(b.Config.Mixer.Channels) == 0 {
+		fmt.Println("No channel declared, add them to CHANNELS in the [Mixer] section of the configuration")
+		return nil
+	}
+	for _, name := range b.Config.Mixer.Channels {
+		latest, format, err := b.readChannelLatest(name)
+		if err != nil {
+			return err
+		}
+		if latest == "" {
+			fmt.Printf("%s: no version promoted\n", name)
+		} else {
+			fmt.Printf("%s: version %s (format %s)\n", name, latest, format)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package builder
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeTestVersion writes the update content of a fully built version with a
+// single bundle.
+func writeTestVersion(t *testing.T, wwwDir string, version int, format string) string {
+	t.Helper()
+	dir := filepath.Join(wwwDir, fmt.Sprint(version))
+	hash := strings.Repeat(fmt.Sprint(version/10), 64)
+	mustWriteTestManifest(t, filepath.Join(dir, "Manifest.MoM"), uint32(version), []string{"contentsize:\t0"},
+		fmt.Sprintf("M...\t%s\t%d\tos-core", hash, version),
+	)
+	mustWriteTestManifest(t, filepath.Join(dir, "Manifest.full"), uint32(version), []string{"contentsize:\t0"},
+		fmt.Sprintf("F...\t%s\t%d\t/usr/bin/core", hash, version),
+	)
+	for _, f := range []string{"Manifest.MoM.tar", "Manifest.os-core.tar", "pack-os-core-from-0.tar", "files/" + hash + ".tar"} {
+		writeTestFile(t, filepath.Join(dir, f), "")
+	}
+	writeTestFile(t, filepath.Join(dir, "format"), format)
+	return filepath.Join(dir, "files", hash+".tar")
+}
+
+func TestPromoteVersion(t *testing.T) {
+	testDir, err := ioutil.TempDir("", "channel-test-")
+	if err != nil {
+		t.Fatalf("couldn't create temporary directory: %s", err)
+	}
+	defer cleanup(testDir)
+
+	b := newTransactionTestBuilder(testDir)
+	b.Config.Mixer.Channels = []string{"alpha", "beta", "stable"}
+	wwwDir := filepath.Join(b.Config.Builder.ServerStateDir, "www")
+	writeTestVersion(t, wwwDir, 10, "1")
+	writeTestVersion(t, wwwDir, 20, "1")
+	fullfile := writeTestVersion(t, wwwDir, 30, "2")
+	writeTestVersion(t, wwwDir, 40, "3")
+	writeTestFile(t, filepath.Join(wwwDir, "version", "format1", "latest"), "20")
+
+	if err = b.PromoteVersion("10", "", "unknown", true); err == nil {
+		t.Errorf("expected error promoting to an unknown channel")
+	}
+
+	if err = os.Remove(fullfile); err != nil {
+		t.Fatal(err)
+	}
+	if err = b.PromoteVersion("30", "", "beta", true); err == nil {
+		t.Errorf("expected error promoting a version with missing fullfiles")
+	}
+	writeTestFile(t, fullfile, "")
+
+	steps := []struct {
+		version, from, to string
+		ok                bool
+	}{
+		{"20", "", "alpha", true},
+		// Version 10 is older than alpha, but was never promoted to it
+		{"10", "alpha", "stable", false},
+		// Format 2 must be crossed first
+		{"40", "", "alpha", false},
+		{"10", "", "beta", true},
+		// The last version of format 1 must be promoted first
+		{"30", "", "beta", false},
+		{"20", "", "beta", true},
+		{"10", "", "beta", false},
+		{"30", "beta", "stable", false},
+		{"20", "beta", "stable", true},
+		{"20", "beta", "stable", false},
+		{"30", "", "beta", true},
+		{"30", "beta", "stable", true},
+	}
+	for _, s := range steps {
+		err = b.PromoteVersion(s.version, s.from, s.to, true)
+		if (err == nil) != s.ok {
+			t.Errorf("promoting %s from %q to %s: got error %v, expected success %v", s.version, s.from, s.to, err, s.ok)
+		}
+	}
+
+	for _, channel := range []string{"beta", "stable"} {
+		dir := b.channelVersionDir(channel)
+		checkTestFile(t, filepath.Join(dir, "latest_version"), "30")
+		checkTestFile(t, filepath.Join(dir, "format1", "latest"), "20")
+		checkTestFile(t, filepath.Join(dir, "format2", "latest"), "30")
+	}
+}
@@ -0,0 +1,287 @@
+package builder
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/clearlinux/mixer-tools/log"
+	"github.com/pkg/errors"
+)
+
+// checkpointDirName is the directory of the state dir holding the checkpoint
+// of each version, recording its completed build phases. It is outside of the
+// image directory of the version, so it is kept when a failed build command is
+// rolled back.
+const checkpointDirName = ".checkpoints"
+
+// Build phases recorded in the checkpoint, in order. The manifests phase
+// includes the content checks, signing and compressing the manifests. The
+// delta packs from each previous version are recorded as separate phases, see
+// deltaPacksPhase.
+var checkpointPhases = []string{phaseBundles, phaseManifests, phaseFullfiles, phaseZeroPacks, phaseDeltaPacks}
+
+// deltaPacksPhase returns the name of the phase creating the delta packs from
+// a previous version.
+func deltaPacksPhase(from uint32) string {
+	return fmt.Sprintf("%s-from-%d", phaseDeltaPacks, from)
+}
+
+// phaseOrder returns the position of a phase in checkpointPhases.
+func phaseOrder(phase string) int {
+	for i, name := range checkpointPhases {
+		if phase == name || strings.HasPrefix(phase, name+"-from-") {
+			return i
+		}
+	}
+	return len(checkpointPhases)
+}
+
+// checkpointPhase is a completed build phase and the digest of its inputs.
+type checkpointPhase struct {
+	Name      string
+	Inputs    string
+	Completed time.Time
+}
+
+// buildCheckpoint records the completed build phases of a version, so an
+// interrupted build can be resumed from the first phase not completed with the
+// same inputs.
+type buildCheckpoint struct {
+	Version string
+	Phases  []checkpointPhase
+
+	filename string
+}
+
+func (b *Builder) checkpointPath(version string) string {
+	return filepath.Join(b.Config.Builder.ServerStateDir, checkpointDirName, version)
+}
+
+// readCheckpoint reads the checkpoint of a version, returning an empty one if
+// none was recorded.
+func (b *Builder) readCheckpoint(version string) (*buildCheckpoint, error) {
+	c := &buildCheckpoint{Version: version, filename: b.checkpointPath(version)}
+	content, err := ioutil.ReadFile(c.filename)
+	if os.IsNotExist(err) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(content, c); err != nil {
+		return nil, errors.Wrapf(err, "couldn't parse checkpoint %s", c.filename)
+	}
+	if c.Version != version {
+		return nil, errors.Errorf("checkpoint %s is for version %s, not %s", c.filename, c.Version, version)
+	}
+	return c, nil
+}
+
+// inputs returns the inputs digest of a completed phase, or an empty string.
+func (c *buildCheckpoint) inputs(phase string) string {
+	for _, p := range c.Phases {
+		if p.Name == phase {
+			return p.Inputs
+		}
+	}
+	return ""
+}
+
+// done reports whether the phase was completed with the same inputs.
+func (c *buildCheckpoint) done(phase, inputs string) bool {
+	return inputs != "" && c.inputs(phase) == inputs
+}
+
+// record marks the phase as completed with the inputs and saves the checkpoint.
+// The phases after it, built from its previous output, are forgotten.
+func (c *buildCheckpoint) record(phase, inputs string) error {
+	order := phaseOrder(phase)
+	phases := c.Phases[:0]
+	for _, p := range c.Phases {
+		if o := phaseOrder(p.Name); o < order || (o == order && p.Name != phase) {
+			phases = append(phases, p)
+		}
+	}
+	c.Phases = append(phases, checkpointPhase{Name: phase, Inputs: inputs, Completed: time.Now().UTC()})
+
+	content, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(c.filename), 0755); err != nil {
+		return err
+	}
+	tmp := c.filename + ".tmp"
+	if err = ioutil.WriteFile(tmp, content, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, c.filename)
+}
+
+// inputsDigest accumulates the inputs of a build phase.
+type inputsDigest struct {
+	h hash.Hash
+}
+
+func newInputsDigest() *inputsDigest {
+	return &inputsDigest{h: sha256.New()}
+}
+
+func (d *inputsDigest) add(key string, value interface{}) {
+	fmt.Fprintf(d.h, "%s=%v\n", key, value)
+}
+
+// addFile adds the content of a file, or its absence.
+func (d *inputsDigest) addFile(path string) error {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		d.add(path, "missing")
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	d.add(path, "file")
+	_, err = io.Copy(d.h, f)
+	return err
+}
+
+// addTree adds the name, type, mode, size and modification time of the files
+// of a directory, without reading their content.
+func (d *inputsDigest) addTree(root string) error {
+	if _, err := os.Lstat(root); os.IsNotExist(err) {
+		d.add(root, "missing")
+		return nil
+	}
+	return filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		d.add(path, fmt.Sprintf("%v %d %d", fi.Mode(), fi.Size(), fi.ModTime().UnixNano()))
+		return nil
+	})
+}
+
+func (d *inputsDigest) sum() string {
+	return hex.EncodeToString(d.h.Sum(nil))
+}
+
+// bundlesInputs returns the digest of the inputs of the bundles phase: the mix
+// configuration, the definition files and content of the bundles of the set,
+// and the local rpms.
+func (b *Builder) bundlesInputs(set bundleSet) (string, error) {
+	d := newInputsDigest()
+	d.add("version", b.MixVer)
+	d.add("upstream", b.UpstreamVer)
+	d.add("format", b.State.Mix.Format)
+
+	files := []string{
+		b.Config.GetConfigFileName(),
+		b.Config.Builder.DNFConf,
+		filepath.Join(b.Config.Builder.VersionPath, b.MixBundlesFile),
+		b.getLocalPackagesPath(),
+	}
+	files = append(files, b.Config.Mixer.PostInstallHooks...)
+	for _, f := range files {
+		if err := d.addFile(f); err != nil {
+			return "", err
+		}
+	}
+	if b.Config.Mixer.LocalRPMDir != "" {
+		if err := d.addTree(b.Config.Mixer.LocalRPMDir); err != nil {
+			return "", err
+		}
+	}
+
+	names := make([]string, 0, len(set))
+	for name := range set {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		bundle := set[name]
+		if err := d.addFile(bundle.Filename); err != nil {
+			return "", err
+		}
+		for _, hook := range bundle.Hooks {
+			if filepath.IsAbs(hook) {
+				if err := d.addFile(hook); err != nil {
+					return "", err
+				}
+			}
+		}
+
+		chroots := make([]string, 0, len(bundle.ContentChroots))
+		for path := range bundle.ContentChroots {
+			chroots = append(chroots, path)
+		}
+		sort.Strings(chroots)
+		for _, path := range chroots {
+			src, staged, err := parseContentSource(path)
+			if err != nil {
+				return "", errors.Wrapf(err, "invalid content source %s of bundle %s", path, name)
+			}
+			if staged {
+				sum, err := src.checksum()
+				if err != nil {
+					return "", err
+				}
+				d.add(path, sum)
+			} else if err = d.addTree(path); err != nil {
+				return "", err
+			}
+			if err = d.addFile(src.Path + contentSpecSuffix); err != nil {
+				return "", err
+			}
+		}
+	}
+	return d.sum(), nil
+}
+
+// updateInputs returns the digest of the inputs of the update phases: the
+// inputs of the bundles and the update parameters.
+func (b *Builder) updateInputs(c *buildCheckpoint, params UpdateParameters) string {
+	d := newInputsDigest()
+	d.add("bundles", c.inputs(phaseBundles))
+	d.add("previous", b.State.Mix.PreviousMixVer)
+	d.add("format", b.State.Mix.Format)
+	d.add("compression", b.Config.Swupd.Compression)
+	d.add("params", fmt.Sprintf("%+v", params))
+	return d.sum()
+}
+
+// deltaPacksInputs returns the digest of the inputs of the delta packs between
+// two versions: their MoMs.
+func (b *Builder) deltaPacksInputs(from, to uint32) (string, error) {
+	d := newInputsDigest()
+	d.add("from", from)
+	d.add("to", to)
+	for _, version := range []uint32{from, to} {
+		if err := d.addFile(filepath.Join(b.Config.Builder.ServerStateDir, "www", fmt.Sprint(version), "Manifest.MoM")); err != nil {
+			return "", err
+		}
+	}
+	return d.sum(), nil
+}
+
+// resumePhase reports whether a phase can be skipped when resuming the build.
+func (b *Builder) resumePhase(c *buildCheckpoint, phase, inputs string) bool {
+	if !b.Resume || !c.done(phase, inputs) {
+		return false
+	}
+	log.Info(log.Mixer, "=> %s - already completed, skipping", phase)
+	return true
+}
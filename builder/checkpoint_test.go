@@ -0,0 +1,124 @@
+package builder
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCheckpointRecord(t *testing.T) {
+	testDir, err := ioutil.TempDir("", "checkpoint-test-")
+	if err != nil {
+		t.Fatalf("couldn't create temporary directory: %s", err)
+	}
+	defer cleanup(testDir)
+
+	var b Builder
+	b.MixVer = "20"
+	b.Config.Builder.ServerStateDir = testDir
+	c, err := b.readCheckpoint("20")
+	if err != nil {
+		t.Fatalf("couldn't read missing checkpoint: %s", err)
+	}
+	if c.done(phaseBundles, "a") {
+		t.Errorf("empty checkpoint should have no completed phase")
+	}
+
+	for _, phase := range []string{phaseBundles, phaseManifests, phaseFullfiles, phaseZeroPacks} {
+		if err = c.record(phase, "a"); err != nil {
+			t.Fatalf("couldn't record %s: %s", phase, err)
+		}
+	}
+
+	// Recording a phase again forgets the phases after it.
+	if err = c.record(phaseManifests, "b"); err != nil {
+		t.Fatal(err)
+	}
+
+	if c, err = b.readCheckpoint("20"); err != nil {
+		t.Fatalf("couldn't read checkpoint: %s", err)
+	}
+	tests := []struct {
+		phase, inputs string
+		done          bool
+	}{
+		{phaseBundles, "a", true},
+		{phaseManifests, "a", false},
+		{phaseManifests, "b", true},
+		{phaseFullfiles, "b", false},
+		{phaseZeroPacks, "a", false},
+		{phaseBundles, "", false},
+	}
+	for _, tt := range tests {
+		if got := c.done(tt.phase, tt.inputs); got != tt.done {
+			t.Errorf("done(%s, %q) = %v, expected %v", tt.phase, tt.inputs, got, tt.done)
+		}
+	}
+
+	// The delta packs from each previous version are recorded separately,
+	// and forgotten with the phases they are built from.
+	for _, from := range []uint32{10, 0} {
+		if err = c.record(deltaPacksPhase(from), "d"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !c.done(deltaPacksPhase(10), "d") || !c.done(deltaPacksPhase(0), "d") {
+		t.Errorf("expected delta packs from 10 and 0 to be done, got %+v", c.Phases)
+	}
+	if err = c.record(phaseFullfiles, "b"); err != nil {
+		t.Fatal(err)
+	}
+	if c.done(deltaPacksPhase(10), "d") {
+		t.Errorf("delta packs should be forgotten when the fullfiles are recorded again")
+	}
+
+	if err = os.Rename(b.checkpointPath("20"), b.checkpointPath("30")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = b.readCheckpoint("30"); err == nil {
+		t.Errorf("expected error reading the checkpoint of another version")
+	}
+}
+
+func TestInputsDigest(t *testing.T) {
+	testDir, err := ioutil.TempDir("", "checkpoint-test-")
+	if err != nil {
+		t.Fatalf("couldn't create temporary directory: %s", err)
+	}
+	defer cleanup(testDir)
+
+	file := filepath.Join(testDir, "tree", "file")
+	if err = os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(file, []byte("content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	digest := func() string {
+		d := newInputsDigest()
+		d.add("version", 20)
+		if err = d.addFile(file); err != nil {
+			t.Fatal(err)
+		}
+		if err = d.addFile(filepath.Join(testDir, "missing")); err != nil {
+			t.Fatal(err)
+		}
+		if err = d.addTree(filepath.Join(testDir, "tree")); err != nil {
+			t.Fatal(err)
+		}
+		return d.sum()
+	}
+
+	first := digest()
+	if digest() != first {
+		t.Errorf("digest of the same inputs changed")
+	}
+	if err = ioutil.WriteFile(file, []byte("changed"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if digest() == first {
+		t.Errorf("digest didn't change with the content of an input")
+	}
+}
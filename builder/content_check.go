@@ -0,0 +1,172 @@
+package builder
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/clearlinux/mixer-tools/log"
+	"github.com/clearlinux/mixer-tools/swupd"
+	"github.com/pkg/errors"
+)
+
+// loadBundleContents reads the bundle info files of a version and returns one
+// manifest per bundle with its BundleInfo and includes set, so the content of a
+// bundle and of its recursive includes can be inspected before the manifests
+// are created.
+func loadBundleContents(stateDir, version string) ([]*swupd.Manifest, error) {
+	versionDir := filepath.Join(stateDir, "image", version)
+	infos, err := filepath.Glob(filepath.Join(versionDir, "*-info"))
+	if err != nil {
+		return nil, err
+	}
+	if len(infos) == 0 {
+		return nil, errors.Errorf("no bundle info files found in %s", versionDir)
+	}
+
+	bundles := make([]*swupd.Manifest, 0, len(infos))
+	for _, path := range infos {
+		m := &swupd.Manifest{Name: strings.TrimSuffix(filepath.Base(path), "-info")}
+		if err = m.GetBundleInfo(stateDir, path); err != nil {
+			return nil, errors.Wrapf(err, "couldn't read bundle info for %s", m.Name)
+		}
+		bundles = append(bundles, m)
+	}
+	for _, m := range bundles {
+		if m.Name == "os-core" {
+			continue
+		}
+		if err = m.ReadIncludesFromBundleInfo(bundles); err != nil {
+			return nil, err
+		}
+	}
+	sort.Slice(bundles, func(i, j int) bool { return bundles[i].Name < bundles[j].Name })
+	return bundles, nil
+}
+
+// includedFiles returns the set of files provided by the recursive includes of
+// a bundle.
+func includedFiles(m *swupd.Manifest) map[string]bool {
+	files := make(map[string]bool)
+	for _, inc := range m.GetRecursiveIncludes() {
+		for f := range inc.BundleInfo.Files {
+			files[f] = true
+		}
+	}
+	return files
+}
+
+// contentIssue is a problem found while checking the content of a bundle.
+// Checks that only report plain problems leave Rule, Package, Severity and
+// Waiver empty.
+type contentIssue struct {
+	Rule     string
+	Bundle   string
+	Package  string
+	Path     string
+	Severity string
+	Waiver   string
+	Message  string
+}
+
+func (i contentIssue) String() string {
+	if i.Package != "" {
+		return fmt.Sprintf("%s (from %s): %s", i.Path, i.Package, i.Message)
+	}
+	return fmt.Sprintf("%s: %s", i.Path, i.Message)
+}
+
+// checkBundles runs check for each bundle in parallel and returns all the
+// issues found, sorted by bundle and path.
+func checkBundles(bundles []*swupd.Manifest, numWorkers int, check func(m *swupd.Manifest) ([]contentIssue, error)) ([]contentIssue, error) {
+	if numWorkers < 1 {
+		numWorkers = 1
+	}
+	var wg sync.WaitGroup
+	var mux sync.Mutex
+	wg.Add(numWorkers)
+	bundleCh := make(chan *swupd.Manifest)
+	errorCh := make(chan error, numWorkers)
+	defer close(errorCh)
+
+	var issues []contentIssue
+	worker := func() {
+		defer wg.Done()
+		for m := range bundleCh {
+			found, err := check(m)
+			if err != nil {
+				errorCh <- errors.Wrapf(err, "couldn't check bundle %s", m.Name)
+				return
+			}
+			mux.Lock()
+			issues = append(issues, found...)
+			mux.Unlock()
+		}
+	}
+	for i := 0; i < numWorkers; i++ {
+		go worker()
+	}
+
+	var err error
+	for _, m := range bundles {
+		select {
+		case bundleCh <- m:
+		case err = <-errorCh:
+			// break as soon as there is a failure.
+			break
+		}
+		if err != nil {
+			break
+		}
+	}
+	close(bundleCh)
+	wg.Wait()
+
+	if err != nil {
+		return nil, err
+	}
+	if len(errorCh) > 0 {
+		return nil, <-errorCh
+	}
+
+	sort.Slice(issues, func(i, j int) bool {
+		if issues[i].Bundle != issues[j].Bundle {
+			return issues[i].Bundle < issues[j].Bundle
+		}
+		if issues[i].Path != issues[j].Path {
+			return issues[i].Path < issues[j].Path
+		}
+		return issues[i].Message < issues[j].Message
+	})
+	return issues, nil
+}
+
+// reportContentIssues logs the issues of a content check grouped by bundle.
+// When strict is set and there are issues, an error is returned.
+func reportContentIssues(what string, issues []contentIssue, strict bool) error {
+	if len(issues) == 0 {
+		log.Info(log.Mixer, "No %s found", what)
+		return nil
+	}
+
+	logf := log.Warning
+	if strict {
+		logf = log.Error
+	}
+	bundle := ""
+	for _, i := range issues {
+		if i.Bundle != bundle {
+			bundle = i.Bundle
+			logf(log.Mixer, "Bundle %s:", bundle)
+		}
+		logf(log.Mixer, "  %s", i)
+	}
+
+	if strict {
+		return errors.Errorf("found %d %s", len(issues), what)
+	}
+	log.Warning(log.Mixer, "Found %d %s", len(issues), what)
+	return nil
+}
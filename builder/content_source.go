@@ -0,0 +1,281 @@
+package builder
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/clearlinux/mixer-tools/helpers"
+	"github.com/clearlinux/mixer-tools/log"
+	"github.com/pkg/errors"
+)
+
+const contentGitPrefix = "git:"
+
+// contentArchiveFlags maps the archive suffixes accepted by content() to the
+// tar flags to extract them.
+var contentArchiveFlags = map[string][]string{
+	".tar":     nil,
+	".tar.gz":  {"-z"},
+	".tgz":     {"-z"},
+	".tar.xz":  {"-J"},
+	".tar.zst": {"--zstd"},
+}
+
+// contentSource is the source of a content() directive that is not a local
+// directory: an archive, or a git repository at a ref as in
+// content(git:/srv/cfg@v1.2).
+type contentSource struct {
+	Path string
+	Ref  string
+	Git  bool
+}
+
+func (s contentSource) String() string {
+	if s.Git {
+		return contentGitPrefix + s.Path + "@" + s.Ref
+	}
+	return s.Path
+}
+
+// archiveFlags returns the tar flags to extract an archive source, and false
+// when the path is not a supported archive.
+func archiveFlags(path string) ([]string, bool) {
+	for suffix, flags := range contentArchiveFlags {
+		if strings.HasSuffix(path, suffix) {
+			return flags, true
+		}
+	}
+	return nil, false
+}
+
+// parseContentSource parses the argument of a content() directive, returning
+// false when it is a plain directory. A git source is split at the first @
+// following an existing repository path, so refs such as HEAD@{1} may contain
+// @.
+func parseContentSource(text string) (contentSource, bool, error) {
+	if strings.HasPrefix(text, contentGitPrefix) {
+		text = strings.TrimPrefix(text, contentGitPrefix)
+		var statErr error
+		for i := 1; i < len(text)-1; i++ {
+			if text[i] != '@' {
+				continue
+			}
+			src := contentSource{Path: filepath.Clean(text[:i]), Ref: text[i+1:], Git: true}
+			if _, err := os.Stat(src.Path); err != nil {
+				statErr = err
+				continue
+			}
+			return src, true, nil
+		}
+		if statErr != nil {
+			return contentSource{}, false, statErr
+		}
+		return contentSource{}, false, errors.Errorf("expected git:<repository>@<ref>")
+	}
+
+	if _, ok := archiveFlags(text); !ok {
+		return contentSource{}, false, nil
+	}
+	fi, err := os.Stat(text)
+	if err != nil {
+		return contentSource{}, false, err
+	}
+	if fi.IsDir() {
+		return contentSource{}, false, nil
+	}
+	return contentSource{Path: text}, true, nil
+}
+
+// checksum returns the checksum identifying the content of the source: the
+// commit of a git ref, or the SHA-256 of an archive.
+func (s contentSource) checksum() (string, error) {
+	if s.Git {
+		out, err := helpers.RunCommandOutput(log.Git, "git", "-C", s.Path, "rev-parse", "--verify", "--quiet", s.Ref+"^{commit}")
+		if err != nil {
+			return "", errors.Errorf("couldn't resolve ref %s of git repository %s", s.Ref, s.Path)
+		}
+		return strings.TrimSpace(out.String()), nil
+	}
+
+	f, err := os.Open(s.Path)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	h := sha256.New()
+	if _, err = io.Copy(h, f); err != nil {
+		return "", errors.Wrapf(err, "couldn't checksum %s", s.Path)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// stage unpacks the source into a directory of cacheDir named after its
+// checksum and the checksum of its spec file, if any, reusing it when already
+// unpacked, and returns the directory and the checksum. Sources with the same
+// content but different specs get their own directories, so their specs don't
+// replace each other.
+func (s contentSource) stage(cacheDir string) (string, string, error) {
+	sum, err := s.checksum()
+	if err != nil {
+		return "", "", err
+	}
+	kind := "sha256"
+	if s.Git {
+		kind = "git"
+	}
+	name := kind + "-" + sum
+
+	spec, err := ioutil.ReadFile(filepath.Clean(s.Path) + contentSpecSuffix)
+	if err != nil && !os.IsNotExist(err) {
+		return "", "", err
+	}
+	hasSpec := err == nil
+	if hasSpec {
+		specSum := sha256.Sum256(spec)
+		name += "-spec-" + hex.EncodeToString(specSum[:])
+	}
+	dir := filepath.Join(cacheDir, name)
+
+	if _, err = os.Stat(dir); os.IsNotExist(err) {
+		if err = s.unpack(dir, sum); err != nil {
+			return "", "", err
+		}
+	} else if err != nil {
+		return "", "", err
+	} else {
+		log.Debug(log.Mixer, "Using cached content %s for %s", dir, s)
+	}
+
+	// Copy the spec file of the source, so its overrides apply to the staged
+	// directory as well.
+	if hasSpec {
+		err = ioutil.WriteFile(dir+contentSpecSuffix, spec, 0644)
+	} else if err = os.Remove(dir + contentSpecSuffix); os.IsNotExist(err) {
+		err = nil
+	}
+	if err != nil {
+		return "", "", err
+	}
+	return dir, sum, nil
+}
+
+// unpack extracts the source to dir, through a temporary directory so an
+// interrupted build doesn't leave a partial cache entry.
+func (s contentSource) unpack(dir, sum string) error {
+	if err := os.MkdirAll(filepath.Dir(dir), 0755); err != nil {
+		return err
+	}
+	tmpDir, err := ioutil.TempDir(filepath.Dir(dir), ".staging-")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = os.RemoveAll(tmpDir)
+	}()
+	// TempDir creates the directory with mode 0700, which would be copied to
+	// the root of the content.
+	if err = os.Chmod(tmpDir, 0755); err != nil {
+		return err
+	}
+
+	archive := s.Path
+	var flags []string
+	if s.Git {
+		archive = tmpDir + ".tar"
+		defer func() {
+			_ = os.Remove(archive)
+		}()
+		// Git only tracks the executable bit, so use the usual 0644 and 0755
+		// modes instead of the group writable default of git archive.
+		if err = helpers.Git("-C", s.Path, "-c", "tar.umask=0022", "archive", "--format=tar", "-o", archive, sum); err != nil {
+			return errors.Wrapf(err, "couldn't export %s", s)
+		}
+	} else {
+		flags, _ = archiveFlags(s.Path)
+	}
+
+	args := append([]string{"-x"}, flags...)
+	args = append(args, "-f", archive, "-C", tmpDir)
+	if err = helpers.RunCommandSilent(log.Tar, "tar", args...); err != nil {
+		return errors.Wrapf(err, "couldn't unpack %s", s)
+	}
+
+	log.Info(log.Mixer, "Unpacked content %s (%s) to %s", s, sum, dir)
+	return os.Rename(tmpDir, dir)
+}
+
+// stageContentSources unpacks the archive and git content() sources of the
+// bundles into cacheDir, replacing them with the staged directories in the
+// content chroots of the bundles, and records their checksums in the
+// ContentSources of the bundles. The cache entries no bundle uses are removed.
+func stageContentSources(set *bundleSet, cacheDir string) error {
+	used := make(map[string]bool)
+	for _, bundle := range *set {
+		var paths []string
+		for path := range bundle.ContentChroots {
+			paths = append(paths, path)
+		}
+		sort.Strings(paths)
+
+		for _, path := range paths {
+			src, ok, err := parseContentSource(path)
+			if err != nil {
+				return errors.Wrapf(err, "invalid content source %s in bundle %s", path, bundle.Name)
+			}
+			if !ok {
+				continue
+			}
+			dir, sum, err := src.stage(cacheDir)
+			if err != nil {
+				return errors.Wrapf(err, "couldn't stage content %s for bundle %s", src, bundle.Name)
+			}
+			used[filepath.Base(dir)] = true
+			delete(bundle.ContentChroots, path)
+			bundle.ContentChroots[dir] = true
+			if bundle.ContentSources == nil {
+				bundle.ContentSources = make(map[string]string)
+			}
+			bundle.ContentSources[src.String()] = sum
+			log.Info(log.Mixer, "Bundle %s: content %s at %s", bundle.Name, src, shortChecksum(sum))
+		}
+	}
+	return pruneContentCache(cacheDir, used)
+}
+
+// pruneContentCache removes the entries of cacheDir not in used, with their
+// spec files, and the staging directories left by interrupted builds. Every
+// new tag or archive would otherwise leave a full copy of its content behind.
+func pruneContentCache(cacheDir string, used map[string]bool) error {
+	entries, err := ioutil.ReadDir(cacheDir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if used[strings.TrimSuffix(e.Name(), contentSpecSuffix)] {
+			continue
+		}
+		log.Debug(log.Mixer, "Removing unused content cache entry %s", e.Name())
+		if err = os.RemoveAll(filepath.Join(cacheDir, e.Name())); err != nil {
+			return errors.Wrap(err, "couldn't prune the content cache")
+		}
+	}
+	return nil
+}
+
+func shortChecksum(sum string) string {
+	if len(sum) > 12 {
+		return sum[:12]
+	}
+	return sum
+}
@@ -0,0 +1,208 @@
+package builder
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseContentSource(t *testing.T) {
+	testDir, err := ioutil.TempDir("", "content-source-test-")
+	if err != nil {
+		t.Fatalf("couldn't create temporary directory: %s", err)
+	}
+	defer cleanup(testDir)
+
+	archive := filepath.Join(testDir, "cfg.tar.xz")
+	if err = ioutil.WriteFile(archive, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		text       string
+		expected   contentSource
+		staged     bool
+		shouldFail bool
+	}{
+		{text: testDir},
+		{text: archive, expected: contentSource{Path: archive}, staged: true},
+		{text: "git:" + testDir + "@v1.2", expected: contentSource{Path: testDir, Ref: "v1.2", Git: true}, staged: true},
+		{text: "git:" + testDir + "@HEAD@{1}", expected: contentSource{Path: testDir, Ref: "HEAD@{1}", Git: true}, staged: true},
+
+		// Error cases.
+		{text: filepath.Join(testDir, "missing.tar"), shouldFail: true},
+		{text: "git:" + testDir, shouldFail: true},
+		{text: "git:" + testDir + "@", shouldFail: true},
+		{text: "git:@v1.2", shouldFail: true},
+		{text: "git:" + filepath.Join(testDir, "missing") + "@v1.2", shouldFail: true},
+	}
+
+	for _, tt := range tests {
+		src, staged, err := parseContentSource(tt.text)
+		if tt.shouldFail {
+			if err == nil {
+				t.Errorf("unexpected success parsing %q", tt.text)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("unexpected error parsing %q: %s", tt.text, err)
+			continue
+		}
+		if staged != tt.staged || src != tt.expected {
+			t.Errorf("got %+v, %t parsing %q, expected %+v, %t", src, staged, tt.text, tt.expected, tt.staged)
+		}
+	}
+}
+
+func runTestCommand(t *testing.T, dir string, name string, args ...string) {
+	cmd := exec.Command(name, args...)
+	cmd.Dir = dir
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("%s %v failed: %s\n%s", name, args, err, out)
+	}
+}
+
+func TestStageContentSources(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not available")
+	}
+	testDir, err := ioutil.TempDir("", "content-source-test-")
+	if err != nil {
+		t.Fatalf("couldn't create temporary directory: %s", err)
+	}
+	defer cleanup(testDir)
+
+	// A git repository whose v1 tag has the file foo, then removed.
+	repo := filepath.Join(testDir, "repo")
+	if err = os.MkdirAll(filepath.Join(repo, "etc"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(filepath.Join(repo, "etc/foo"), []byte("foo"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	runTestCommand(t, repo, "git", "init", "-q")
+	runTestCommand(t, repo, "git", "add", "etc/foo")
+	runTestCommand(t, repo, "git", "-c", "user.name=test", "-c", "user.email=test@example.com", "commit", "-q", "-m", "foo")
+	runTestCommand(t, repo, "git", "tag", "v1")
+	runTestCommand(t, repo, "git", "rm", "-q", "etc/foo")
+	runTestCommand(t, repo, "git", "-c", "user.name=test", "-c", "user.email=test@example.com", "commit", "-q", "-m", "rm")
+
+	// An archive with the file bar and a spec for it.
+	archive := filepath.Join(testDir, "bar.tar.gz")
+	if err = os.MkdirAll(filepath.Join(repo, "etc"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(filepath.Join(repo, "etc/bar"), []byte("bar"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	runTestCommand(t, repo, "tar", "-czf", archive, "etc/bar")
+	if err = ioutil.WriteFile(archive+contentSpecSuffix, []byte("/etc/bar mode=0600\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	gitSource := "git:" + repo + "@v1"
+	set := &bundleSet{"foo": &bundle{
+		Name:           "foo",
+		ContentChroots: map[string]bool{gitSource: true, archive: true},
+		Files:          map[string]bool{},
+	}}
+	cacheDir := filepath.Join(testDir, "cache")
+	if err = stageContentSources(set, cacheDir); err != nil {
+		t.Fatalf("unexpected error staging content: %s", err)
+	}
+
+	foo := (*set)["foo"]
+	if len(foo.ContentChroots) != 2 || len(foo.ContentSources) != 2 {
+		t.Fatalf("got content chroots %v and sources %v, expected two staged sources", foo.ContentChroots, foo.ContentSources)
+	}
+	for dir := range foo.ContentChroots {
+		if filepath.Dir(dir) != cacheDir {
+			t.Errorf("content chroot %s is not in the content cache", dir)
+		}
+	}
+	if len(foo.ContentSources[gitSource]) != 40 || len(foo.ContentSources[archive]) != 64 {
+		t.Errorf("got checksums %v, expected a commit and a SHA-256", foo.ContentSources)
+	}
+
+	fullDir := filepath.Join(testDir, "full")
+	if err = os.Mkdir(fullDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err = addBundleContentChroots(set, fullDir); err != nil {
+		t.Fatalf("unexpected error adding content chroots: %s", err)
+	}
+	mustExist(t, filepath.Join(fullDir, "etc/foo"))
+	fi, err := os.Stat(filepath.Join(fullDir, "etc/bar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0600 {
+		t.Errorf("got mode %o for staged file with spec, expected 600", fi.Mode().Perm())
+	}
+
+	// Staging again reuses the cache, removing the entries no bundle uses
+	// anymore.
+	var gitDir string
+	for dir := range foo.ContentChroots {
+		if strings.HasPrefix(filepath.Base(dir), "git-") {
+			gitDir = dir
+		}
+	}
+	if err = os.Mkdir(filepath.Join(cacheDir, ".staging-interrupted"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	set = &bundleSet{"foo": &bundle{Name: "foo", ContentChroots: map[string]bool{gitSource: true}}}
+	if err = stageContentSources(set, cacheDir); err != nil {
+		t.Fatalf("unexpected error staging content again: %s", err)
+	}
+	if !(*set)["foo"].ContentChroots[gitDir] {
+		t.Errorf("got content chroots %v, expected the cached %s", (*set)["foo"].ContentChroots, gitDir)
+	}
+	again, err := ioutil.ReadDir(cacheDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(again) != 1 || again[0].Name() != filepath.Base(gitDir) {
+		var names []string
+		for _, e := range again {
+			names = append(names, e.Name())
+		}
+		t.Errorf("got content cache entries %v after staging again, expected only %s", names, filepath.Base(gitDir))
+	}
+
+	// A copy of the archive with another spec is staged apart, keeping the
+	// spec of the first.
+	other := filepath.Join(testDir, "other.tar.gz")
+	runTestCommand(t, testDir, "cp", archive, other)
+	if err = ioutil.WriteFile(other+contentSpecSuffix, []byte("/etc/bar mode=0640\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	set = &bundleSet{
+		"bar":   &bundle{Name: "bar", ContentChroots: map[string]bool{archive: true}},
+		"other": &bundle{Name: "other", ContentChroots: map[string]bool{other: true}},
+	}
+	if err = stageContentSources(set, cacheDir); err != nil {
+		t.Fatalf("unexpected error staging archives with different specs: %s", err)
+	}
+	var barDir, otherDir string
+	for dir := range (*set)["bar"].ContentChroots {
+		barDir = dir
+	}
+	for dir := range (*set)["other"].ContentChroots {
+		otherDir = dir
+	}
+	if barDir == otherDir {
+		t.Errorf("archives with different specs were staged to the same directory %s", barDir)
+	}
+	checkTestFile(t, barDir+contentSpecSuffix, "/etc/bar mode=0600\n")
+	checkTestFile(t, otherDir+contentSpecSuffix, "/etc/bar mode=0640\n")
+
+	set = &bundleSet{"foo": &bundle{Name: "foo", ContentChroots: map[string]bool{"git:" + repo + "@missing": true}}}
+	if err = stageContentSources(set, cacheDir); err == nil {
+		t.Errorf("unexpected success staging a missing git ref")
+	}
+}
@@ -0,0 +1,314 @@
+package builder
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/clearlinux/mixer-tools/swupd"
+	"github.com/pkg/errors"
+)
+
+// contentSpecSuffix is appended to the path of a content() directory to get the
+// path of its spec file, e.g. the spec of content(/path/to/foo) is read from
+// /path/to/foo.mtree.
+const contentSpecSuffix = ".mtree"
+
+// contentAttrs are the attributes a content spec sets for a path. Negative
+// values and an empty type are not set, so the attribute of the file in the
+// content directory is used.
+type contentAttrs struct {
+	UID  int
+	GID  int
+	Mode int
+	Type string
+
+	// Line is the line of the entry in the spec file.
+	Line int
+}
+
+func unsetContentAttrs() contentAttrs {
+	return contentAttrs{UID: -1, GID: -1, Mode: -1}
+}
+
+// merge returns the attributes with the ones set in o overriding them.
+func (a contentAttrs) merge(o contentAttrs) contentAttrs {
+	if o.UID >= 0 {
+		a.UID = o.UID
+	}
+	if o.GID >= 0 {
+		a.GID = o.GID
+	}
+	if o.Mode >= 0 {
+		a.Mode = o.Mode
+	}
+	if o.Type != "" {
+		a.Type = o.Type
+	}
+	return a
+}
+
+func (a contentAttrs) isSet() bool {
+	return a.UID >= 0 || a.GID >= 0 || a.Mode >= 0
+}
+
+// contentSpec is an mtree-like spec file overriding the ownership and mode of
+// the files of a content() directory. Each line has a path relative to the
+// content directory followed by keyword=value pairs:
+//
+//	/set uid=0 gid=0
+//	/usr/bin/foo mode=4755
+//	/etc/foo type=dir mode=0750 gid=1000
+//
+// The keywords are uid, gid, mode (octal) and type (file, dir or link). The
+// keywords of a /set line apply to every path of the content directory.
+type contentSpec struct {
+	Filename string
+	Defaults contentAttrs
+	Entries  map[string]contentAttrs
+}
+
+// readContentSpec reads the spec file of a content directory, returning nil
+// when the directory has none.
+func readContentSpec(chrootPath string) (*contentSpec, error) {
+	filename := filepath.Clean(chrootPath) + contentSpecSuffix
+	content, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	spec, err := parseContentSpec(content)
+	if err != nil {
+		return nil, errors.Wrapf(err, "couldn't parse content spec %s", filename)
+	}
+	spec.Filename = filename
+	return spec, nil
+}
+
+func parseContentSpec(content []byte) (*contentSpec, error) {
+	spec := &contentSpec{
+		Defaults: unsetContentAttrs(),
+		Entries:  make(map[string]contentAttrs),
+	}
+
+	scanner := bufio.NewScanner(strings.NewReader(string(content)))
+	line := 0
+	for scanner.Scan() {
+		line++
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+
+		attrs := unsetContentAttrs()
+		attrs.Line = line
+		for _, kw := range fields[1:] {
+			if err := attrs.parseKeyword(kw); err != nil {
+				return nil, fmt.Errorf("%s in line %d", err, line)
+			}
+		}
+
+		if fields[0] == "/set" {
+			if attrs.Type != "" {
+				return nil, fmt.Errorf("Invalid keyword type in /set in line %d", line)
+			}
+			spec.Defaults = spec.Defaults.merge(attrs)
+			continue
+		}
+		if len(fields) == 1 {
+			return nil, fmt.Errorf("Missing keywords for %s in line %d", fields[0], line)
+		}
+		path := filepath.Join("/", fields[0])
+		if path == "/" {
+			return nil, fmt.Errorf("Invalid path %q in line %d", fields[0], line)
+		}
+		if prev, ok := spec.Entries[path]; ok {
+			return nil, fmt.Errorf("Duplicate entry for %s in line %d, previous entry in line %d", path, line, prev.Line)
+		}
+		spec.Entries[path] = attrs
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return spec, nil
+}
+
+func (a *contentAttrs) parseKeyword(kw string) error {
+	parts := strings.SplitN(kw, "=", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return fmt.Errorf("Invalid keyword %q", kw)
+	}
+
+	var err error
+	switch parts[0] {
+	case "uid":
+		a.UID, err = parseContentID(parts[1])
+	case "gid":
+		a.GID, err = parseContentID(parts[1])
+	case "mode":
+		var mode uint64
+		mode, err = strconv.ParseUint(parts[1], 8, 32)
+		if err == nil && mode > 07777 {
+			err = errors.New("out of range")
+		}
+		a.Mode = int(mode)
+	case "type":
+		switch parts[1] {
+		case "file", "dir", "link":
+			a.Type = parts[1]
+		default:
+			err = errors.New("expected file, dir or link")
+		}
+	default:
+		return fmt.Errorf("Unknown keyword %q", parts[0])
+	}
+	if err != nil {
+		return fmt.Errorf("Invalid value for keyword %q (%s)", kw, err)
+	}
+	return nil
+}
+
+func parseContentID(s string) (int, error) {
+	id, err := strconv.ParseUint(s, 10, 32)
+	if err != nil {
+		return 0, errors.New("not a number")
+	}
+	return int(id), nil
+}
+
+// attrs returns the attributes set for a path of the content directory. It is
+// safe to call on a nil spec.
+func (s *contentSpec) attrs(path string) contentAttrs {
+	if s == nil {
+		return unsetContentAttrs()
+	}
+	a := s.Defaults
+	if entry, ok := s.Entries[path]; ok {
+		a = a.merge(entry)
+		a.Line = entry.Line
+	}
+	return a
+}
+
+// check verifies every entry of the spec was found in the content directory.
+func (s *contentSpec) check(found map[string]bool) error {
+	if s == nil {
+		return nil
+	}
+	for path, entry := range s.Entries {
+		if !found[path] {
+			return errors.Errorf("%s:%d: %s not found in content directory", s.Filename, entry.Line, path)
+		}
+	}
+	return nil
+}
+
+// contentFileType returns the spec type of a file.
+func contentFileType(fi os.FileInfo) string {
+	switch {
+	case fi.IsDir():
+		return "dir"
+	case fi.Mode()&os.ModeSymlink != 0:
+		return "link"
+	case fi.Mode().IsRegular():
+		return "file"
+	}
+	return "other"
+}
+
+// fileMode returns the mode of the file with the spec mode applied.
+func (a contentAttrs) fileMode(fi os.FileInfo) os.FileMode {
+	if a.Mode < 0 {
+		return fi.Mode()
+	}
+	mode := fi.Mode() &^ (os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky)
+	mode |= os.FileMode(a.Mode) & os.ModePerm
+	if a.Mode&04000 != 0 {
+		mode |= os.ModeSetuid
+	}
+	if a.Mode&02000 != 0 {
+		mode |= os.ModeSetgid
+	}
+	if a.Mode&01000 != 0 {
+		mode |= os.ModeSticky
+	}
+	return mode
+}
+
+// owner returns the owner of the file with the spec uid and gid applied.
+func (a contentAttrs) owner(st *syscall.Stat_t) (int, int) {
+	uid, gid := int(st.Uid), int(st.Gid)
+	if a.UID >= 0 {
+		uid = a.UID
+	}
+	if a.GID >= 0 {
+		gid = a.GID
+	}
+	return uid, gid
+}
+
+// apply sets the spec ownership and mode on a file copied from the content
+// directory.
+func (a contentAttrs) apply(dest string, fi os.FileInfo) error {
+	if !a.isSet() {
+		return nil
+	}
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return errors.Errorf("Cannot get file ownership: %s", dest)
+	}
+	uid, gid := a.owner(st)
+	if err := os.Lchown(dest, uid, gid); err != nil {
+		return err
+	}
+	// Symlinks have no mode of their own.
+	if fi.Mode()&os.ModeSymlink != 0 {
+		return nil
+	}
+	// Changing the owner clears the setuid and setgid bits, so the mode is
+	// always set afterwards.
+	return os.Chmod(dest, a.fileMode(fi))
+}
+
+// hash returns the swupd hash the file would have once copied from the
+// content directory with the spec attributes applied.
+func (a contentAttrs) hash(path string, fi os.FileInfo) (string, error) {
+	if !a.isSet() {
+		return swupd.GetHashForFile(path)
+	}
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return "", errors.Errorf("Cannot get file ownership: %s", path)
+	}
+	uid, gid := a.owner(st)
+	mode := st.Mode
+	if a.Mode >= 0 {
+		mode = mode&^07777 | uint32(a.Mode)
+	}
+	info := &swupd.HashFileInfo{
+		Mode: mode,
+		UID:  uint32(uid),
+		GID:  uint32(gid),
+		Size: st.Size,
+	}
+
+	var data []byte
+	var err error
+	switch contentFileType(fi) {
+	case "link":
+		info.Linkname, err = os.Readlink(path)
+	case "file":
+		data, err = ioutil.ReadFile(path)
+	}
+	if err != nil {
+		return "", err
+	}
+	return swupd.GetHashForBytes(info, data)
+}
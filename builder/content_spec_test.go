@@ -0,0 +1,115 @@
+package builder
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestParseContentSpec(t *testing.T) {
+	spec, err := parseContentSpec([]byte(`# comment
+/set uid=0 gid=0
+/usr/bin/foo mode=4755
+./etc/foo type=dir mode=0750 gid=1000
+`))
+	if err != nil {
+		t.Fatalf("unexpected error parsing spec: %s", err)
+	}
+
+	tests := []struct {
+		path     string
+		expected contentAttrs
+	}{
+		{"/usr/bin/foo", contentAttrs{UID: 0, GID: 0, Mode: 04755, Line: 3}},
+		{"/etc/foo", contentAttrs{UID: 0, GID: 1000, Mode: 0750, Type: "dir", Line: 4}},
+		{"/usr/bin/bar", contentAttrs{UID: 0, GID: 0, Mode: -1}},
+	}
+	for _, tt := range tests {
+		if got := spec.attrs(tt.path); got != tt.expected {
+			t.Errorf("got attributes %+v for %s, expected %+v", got, tt.path, tt.expected)
+		}
+	}
+
+	if got := (*contentSpec)(nil).attrs("/usr/bin/foo"); got.isSet() {
+		t.Errorf("got attributes %+v from nil spec", got)
+	}
+
+	for _, contents := range []string{
+		"/usr/bin/foo",
+		"/usr/bin/foo mode=0999",
+		"/usr/bin/foo mode=17777",
+		"/usr/bin/foo uid=root",
+		"/usr/bin/foo type=fifo",
+		"/usr/bin/foo size=10",
+		"/usr/bin/foo mode=",
+		"/set type=file",
+		"/usr/bin/foo mode=0755\n/usr/bin/foo uid=0",
+	} {
+		if _, err = parseContentSpec([]byte(contents)); err == nil {
+			t.Errorf("unexpected success parsing %q", contents)
+		}
+	}
+}
+
+func TestContentSpecOverrides(t *testing.T) {
+	testDir, err := ioutil.TempDir("", "content-spec-test-")
+	if err != nil {
+		t.Fatalf("couldn't create temporary directory: %s", err)
+	}
+	defer cleanup(testDir)
+
+	chroot := filepath.Join(testDir, "content")
+	fullDir := filepath.Join(testDir, "full")
+	for _, d := range []string{filepath.Join(chroot, "etc/foo"), fullDir} {
+		if err = os.MkdirAll(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = ioutil.WriteFile(filepath.Join(chroot, "etc/foo/foo.conf"), []byte("foo"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Use the current user, so the test does not need to run as root.
+	uid := strconv.Itoa(os.Getuid())
+	spec := "/set uid=" + uid + "\n/etc/foo type=dir mode=0750\n/etc/foo/foo.conf type=file mode=0600\n"
+	if err = ioutil.WriteFile(chroot+contentSpecSuffix, []byte(spec), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	set := &bundleSet{"foo": &bundle{ContentChroots: map[string]bool{chroot: true}, Files: map[string]bool{}}}
+	if err = addBundleContentChroots(set, fullDir); err != nil {
+		t.Fatalf("unexpected error adding content chroots: %s", err)
+	}
+	for path, mode := range map[string]os.FileMode{"etc": 0755, "etc/foo": 0750, "etc/foo/foo.conf": 0600} {
+		fi, err := os.Lstat(filepath.Join(fullDir, path))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Mode().Perm() != mode {
+			t.Errorf("got mode %o for %s, expected %o", fi.Mode().Perm(), path, mode)
+		}
+	}
+
+	// The spec is also applied when comparing with the full chroot content.
+	if err = addBundleContentChroots(set, fullDir); err != nil {
+		t.Errorf("unexpected conflict adding content chroots again: %s", err)
+	}
+
+	// Entries must match the type of the file and exist.
+	for _, spec := range []string{"/etc/foo type=file\n", "/etc/bar mode=0644\n"} {
+		if err = os.RemoveAll(fullDir); err != nil {
+			t.Fatal(err)
+		}
+		if err = os.Mkdir(fullDir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err = ioutil.WriteFile(chroot+contentSpecSuffix, []byte(spec), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err = addBundleContentChroots(set, fullDir); err == nil {
+			t.Errorf("unexpected success with spec %q", spec)
+		}
+	}
+}
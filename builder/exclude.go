@@ -0,0 +1,155 @@
+package builder
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/clearlinux/mixer-tools/log"
+	"github.com/pkg/errors"
+)
+
+// matchExclude returns the first exclude() pattern matching path or one of its
+// parent directories, so "/usr/share/doc/*" also excludes the content of the
+// doc directories. Patterns starting with a slash match the full path, other
+// patterns match the base name, e.g. "*.a".
+func matchExclude(patterns []string, path string) (string, bool) {
+	for _, pattern := range patterns {
+		full := strings.HasPrefix(pattern, "/")
+		for p := path; p != "/" && p != "."; p = filepath.Dir(p) {
+			name := p
+			if !full {
+				name = filepath.Base(p)
+			}
+			if ok, _ := filepath.Match(pattern, name); ok {
+				return pattern, true
+			}
+		}
+	}
+	return "", false
+}
+
+// excludeBundleFiles removes the files matching the exclude() patterns of the
+// bundles from their file lists, so they are not part of the bundle manifests,
+// and records them in the ExcludedFiles of the bundles. The patterns of a
+// bundle also apply to the files of its packages in the other bundles
+// containing them, such as the bundles including it, so the excluded files
+// are not shipped through those bundles. providers maps each file to the
+// packages providing it.
+func excludeBundleFiles(set bundleSet, providers map[string][]string) {
+	var declaring []*bundle
+	for _, bundle := range set {
+		if len(bundle.Excludes) > 0 {
+			declaring = append(declaring, bundle)
+		}
+	}
+	if len(declaring) == 0 {
+		return
+	}
+	sort.Slice(declaring, func(i, j int) bool { return declaring[i].Name < declaring[j].Name })
+
+	for _, bundle := range set {
+		excluded := make(map[string]string)
+		counts := make(map[string]int)
+		for f := range bundle.Files {
+			pattern, from, ok := matchBundleExclude(bundle, declaring, providers[f], f)
+			if !ok {
+				continue
+			}
+			delete(bundle.Files, f)
+			excluded[f] = pattern
+			counts[from+" "+pattern]++
+		}
+		if len(excluded) == 0 && len(bundle.Excludes) == 0 {
+			continue
+		}
+		bundle.ExcludedFiles = excluded
+
+		for _, d := range declaring {
+			for _, pattern := range d.Excludes {
+				if d == bundle {
+					log.Info(log.Mixer, "Bundle %s: exclude(%s) removed %d paths", bundle.Name, pattern, counts[d.Name+" "+pattern])
+				} else if n := counts[d.Name+" "+pattern]; n > 0 {
+					log.Info(log.Mixer, "Bundle %s: exclude(%s) of bundle %s removed %d paths", bundle.Name, pattern, d.Name, n)
+				}
+			}
+		}
+		files := make([]string, 0, len(excluded))
+		for f := range excluded {
+			files = append(files, f)
+		}
+		sort.Strings(files)
+		for _, f := range files {
+			log.Info(log.Mixer, "Bundle %s: excluded %s", bundle.Name, f)
+		}
+	}
+}
+
+// matchBundleExclude returns the exclude() pattern removing a file from a
+// bundle, and the name of the bundle declaring it. The patterns of the bundle
+// match all its files, and the patterns of the other bundles only match the
+// files of the packages they share with it.
+func matchBundleExclude(bundle *bundle, declaring []*bundle, packages []string, f string) (string, string, bool) {
+	if pattern, ok := matchExclude(bundle.Excludes, f); ok {
+		return pattern, bundle.Name, true
+	}
+	for _, d := range declaring {
+		if d == bundle {
+			continue
+		}
+		for _, pkg := range packages {
+			if !d.AllPackages[pkg] || !bundle.AllPackages[pkg] {
+				continue
+			}
+			if pattern, ok := matchExclude(d.Excludes, f); ok {
+				return pattern, d.Name, true
+			}
+		}
+	}
+	return "", "", false
+}
+
+// removeExcludedFiles removes from the full chroot the files excluded from a
+// bundle that are not part of any other bundle, so they are not published in
+// the full manifest either.
+func removeExcludedFiles(set bundleSet, fullDir string) error {
+	var paths []string
+	seen := make(map[string]bool)
+	for _, bundle := range set {
+		for f := range bundle.ExcludedFiles {
+			if seen[f] {
+				continue
+			}
+			seen[f] = true
+
+			shipped := false
+			for _, other := range set {
+				if _, ok := other.Files[f]; ok {
+					shipped = true
+					break
+				}
+			}
+			if !shipped {
+				paths = append(paths, f)
+			}
+		}
+	}
+
+	// Remove the deepest paths first, so directories are empty when reached.
+	sort.Slice(paths, func(i, j int) bool { return paths[i] > paths[j] })
+	for _, f := range paths {
+		err := os.Remove(filepath.Join(fullDir, f))
+		if err != nil && !os.IsNotExist(err) {
+			if fi, statErr := os.Lstat(filepath.Join(fullDir, f)); statErr == nil && fi.IsDir() {
+				log.Warning(log.Mixer, "Couldn't remove excluded directory %s: %s", f, err)
+				continue
+			}
+			return errors.Wrapf(err, "couldn't remove excluded file %s", f)
+		}
+	}
+	if len(paths) > 0 {
+		log.Info(log.Mixer, "Removed %d excluded paths from the full chroot", len(paths))
+	}
+	return nil
+}
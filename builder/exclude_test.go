@@ -0,0 +1,129 @@
+package builder
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestMatchExclude(t *testing.T) {
+	patterns := []string{"/usr/share/doc/*", "*.a", "/usr/share/locale/[a-d]*"}
+	tests := []struct {
+		path    string
+		pattern string
+	}{
+		{"/usr/share/doc/foo", "/usr/share/doc/*"},
+		{"/usr/share/doc/foo/README", "/usr/share/doc/*"},
+		{"/usr/share/doc", ""},
+		{"/usr/lib64/libfoo.a", "*.a"},
+		{"/usr/lib64/libfoo.so", ""},
+		{"/usr/lib64/foo.a/file", "*.a"},
+		{"/usr/share/locale/de/LC_MESSAGES/foo.mo", "/usr/share/locale/[a-d]*"},
+		{"/usr/share/locale/fr/LC_MESSAGES/foo.mo", ""},
+	}
+
+	for _, tt := range tests {
+		pattern, ok := matchExclude(patterns, tt.path)
+		if ok != (tt.pattern != "") || pattern != tt.pattern {
+			t.Errorf("matchExclude(%q) = %q, %t, expected %q", tt.path, pattern, ok, tt.pattern)
+		}
+	}
+}
+
+func TestParseBundleExclude(t *testing.T) {
+	b, err := parseBundle([]byte("pkg1\nexclude(/usr/share/doc/*)\nexclude( *.a )\n"))
+	if err != nil {
+		t.Fatalf("unexpected error parsing bundle: %s", err)
+	}
+	if expected := []string{"/usr/share/doc/*", "*.a"}; !reflect.DeepEqual(b.Excludes, expected) {
+		t.Errorf("got excludes %q, expected %q", b.Excludes, expected)
+	}
+
+	for _, contents := range []string{"exclude(", "exclude()", "exclude([)"} {
+		if _, err = parseBundle([]byte(contents)); err == nil {
+			t.Errorf("unexpected success parsing %q", contents)
+		}
+	}
+}
+
+func TestExcludeBundleFiles(t *testing.T) {
+	fullDir, err := ioutil.TempDir("", "exclude-test-")
+	if err != nil {
+		t.Fatalf("couldn't create temporary directory: %s", err)
+	}
+	defer cleanup(fullDir)
+
+	for _, d := range []string{"usr/bin", "usr/share/doc/foo"} {
+		if err = os.MkdirAll(filepath.Join(fullDir, d), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, f := range []string{"usr/bin/foo", "usr/share/doc/foo/README", "usr/share/doc/foo/COPYING"} {
+		if err = ioutil.WriteFile(filepath.Join(fullDir, f), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	foo := &bundle{Name: "foo", Excludes: []string{"/usr/share/doc/*"}, Files: make(map[string]bool)}
+	foo.AllPackages = map[string]bool{"foo": true}
+	addFileAndPath(foo.Files, nil, "/usr/bin/foo", "/usr/share/doc/foo/README", "/usr/share/doc/foo/COPYING")
+	bar := &bundle{Name: "bar", Files: make(map[string]bool)}
+	bar.AllPackages = map[string]bool{"bar": true}
+	addFileAndPath(bar.Files, nil, "/usr/share/doc/foo/COPYING")
+	// baz includes foo, so it has its own copy of the files of its package.
+	baz := &bundle{Name: "baz", Files: make(map[string]bool)}
+	baz.AllPackages = map[string]bool{"foo": true, "baz": true}
+	addFileAndPath(baz.Files, nil, "/usr/bin/foo", "/usr/share/doc/foo/README", "/usr/share/doc/baz")
+	providers := map[string][]string{
+		"/usr/bin/foo":               {"foo"},
+		"/usr/share/doc/foo":         {"foo"},
+		"/usr/share/doc/foo/README":  {"foo"},
+		"/usr/share/doc/foo/COPYING": {"foo", "bar"},
+		"/usr/share/doc/baz":         {"baz"},
+	}
+
+	excludeBundleFiles(bundleSet{"foo": foo, "bar": bar, "baz": baz}, providers)
+
+	var files []string
+	for f := range foo.Files {
+		files = append(files, f)
+	}
+	sort.Strings(files)
+	expectedFiles := []string{"/usr", "/usr/bin", "/usr/bin/foo", "/usr/share", "/usr/share/doc"}
+	if !reflect.DeepEqual(files, expectedFiles) {
+		t.Errorf("got files %q, expected %q", files, expectedFiles)
+	}
+	expectedExcluded := map[string]string{
+		"/usr/share/doc/foo":         "/usr/share/doc/*",
+		"/usr/share/doc/foo/README":  "/usr/share/doc/*",
+		"/usr/share/doc/foo/COPYING": "/usr/share/doc/*",
+	}
+	if !reflect.DeepEqual(foo.ExcludedFiles, expectedExcluded) {
+		t.Errorf("got excluded files %v, expected %v", foo.ExcludedFiles, expectedExcluded)
+	}
+	if bar.ExcludedFiles != nil {
+		t.Errorf("got excluded files %v for bundle not sharing packages with foo", bar.ExcludedFiles)
+	}
+	expectedExcluded = map[string]string{
+		"/usr/share/doc/foo":        "/usr/share/doc/*",
+		"/usr/share/doc/foo/README": "/usr/share/doc/*",
+	}
+	if !reflect.DeepEqual(baz.ExcludedFiles, expectedExcluded) {
+		t.Errorf("got excluded files %v for bundle including foo, expected %v", baz.ExcludedFiles, expectedExcluded)
+	}
+	if _, ok := baz.Files["/usr/share/doc/baz"]; !ok {
+		t.Errorf("file of a package of baz removed by the exclude() of foo")
+	}
+
+	if err = removeExcludedFiles(bundleSet{"foo": foo, "bar": bar, "baz": baz}, fullDir); err != nil {
+		t.Fatalf("unexpected error removing excluded files: %s", err)
+	}
+	// COPYING is still shipped by bar, so it and its directory are kept.
+	mustExist(t, filepath.Join(fullDir, "usr/share/doc/foo/COPYING"))
+	if _, err = os.Lstat(filepath.Join(fullDir, "usr/share/doc/foo/README")); !os.IsNotExist(err) {
+		t.Errorf("excluded file README was not removed from the full chroot")
+	}
+}
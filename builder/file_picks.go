@@ -0,0 +1,237 @@
+package builder
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/clearlinux/mixer-tools/helpers"
+	"github.com/clearlinux/mixer-tools/log"
+	"github.com/pkg/errors"
+)
+
+// filePick is a file(<package>:<glob>) directive of a bundle definition file,
+// selecting the files of a package matching the glob without adding the rest
+// of the package to the bundle.
+type filePick struct {
+	Package string
+	Pattern string
+
+	// Filename and Line locate the directive in the bundle definition file.
+	Filename string
+	Line     int
+}
+
+func (p filePick) String() string {
+	return fmt.Sprintf("file(%s:%s)", p.Package, p.Pattern)
+}
+
+// location returns the bundle definition file and line of the directive.
+func (p filePick) location() string {
+	if p.Filename == "" {
+		return fmt.Sprintf("line %d", p.Line)
+	}
+	return fmt.Sprintf("%s:%d", p.Filename, p.Line)
+}
+
+// parseFilePick parses the argument of a file() directive.
+func parseFilePick(text string, line int) (filePick, error) {
+	parts := strings.SplitN(text, ":", 2)
+	if len(parts) != 2 {
+		return filePick{}, fmt.Errorf("Invalid file directive %q in line %d, expected file(<package>:<glob>)", text, line)
+	}
+	pick := filePick{Package: strings.TrimSpace(parts[0]), Pattern: strings.TrimSpace(parts[1]), Line: line}
+	if !validPackageNameRegex.MatchString(pick.Package) {
+		return filePick{}, fmt.Errorf("Invalid package name %q in line %d", pick.Package, line)
+	}
+	if _, err := filepath.Match(pick.Pattern, "/"); err != nil || !filepath.IsAbs(pick.Pattern) {
+		return filePick{}, fmt.Errorf("Invalid file pattern %q in line %d", pick.Pattern, line)
+	}
+	return pick, nil
+}
+
+// matchFilePicks returns the files of a package matching the picks for it and
+// fails when a pick matches nothing.
+func matchFilePicks(picks []filePick, pkg string, files []string) ([]string, error) {
+	var matched []string
+	seen := make(map[string]bool)
+	for _, pick := range picks {
+		if pick.Package != pkg {
+			continue
+		}
+		found := false
+		for _, f := range files {
+			ok, _ := filepath.Match(pick.Pattern, f)
+			if !ok {
+				// Also match the path the file is installed to.
+				ok, _ = filepath.Match(pick.Pattern, resolveFileName(f))
+			}
+			if ok {
+				found = true
+				if !seen[f] {
+					seen[f] = true
+					matched = append(matched, f)
+				}
+			}
+		}
+		if !found {
+			return nil, errors.Errorf("%s: %s did not match any file in package %s", pick.location(), pick, pkg)
+		}
+	}
+	return matched, nil
+}
+
+// resolveFilePicks resolves the packages of the file() directives of a bundle,
+// adding them to AllRpms and the matching files to the bundle file list. The
+// files to extract from each package not otherwise in the bundle are recorded
+// in PartialRpms, so only they are installed to the full chroot.
+func resolveFilePicks(bundle *bundle, packagerCmd []string, emptyDir string) error {
+	if len(bundle.FilePicks) == 0 {
+		return nil
+	}
+
+	var names []string
+	seen := make(map[string]bool)
+	for _, pick := range bundle.FilePicks {
+		if !seen[pick.Package] {
+			seen[pick.Package] = true
+			names = append(names, pick.Package)
+		}
+	}
+
+	queryString := merge(packagerCmd, "--installroot="+emptyDir, "--assumeno", "install")
+	queryString = append(queryString, names...)
+	// As with the packages of the bundle, the --assumeno install always fails.
+	outBuf, errStr := helpers.RunCommandOutputEnv(log.Dnf, queryString[0], queryString[1:], []string{"LC_ALL=en_US.UTF-8"})
+	rpms, err := repoPkgFromNoopInstall(outBuf.String())
+	if err != nil {
+		if errStr != nil {
+			log.Error(log.Dnf, errStr.Error())
+			log.Debug(log.Dnf, outBuf.String())
+		}
+		return errors.Wrapf(err, "couldn't resolve file() packages for %s", bundle.Name)
+	}
+
+	bundle.PartialRpms = make(map[string][]string)
+	for _, name := range names {
+		var pkg *packageMetadata
+		for _, pkgs := range rpms {
+			for i := range pkgs {
+				if pkgs[i].name == name {
+					pkg = &pkgs[i]
+				}
+			}
+		}
+		if pkg == nil {
+			return errors.Errorf("couldn't resolve package %s for file() in bundle %s", name, bundle.Name)
+		}
+
+		// List the files of the exact package resolved, not of another
+		// version in the repo.
+		nevra := pkg.name + "-" + pkg.version + "." + pkg.arch
+		query := merge(packagerCmd, "repoquery", "-l", "--quiet", "--repo", pkg.repo, nevra)
+		out, err := helpers.RunCommandOutputEnv(log.Dnf, query[0], query[1:], []string{"LC_ALL=en_US.UTF-8"})
+		if err != nil {
+			log.Error(log.Dnf, err.Error())
+			return errors.Errorf("couldn't list files of package %s for bundle %s", name, bundle.Name)
+		}
+		var files []string
+		for _, f := range strings.Split(out.String(), "\n") {
+			if f != "" {
+				files = append(files, f)
+			}
+		}
+
+		matched, err := matchFilePicks(bundle.FilePicks, name, files)
+		if err != nil {
+			return err
+		}
+		for _, f := range matched {
+			addFileAndPath(bundle.Files, bundle.UnExport, resolveFileName(f))
+		}
+
+		// Packages fully in the bundle are already installed.
+		if bundle.AllPackages[name] {
+			continue
+		}
+		rpmName := pkg.name + "-" + pkg.version + "." + pkg.arch + ".rpm"
+		bundle.AllRpms[rpmName] = *pkg
+		bundle.PartialRpms[rpmName] = matched
+		log.Info(log.Mixer, "Picked %d files of %s for %s", len(matched), name, bundle.Name)
+	}
+	return nil
+}
+
+// archivedPicks splits the files to extract from an rpm into the files found
+// in its archive, listed by tar as members, and the files missing from it, such
+// as %ghost files listed by the rpm but not shipped.
+func archivedPicks(files, members []string) (found, missing []string) {
+	inArchive := make(map[string]bool, len(members))
+	for _, m := range members {
+		m = strings.TrimSuffix(strings.TrimPrefix(m, "."), "/")
+		inArchive[m] = true
+	}
+	for _, f := range files {
+		if inArchive[f] {
+			found = append(found, f)
+		} else {
+			missing = append(missing, f)
+		}
+	}
+	return found, missing
+}
+
+// extractRpmFiles extracts only the given files of an rpm to baseDir,
+// returning the files extracted. Files not in the archive of the rpm are
+// skipped.
+func extractRpmFiles(baseDir string, rpm string, files []string) ([]string, error) {
+	dir, file := filepath.Split(rpm)
+	rpm2Cmd := exec.Command("rpm2archive", file)
+	rpm2Cmd.Dir = dir
+	rpm2Cmd.Env = os.Environ()
+
+	if err := rpm2Cmd.Run(); err != nil {
+		log.Error(log.Rpm2Archive, err.Error())
+		return nil, fmt.Errorf("rpm2archive cmd failed for %s", file)
+	}
+
+	rpmTar := file + ".tgz"
+	defer func() {
+		if err := os.Remove(filepath.Join(dir, rpmTar)); err != nil {
+			log.Warning(log.Mixer, "Failed to remove file %s", rpmTar)
+		}
+	}()
+
+	listCmd := exec.Command("tar", "-tf", rpmTar)
+	listCmd.Env = os.Environ()
+	listCmd.Dir = dir
+	out, err := listCmd.Output()
+	if err != nil {
+		log.Error(log.Tar, err.Error())
+		return nil, fmt.Errorf("couldn't list %s", rpmTar)
+	}
+	found, missing := archivedPicks(files, strings.Split(string(out), "\n"))
+	for _, f := range missing {
+		log.Warning(log.Mixer, "Skipping %s, not in the archive of %s", f, file)
+	}
+	if len(found) == 0 {
+		return nil, nil
+	}
+
+	args := []string{"-xf", rpmTar, "-C", baseDir}
+	for _, f := range found {
+		args = append(args, "."+f)
+	}
+	tarCmd := exec.Command("tar", args...)
+	tarCmd.Env = os.Environ()
+	tarCmd.Dir = dir
+
+	if err := tarCmd.Run(); err != nil {
+		log.Error(log.Tar, err.Error())
+		return nil, fmt.Errorf("tarCmd failed for %s", rpmTar)
+	}
+
+	return found, nil
+}
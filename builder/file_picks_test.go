@@ -0,0 +1,95 @@
+package builder
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseFilePick(t *testing.T) {
+	tests := []struct {
+		text       string
+		expected   filePick
+		shouldFail bool
+	}{
+		{text: "coreutils:/usr/bin/ls", expected: filePick{Package: "coreutils", Pattern: "/usr/bin/ls", Line: 1}},
+		{text: " foo : /usr/lib64/libfoo.so.* ", expected: filePick{Package: "foo", Pattern: "/usr/lib64/libfoo.so.*", Line: 1}},
+
+		// Error cases.
+		{text: "coreutils", shouldFail: true},
+		{text: "coreutils:usr/bin/ls", shouldFail: true},
+		{text: "coreutils:/usr/bin/[", shouldFail: true},
+		{text: "core$utils:/usr/bin/ls", shouldFail: true},
+	}
+
+	for _, tt := range tests {
+		pick, err := parseFilePick(tt.text, 1)
+		if tt.shouldFail {
+			if err == nil {
+				t.Errorf("unexpected success parsing %q", tt.text)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("unexpected error parsing %q: %s", tt.text, err)
+			continue
+		}
+		if pick != tt.expected {
+			t.Errorf("got %+v parsing %q, expected %+v", pick, tt.text, tt.expected)
+		}
+	}
+}
+
+func TestMatchFilePicks(t *testing.T) {
+	picks := []filePick{
+		{Package: "coreutils", Pattern: "/usr/bin/ls", Line: 2},
+		{Package: "coreutils", Pattern: "/usr/bin/c*", Line: 3},
+		{Package: "other", Pattern: "/usr/bin/other", Line: 4},
+	}
+	files := []string{"/usr/bin/ls", "/usr/bin/cat", "/usr/bin/cp", "/usr/bin/mv", "/usr/share/doc/coreutils/README"}
+
+	matched, err := matchFilePicks(picks, "coreutils", files)
+	if err != nil {
+		t.Fatalf("unexpected error matching picks: %s", err)
+	}
+	if expected := []string{"/usr/bin/ls", "/usr/bin/cat", "/usr/bin/cp"}; !reflect.DeepEqual(matched, expected) {
+		t.Errorf("got matched files %q, expected %q", matched, expected)
+	}
+
+	picks = append(picks, filePick{Package: "coreutils", Pattern: "/usr/sbin/*", Line: 5})
+	_, err = matchFilePicks(picks, "coreutils", files)
+	if err == nil || !strings.Contains(err.Error(), "line 5") {
+		t.Errorf("got error %v, expected pick in line 5 not matching", err)
+	}
+}
+
+func TestParseBundleFilePick(t *testing.T) {
+	b, err := parseBundle([]byte("pkg1\nfile(coreutils:/usr/bin/ls)\n"))
+	if err != nil {
+		t.Fatalf("unexpected error parsing bundle: %s", err)
+	}
+	expected := []filePick{{Package: "coreutils", Pattern: "/usr/bin/ls", Line: 2}}
+	if !reflect.DeepEqual(b.FilePicks, expected) {
+		t.Errorf("got file picks %+v, expected %+v", b.FilePicks, expected)
+	}
+	if b.DirectPackages["coreutils"] {
+		t.Errorf("file() package was added to the bundle packages")
+	}
+
+	for _, contents := range []string{"file(", "file(coreutils)", "file(coreutils:/usr/bin/ls"} {
+		if _, err = parseBundle([]byte(contents)); err == nil {
+			t.Errorf("unexpected success parsing %q", contents)
+		}
+	}
+}
+
+func TestArchivedPicks(t *testing.T) {
+	members := []string{"./", "./usr/", "./usr/bin/", "./usr/bin/ls", "./usr/bin/cat", ""}
+	found, missing := archivedPicks([]string{"/usr/bin/ls", "/var/log/ghost.log", "/usr/bin/cat"}, members)
+	if expected := []string{"/usr/bin/ls", "/usr/bin/cat"}; !reflect.DeepEqual(found, expected) {
+		t.Errorf("got found files %q, expected %q", found, expected)
+	}
+	if expected := []string{"/var/log/ghost.log"}; !reflect.DeepEqual(missing, expected) {
+		t.Errorf("got missing files %q, expected %q", missing, expected)
+	}
+}
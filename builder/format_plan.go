@@ -0,0 +1,451 @@
+package builder
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/clearlinux/mixer-tools/helpers"
+	"github.com/clearlinux/mixer-tools/log"
+	"github.com/pkg/errors"
+)
+
+// formatBumpPlanFile records the plan of a format bump in progress under the
+// server state directory.
+const formatBumpPlanFile = ".format-bump"
+
+// Stages of a format bump step, in order: the +10 build in the old format and
+// the +20 build in the new format.
+const (
+	formatBumpOld = "old"
+	formatBumpNew = "new"
+)
+
+var formatBumpStages = []string{formatBumpOld, formatBumpNew}
+
+// FormatBumpStep is a downstream format bump crossing one upstream format
+// boundary.
+type FormatBumpStep struct {
+	// FromFormat is the format of the mix before the bump, and Format after.
+	FromFormat string
+	Format     string
+
+	// UpstreamVersion is the upstream version both builds are based on: the
+	// first version after the latest of UpstreamFormat.
+	UpstreamVersion string
+	UpstreamFormat  string
+
+	OldVersion int
+	NewVersion int
+
+	// Completed lists the stages already built.
+	Completed []string
+}
+
+func (s *FormatBumpStep) done(stage string) bool {
+	for _, c := range s.Completed {
+		if c == stage {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *FormatBumpStep) version(stage string) int {
+	if stage == formatBumpOld {
+		return s.OldVersion
+	}
+	return s.NewVersion
+}
+
+// FormatBumpPlan is the sequence of format bumps needed to build the target
+// upstream version on top of the last build of the mix.
+type FormatBumpPlan struct {
+	LastVersion         int
+	LastUpstreamVersion string
+	Format              string
+
+	TargetUpstreamVersion string
+	TargetUpstreamFormat  string
+
+	Steps []FormatBumpStep
+
+	// NextVersion is the mix version of the first build of the target
+	// upstream version, once the format bumps are done.
+	NextVersion int
+
+	// MixVersion is the mix version when the format bump started, zero in
+	// plans saved before it was recorded.
+	MixVersion int `json:",omitempty"`
+
+	filename string
+}
+
+func (b *Builder) formatBumpPlanPath() string {
+	return filepath.Join(b.Config.Builder.ServerStateDir, formatBumpPlanFile)
+}
+
+// readFormatBumpPlan reads the plan of the format bump in progress, returning
+// nil if there is none.
+func readFormatBumpPlan(filename string) (*FormatBumpPlan, error) {
+	content, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	p := &FormatBumpPlan{filename: filename}
+	if err = json.Unmarshal(content, p); err != nil {
+		return nil, errors.Wrapf(err, "couldn't parse format bump plan %s", filename)
+	}
+	return p, nil
+}
+
+func (p *FormatBumpPlan) save() error {
+	content, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := p.filename + ".tmp"
+	if err = ioutil.WriteFile(tmp, content, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, p.filename)
+}
+
+// targetUpstreamVersion returns the upstream version the user wants to build,
+// which is saved in the ".bump" file while the mix is staged for a bump.
+func (b *Builder) targetUpstreamVersion() (string, error) {
+	vBFile := filepath.Join(b.Config.Builder.VersionPath, b.UpstreamVerFile+".bump")
+	content, err := ioutil.ReadFile(vBFile)
+	if os.IsNotExist(err) {
+		return b.UpstreamVer, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(content)), nil
+}
+
+// PlanFormatBump returns the plan of the format bump in progress or, if there
+// is none, computes the format bumps needed to reach the upstream version of
+// the mix from the last build. The first bump is to newFormat, or to the next
+// format if empty, and each following bump to the next format.
+func (b *Builder) PlanFormatBump(newFormat string) (*FormatBumpPlan, error) {
+	p, err := readFormatBumpPlan(b.formatBumpPlanPath())
+	if err != nil {
+		return nil, err
+	}
+	if p != nil {
+		if err = b.checkFormatBumpPlan(p); err != nil {
+			return nil, err
+		}
+		return p, nil
+	}
+
+	if Offline {
+		return nil, errors.New("format bumps can't be planned offline, the upstream formats are needed")
+	}
+
+	lastVer, err := b.GetLastBuildVersion()
+	if err != nil {
+		return nil, errors.Wrap(err, "couldn't read the version of the last build")
+	}
+	p = &FormatBumpPlan{Format: b.State.Mix.Format, filename: b.formatBumpPlanPath()}
+	if p.LastVersion, err = strconv.Atoi(lastVer); err != nil {
+		return nil, errors.Wrapf(err, "invalid last build version %q", lastVer)
+	}
+	if p.LastUpstreamVersion, err = b.getLocalUpstreamVersion(lastVer); err != nil {
+		return nil, errors.Wrapf(err, "couldn't read the upstream version of the last build %s", lastVer)
+	}
+	if p.TargetUpstreamVersion, err = b.targetUpstreamVersion(); err != nil {
+		return nil, err
+	}
+	if p.TargetUpstreamFormat, err = b.getUpstreamFormat(p.TargetUpstreamVersion); err != nil {
+		return nil, err
+	}
+
+	nextFormat := newFormat
+	if nextFormat == "" {
+		format, err := strconv.Atoi(p.Format)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid mix format %q", p.Format)
+		}
+		nextFormat = strconv.Itoa(format + 1)
+	}
+
+	formatRange := func(version string) (string, uint32, error) {
+		format, _, latest, err := b.getUpstreamFormatRange(version)
+		return format, latest, err
+	}
+	if err = p.planSteps(nextFormat, formatRange); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// checkFormatBumpPlan refuses a saved plan when the last build version or the
+// mix version were changed since it was saved, as running it would overwrite
+// them with the versions of the plan.
+func (b *Builder) checkFormatBumpPlan(p *FormatBumpPlan) error {
+	lastVer, err := b.GetLastBuildVersion()
+	if err != nil {
+		return errors.Wrap(err, "couldn't read the version of the last build")
+	}
+	last, err := strconv.Atoi(lastVer)
+	if err != nil {
+		return errors.Wrapf(err, "invalid last build version %q", lastVer)
+	}
+	mix, err := strconv.Atoi(b.MixVer)
+	if err != nil {
+		return errors.Wrapf(err, "invalid mix version %q", b.MixVer)
+	}
+
+	// The versions expected between the builds of the first step not
+	// completed, including after an interruption before the completion of a
+	// build was recorded, or once all the steps are completed.
+	var lastVers, mixVers []int
+	var step *FormatBumpStep
+	for i := range p.Steps {
+		if !p.Steps[i].done(formatBumpOld) || !p.Steps[i].done(formatBumpNew) {
+			step = &p.Steps[i]
+			break
+		}
+	}
+	switch {
+	case step != nil:
+		lastVers = []int{step.OldVersion - 10, step.OldVersion, step.NewVersion}
+		mixVers = []int{step.OldVersion, step.NewVersion}
+		if step == &p.Steps[0] && len(step.Completed) == 0 {
+			mixVers = append(mixVers, p.MixVersion)
+		}
+	case len(p.Steps) > 0:
+		final := p.Steps[len(p.Steps)-1].NewVersion
+		lastVers = []int{final}
+		mixVers = []int{final, p.NextVersion}
+	default:
+		lastVers = []int{p.LastVersion}
+		mixVers = []int{p.MixVersion}
+	}
+
+	contains := func(list []int, v int) bool {
+		for _, l := range list {
+			if l == v {
+				return true
+			}
+		}
+		return false
+	}
+	if !contains(lastVers, last) {
+		return errors.Errorf("the last build version is %d, but the format bump plan expects %v: it was changed since the plan was saved, remove %s to plan the format bump again", last, lastVers, p.filename)
+	}
+	// Plans saved without the mix version can't tell the one they started
+	// from
+	if p.MixVersion != 0 && !contains(mixVers, mix) {
+		return errors.Errorf("the mix version is %d, but the format bump plan expects %v: it was changed since the plan was saved, remove %s to plan the format bump again", mix, mixVers, p.filename)
+	}
+	return nil
+}
+
+// planSteps walks the upstream formats from the upstream version of the last
+// build to the format of the target upstream version, adding a format bump for
+// each boundary crossed. formatRange returns the upstream format of a version
+// and the latest version of that format.
+func (p *FormatBumpPlan) planSteps(nextFormat string, formatRange func(string) (string, uint32, error)) error {
+	target, err := strconv.Atoi(p.TargetUpstreamFormat)
+	if err != nil {
+		return errors.Errorf("upstream format %q of version %s is not a number", p.TargetUpstreamFormat, p.TargetUpstreamVersion)
+	}
+	mixFormat, err := strconv.Atoi(nextFormat)
+	if err != nil {
+		return errors.Errorf("invalid format %q", nextFormat)
+	}
+
+	p.Steps = nil
+	version := p.LastVersion
+	fromFormat := p.Format
+	upstream := p.LastUpstreamVersion
+	previous := -1
+	for {
+		formatStr, latest, err := formatRange(upstream)
+		if err != nil {
+			return err
+		}
+		format, err := strconv.Atoi(formatStr)
+		if err != nil {
+			return errors.Errorf("upstream format %q of version %s is not a number", formatStr, upstream)
+		}
+		if format <= previous {
+			return errors.Errorf("upstream version %s doesn't cross the upstream format %d", upstream, previous)
+		}
+		if format > target {
+			return errors.Errorf("upstream version %s is in format %d, older than the format %d of upstream version %s", p.TargetUpstreamVersion, target, format, upstream)
+		}
+		if format == target {
+			break
+		}
+
+		step := FormatBumpStep{
+			FromFormat:      fromFormat,
+			Format:          strconv.Itoa(mixFormat),
+			UpstreamVersion: strconv.FormatUint(uint64(latest)+10, 10),
+			UpstreamFormat:  formatStr,
+			OldVersion:      version + 10,
+			NewVersion:      version + 20,
+		}
+		p.Steps = append(p.Steps, step)
+
+		version = step.NewVersion
+		fromFormat = step.Format
+		mixFormat++
+		upstream = step.UpstreamVersion
+		previous = format
+	}
+	p.NextVersion = version + 10
+	return nil
+}
+
+// Print shows the builds of the plan and the stages already completed.
+func (p *FormatBumpPlan) Print() {
+	fmt.Printf("Last build: version %d in format %s, upstream version %s\n", p.LastVersion, p.Format, p.LastUpstreamVersion)
+	fmt.Printf("Target: upstream version %s in upstream format %s\n\n", p.TargetUpstreamVersion, p.TargetUpstreamFormat)
+	if len(p.Steps) == 0 {
+		fmt.Println("No format bump needed")
+		return
+	}
+
+	for i, step := range p.Steps {
+		fmt.Printf("Format bump %d: format %s -> %s, crossing upstream format %s with upstream version %s\n",
+			i+1, step.FromFormat, step.Format, step.UpstreamFormat, step.UpstreamVersion)
+		for _, stage := range formatBumpStages {
+			format := step.FromFormat
+			if stage == formatBumpNew {
+				format = step.Format
+			}
+			status := ""
+			if step.done(stage) {
+				status = " (done)"
+			}
+			fmt.Printf("  %d: format-bump %s, format %s%s\n", step.version(stage), stage, format, status)
+		}
+	}
+	fmt.Printf("\nNext build: version %d on upstream version %s\n", p.NextVersion, p.TargetUpstreamVersion)
+}
+
+// stageUpstreamVersion sets the upstream version of the mix for a bump build,
+// saving the target upstream version in the ".bump" file first.
+func (b *Builder) stageUpstreamVersion(version string) error {
+	vFile := filepath.Join(b.Config.Builder.VersionPath, b.UpstreamVerFile)
+	vBFile := vFile + ".bump"
+	if _, err := os.Stat(vBFile); os.IsNotExist(err) {
+		if err = helpers.CopyFile(vBFile, vFile); err != nil {
+			return err
+		}
+	}
+	if err := ioutil.WriteFile(vFile, []byte(version), 0644); err != nil {
+		return err
+	}
+	if err := b.ReadVersions(); err != nil {
+		return err
+	}
+	return b.getUpstreamBundles()
+}
+
+// setFormatBumpState sets the last build version, which is also the previous
+// version of the manifests, the mix version and the format expected between
+// the builds of a format bump. Setting it before and after each build makes
+// the builds safe to run again after an interruption.
+func (b *Builder) setFormatBumpState(last, mix int, format string) error {
+	lastVer := strconv.Itoa(last)
+	if err := ioutil.WriteFile(filepath.Join(b.Config.Builder.ServerStateDir, "image", "LAST_VER"), []byte(lastVer), 0644); err != nil {
+		return err
+	}
+	b.State.Mix.PreviousMixVer = lastVer
+	b.State.Mix.Format = format
+	if err := b.State.Save(); err != nil {
+		return err
+	}
+	return b.UpdateMixVer(mix)
+}
+
+// RunFormatBump runs the builds of the plan, calling build for each stage of
+// each step not completed yet. Completed stages are recorded in the plan, so
+// running it again after a failure resumes from the failed build. Once done,
+// the upstream version of the mix is set back to the target and the mix
+// version to the next version.
+func (b *Builder) RunFormatBump(p *FormatBumpPlan, build func(stage string, step *FormatBumpStep) error) error {
+	t, err := readTransaction(b.transactionDir())
+	if err != nil {
+		return err
+	}
+	if t != nil && !t.Committed {
+		return errors.New("a build was interrupted, roll it back with \"mixer build rollback\" before running the format bump")
+	}
+	if p.MixVersion == 0 {
+		if p.MixVersion, err = strconv.Atoi(b.MixVer); err != nil {
+			return errors.Wrapf(err, "invalid mix version %q", b.MixVer)
+		}
+	}
+	if err = p.save(); err != nil {
+		return err
+	}
+
+	for i := range p.Steps {
+		step := &p.Steps[i]
+		for _, stage := range formatBumpStages {
+			version := step.version(stage)
+			if step.done(stage) {
+				log.Info(log.Mixer, "Version %d of the format bump to format %s already built, skipping", version, step.Format)
+				continue
+			}
+
+			built, err := b.versionCommitted(strconv.Itoa(version))
+			if err != nil {
+				return err
+			}
+			if built {
+				log.Info(log.Mixer, "Version %d of the format bump to format %s found, skipping", version, step.Format)
+			} else {
+				// Both builds start from the version before the bump
+				if err = b.setFormatBumpState(step.OldVersion-10, step.OldVersion, step.FromFormat); err != nil {
+					return err
+				}
+				if err = b.stageUpstreamVersion(step.UpstreamVersion); err != nil {
+					return err
+				}
+				log.Info(log.Mixer, "Building version %d of the format bump to format %s (format-bump %s)", version, step.Format, stage)
+				if err = build(stage, step); err != nil {
+					return errors.Wrapf(err, "couldn't build version %d, run the format bump again to resume", version)
+				}
+			}
+
+			if stage == formatBumpOld {
+				err = b.setFormatBumpState(step.OldVersion-10, step.OldVersion, step.FromFormat)
+			} else {
+				err = b.setFormatBumpState(step.NewVersion, step.NewVersion, step.Format)
+			}
+			if err != nil {
+				return err
+			}
+			step.Completed = append(step.Completed, stage)
+			if err = p.save(); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err = b.UnstageMixFromBump(); err != nil {
+		return err
+	}
+	if len(p.Steps) > 0 {
+		if err = b.UpdateMixVer(p.NextVersion); err != nil {
+			return err
+		}
+	}
+	return os.Remove(p.filename)
+}
@@ -0,0 +1,189 @@
+package builder
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+var testUpstreamFormats = map[string]struct {
+	format string
+	latest uint32
+}{
+	"29000": {"28", 29500},
+	"29510": {"29", 29800},
+	"29810": {"30", 30500},
+}
+
+func testFormatRange(version string) (string, uint32, error) {
+	f, ok := testUpstreamFormats[version]
+	if !ok {
+		return "", 0, fmt.Errorf("unknown upstream version %s", version)
+	}
+	return f.format, f.latest, nil
+}
+
+func newTestFormatBumpPlan() *FormatBumpPlan {
+	return &FormatBumpPlan{
+		LastVersion:           100,
+		LastUpstreamVersion:   "29000",
+		Format:                "1",
+		TargetUpstreamVersion: "30000",
+		TargetUpstreamFormat:  "30",
+	}
+}
+
+func TestPlanFormatBumpSteps(t *testing.T) {
+	p := newTestFormatBumpPlan()
+	if err := p.planSteps("2", testFormatRange); err != nil {
+		t.Fatalf("couldn't plan format bump: %s", err)
+	}
+
+	expected := []FormatBumpStep{
+		{FromFormat: "1", Format: "2", UpstreamVersion: "29510", UpstreamFormat: "28", OldVersion: 110, NewVersion: 120},
+		{FromFormat: "2", Format: "3", UpstreamVersion: "29810", UpstreamFormat: "29", OldVersion: 130, NewVersion: 140},
+	}
+	if len(p.Steps) != len(expected) {
+		t.Fatalf("got steps %+v, expected %+v", p.Steps, expected)
+	}
+	for i, step := range p.Steps {
+		e := expected[i]
+		if step.FromFormat != e.FromFormat || step.Format != e.Format || step.UpstreamVersion != e.UpstreamVersion ||
+			step.UpstreamFormat != e.UpstreamFormat || step.OldVersion != e.OldVersion || step.NewVersion != e.NewVersion {
+			t.Errorf("got step %+v, expected %+v", step, e)
+		}
+	}
+	if p.NextVersion != 150 {
+		t.Errorf("got next version %d, expected 150", p.NextVersion)
+	}
+
+	// No bump within the same upstream format
+	p.TargetUpstreamFormat = "28"
+	if err := p.planSteps("2", testFormatRange); err != nil || len(p.Steps) != 0 || p.NextVersion != 110 {
+		t.Errorf("expected no format bump, got %+v (%v)", p.Steps, err)
+	}
+
+	// Target older than the last build
+	p.TargetUpstreamFormat = "27"
+	if err := p.planSteps("2", testFormatRange); err == nil {
+		t.Errorf("expected error planning a format bump to an older upstream format")
+	}
+}
+
+func TestRunFormatBumpResume(t *testing.T) {
+	testDir, err := ioutil.TempDir("", "format-bump-test-")
+	if err != nil {
+		t.Fatalf("couldn't create temporary directory: %s", err)
+	}
+	defer cleanup(testDir)
+
+	// mixer.state is written to the working directory
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Chdir(testDir); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = os.Chdir(wd)
+	}()
+	defer func(offline bool) {
+		Offline = offline
+	}(Offline)
+	Offline = true
+
+	b := newTransactionTestBuilder(testDir)
+	stateDir := b.Config.Builder.ServerStateDir
+	writeTestFile(t, filepath.Join(testDir, "mixversion"), "110")
+	writeTestFile(t, filepath.Join(testDir, "upstreamversion"), "30000")
+	writeTestFile(t, filepath.Join(stateDir, "image", "LAST_VER"), "100")
+	b.State.LoadDefaults(b.Config)
+	b.State.Mix.Format = "1"
+
+	p := newTestFormatBumpPlan()
+	p.filename = b.formatBumpPlanPath()
+	if err = p.planSteps("2", testFormatRange); err != nil {
+		t.Fatal(err)
+	}
+
+	var built []int
+	fail := 120
+	build := func(stage string, step *FormatBumpStep) error {
+		if err := b.ReadVersions(); err != nil {
+			return err
+		}
+		if b.UpstreamVer != step.UpstreamVersion {
+			t.Errorf("version %d built on upstream version %s, expected %s", step.version(stage), b.UpstreamVer, step.UpstreamVersion)
+		}
+		if b.MixVer != strconv.Itoa(step.OldVersion) || b.State.Mix.Format != step.FromFormat {
+			t.Errorf("version %d built from mix version %s in format %s", step.version(stage), b.MixVer, b.State.Mix.Format)
+		}
+		version := step.version(stage)
+		if version == fail {
+			return fmt.Errorf("build of %d failed", version)
+		}
+		built = append(built, version)
+		writeTestFile(t, filepath.Join(stateDir, "www", strconv.Itoa(version), "Manifest.MoM"), "")
+		return nil
+	}
+
+	if err = b.RunFormatBump(p, build); err == nil {
+		t.Fatalf("expected format bump to fail")
+	}
+	p, err = b.PlanFormatBump("")
+	if err != nil || p == nil {
+		t.Fatalf("couldn't read the format bump in progress: %v", err)
+	}
+	if len(p.Steps[0].Completed) != 1 || !p.Steps[0].done(formatBumpOld) {
+		t.Errorf("expected only the old stage of the first bump to be completed, got %v", p.Steps[0].Completed)
+	}
+	checkTestFile(t, filepath.Join(testDir, "upstreamversion.bump"), "30000")
+
+	// The plan is refused once the last build or mix version were changed by
+	// hand.
+	lastVerFile := filepath.Join(stateDir, "image", "LAST_VER")
+	writeTestFile(t, lastVerFile, "90")
+	if _, err = b.PlanFormatBump(""); err == nil {
+		t.Error("expected the plan to be refused after LAST_VER changed")
+	}
+	writeTestFile(t, lastVerFile, "100")
+	if err = b.UpdateMixVer(500); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = b.PlanFormatBump(""); err == nil {
+		t.Error("expected the plan to be refused after the mix version changed")
+	}
+	if err = b.UpdateMixVer(110); err != nil {
+		t.Fatal(err)
+	}
+	if p, err = b.PlanFormatBump(""); err != nil {
+		t.Fatalf("couldn't read the format bump in progress: %s", err)
+	}
+
+	// Version 130 was built but not recorded before an interruption.
+	writeTestFile(t, filepath.Join(stateDir, "www", "130", "Manifest.MoM"), "")
+	fail = 0
+	built = nil
+	if err = b.RunFormatBump(p, build); err != nil {
+		t.Fatalf("couldn't resume format bump: %s", err)
+	}
+	if fmt.Sprint(built) != "[120 140]" {
+		t.Errorf("resumed format bump built %v, expected [120 140]", built)
+	}
+
+	checkTestFile(t, filepath.Join(testDir, "mixversion"), "150")
+	checkTestFile(t, filepath.Join(testDir, "upstreamversion"), "30000")
+	checkTestFile(t, filepath.Join(stateDir, "image", "LAST_VER"), "140")
+	if b.State.Mix.Format != "3" || b.State.Mix.PreviousMixVer != "140" {
+		t.Errorf("got format %s and previous version %s, expected 3 and 140", b.State.Mix.Format, b.State.Mix.PreviousMixVer)
+	}
+	for _, f := range []string{filepath.Join(testDir, "upstreamversion.bump"), b.formatBumpPlanPath()} {
+		if _, err = os.Stat(f); !os.IsNotExist(err) {
+			t.Errorf("%s should be removed after the format bump", f)
+		}
+	}
+}
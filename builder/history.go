@@ -0,0 +1,415 @@
+package builder
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/clearlinux/mixer-tools/swupd"
+	"github.com/olekukonko/tablewriter"
+	"github.com/pkg/errors"
+)
+
+// historyFile records every successful build under the server state directory,
+// one JSON record per line, in version order.
+const historyFile = "history"
+
+// historySizes are the sizes of the update content of a version when it was
+// built.
+type historySizes struct {
+	Manifests uint64
+	Fullfiles uint64
+	Packs     uint64
+	Total     uint64
+}
+
+// historyRecord is a successful build of a mix version.
+type historyRecord struct {
+	Version         string
+	UpstreamVersion string
+	Format          string
+	MinVersion      uint32
+	PreviousVersion string
+
+	// GitCommit is the commit of the mix workspace, if it is a git
+	// repository, and GitDirty is set when it had uncommitted changes.
+	GitCommit string `json:",omitempty"`
+	GitDirty  bool   `json:",omitempty"`
+
+	// Bundles are the bundles of the version, and AddedBundles and
+	// RemovedBundles the changes relative to the record of the previous
+	// version.
+	Bundles        []string
+	AddedBundles   []string `json:",omitempty"`
+	RemovedBundles []string `json:",omitempty"`
+
+	// Started is when the build transaction of the version started, with the
+	// first build command since the last committed build, and Phases the
+	// durations of the update phases.
+	Started   time.Time
+	Completed time.Time
+	Phases    []phaseHookTiming `json:",omitempty"`
+
+	Sizes historySizes
+}
+
+func (r *historyRecord) duration() time.Duration {
+	return r.Completed.Sub(r.Started).Truncate(time.Second)
+}
+
+func (b *Builder) historyPath() string {
+	return filepath.Join(b.Config.Builder.ServerStateDir, historyFile)
+}
+
+// readHistory returns the records of the history file, or none if it doesn't
+// exist.
+func readHistory(filename string) ([]historyRecord, error) {
+	f, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+
+	var records []historyRecord
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 16*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var r historyRecord
+		if err = json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			return nil, errors.Wrapf(err, "couldn't parse line %d of history file %s", line, filename)
+		}
+		records = append(records, r)
+	}
+	return records, scanner.Err()
+}
+
+func writeHistory(filename string, records []historyRecord) error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for i := range records {
+		if err := enc.Encode(&records[i]); err != nil {
+			return err
+		}
+	}
+	return ioutil.WriteFile(filename, buf.Bytes(), 0644)
+}
+
+// workspaceCommit returns the git commit of the mix workspace and whether it
+// has uncommitted changes, or an empty commit if it isn't a git repository.
+func (b *Builder) workspaceCommit() (string, bool) {
+	dir := b.Config.Builder.VersionPath
+	out, err := exec.Command("git", "-C", dir, "rev-parse", "--verify", "-q", "HEAD").Output()
+	if err != nil {
+		return "", false
+	}
+	status, err := exec.Command("git", "-C", dir, "status", "--porcelain").Output()
+	return strings.TrimSpace(string(out)), err == nil && len(bytes.TrimSpace(status)) > 0
+}
+
+// updateSizes returns the sizes of the manifests, fullfiles and packs of the
+// update content of a version.
+func updateSizes(wwwDir string) (historySizes, error) {
+	var sizes historySizes
+	// Until the build is committed, the directory is a symlink to the
+	// transaction
+	wwwDir, err := filepath.EvalSymlinks(wwwDir)
+	if err != nil {
+		return sizes, err
+	}
+	err = filepath.Walk(wwwDir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil || !fi.Mode().IsRegular() {
+			return err
+		}
+		size := uint64(fi.Size())
+		rel, _ := filepath.Rel(wwwDir, path)
+		switch {
+		case strings.HasPrefix(rel, "files"+string(filepath.Separator)):
+			sizes.Fullfiles += size
+		case strings.HasPrefix(rel, "Manifest."):
+			sizes.Manifests += size
+		case strings.HasPrefix(rel, "pack-"):
+			sizes.Packs += size
+		}
+		sizes.Total += size
+		return nil
+	})
+	return sizes, err
+}
+
+// newHistoryRecord describes the version built from its MoM and update
+// content, comparing its bundles with the record of the previous version, if
+// any.
+func (b *Builder) newHistoryRecord(prev *historyRecord, timer *stopWatch, started time.Time) (historyRecord, error) {
+	wwwDir := filepath.Join(b.Config.Builder.ServerStateDir, "www", b.MixVer)
+	mom, err := swupd.ParseManifestFile(filepath.Join(wwwDir, "Manifest.MoM"))
+	if err != nil {
+		return historyRecord{}, err
+	}
+
+	r := historyRecord{
+		Version:         b.MixVer,
+		UpstreamVersion: b.UpstreamVer,
+		Format:          b.State.Mix.Format,
+		MinVersion:      mom.Header.MinVersion,
+		PreviousVersion: fmt.Sprint(mom.Header.Previous),
+		Started:         started.UTC(),
+		Completed:       time.Now().UTC(),
+		Phases:          timer.timings(),
+	}
+	r.GitCommit, r.GitDirty = b.workspaceCommit()
+	if r.Sizes, err = updateSizes(wwwDir); err != nil {
+		return historyRecord{}, err
+	}
+
+	for _, f := range mom.Files {
+		if f.Status != swupd.StatusDeleted {
+			r.Bundles = append(r.Bundles, f.Name)
+		}
+	}
+	sort.Strings(r.Bundles)
+	if prev != nil {
+		r.AddedBundles, r.RemovedBundles = diffBundleLists(prev.Bundles, r.Bundles)
+	}
+	return r, nil
+}
+
+// diffBundleLists returns the bundles added and removed from one sorted list
+// to another.
+func diffBundleLists(from, to []string) ([]string, []string) {
+	before := make(map[string]bool)
+	for _, name := range from {
+		before[name] = true
+	}
+	after := make(map[string]bool)
+	var added, removed []string
+	for _, name := range to {
+		after[name] = true
+		if !before[name] {
+			added = append(added, name)
+		}
+	}
+	for _, name := range from {
+		if !after[name] {
+			removed = append(removed, name)
+		}
+	}
+	return added, removed
+}
+
+// stageHistory writes the history with the record of the version built in the
+// staging directory of the transaction, so it is only updated when the build
+// is committed, and restored if it is rolled back. The record is inserted in
+// version order, so an older version built again is compared with the version
+// before it, and the next version with it.
+func (b *Builder) stageHistory(t *buildTransaction, timer *stopWatch, stagingDir string, staged map[string]string) error {
+	records, err := readHistory(b.historyPath())
+	if err != nil {
+		return err
+	}
+	// A version built again replaces its record.
+	kept := records[:0]
+	for _, r := range records {
+		if r.Version != b.MixVer {
+			kept = append(kept, r)
+		}
+	}
+	i := sort.Search(len(kept), func(i int) bool {
+		return historyVersionLess(b.MixVer, kept[i].Version)
+	})
+	var prev *historyRecord
+	if i > 0 {
+		prev = &kept[i-1]
+	}
+	r, err := b.newHistoryRecord(prev, timer, t.Started)
+	if err != nil {
+		return errors.Wrap(err, "couldn't record the build history")
+	}
+	records = append(kept[:i:i], append([]historyRecord{r}, kept[i:]...)...)
+	if i+1 < len(records) {
+		next := &records[i+1]
+		next.AddedBundles, next.RemovedBundles = diffBundleLists(r.Bundles, next.Bundles)
+	}
+
+	filename := filepath.Join(stagingDir, historyFile)
+	if err = writeHistory(filename, records); err != nil {
+		return err
+	}
+	staged[filename] = b.historyPath()
+	return nil
+}
+
+// historyVersionLess compares two versions of the history numerically.
+func historyVersionLess(a, b string) bool {
+	x, _ := strconv.ParseUint(a, 10, 32)
+	y, _ := strconv.ParseUint(b, 10, 32)
+	return x < y
+}
+
+func findHistoryRecord(records []historyRecord, version string) (*historyRecord, error) {
+	for i := range records {
+		if records[i].Version == version {
+			return &records[i], nil
+		}
+	}
+	return nil, errors.Errorf("version %s not found in the build history", version)
+}
+
+func shortCommit(r *historyRecord) string {
+	commit := r.GitCommit
+	if len(commit) > 12 {
+		commit = commit[:12]
+	}
+	if r.GitDirty {
+		commit += "+dirty"
+	}
+	return commit
+}
+
+// ListHistory prints a line for each build recorded in the history.
+func (b *Builder) ListHistory() error {
+	records, err := readHistory(b.historyPath())
+	if err != nil {
+		return err
+	}
+	if len(records) == 0 {
+		fmt.Println("No build recorded in the history")
+		return nil
+	}
+
+	table := tablewriter.NewWriter(os.Stdout)
+	table.SetAutoWrapText(false)
+	table.SetHeader([]string{"VERSION", "UPSTREAM", "FORMAT", "MINVERSION", "BUNDLES", "COMMIT", "COMPLETED", "DURATION", "SIZE"})
+	for i := range records {
+		r := &records[i]
+		bundles := fmt.Sprint(len(r.Bundles))
+		if len(r.AddedBundles) > 0 || len(r.RemovedBundles) > 0 {
+			bundles += fmt.Sprintf(" (+%d -%d)", len(r.AddedBundles), len(r.RemovedBundles))
+		}
+		table.Append([]string{
+			r.Version,
+			r.UpstreamVersion,
+			r.Format,
+			fmt.Sprint(r.MinVersion),
+			bundles,
+			shortCommit(r),
+			r.Completed.Local().Format("2006-01-02 15:04"),
+			r.duration().String(),
+			formatSize(r.Sizes.Total),
+		})
+	}
+	table.Render()
+	return nil
+}
+
+// ShowHistory prints the record of a version.
+func (b *Builder) ShowHistory(version string) error {
+	records, err := readHistory(b.historyPath())
+	if err != nil {
+		return err
+	}
+	r, err := findHistoryRecord(records, version)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Version:          %s\n", r.Version)
+	fmt.Printf("Upstream version: %s\n", r.UpstreamVersion)
+	fmt.Printf("Format:           %s\n", r.Format)
+	fmt.Printf("Minversion:       %d\n", r.MinVersion)
+	fmt.Printf("Previous version: %s\n", r.PreviousVersion)
+	if r.GitCommit != "" {
+		fmt.Printf("Git commit:       %s\n", r.GitCommit)
+		if r.GitDirty {
+			fmt.Printf("                  with uncommitted changes\n")
+		}
+	}
+	fmt.Printf("Started:          %s\n", r.Started.Local().Format(time.RFC1123))
+	fmt.Printf("Completed:        %s (%s)\n", r.Completed.Local().Format(time.RFC1123), r.duration())
+
+	fmt.Printf("\nBundles (%d): %s\n", len(r.Bundles), strings.Join(r.Bundles, " "))
+	for _, name := range r.AddedBundles {
+		fmt.Printf("  + %s\n", name)
+	}
+	for _, name := range r.RemovedBundles {
+		fmt.Printf("  - %s\n", name)
+	}
+
+	if len(r.Phases) > 0 {
+		fmt.Printf("\nUpdate phases:\n")
+		for _, p := range r.Phases {
+			d := time.Duration(p.Seconds * float64(time.Second)).Truncate(time.Millisecond)
+			fmt.Printf("  %-30s %s\n", p.Name, d)
+		}
+	}
+
+	fmt.Printf("\nSizes:\n")
+	fmt.Printf("  Manifests: %s\n", formatSize(r.Sizes.Manifests))
+	fmt.Printf("  Fullfiles: %s\n", formatSize(r.Sizes.Fullfiles))
+	fmt.Printf("  Packs:     %s\n", formatSize(r.Sizes.Packs))
+	fmt.Printf("  Total:     %s\n", formatSize(r.Sizes.Total))
+	return nil
+}
+
+// DiffHistory prints the differences between the records of two versions.
+func (b *Builder) DiffHistory(from, to string) error {
+	records, err := readHistory(b.historyPath())
+	if err != nil {
+		return err
+	}
+	f, err := findHistoryRecord(records, from)
+	if err != nil {
+		return err
+	}
+	t, err := findHistoryRecord(records, to)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Version %s -> %s\n", f.Version, t.Version)
+	diffField := func(name, from, to string) {
+		if from != to {
+			fmt.Printf("%-17s %s -> %s\n", name+":", from, to)
+		}
+	}
+	diffField("Upstream version", f.UpstreamVersion, t.UpstreamVersion)
+	diffField("Format", f.Format, t.Format)
+	diffField("Minversion", fmt.Sprint(f.MinVersion), fmt.Sprint(t.MinVersion))
+	diffField("Git commit", shortCommit(f), shortCommit(t))
+	diffField("Duration", f.duration().String(), t.duration().String())
+
+	added, removed := diffBundleLists(f.Bundles, t.Bundles)
+	fmt.Printf("\nBundles: %d -> %d\n", len(f.Bundles), len(t.Bundles))
+	for _, name := range added {
+		fmt.Printf("  + %s\n", name)
+	}
+	for _, name := range removed {
+		fmt.Printf("  - %s\n", name)
+	}
+
+	fmt.Printf("\nSizes:\n")
+	diffSize := func(name string, from, to uint64) {
+		fmt.Printf("  %-10s %s -> %s (%s)\n", name+":", formatSize(from), formatSize(to), formatGrowth(from, to))
+	}
+	diffSize("Manifests", f.Sizes.Manifests, t.Sizes.Manifests)
+	diffSize("Fullfiles", f.Sizes.Fullfiles, t.Sizes.Fullfiles)
+	diffSize("Packs", f.Sizes.Packs, t.Sizes.Packs)
+	diffSize("Total", f.Sizes.Total, t.Sizes.Total)
+	return nil
+}
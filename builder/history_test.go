@@ -0,0 +1,81 @@
+package builder
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStageHistory(t *testing.T) {
+	testDir, err := ioutil.TempDir("", "history-test-")
+	if err != nil {
+		t.Fatalf("couldn't create temporary directory: %s", err)
+	}
+	defer cleanup(testDir)
+
+	b := newTransactionTestBuilder(testDir)
+	b.UpstreamVer = "31000"
+	wwwDir := filepath.Join(b.Config.Builder.ServerStateDir, "www", "20")
+	hash1 := strings.Repeat("1", 64)
+	hash2 := strings.Repeat("2", 64)
+	mustWriteTestManifest(t, filepath.Join(wwwDir, "Manifest.MoM"), 20, []string{"contentsize:\t0", "minversion:\t10"},
+		"M...\t"+hash1+"\t10\tos-core",
+		"M...\t"+hash2+"\t20\tfoo",
+		"Md..\t"+hash2+"\t20\tgone",
+	)
+	writeTestFile(t, filepath.Join(wwwDir, "files", hash2+".tar"), "12345")
+	writeTestFile(t, filepath.Join(wwwDir, "pack-foo-from-10.tar"), "123")
+
+	previous := []historyRecord{
+		{Version: "10", Bundles: []string{"gone", "os-core"}},
+		{Version: "20", Bundles: []string{"stale"}},
+		{Version: "30", Bundles: []string{"bar", "foo", "os-core"}, AddedBundles: []string{"bar", "foo", "os-core"}},
+	}
+	if err = writeHistory(b.historyPath(), previous); err != nil {
+		t.Fatal(err)
+	}
+
+	stagingDir := filepath.Join(testDir, "staging")
+	writeTestFile(t, filepath.Join(stagingDir, "LAST_VER"), "20")
+	staged := make(map[string]string)
+	tr := &buildTransaction{Started: time.Now().Add(-time.Minute)}
+	timer := &stopWatch{}
+	timer.Start("CREATE MANIFESTS")
+	timer.Stop()
+	if err = b.stageHistory(tr, timer, stagingDir, staged); err != nil {
+		t.Fatalf("couldn't stage the history: %s", err)
+	}
+
+	filename := filepath.Join(stagingDir, historyFile)
+	if staged[filename] != b.historyPath() {
+		t.Fatalf("history not staged, got %v", staged)
+	}
+	records, err := readHistory(filename)
+	if err != nil {
+		t.Fatalf("couldn't read staged history: %s", err)
+	}
+	// The version built again is kept in version order, and the next version
+	// is compared with it.
+	if len(records) != 3 || records[0].Version != "10" || records[1].Version != "20" || records[2].Version != "30" {
+		t.Fatalf("unexpected history %+v", records)
+	}
+	if next := records[2]; strings.Join(next.AddedBundles, ",") != "bar" || len(next.RemovedBundles) != 0 {
+		t.Errorf("got added %v and removed %v bundles for the next version", next.AddedBundles, next.RemovedBundles)
+	}
+
+	r := records[1]
+	if r.UpstreamVersion != "31000" || r.Format != "1" || r.MinVersion != 10 || r.PreviousVersion != "0" {
+		t.Errorf("unexpected record %+v", r)
+	}
+	if strings.Join(r.Bundles, ",") != "foo,os-core" || strings.Join(r.AddedBundles, ",") != "foo" || strings.Join(r.RemovedBundles, ",") != "gone" {
+		t.Errorf("got bundles %v, added %v, removed %v", r.Bundles, r.AddedBundles, r.RemovedBundles)
+	}
+	if r.Sizes.Fullfiles != 5 || r.Sizes.Packs != 3 || r.Sizes.Manifests == 0 || r.Sizes.Total != r.Sizes.Manifests+8 {
+		t.Errorf("unexpected sizes %+v", r.Sizes)
+	}
+	if r.duration() < time.Minute || len(r.Phases) != 1 {
+		t.Errorf("unexpected timings: duration %s, phases %+v", r.duration(), r.Phases)
+	}
+}
@@ -0,0 +1,212 @@
+package builder
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/clearlinux/mixer-tools/helpers"
+	"github.com/clearlinux/mixer-tools/log"
+	"github.com/pkg/errors"
+)
+
+// Built-in post-install hooks. Any other hook is the absolute path of a script.
+const (
+	ldconfigHook       = "ldconfig"
+	systemdPresetsHook = "systemd-presets"
+)
+
+// installHook is a post-install hook run over the full chroot once all the
+// bundles are installed, replacing the RPM scriptlets that are not run when
+// the packages are extracted. The files changed by the hook are attributed to
+// the bundle declaring it, and the hooks of the mix are attributed to os-core.
+type installHook struct {
+	Name   string
+	Bundle string
+}
+
+// validateInstallHook checks a hook is either built-in or a script path.
+func validateInstallHook(name string) error {
+	switch {
+	case name == ldconfigHook, name == systemdPresetsHook:
+		return nil
+	case filepath.IsAbs(name):
+		return nil
+	}
+	return errors.Errorf("unknown hook %q, expected %s, %s or the absolute path of a script", name, ldconfigHook, systemdPresetsHook)
+}
+
+// run runs the hook over the full chroot. Scripts get the full chroot as their
+// argument, and MIXER_ROOT, MIXER_BUNDLE and MIXER_VERSION in the environment.
+func (h installHook) run(fullDir, version string) error {
+	var cmd []string
+	var env []string
+	switch h.Name {
+	case ldconfigHook:
+		cmd = []string{"ldconfig", "-r", fullDir}
+	case systemdPresetsHook:
+		cmd = []string{"systemctl", "--root=" + fullDir, "preset-all"}
+	default:
+		cmd = []string{h.Name, fullDir}
+		env = []string{
+			"MIXER_ROOT=" + fullDir,
+			"MIXER_BUNDLE=" + h.Bundle,
+			"MIXER_VERSION=" + version,
+		}
+	}
+
+	out, err := helpers.RunCommandOutputEnv(log.Mixer, cmd[0], cmd[1:], env)
+	if err != nil {
+		return errors.Wrapf(err, "hook %s of bundle %s failed", h.Name, h.Bundle)
+	}
+	if out.Len() > 0 {
+		log.Debug(log.Mixer, "hook %s: %s", h.Name, strings.TrimSpace(out.String()))
+	}
+	return nil
+}
+
+// chrootFile is the state of a file of the full chroot used to tell which
+// files a hook changed.
+type chrootFile struct {
+	Mode    os.FileMode
+	Size    int64
+	ModTime time.Time
+}
+
+// listChrootFiles returns the state of the files in the full chroot.
+func listChrootFiles(fullDir string) (map[string]chrootFile, error) {
+	files := make(map[string]chrootFile)
+	err := filepath.Walk(fullDir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if path != fullDir {
+			files[strings.TrimPrefix(path, fullDir)] = chrootFile{Mode: fi.Mode(), Size: fi.Size(), ModTime: fi.ModTime()}
+		}
+		return nil
+	})
+	return files, err
+}
+
+// fileOwner returns the first bundle of names having file, preferring
+// bundle, or an empty string when no bundle has it.
+func fileOwner(set bundleSet, names []string, bundle, file string) string {
+	if _, ok := set[bundle].Files[file]; ok {
+		return bundle
+	}
+	for _, name := range names {
+		if _, ok := set[name].Files[file]; ok {
+			return name
+		}
+	}
+	return ""
+}
+
+// hookFileOwner returns the bundle a file created by the hook of bundle
+// belongs to. Symlinks, such as the library links created by ldconfig, belong
+// to the bundle of their target, and other files to bundle.
+func hookFileOwner(set bundleSet, names []string, bundle, fullDir, file string) string {
+	target, err := os.Readlink(filepath.Join(fullDir, file))
+	if err != nil {
+		return bundle
+	}
+	if !filepath.IsAbs(target) {
+		target = filepath.Join(filepath.Dir(file), target)
+	}
+	if owner := fileOwner(set, names, bundle, filepath.Clean(target)); owner != "" {
+		return owner
+	}
+	return bundle
+}
+
+// runInstallHooks runs the post-install hooks of the mix and of the bundles over
+// the full chroot. The files each hook creates are added to the bundle
+// declaring it, or to the bundle of their target for symlinks, files it
+// modifies that no bundle has are added to the bundle declaring it, and the
+// files it removes are dropped from the bundles.
+func runInstallHooks(set bundleSet, mixHooks []string, fullDir, version string) error {
+	var hooks []installHook
+	for _, name := range mixHooks {
+		if err := validateInstallHook(name); err != nil {
+			return errors.Wrap(err, "invalid post-install hook in builder.conf")
+		}
+		hooks = append(hooks, installHook{Name: name, Bundle: "os-core"})
+	}
+	var names []string
+	for name := range set {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, hook := range set[name].Hooks {
+			hooks = append(hooks, installHook{Name: hook, Bundle: name})
+		}
+	}
+	if len(hooks) == 0 {
+		return nil
+	}
+
+	before, err := listChrootFiles(fullDir)
+	if err != nil {
+		return err
+	}
+	// The chroot is walked once after the consecutive hooks of each bundle, as
+	// their changes are attributed the same way.
+	for i := 0; i < len(hooks); {
+		bundle := hooks[i].Bundle
+		if _, ok := set[bundle]; !ok {
+			return errors.Errorf("bundle %s of hook %s is not part of the mix", bundle, hooks[i].Name)
+		}
+		var run []string
+		for ; i < len(hooks) && hooks[i].Bundle == bundle; i++ {
+			log.Info(log.Mixer, "Running post-install hook %s for %s", hooks[i].Name, bundle)
+			if err = hooks[i].run(fullDir, version); err != nil {
+				return err
+			}
+			run = append(run, hooks[i].Name)
+		}
+		after, err := listChrootFiles(fullDir)
+		if err != nil {
+			return err
+		}
+
+		var added, modified []string
+		for f, state := range after {
+			prev, ok := before[f]
+			switch {
+			case !ok:
+				added = append(added, f)
+			case state != prev && !(state.Mode.IsDir() && prev.Mode.IsDir()):
+				modified = append(modified, f)
+			}
+		}
+		sort.Strings(added)
+		for _, f := range added {
+			b := set[hookFileOwner(set, names, bundle, fullDir, f)]
+			addFileAndPath(b.Files, b.UnExport, f)
+		}
+		// Modified files stay in the bundles having them.
+		for _, f := range modified {
+			if fileOwner(set, names, bundle, f) == "" {
+				b := set[bundle]
+				addFileAndPath(b.Files, b.UnExport, f)
+			}
+		}
+
+		removed := 0
+		for f := range before {
+			if _, ok := after[f]; ok {
+				continue
+			}
+			removed++
+			for _, b := range set {
+				delete(b.Files, f)
+			}
+		}
+		log.Info(log.Mixer, "Hooks %s of %s added %d, modified %d and removed %d files", strings.Join(run, ", "), bundle, len(added), len(modified), removed)
+		before = after
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+package builder
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParseBundleHook(t *testing.T) {
+	b, err := parseBundle([]byte("pkg1\nhook(ldconfig)\nhook( /usr/local/bin/gen-config )\n"))
+	if err != nil {
+		t.Fatalf("unexpected error parsing bundle: %s", err)
+	}
+	if expected := []string{"ldconfig", "/usr/local/bin/gen-config"}; !reflect.DeepEqual(b.Hooks, expected) {
+		t.Errorf("got hooks %q, expected %q", b.Hooks, expected)
+	}
+
+	for _, contents := range []string{"hook(", "hook()", "hook(fc-cache)", "hook(bin/gen-config)"} {
+		if _, err = parseBundle([]byte(contents)); err == nil {
+			t.Errorf("unexpected success parsing %q", contents)
+		}
+	}
+}
+
+func TestRunInstallHooks(t *testing.T) {
+	testDir, err := ioutil.TempDir("", "install-hooks-test-")
+	if err != nil {
+		t.Fatalf("couldn't create temporary directory: %s", err)
+	}
+	defer cleanup(testDir)
+
+	fullDir := filepath.Join(testDir, "full")
+	if err = os.MkdirAll(filepath.Join(fullDir, "usr/share/foo"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(filepath.Join(fullDir, "usr/share/foo/old"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.MkdirAll(filepath.Join(fullDir, "usr/lib64"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range []string{"usr/lib64/libbar.so.1.0", "usr/share/foo/cache"} {
+		if err = ioutil.WriteFile(filepath.Join(fullDir, f), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	mixHook := filepath.Join(testDir, "mix-hook")
+	script := "#!/bin/sh\nmkdir -p \"$1/usr/share/mix\" && echo \"$MIXER_VERSION\" > \"$1/usr/share/mix/version\"\n"
+	if err = ioutil.WriteFile(mixHook, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	fooHook := filepath.Join(testDir, "foo-hook")
+	script = "#!/bin/sh\nrm \"$MIXER_ROOT/usr/share/foo/old\" && touch \"$MIXER_ROOT/usr/share/foo/$MIXER_BUNDLE\"\n" +
+		"echo cache >> \"$MIXER_ROOT/usr/share/foo/cache\"\n" +
+		"ln -s libbar.so.1.0 \"$MIXER_ROOT/usr/lib64/libbar.so.1\"\n"
+	if err = ioutil.WriteFile(fooHook, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	osCore := &bundle{Name: "os-core", Files: make(map[string]bool)}
+	foo := &bundle{Name: "foo", Files: make(map[string]bool), Hooks: []string{fooHook}}
+	addFileAndPath(foo.Files, nil, "/usr/share/foo/old")
+	bar := &bundle{Name: "bar", Files: make(map[string]bool)}
+	addFileAndPath(bar.Files, nil, "/usr/lib64/libbar.so.1.0")
+	set := bundleSet{"os-core": osCore, "foo": foo, "bar": bar}
+
+	if err = runInstallHooks(set, []string{mixHook}, fullDir, "10"); err != nil {
+		t.Fatalf("unexpected error running hooks: %s", err)
+	}
+	content, err := ioutil.ReadFile(filepath.Join(fullDir, "usr/share/mix/version"))
+	if err != nil || string(content) != "10\n" {
+		t.Errorf("got version file %q (%v), expected the mix version", content, err)
+	}
+	if _, ok := osCore.Files["/usr/share/mix/version"]; !ok {
+		t.Errorf("file created by the mix hook was not added to os-core: %v", osCore.Files)
+	}
+	if _, ok := foo.Files["/usr/share/foo/foo"]; !ok {
+		t.Errorf("file created by the bundle hook was not added to foo: %v", foo.Files)
+	}
+	if _, ok := foo.Files["/usr/share/foo/old"]; ok {
+		t.Errorf("file removed by the bundle hook is still in foo")
+	}
+	if _, ok := osCore.Files["/usr/share/foo/foo"]; ok {
+		t.Errorf("file created by the bundle hook was added to os-core")
+	}
+	if _, ok := foo.Files["/usr/share/foo/cache"]; !ok {
+		t.Errorf("file modified by the bundle hook was not added to foo: %v", foo.Files)
+	}
+	if _, ok := bar.Files["/usr/lib64/libbar.so.1"]; !ok {
+		t.Errorf("symlink created by the bundle hook was not added to the bundle of its target: %v", bar.Files)
+	}
+	if _, ok := foo.Files["/usr/lib64/libbar.so.1"]; ok {
+		t.Errorf("symlink to a file of bar was added to foo")
+	}
+
+	if err = runInstallHooks(set, []string{"/bin/false"}, fullDir, "10"); err == nil {
+		t.Errorf("unexpected success running a failing hook")
+	}
+	if err = runInstallHooks(set, []string{"fc-cache"}, fullDir, "10"); err == nil {
+		t.Errorf("unexpected success running an unknown hook")
+	}
+}
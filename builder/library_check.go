@@ -0,0 +1,197 @@
+package builder
+
+import (
+	"bufio"
+	"debug/elf"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/clearlinux/mixer-tools/swupd"
+)
+
+// defaultLibraryDirs are the directories searched by the dynamic linker after
+// the RPATH, RUNPATH and ld.so.conf directories.
+var defaultLibraryDirs = []string{"/usr/lib64", "/usr/lib"}
+
+// ldSoConfFiles are the dynamic linker configuration files read from the full
+// chroot. Clear Linux OS keeps the default configuration under /usr/share.
+var ldSoConfFiles = []string{"/etc/ld.so.conf", "/usr/share/defaults/etc/ld.so.conf"}
+
+// readLdSoConf returns the library directories configured in the ld.so.conf
+// file at path inside fullDir, following include directives.
+func readLdSoConf(fullDir, path string, seen map[string]bool) []string {
+	if seen[path] {
+		return nil
+	}
+	seen[path] = true
+
+	f, err := os.Open(filepath.Join(fullDir, path))
+	if err != nil {
+		return nil
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+
+	var dirs []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "include") {
+			pattern := strings.TrimSpace(strings.TrimPrefix(line, "include"))
+			if !filepath.IsAbs(pattern) {
+				pattern = filepath.Join(filepath.Dir(path), pattern)
+			}
+			matches, _ := filepath.Glob(filepath.Join(fullDir, pattern))
+			for _, m := range matches {
+				dirs = append(dirs, readLdSoConf(fullDir, strings.TrimPrefix(m, fullDir), seen)...)
+			}
+			continue
+		}
+		dirs = append(dirs, filepath.Clean(line))
+	}
+	return dirs
+}
+
+// libraryDirs returns the system library search path of the full chroot.
+func libraryDirs(fullDir string) []string {
+	seen := make(map[string]bool)
+	var dirs []string
+	for _, conf := range ldSoConfFiles {
+		dirs = append(dirs, readLdSoConf(fullDir, conf, seen)...)
+	}
+	return append(dirs, defaultLibraryDirs...)
+}
+
+// expandLibraryPath expands the dynamic string tokens supported in RPATH and
+// RUNPATH entries. Entries using unsupported tokens are dropped.
+func expandLibraryPath(path, origin string) string {
+	path = strings.Replace(path, "${ORIGIN}", origin, -1)
+	path = strings.Replace(path, "$ORIGIN", origin, -1)
+	path = strings.Replace(path, "${LIB}", "lib64", -1)
+	path = strings.Replace(path, "$LIB", "lib64", -1)
+	if strings.Contains(path, "$") || !filepath.IsAbs(path) {
+		return ""
+	}
+	return filepath.Clean(path)
+}
+
+// neededLibraries returns the DT_NEEDED entries of an ELF file together with the
+// directories from its RPATH and RUNPATH. Files that are not dynamically linked
+// ELF objects return no libraries.
+func neededLibraries(fullDir, file string) ([]string, []string) {
+	f, err := elf.Open(filepath.Join(fullDir, file))
+	if err != nil {
+		return nil, nil
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	if f.Type != elf.ET_EXEC && f.Type != elf.ET_DYN {
+		return nil, nil
+	}
+
+	needed, err := f.ImportedLibraries()
+	if err != nil || len(needed) == 0 {
+		return nil, nil
+	}
+
+	var dirs []string
+	for _, tag := range []elf.DynTag{elf.DT_RPATH, elf.DT_RUNPATH} {
+		paths, err := f.DynString(tag)
+		if err != nil {
+			continue
+		}
+		for _, p := range paths {
+			for _, d := range strings.Split(p, ":") {
+				if d = expandLibraryPath(d, filepath.Dir(file)); d != "" {
+					dirs = append(dirs, d)
+				}
+			}
+		}
+	}
+	return needed, dirs
+}
+
+// checkBundleLibraries verifies that the libraries needed by the ELF files of a
+// bundle are provided by the bundle or by one of its recursive includes.
+func checkBundleLibraries(fullDir string, systemDirs []string, m *swupd.Manifest) ([]contentIssue, error) {
+	included := includedFiles(m)
+	available := func(path string) bool {
+		path = resolveFileName(path)
+		_, ok := m.BundleInfo.Files[path]
+		return ok || included[path]
+	}
+
+	var issues []contentIssue
+	for file := range m.BundleInfo.Files {
+		// Files from includes are checked as part of the bundle providing them.
+		if included[file] {
+			continue
+		}
+		fi, err := os.Lstat(filepath.Join(fullDir, file))
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		if !fi.Mode().IsRegular() {
+			continue
+		}
+
+		needed, searchDirs := neededLibraries(fullDir, file)
+		searchDirs = append(searchDirs, systemDirs...)
+		for _, lib := range needed {
+			var found bool
+			if strings.Contains(lib, "/") {
+				found = available(filepath.Clean(lib))
+			} else {
+				for _, dir := range searchDirs {
+					if available(filepath.Join(dir, lib)) {
+						found = true
+						break
+					}
+				}
+			}
+			if !found {
+				issues = append(issues, contentIssue{
+					Bundle:  m.Name,
+					Path:    file,
+					Message: fmt.Sprintf("needs %s, which is not provided by the bundle or its includes", lib),
+				})
+			}
+		}
+	}
+	return issues, nil
+}
+
+// checkLibraries reports the ELF files in each bundle of the current version
+// that need shared libraries not provided by the bundle or its recursive
+// includes. When strict is set, any unresolved library fails the check.
+func (b *Builder) checkLibraries(strict bool) error {
+	bundles, err := loadBundleContents(b.Config.Builder.ServerStateDir, b.MixVer)
+	if err != nil {
+		return err
+	}
+	fullDir := filepath.Join(b.Config.Builder.ServerStateDir, "image", b.MixVer, "full")
+	systemDirs := libraryDirs(fullDir)
+
+	issues, err := checkBundles(bundles, b.NumBundleWorkers, func(m *swupd.Manifest) ([]contentIssue, error) {
+		return checkBundleLibraries(fullDir, systemDirs, m)
+	})
+	if err != nil {
+		return err
+	}
+
+	return reportContentIssues("unresolved shared libraries", issues, strict)
+}
@@ -0,0 +1,196 @@
+package builder
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/clearlinux/mixer-tools/swupd"
+)
+
+// mustWriteELFWithNeeded writes a minimal ELF shared object to path. When
+// needed is set it has a .dynamic section with a DT_NEEDED entry for each
+// library.
+func mustWriteELFWithNeeded(t *testing.T, path string, needed ...string) {
+	t.Helper()
+
+	type section struct {
+		name string
+		hdr  elf.Section64
+		data []byte
+	}
+	var sections []section
+
+	if len(needed) > 0 {
+		dynstr := []byte{0}
+		var dynamic bytes.Buffer
+		for _, lib := range needed {
+			_ = binary.Write(&dynamic, binary.LittleEndian, elf.Dyn64{Tag: int64(elf.DT_NEEDED), Val: uint64(len(dynstr))})
+			dynstr = append(append(dynstr, lib...), 0)
+		}
+		_ = binary.Write(&dynamic, binary.LittleEndian, elf.Dyn64{Tag: int64(elf.DT_NULL)})
+		// .dynamic links to .dynstr, section 1 after the null section.
+		sections = append(sections,
+			section{".dynstr", elf.Section64{Type: uint32(elf.SHT_STRTAB), Addralign: 1}, dynstr},
+			section{".dynamic", elf.Section64{Type: uint32(elf.SHT_DYNAMIC), Link: 1, Addralign: 8, Entsize: 16}, dynamic.Bytes()},
+		)
+	}
+
+	shstrtab := []byte{0}
+	for i := range sections {
+		sections[i].hdr.Name = uint32(len(shstrtab))
+		shstrtab = append(append(shstrtab, sections[i].name...), 0)
+	}
+	shstrtabName := uint32(len(shstrtab))
+	shstrtab = append(shstrtab, ".shstrtab\x00"...)
+	sections = append(sections, section{".shstrtab", elf.Section64{Name: shstrtabName, Type: uint32(elf.SHT_STRTAB), Addralign: 1}, shstrtab})
+
+	off := uint64(binary.Size(elf.Header64{}))
+	var data bytes.Buffer
+	for i := range sections {
+		for (off+uint64(data.Len()))%8 != 0 {
+			data.WriteByte(0)
+		}
+		sections[i].hdr.Off = off + uint64(data.Len())
+		sections[i].hdr.Size = uint64(len(sections[i].data))
+		data.Write(sections[i].data)
+	}
+	for (off+uint64(data.Len()))%8 != 0 {
+		data.WriteByte(0)
+	}
+
+	hdr := elf.Header64{
+		Type:      uint16(elf.ET_DYN),
+		Machine:   uint16(elf.EM_X86_64),
+		Version:   uint32(elf.EV_CURRENT),
+		Shoff:     off + uint64(data.Len()),
+		Ehsize:    uint16(off),
+		Shentsize: uint16(binary.Size(elf.Section64{})),
+		Shnum:     uint16(len(sections) + 1),
+		Shstrndx:  uint16(len(sections)),
+	}
+	copy(hdr.Ident[:], elf.ELFMAG)
+	hdr.Ident[elf.EI_CLASS] = byte(elf.ELFCLASS64)
+	hdr.Ident[elf.EI_DATA] = byte(elf.ELFDATA2LSB)
+	hdr.Ident[elf.EI_VERSION] = byte(elf.EV_CURRENT)
+
+	var out bytes.Buffer
+	_ = binary.Write(&out, binary.LittleEndian, hdr)
+	out.Write(data.Bytes())
+	_ = binary.Write(&out, binary.LittleEndian, elf.Section64{})
+	for _, s := range sections {
+		_ = binary.Write(&out, binary.LittleEndian, s.hdr)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, out.Bytes(), 0755); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// mustWriteBundleInfo writes the bundle info file of a bundle including the
+// given bundles and owning files.
+func mustWriteBundleInfo(t *testing.T, versionDir, name string, includes []string, files ...string) {
+	t.Helper()
+	bundle := bundle{Name: name, DirectIncludes: includes, Files: make(map[string]bool)}
+	for _, f := range files {
+		bundle.Files[f] = false
+	}
+	info, err := json.Marshal(bundle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(filepath.Join(versionDir, name+"-info"), info, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCheckLibraries(t *testing.T) {
+	testDir, err := ioutil.TempDir("", "libcheck-test-")
+	if err != nil {
+		t.Fatalf("couldn't create temporary directory: %s", err)
+	}
+	defer cleanup(testDir)
+
+	b := New()
+	b.Config.Builder.ServerStateDir = testDir
+	b.MixVer = "10"
+	b.NumBundleWorkers = 2
+
+	versionDir := filepath.Join(testDir, "image", "10")
+	fullDir := filepath.Join(versionDir, "full")
+	mustWriteELFWithNeeded(t, filepath.Join(fullDir, "usr/lib64/libc.so.6"))
+	mustWriteELFWithNeeded(t, filepath.Join(fullDir, "usr/lib64/libfoo.so.1"), "libc.so.6")
+	mustWriteELFWithNeeded(t, filepath.Join(fullDir, "usr/lib64/libbar.so.1"), "libc.so.6")
+	mustWriteELFWithNeeded(t, filepath.Join(fullDir, "opt/app/lib/libapp.so"))
+	mustWriteELFWithNeeded(t, filepath.Join(fullDir, "usr/bin/foo"), "libfoo.so.1", "libc.so.6")
+	mustWriteELFWithNeeded(t, filepath.Join(fullDir, "usr/bin/bar"), "libbar.so.1", "libmissing.so.2")
+	mustWriteELFWithNeeded(t, filepath.Join(fullDir, "usr/bin/app"), "libapp.so")
+	if err = ioutil.WriteFile(filepath.Join(fullDir, "usr/bin/script"), []byte("#!/bin/sh\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	mustWriteBundleInfo(t, versionDir, "os-core", nil, "/usr/lib64/libc.so.6", "/usr/bin/script")
+	mustWriteBundleInfo(t, versionDir, "foo", nil, "/usr/lib64/libfoo.so.1", "/usr/bin/foo")
+	mustWriteBundleInfo(t, versionDir, "bar", []string{"foo"}, "/usr/lib64/libbar.so.1", "/usr/bin/bar", "/usr/bin/foo")
+	mustWriteBundleInfo(t, versionDir, "app", nil, "/usr/bin/app")
+	mustWriteBundleInfo(t, versionDir, "app-libs", nil, "/opt/app/lib/libapp.so")
+
+	bundles, err := loadBundleContents(testDir, "10")
+	if err != nil {
+		t.Fatalf("couldn't load bundle contents: %s", err)
+	}
+
+	issues, err := checkBundles(bundles, 2, func(m *swupd.Manifest) ([]contentIssue, error) {
+		return checkBundleLibraries(fullDir, libraryDirs(fullDir), m)
+	})
+	if err != nil {
+		t.Fatalf("unexpected error checking libraries: %s", err)
+	}
+
+	var got []string
+	for _, i := range issues {
+		got = append(got, i.Bundle+" "+i.Path+" "+strings.TrimSuffix(strings.Fields(i.Message)[1], ","))
+	}
+	expected := []string{
+		"app /usr/bin/app libapp.so",
+		"bar /usr/bin/bar libmissing.so.2",
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("got issues %q, expected %q", got, expected)
+	}
+
+	if err = b.checkLibraries(false); err != nil {
+		t.Errorf("unexpected error without strict checks: %s", err)
+	}
+	if err = b.checkLibraries(true); err == nil {
+		t.Error("unexpected success with strict checks")
+	}
+
+	// Resolve app through the ld.so.conf of the chroot and bar through its
+	// new include.
+	mustWriteBundleInfo(t, versionDir, "app", []string{"app-libs"}, "/usr/bin/app")
+	mustWriteBundleInfo(t, versionDir, "bar", []string{"foo", "missing"}, "/usr/lib64/libbar.so.1", "/usr/bin/bar", "/usr/bin/foo")
+	mustWriteBundleInfo(t, versionDir, "missing", nil, "/usr/lib64/libmissing.so.2")
+	if err = os.MkdirAll(filepath.Join(fullDir, "etc/ld.so.conf.d"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(filepath.Join(fullDir, "etc/ld.so.conf"), []byte("include ld.so.conf.d/*.conf\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(filepath.Join(fullDir, "etc/ld.so.conf.d/app.conf"), []byte("# app\n/opt/app/lib\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = b.checkLibraries(true); err != nil {
+		t.Errorf("unexpected error after fixing includes: %s", err)
+	}
+}
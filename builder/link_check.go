@@ -0,0 +1,112 @@
+package builder
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/clearlinux/mixer-tools/swupd"
+)
+
+// maxLinkHops is the number of symlinks followed before a link is reported as
+// a loop, the same limit used by the kernel.
+const maxLinkHops = 40
+
+// checkBundleLinks verifies that every symlink in a bundle points to content
+// in the bundle or in one of its recursive includes. Links to paths missing
+// from the full chroot are reported as dangling, and links to paths only
+// provided by other bundles are reported with the bundles providing them.
+func checkBundleLinks(fullDir string, owners map[string][]string, m *swupd.Manifest) ([]contentIssue, error) {
+	included := includedFiles(m)
+	available := func(path string) bool {
+		_, ok := m.BundleInfo.Files[path]
+		return ok || included[path]
+	}
+
+	var issues []contentIssue
+	for file := range m.BundleInfo.Files {
+		// Files from includes are checked as part of the bundle providing them.
+		if included[file] {
+			continue
+		}
+		fi, err := os.Lstat(filepath.Join(fullDir, file))
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		if fi.Mode()&os.ModeSymlink == 0 {
+			continue
+		}
+
+		path := file
+		var msg string
+		for hops := 0; msg == ""; hops++ {
+			if hops == maxLinkHops {
+				msg = "too many levels of symbolic links"
+				break
+			}
+			target, err := os.Readlink(filepath.Join(fullDir, path))
+			if err != nil {
+				return nil, err
+			}
+			if !filepath.IsAbs(target) {
+				target = filepath.Join(filepath.Dir(path), target)
+			}
+			path = resolveFileName(filepath.Clean(target))
+
+			fi, err = os.Lstat(filepath.Join(fullDir, path))
+			if os.IsNotExist(err) {
+				msg = fmt.Sprintf("dangling link to %s", path)
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			if !available(path) {
+				if len(owners[path]) == 0 {
+					msg = fmt.Sprintf("links to %s, which is not in any bundle", path)
+				} else {
+					msg = fmt.Sprintf("links to %s, which is only in %s", path, strings.Join(owners[path], ", "))
+				}
+				break
+			}
+			if fi.Mode()&os.ModeSymlink == 0 {
+				break
+			}
+		}
+		if msg != "" {
+			issues = append(issues, contentIssue{Bundle: m.Name, Path: file, Message: msg})
+		}
+	}
+	return issues, nil
+}
+
+// checkLinks reports the symlinks in each bundle of the current version that
+// are dangling or point to content not provided by the bundle or its recursive
+// includes. When strict is set, any broken link fails the check.
+func (b *Builder) checkLinks(strict bool) error {
+	bundles, err := loadBundleContents(b.Config.Builder.ServerStateDir, b.MixVer)
+	if err != nil {
+		return err
+	}
+	fullDir := filepath.Join(b.Config.Builder.ServerStateDir, "image", b.MixVer, "full")
+
+	owners := make(map[string][]string)
+	for _, m := range bundles {
+		for f := range m.BundleInfo.Files {
+			owners[f] = append(owners[f], m.Name)
+		}
+	}
+
+	issues, err := checkBundles(bundles, b.NumBundleWorkers, func(m *swupd.Manifest) ([]contentIssue, error) {
+		return checkBundleLinks(fullDir, owners, m)
+	})
+	if err != nil {
+		return err
+	}
+
+	return reportContentIssues("broken symlinks", issues, strict)
+}
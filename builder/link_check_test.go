@@ -0,0 +1,88 @@
+package builder
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestCheckLinks(t *testing.T) {
+	testDir, err := ioutil.TempDir("", "linkcheck-test-")
+	if err != nil {
+		t.Fatalf("couldn't create temporary directory: %s", err)
+	}
+	defer cleanup(testDir)
+
+	b := New()
+	b.Config.Builder.ServerStateDir = testDir
+	b.MixVer = "10"
+	b.NumBundleWorkers = 2
+
+	versionDir := filepath.Join(testDir, "image", "10")
+	fullDir := filepath.Join(versionDir, "full")
+	if err = os.MkdirAll(filepath.Join(fullDir, "usr/bin"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range []string{"usr/bin/core", "usr/bin/foo"} {
+		if err = ioutil.WriteFile(filepath.Join(fullDir, f), nil, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	links := map[string]string{
+		"usr/bin/to-core":    "core",
+		"usr/bin/to-foo":     "/usr/bin/foo",
+		"usr/bin/chain":      "to-core",
+		"usr/bin/dangling":   "nothing",
+		"usr/bin/loop":       "loop",
+		"usr/bin/via-prefix": "/bin/core",
+	}
+	for link, target := range links {
+		if err = os.Symlink(target, filepath.Join(fullDir, link)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	mustWriteBundleInfo(t, versionDir, "os-core", nil, "/usr/bin/core", "/usr/bin/to-core")
+	mustWriteBundleInfo(t, versionDir, "foo", nil, "/usr/bin/foo")
+	mustWriteBundleInfo(t, versionDir, "bar", nil,
+		"/usr/bin/to-foo", "/usr/bin/chain", "/usr/bin/dangling", "/usr/bin/loop", "/usr/bin/via-prefix")
+
+	bundles, err := loadBundleContents(testDir, "10")
+	if err != nil {
+		t.Fatalf("couldn't load bundle contents: %s", err)
+	}
+	owners := map[string][]string{"/usr/bin/foo": {"foo"}}
+	var got []contentIssue
+	for _, m := range bundles {
+		issues, err := checkBundleLinks(fullDir, owners, m)
+		if err != nil {
+			t.Fatalf("unexpected error checking links: %s", err)
+		}
+		got = append(got, issues...)
+	}
+
+	expected := map[string]string{
+		"/usr/bin/to-foo":   "links to /usr/bin/foo, which is only in foo",
+		"/usr/bin/dangling": "dangling link to /usr/bin/nothing",
+		"/usr/bin/loop":     "too many levels of symbolic links",
+	}
+	gotMap := make(map[string]string)
+	for _, i := range got {
+		if i.Bundle != "bar" {
+			t.Errorf("unexpected issue in bundle %s: %s", i.Bundle, i)
+		}
+		gotMap[i.Path] = i.Message
+	}
+	if !reflect.DeepEqual(gotMap, expected) {
+		t.Errorf("got issues %v, expected %v", gotMap, expected)
+	}
+
+	if err = b.checkLinks(false); err != nil {
+		t.Errorf("unexpected error without strict checks: %s", err)
+	}
+	if err = b.checkLinks(true); err == nil {
+		t.Error("unexpected success with strict checks")
+	}
+}
@@ -0,0 +1,410 @@
+package builder
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/pkg/errors"
+)
+
+// Rules checked by the manifest correctness analysis (MCA).
+const (
+	// A file changed in a manifest without a matching change in a package.
+	mcaRuleNotInPackage = "not-in-package"
+	// A file changed in a package without a matching change in a manifest.
+	mcaRuleNotInManifest = "not-in-manifest"
+	// A new bundle without its tracking file.
+	mcaRuleMissingTrackingFile = "missing-tracking-file"
+	// A file updated by mixer in every version, which is unchanged.
+	mcaRuleNotModified = "not-modified"
+	// The versions compared may not follow the expected changes.
+	mcaRuleComparison = "comparison"
+)
+
+var mcaRules = []string{mcaRuleNotInPackage, mcaRuleNotInManifest, mcaRuleMissingTrackingFile, mcaRuleNotModified, mcaRuleComparison}
+
+// Severities of MCA findings. Errors fail the validation, and waived findings
+// are expected discrepancies, either generated by mixer or declared in the
+// waiver file.
+const (
+	mcaSeverityError   = "error"
+	mcaSeverityWarning = "warning"
+	mcaSeverityWaived  = "waived"
+)
+
+// Output formats of the MCA report.
+const (
+	McaFormatText  = "text"
+	McaFormatJSON  = "json"
+	McaFormatJUnit = "junit"
+)
+
+// McaOptions are the options of CheckManifestCorrectness.
+type McaOptions struct {
+	// Format of the report: text, json or junit
+	Format string
+	// File the json or junit report is written to, standard output if empty
+	Output string
+	// TOML file declaring expected discrepancies, overriding MCA_WAIVER_FILE
+	WaiverFile string
+	// Read the package files from the snapshots recorded at build time
+	// instead of downloading the packages
+	Snapshot bool
+}
+
+// mcaFinding is a discrepancy between the manifests and packages of two
+// versions.
+type mcaFinding struct {
+	Rule     string
+	Severity string
+	Bundle   string `json:",omitempty"`
+	Path     string `json:",omitempty"`
+	Package  string `json:",omitempty"`
+
+	// Change is added, modified or deleted for file findings.
+	Change  string `json:",omitempty"`
+	Message string
+	Reason  string `json:",omitempty"`
+}
+
+// newMcaFinding returns an error finding for a file of a bundle.
+func newMcaFinding(rule, bundle, path, pkg, change string) mcaFinding {
+	f := mcaFinding{Rule: rule, Severity: mcaSeverityError, Bundle: bundle, Path: path, Package: pkg, Change: change}
+	switch rule {
+	case mcaRuleNotInPackage:
+		f.Message = fmt.Sprintf("%s is %s in manifest '%s', but not in a package", path, change, bundle)
+	case mcaRuleNotInManifest:
+		f.Message = fmt.Sprintf("%s is %s in package '%s', but not %s in manifest '%s'", path, change, pkg, change, bundle)
+	case mcaRuleMissingTrackingFile:
+		f.Message = fmt.Sprintf("%s is missing from manifest '%s'", path, bundle)
+	case mcaRuleNotModified:
+		f.Message = fmt.Sprintf("%s is not modified in manifest '%s'", path, bundle)
+	}
+	return f
+}
+
+// is reports whether the finding is about a modified file of a bundle.
+func (f *mcaFinding) is(rule, bundle, path string) bool {
+	return f.Rule == rule && f.Bundle == bundle && f.Path == path && (f.Change == "" || f.Change == "modified")
+}
+
+func (f *mcaFinding) waive(reason string) {
+	f.Severity = mcaSeverityWaived
+	f.Reason = reason
+}
+
+// mcaWaiver declares the findings of a rule matching the Path glob, optionally
+// only in a given bundle or for a given change, as expected.
+type mcaWaiver struct {
+	Rule   string `toml:"RULE"`
+	Bundle string `toml:"BUNDLE"`
+	Path   string `toml:"PATH"`
+	Change string `toml:"CHANGE"`
+	Reason string `toml:"REASON"`
+}
+
+// mcaWaivers is read from the waiver file, for example:
+//
+//	[[WAIVER]]
+//	RULE = "not-in-package"
+//	BUNDLE = "os-core"
+//	PATH = "/usr/share/branding/*"
+//	REASON = "generated by the branding hook"
+//
+// The waivers of the file are added to the default ones, unless it sets
+// DEFAULT_WAIVERS to false.
+type mcaWaivers struct {
+	DefaultWaivers *bool       `toml:"DEFAULT_WAIVERS"`
+	Waivers        []mcaWaiver `toml:"WAIVER"`
+}
+
+// defaultMcaWaivers waives the changes to the files mixer updates in every
+// version, which have no package equivalent.
+const defaultMcaWaivers = `
+[[WAIVER]]
+RULE = "not-in-package"
+BUNDLE = "os-core"
+PATH = "/usr/lib/os-release"
+CHANGE = "modified"
+REASON = "the version in os-release is updated by mixer"
+
+[[WAIVER]]
+RULE = "not-in-package"
+BUNDLE = "os-core"
+PATH = "/usr/share/clear/version"
+CHANGE = "modified"
+REASON = "the version file is updated by mixer"
+
+[[WAIVER]]
+RULE = "not-in-package"
+BUNDLE = "os-core"
+PATH = "/usr/share/clear/versionstamp"
+CHANGE = "modified"
+REASON = "the versionstamp file is updated by mixer"
+
+[[WAIVER]]
+RULE = "not-in-package"
+BUNDLE = "os-core-update"
+PATH = "/usr/share/defaults/swupd/format"
+CHANGE = "modified"
+REASON = "the format file is updated by mixer"
+`
+
+// loadMcaWaivers returns the default waivers, along with the waivers of the
+// waiver file if not empty.
+func loadMcaWaivers(filename string) (*mcaWaivers, error) {
+	w, err := decodeMcaWaivers(defaultMcaWaivers, "default waivers")
+	if err != nil {
+		return nil, err
+	}
+	if filename == "" {
+		return w, nil
+	}
+	user, err := readMcaWaivers(filename)
+	if err != nil {
+		return nil, err
+	}
+	if user.DefaultWaivers != nil && !*user.DefaultWaivers {
+		w.Waivers = nil
+	}
+	w.Waivers = append(w.Waivers, user.Waivers...)
+	return w, nil
+}
+
+func readMcaWaivers(filename string) (*mcaWaivers, error) {
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, errors.Wrapf(err, "couldn't read waiver file %s", filename)
+	}
+	return decodeMcaWaivers(string(content), "waiver file "+filename)
+}
+
+func decodeMcaWaivers(content, name string) (*mcaWaivers, error) {
+	w := &mcaWaivers{}
+	md, err := toml.Decode(content, w)
+	if err != nil {
+		return nil, errors.Wrapf(err, "couldn't parse %s", name)
+	}
+	if undecoded := md.Undecoded(); len(undecoded) > 0 {
+		return nil, errors.Errorf("unknown key %s in %s", undecoded[0], name)
+	}
+	for _, waiver := range w.Waivers {
+		if waiver.Rule != "" && !isMcaRule(waiver.Rule) {
+			return nil, errors.Errorf("unknown rule %q in %s, expected one of %s", waiver.Rule, name, strings.Join(mcaRules, ", "))
+		}
+		if _, err = filepath.Match(waiver.Path, "/"); err != nil || waiver.Path == "" {
+			return nil, errors.Errorf("invalid waiver path %q in %s", waiver.Path, name)
+		}
+		switch waiver.Change {
+		case "", "added", "modified", "deleted":
+		default:
+			return nil, errors.Errorf("invalid change %q in %s", waiver.Change, name)
+		}
+	}
+	return w, nil
+}
+
+func isMcaRule(rule string) bool {
+	for _, r := range mcaRules {
+		if r == rule {
+			return true
+		}
+	}
+	return false
+}
+
+// apply waives the error and warning findings matching a waiver.
+func (w *mcaWaivers) apply(findings []mcaFinding) {
+	for i := range findings {
+		f := &findings[i]
+		if f.Severity == mcaSeverityWaived {
+			continue
+		}
+		for _, waiver := range w.Waivers {
+			if waiver.Rule != "" && waiver.Rule != f.Rule {
+				continue
+			}
+			if waiver.Bundle != "" && waiver.Bundle != f.Bundle {
+				continue
+			}
+			if waiver.Change != "" && waiver.Change != f.Change {
+				continue
+			}
+			if ok, _ := filepath.Match(waiver.Path, f.Path); ok {
+				reason := waiver.Reason
+				if reason == "" {
+					reason = "waived"
+				}
+				f.waive(reason)
+				break
+			}
+		}
+	}
+}
+
+// countMcaFindings returns the number of findings of each severity.
+func countMcaFindings(findings []mcaFinding) map[string]int {
+	counts := make(map[string]int)
+	for _, f := range findings {
+		counts[f.Severity]++
+	}
+	return counts
+}
+
+// mcaReport is the JSON report of the MCA.
+type mcaReport struct {
+	FromVersion int
+	ToVersion   int
+	Errors      int
+	Warnings    int
+	Waived      int
+
+	AddedBundles   []string
+	ChangedBundles []string
+	DeletedBundles []string
+	Findings       []mcaFinding
+}
+
+func writeMcaJSON(w io.Writer, results *mcaDiffResults, findings []mcaFinding, fromVer, toVer int) error {
+	counts := countMcaFindings(findings)
+	report := mcaReport{
+		FromVersion:    fromVer,
+		ToVersion:      toVer,
+		Errors:         counts[mcaSeverityError],
+		Warnings:       counts[mcaSeverityWarning],
+		Waived:         counts[mcaSeverityWaived],
+		AddedBundles:   sortedCopy(results.addList),
+		ChangedBundles: sortedCopy(results.modList),
+		DeletedBundles: sortedCopy(results.delList),
+		Findings:       findings,
+	}
+	if report.Findings == nil {
+		report.Findings = []mcaFinding{}
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(report)
+}
+
+func sortedCopy(list []string) []string {
+	result := append([]string{}, list...)
+	sort.Strings(result)
+	return result
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Type    string `xml:"type,attr"`
+	Text    string `xml:",chardata"`
+}
+
+type junitTestCase struct {
+	Name      string        `xml:"name,attr"`
+	ClassName string        `xml:"classname,attr"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+	SystemOut string        `xml:"system-out,omitempty"`
+}
+
+type junitTestSuite struct {
+	XMLName  xml.Name        `xml:"testsuite"`
+	Name     string          `xml:"name,attr"`
+	Tests    int             `xml:"tests,attr"`
+	Failures int             `xml:"failures,attr"`
+	Cases    []junitTestCase `xml:"testcase"`
+}
+
+// writeMcaJUnit writes a JUnit report with a test case per compared bundle,
+// failing when the bundle has error findings. Warnings and waived findings are
+// listed in the output of the test case.
+func writeMcaJUnit(w io.Writer, results *mcaDiffResults, findings []mcaFinding, fromVer, toVer int) error {
+	byBundle := make(map[string][]mcaFinding)
+	for _, b := range results.bundleDiff {
+		byBundle[b.name] = nil
+	}
+	for _, f := range findings {
+		name := f.Bundle
+		if name == "" {
+			name = "(versions)"
+		}
+		byBundle[name] = append(byBundle[name], f)
+	}
+	names := make([]string, 0, len(byBundle))
+	for name := range byBundle {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	suite := junitTestSuite{Name: fmt.Sprintf("mca %d to %d", fromVer, toVer)}
+	for _, name := range names {
+		tc := junitTestCase{Name: name, ClassName: "mca"}
+		var failures, output []string
+		for _, f := range byBundle[name] {
+			line := fmt.Sprintf("%s: %s", f.Rule, f.Message)
+			switch f.Severity {
+			case mcaSeverityError:
+				failures = append(failures, line)
+			case mcaSeverityWaived:
+				output = append(output, fmt.Sprintf("waived %s (%s)", line, f.Reason))
+			default:
+				output = append(output, f.Severity+" "+line)
+			}
+		}
+		if len(failures) > 0 {
+			tc.Failure = &junitFailure{
+				Message: fmt.Sprintf("%d manifest errors", len(failures)),
+				Type:    "mca",
+				Text:    strings.Join(failures, "\n"),
+			}
+			suite.Failures++
+		}
+		tc.SystemOut = strings.Join(output, "\n")
+		suite.Cases = append(suite.Cases, tc)
+	}
+	suite.Tests = len(suite.Cases)
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(suite); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+// writeMcaReport writes the json or junit report to the output file, or to the
+// standard output.
+func writeMcaReport(opts McaOptions, results *mcaDiffResults, findings []mcaFinding, fromVer, toVer int) error {
+	var write func(io.Writer, *mcaDiffResults, []mcaFinding, int, int) error
+	switch opts.Format {
+	case McaFormatJSON:
+		write = writeMcaJSON
+	case McaFormatJUnit:
+		write = writeMcaJUnit
+	default:
+		return errors.Errorf("unknown report format %q", opts.Format)
+	}
+
+	if opts.Output == "" {
+		return write(os.Stdout, results, findings, fromVer, toVer)
+	}
+	f, err := os.Create(opts.Output)
+	if err != nil {
+		return err
+	}
+	if err = write(f, results, findings, fromVer, toVer); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
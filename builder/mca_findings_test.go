@@ -0,0 +1,216 @@
+package builder
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDiffResultListsFindings(t *testing.T) {
+	diff := &mcaBundleDiff{
+		name:   "editors",
+		status: added,
+		pkgFileDiffs: diffLists{
+			addList: []string{"/usr/bin/vim", "/usr/bin/nano"},
+		},
+		manFileDiffs: diffLists{
+			addList: []string{"/usr/bin/vim", "/usr/share/branding/logo"},
+		},
+	}
+	info := map[string]*fileInfo{
+		"/usr/bin/nano": {name: "/usr/bin/nano", pkg: "nano"},
+	}
+
+	findings := diffResultLists(diff, info, "added")
+	expected := []mcaFinding{
+		{Rule: mcaRuleNotInManifest, Bundle: "editors", Path: "/usr/bin/nano", Package: "nano", Change: "added"},
+		{Rule: mcaRuleNotInPackage, Bundle: "editors", Path: "/usr/share/branding/logo", Change: "added"},
+		{Rule: mcaRuleMissingTrackingFile, Bundle: "editors", Path: "/usr/share/clear/bundles/editors"},
+	}
+	if len(findings) != len(expected) {
+		t.Fatalf("got findings %+v, expected %+v", findings, expected)
+	}
+	for i, f := range findings {
+		e := expected[i]
+		if f.Rule != e.Rule || f.Bundle != e.Bundle || f.Path != e.Path || f.Package != e.Package || f.Change != e.Change {
+			t.Errorf("got finding %+v, expected %+v", f, e)
+		}
+		if f.Severity != mcaSeverityError || f.Message == "" {
+			t.Errorf("finding %+v should be an error with a message", f)
+		}
+	}
+}
+
+func TestMcaWaivers(t *testing.T) {
+	testDir, err := ioutil.TempDir("", "mca-waivers-test-")
+	if err != nil {
+		t.Fatalf("couldn't create temporary directory: %s", err)
+	}
+	defer cleanup(testDir)
+
+	filename := filepath.Join(testDir, "waivers.toml")
+	content := `
+[[WAIVER]]
+RULE = "not-in-package"
+BUNDLE = "os-core"
+PATH = "/usr/share/branding/*"
+REASON = "branding"
+
+[[WAIVER]]
+PATH = "/etc/issue"
+CHANGE = "modified"
+`
+	if err = ioutil.WriteFile(filename, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	waivers, err := readMcaWaivers(filename)
+	if err != nil {
+		t.Fatalf("couldn't read waivers: %s", err)
+	}
+
+	findings := []mcaFinding{
+		newMcaFinding(mcaRuleNotInPackage, "os-core", "/usr/share/branding/logo", "", "modified"),
+		newMcaFinding(mcaRuleNotInPackage, "editors", "/usr/share/branding/logo", "", "modified"),
+		newMcaFinding(mcaRuleNotInManifest, "os-core", "/etc/issue", "filesystem", "modified"),
+		newMcaFinding(mcaRuleNotInManifest, "os-core", "/etc/issue", "filesystem", "deleted"),
+	}
+	waivers.apply(findings)
+
+	expected := []struct {
+		severity, reason string
+	}{
+		{mcaSeverityWaived, "branding"},
+		{mcaSeverityError, ""},
+		{mcaSeverityWaived, "waived"},
+		{mcaSeverityError, ""},
+	}
+	for i, e := range expected {
+		if findings[i].Severity != e.severity || findings[i].Reason != e.reason {
+			t.Errorf("finding %d: got %s (%q), expected %s (%q)", i, findings[i].Severity, findings[i].Reason, e.severity, e.reason)
+		}
+	}
+
+	invalid := []string{
+		"[[WAIVER]]\nRULE = \"unknown\"\nPATH = \"/\"\n",
+		"[[WAIVER]]\nBUNDLE = \"os-core\"\n",
+		"[[WAIVER]]\nPATH = \"/\"\nCHANGE = \"renamed\"\n",
+		"[[WAIVER]]\nPATH = \"/\"\nUNKNOWN = 1\n",
+	}
+	for _, c := range invalid {
+		if err = ioutil.WriteFile(filename, []byte(c), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = readMcaWaivers(filename); err == nil {
+			t.Errorf("expected error parsing waiver file %q", c)
+		}
+	}
+}
+
+func TestMcaReports(t *testing.T) {
+	results := &mcaDiffResults{
+		bundleDiff: []*mcaBundleDiff{{name: "os-core"}, {name: "editors"}},
+		modList:    []string{"os-core", "editors"},
+	}
+	findings := []mcaFinding{
+		newMcaFinding(mcaRuleNotInManifest, "editors", "/usr/bin/nano", "nano", "added"),
+		newMcaFinding(mcaRuleNotInPackage, "os-core", "/usr/share/clear/version", "", "modified"),
+		{Rule: mcaRuleComparison, Severity: mcaSeverityWarning, Message: "check"},
+	}
+	findings[1].waive("updated by mixer")
+
+	var buf bytes.Buffer
+	if err := writeMcaJSON(&buf, results, findings, 10, 20); err != nil {
+		t.Fatal(err)
+	}
+	var report mcaReport
+	if err := json.Unmarshal(buf.Bytes(), &report); err != nil {
+		t.Fatalf("couldn't parse JSON report: %s", err)
+	}
+	if report.Errors != 1 || report.Warnings != 1 || report.Waived != 1 || len(report.Findings) != 3 {
+		t.Errorf("unexpected JSON report %+v", report)
+	}
+	if strings.Join(report.ChangedBundles, ",") != "editors,os-core" {
+		t.Errorf("got changed bundles %v", report.ChangedBundles)
+	}
+
+	buf.Reset()
+	if err := writeMcaJUnit(&buf, results, findings, 10, 20); err != nil {
+		t.Fatal(err)
+	}
+	var suite junitTestSuite
+	if err := xml.Unmarshal(buf.Bytes(), &suite); err != nil {
+		t.Fatalf("couldn't parse JUnit report: %s", err)
+	}
+	if suite.Tests != 3 || suite.Failures != 1 {
+		t.Errorf("got %d tests and %d failures, expected 3 and 1", suite.Tests, suite.Failures)
+	}
+	for _, tc := range suite.Cases {
+		failed := tc.Failure != nil
+		if failed != (tc.Name == "editors") {
+			t.Errorf("test case %s: failed %v", tc.Name, failed)
+		}
+		if tc.Name == "os-core" && !strings.Contains(tc.SystemOut, "updated by mixer") {
+			t.Errorf("waived finding missing from the output of os-core: %q", tc.SystemOut)
+		}
+	}
+}
+
+func TestMcaDefaultWaivers(t *testing.T) {
+	testDir, err := ioutil.TempDir("", "mca-waivers-test-")
+	if err != nil {
+		t.Fatalf("couldn't create temporary directory: %s", err)
+	}
+	defer cleanup(testDir)
+
+	newFindings := func() []mcaFinding {
+		return []mcaFinding{
+			newMcaFinding(mcaRuleNotInPackage, "os-core", "/usr/lib/os-release", "", "modified"),
+			newMcaFinding(mcaRuleNotInPackage, "os-core", "/usr/share/clear/version", "", "modified"),
+			newMcaFinding(mcaRuleNotInPackage, "os-core", "/usr/share/clear/versionstamp", "", "modified"),
+			newMcaFinding(mcaRuleNotInPackage, "os-core-update", "/usr/share/defaults/swupd/format", "", "modified"),
+			newMcaFinding(mcaRuleNotInPackage, "os-core", "/usr/share/branding/logo", "", "modified"),
+		}
+	}
+
+	waivers, err := loadMcaWaivers("")
+	if err != nil {
+		t.Fatalf("couldn't load the default waivers: %s", err)
+	}
+	findings := newFindings()
+	waivers.apply(findings)
+	for i, f := range findings {
+		expected := mcaSeverityWaived
+		if i == len(findings)-1 {
+			expected = mcaSeverityError
+		}
+		if f.Severity != expected {
+			t.Errorf("finding %s: got %s, expected %s", f.Path, f.Severity, expected)
+		}
+	}
+
+	// The waiver file adds to the default waivers, or replaces them.
+	filename := filepath.Join(testDir, "waivers.toml")
+	for _, c := range []struct {
+		content string
+		waived  int
+	}{
+		{"[[WAIVER]]\nPATH = \"/usr/share/branding/*\"\n", 5},
+		{"DEFAULT_WAIVERS = false\n[[WAIVER]]\nPATH = \"/usr/share/branding/*\"\n", 1},
+	} {
+		if err = ioutil.WriteFile(filename, []byte(c.content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if waivers, err = loadMcaWaivers(filename); err != nil {
+			t.Fatalf("couldn't load waivers: %s", err)
+		}
+		findings = newFindings()
+		waivers.apply(findings)
+		if waived := countMcaFindings(findings)[mcaSeverityWaived]; waived != c.waived {
+			t.Errorf("got %d waived findings with %q, expected %d", waived, c.content, c.waived)
+		}
+	}
+}
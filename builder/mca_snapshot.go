@@ -0,0 +1,68 @@
+package builder
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"github.com/clearlinux/mixer-tools/swupd"
+	"github.com/pkg/errors"
+)
+
+// mcaSnapshotPkgInfo collects the package file metadata of each bundle from the
+// snapshot recorded in the rpm-files of the version when it was built, instead
+// of downloading and querying the packages.
+func (b *Builder) mcaSnapshotPkgInfo(manifests []*swupd.Manifest, version int) (map[string]*mcaBundlePkgInfo, error) {
+	versionDir := filepath.Join(b.Config.Builder.ServerStateDir, "image", fmt.Sprint(version))
+	lists, err := readRpmFiles(versionDir)
+	if err != nil {
+		return nil, err
+	}
+	if len(lists) == 0 {
+		return nil, errors.Errorf("no package snapshot recorded for version %d", version)
+	}
+
+	pkgs := make(map[string]*pkgInfo)
+	for rpm, list := range lists {
+		name, _, ok := splitRpmFilename(rpm)
+		if !ok {
+			return nil, errors.Errorf("invalid rpm name %s in the package snapshot of version %d", rpm, version)
+		}
+		if len(list.Files) > 0 && len(list.Metadata) == 0 {
+			return nil, errors.Errorf("the package snapshot of version %d has no file metadata, it was built by an older mixer", version)
+		}
+		pkg := &pkgInfo{name: name, uri: rpm}
+		for _, m := range list.Metadata {
+			if f := newPkgFileInfo(name, m.fields()); f != nil {
+				pkg.files = append(pkg.files, f)
+			}
+		}
+		pkgs[name] = pkg
+	}
+
+	return snapshotBundlePkgInfos(manifests, pkgs, version)
+}
+
+// snapshotBundlePkgInfos returns the package metadata of the packages of each
+// bundle, as recorded in its bundle info.
+func snapshotBundlePkgInfos(manifests []*swupd.Manifest, pkgs map[string]*pkgInfo, version int) (map[string]*mcaBundlePkgInfo, error) {
+	pInfo := make(map[string]*mcaBundlePkgInfo)
+	for _, m := range manifests {
+		bundlePkgInfo := &mcaBundlePkgInfo{
+			name:     m.Name,
+			allFiles: make(map[string]bool),
+			allPkgs:  make(map[string]*pkgInfo),
+		}
+		for name := range m.BundleInfo.AllPackages {
+			pkg, ok := pkgs[name]
+			if !ok {
+				return nil, errors.Errorf("package %s of bundle %s is missing from the package snapshot of version %d", name, m.Name, version)
+			}
+			bundlePkgInfo.allPkgs[name] = pkg
+			for _, f := range pkg.files {
+				bundlePkgInfo.allFiles[f.name] = true
+			}
+		}
+		pInfo[m.Name] = bundlePkgInfo
+	}
+	return pInfo, nil
+}
@@ -0,0 +1,97 @@
+package builder
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/clearlinux/mixer-tools/swupd"
+)
+
+func TestMcaSnapshotPkgInfo(t *testing.T) {
+	testDir, err := ioutil.TempDir("", "mca-snapshot-test-")
+	if err != nil {
+		t.Fatalf("couldn't create temporary directory: %s", err)
+	}
+	defer cleanup(testDir)
+
+	var b Builder
+	b.Config.Builder.ServerStateDir = testDir
+	versionDir := filepath.Join(testDir, "image", "20")
+	if err = os.MkdirAll(versionDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	manifests := []*swupd.Manifest{
+		{Name: "os-core", BundleInfo: swupd.BundleInfo{Name: "os-core", AllPackages: map[string]bool{"filesystem": true}}},
+		{Name: "editors", BundleInfo: swupd.BundleInfo{Name: "editors", AllPackages: map[string]bool{"filesystem": true, "nano": true}}},
+	}
+
+	if _, err = b.mcaSnapshotPkgInfo(manifests, 20); err == nil {
+		t.Errorf("expected error without a package snapshot")
+	}
+
+	lists := map[string]*rpmFileList{
+		"filesystem-1.0-1.x86_64.rpm": {
+			Files: []string{"/usr", "/usr/share/defaults/etc/issue"},
+			Metadata: []rpmFileMetadata{
+				{Name: "/usr", Size: "4096", Mode: "drwxr-xr-x", User: "root", Group: "root"},
+				{Name: "/usr/share/defaults/etc/issue", Size: "10", Digest: "abc", Mode: "-rw-r--r--", User: "root", Group: "root"},
+			},
+		},
+		"nano-4.0-2.x86_64.rpm": {
+			Files: []string{"/usr/bin/nano"},
+			Metadata: []rpmFileMetadata{
+				{Name: "/usr/bin/nano", Size: "200", Digest: "def", Mode: "-rwxr-xr-x", User: "root", Group: "root"},
+			},
+		},
+	}
+	content, err := json.Marshal(lists)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(filepath.Join(versionDir, rpmFilesName), content, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	pInfo, err := b.mcaSnapshotPkgInfo(manifests, 20)
+	if err != nil {
+		t.Fatalf("couldn't read package snapshot: %s", err)
+	}
+	editors := pInfo["editors"]
+	if editors == nil || len(editors.allPkgs) != 2 {
+		t.Fatalf("got editors package info %+v, expected filesystem and nano", editors)
+	}
+	if !editors.allFiles["/usr/bin/nano"] || !editors.allFiles["/usr/share/defaults/etc/issue"] {
+		t.Errorf("got editors files %v", editors.allFiles)
+	}
+	if editors.allFiles["/usr"] {
+		t.Errorf("directories should be skipped")
+	}
+	nano := editors.allPkgs["nano"]
+	if len(nano.files) != 1 || nano.files[0].hash != "def" || nano.files[0].pkg != "nano" {
+		t.Errorf("got nano files %+v", nano.files)
+	}
+	if pInfo["os-core"].allPkgs["filesystem"] != editors.allPkgs["filesystem"] {
+		t.Errorf("bundles should share the metadata of the same package")
+	}
+
+	// Packages missing from the snapshot and snapshots without metadata fail.
+	manifests[1].BundleInfo.AllPackages["vim"] = true
+	if _, err = b.mcaSnapshotPkgInfo(manifests, 20); err == nil {
+		t.Errorf("expected error for package missing from the snapshot")
+	}
+	delete(manifests[1].BundleInfo.AllPackages, "vim")
+	lists["nano-4.0-2.x86_64.rpm"].Metadata = nil
+	if content, err = json.Marshal(lists); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(filepath.Join(versionDir, rpmFilesName), content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = b.mcaSnapshotPkgInfo(manifests, 20); err == nil {
+		t.Errorf("expected error for snapshot without file metadata")
+	}
+}
@@ -0,0 +1,252 @@
+package builder
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+var validPackageVersionRegex = regexp.MustCompile(`^[A-Za-z0-9._+~^:-]+$`)
+
+// constraintOperators lists the supported comparison operators, longest first
+// so that "<=" is not parsed as "<".
+var constraintOperators = []string{"<=", ">=", "==", "=", "<", ">"}
+
+// versionConstraint is a requirement on the version of a package listed in a
+// bundle definition file, e.g. the "< 3.1" in "openssl >= 3.0, < 3.1".
+type versionConstraint struct {
+	Op      string
+	Version string
+
+	// Filename and Line locate the constraint in the bundle definition file.
+	Filename string
+	Line     int
+}
+
+func (c versionConstraint) String() string {
+	return c.Op + " " + c.Version
+}
+
+// location returns the bundle definition file and line of the constraint.
+func (c versionConstraint) location() string {
+	if c.Filename == "" {
+		return fmt.Sprintf("line %d", c.Line)
+	}
+	return fmt.Sprintf("%s:%d", c.Filename, c.Line)
+}
+
+// satisfiedBy reports whether the [epoch:]version[-release] of a package
+// satisfies the constraint. When the constraint has no release, only the
+// version of the package is compared, the same way rpm does.
+func (c versionConstraint) satisfiedBy(evr string) bool {
+	cmp := compareEVR(evr, c.Version)
+	switch c.Op {
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	case ">=":
+		return cmp >= 0
+	}
+	return cmp == 0
+}
+
+// dnfSpec returns the argument passed to dnf to select a package satisfying
+// the constraint.
+func (c versionConstraint) dnfSpec(name string) string {
+	op := c.Op
+	if op == "==" {
+		op = "="
+	}
+	return name + " " + op + " " + c.Version
+}
+
+// parsePackageLine parses a package line of a bundle definition file, which is
+// either a bare package name or a package name followed by a comma separated
+// list of version constraints, e.g. "openssl = 3.0.13" or "openssl >= 3.0, < 3.1".
+func parsePackageLine(text string, line int) (string, []versionConstraint, error) {
+	end := strings.IndexFunc(text, func(r rune) bool {
+		return unicode.IsSpace(r) || strings.ContainsRune("<>=", r)
+	})
+	if end == -1 {
+		end = len(text)
+	}
+	name := text[:end]
+	if !validPackageNameRegex.MatchString(name) {
+		return "", nil, fmt.Errorf("Invalid package name %q in line %d", name, line)
+	}
+	rest := strings.TrimSpace(text[end:])
+	if rest == "" {
+		return name, nil, nil
+	}
+
+	var constraints []versionConstraint
+	for _, part := range strings.Split(rest, ",") {
+		part = strings.TrimSpace(part)
+		var op string
+		for _, o := range constraintOperators {
+			if strings.HasPrefix(part, o) {
+				op = o
+				break
+			}
+		}
+		version := strings.TrimSpace(strings.TrimPrefix(part, op))
+		if op == "" || !validPackageVersionRegex.MatchString(version) {
+			return "", nil, fmt.Errorf("Invalid version constraint %q for package %s in line %d", part, name, line)
+		}
+		constraints = append(constraints, versionConstraint{Op: op, Version: version, Line: line})
+	}
+	return name, constraints, nil
+}
+
+// checkPackageConstraints returns a description of each constraint of a
+// bundle not satisfied by the resolved packages.
+func checkPackageConstraints(bundleName string, constraints map[string][]versionConstraint, rpms repoPkgMap) []string {
+	var violations []string
+	for _, pkgs := range rpms {
+		for _, pkg := range pkgs {
+			for _, c := range constraints[pkg.name] {
+				if !c.satisfiedBy(pkg.version) {
+					violations = append(violations, fmt.Sprintf("%s: package %s-%s resolved for bundle %s does not satisfy %q",
+						c.location(), pkg.name, pkg.version, bundleName, c.dnfSpec(pkg.name)))
+				}
+			}
+		}
+	}
+	return violations
+}
+
+// compareEVR compares two [epoch:]version[-release] strings. As rpm does, when
+// b has no epoch, the epoch of a is ignored, and when b has no release, the
+// release of a is ignored.
+func compareEVR(a, b string) int {
+	epochA, verA, relA := splitEVR(a)
+	epochB, verB, relB := splitEVR(b)
+	if epochB != "" {
+		if epochA == "" {
+			epochA = "0"
+		}
+		if cmp := rpmVerCmp(epochA, epochB); cmp != 0 {
+			return cmp
+		}
+	}
+	if cmp := rpmVerCmp(verA, verB); cmp != 0 {
+		return cmp
+	}
+	if relB == "" {
+		return 0
+	}
+	return rpmVerCmp(relA, relB)
+}
+
+// splitEVR splits an [epoch:]version[-release] string. The epoch is empty
+// when missing.
+func splitEVR(evr string) (epoch, version, release string) {
+	if i := strings.Index(evr, ":"); i != -1 {
+		epoch, evr = evr[:i], evr[i+1:]
+	}
+	if i := strings.LastIndex(evr, "-"); i != -1 {
+		return epoch, evr[:i], evr[i+1:]
+	}
+	return epoch, evr, ""
+}
+
+// rpmVerCmp compares two version or release strings using the rpm algorithm.
+// It returns -1, 0 or 1 when a is older, equal or newer than b.
+func rpmVerCmp(a, b string) int {
+	if a == b {
+		return 0
+	}
+	isAlnum := func(r byte) bool {
+		return r >= '0' && r <= '9' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z'
+	}
+	isDigit := func(r byte) bool { return r >= '0' && r <= '9' }
+	segment := func(s string, numeric bool) (string, string) {
+		i := 0
+		for i < len(s) && isAlnum(s[i]) && isDigit(s[i]) == numeric {
+			i++
+		}
+		return s[:i], s[i:]
+	}
+
+	for len(a) > 0 || len(b) > 0 {
+		// Skip separators, handling the ~ and ^ markers.
+		for len(a) > 0 && !isAlnum(a[0]) && a[0] != '~' && a[0] != '^' {
+			a = a[1:]
+		}
+		for len(b) > 0 && !isAlnum(b[0]) && b[0] != '~' && b[0] != '^' {
+			b = b[1:]
+		}
+
+		// A tilde sorts before everything, even the end of the string.
+		if strings.HasPrefix(a, "~") || strings.HasPrefix(b, "~") {
+			if !strings.HasPrefix(a, "~") {
+				return 1
+			}
+			if !strings.HasPrefix(b, "~") {
+				return -1
+			}
+			a, b = a[1:], b[1:]
+			continue
+		}
+
+		// A caret sorts after the end of the string, but before anything else.
+		if strings.HasPrefix(a, "^") || strings.HasPrefix(b, "^") {
+			if len(a) == 0 {
+				return -1
+			}
+			if len(b) == 0 {
+				return 1
+			}
+			if !strings.HasPrefix(a, "^") {
+				return 1
+			}
+			if !strings.HasPrefix(b, "^") {
+				return -1
+			}
+			a, b = a[1:], b[1:]
+			continue
+		}
+
+		if len(a) == 0 || len(b) == 0 {
+			break
+		}
+
+		numeric := isDigit(a[0])
+		var segA, segB string
+		segA, a = segment(a, numeric)
+		segB, b = segment(b, numeric)
+		if segB == "" {
+			// Numeric segments are newer than alphabetic ones.
+			if numeric {
+				return 1
+			}
+			return -1
+		}
+
+		if numeric {
+			segA = strings.TrimLeft(segA, "0")
+			segB = strings.TrimLeft(segB, "0")
+			if len(segA) != len(segB) {
+				if len(segA) > len(segB) {
+					return 1
+				}
+				return -1
+			}
+		}
+		if cmp := strings.Compare(segA, segB); cmp != 0 {
+			return cmp
+		}
+	}
+
+	switch {
+	case len(a) == 0 && len(b) == 0:
+		return 0
+	case len(a) == 0:
+		return -1
+	}
+	return 1
+}
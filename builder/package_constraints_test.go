@@ -0,0 +1,147 @@
+package builder
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRpmVerCmp(t *testing.T) {
+	tests := []struct {
+		a, b     string
+		expected int
+	}{
+		{"1.0", "1.0", 0},
+		{"1.0", "2.0", -1},
+		{"2.0", "1.0", 1},
+		{"2.0.1", "2.0", 1},
+		{"2.0", "2.0.1", -1},
+		{"1.10", "1.9", 1},
+		{"1.010", "1.10", 0},
+		{"1.0a", "1.0", 1},
+		{"1.0", "1.0a", -1},
+		{"1.a", "1.1", -1},
+		{"1.0~rc1", "1.0", -1},
+		{"1.0~rc1", "1.0~rc2", -1},
+		{"1.0^git1", "1.0", 1},
+		{"1.0^git1", "1.0.1", -1},
+		{"1_0", "1.0", 0},
+		{"3.0.13", "3.1", -1},
+	}
+
+	for _, tt := range tests {
+		if got := rpmVerCmp(tt.a, tt.b); got != tt.expected {
+			t.Errorf("rpmVerCmp(%q, %q) = %d, expected %d", tt.a, tt.b, got, tt.expected)
+		}
+	}
+}
+
+func TestVersionConstraintSatisfiedBy(t *testing.T) {
+	tests := []struct {
+		op, version, evr string
+		expected         bool
+	}{
+		{"=", "3.0.13", "3.0.13-5", true},
+		{"==", "3.0.13", "3.0.14-1", false},
+		{"=", "3.0.13-5", "3.0.13-6", false},
+		{"<", "3.1", "3.0.13-5", true},
+		{"<", "3.1", "3.1-1", false},
+		{"<=", "3.1", "3.1-1", true},
+		{">", "3.1", "3.1.1-1", true},
+		{">=", "3.1", "3.0.99-1", false},
+		// Without an epoch in the constraint, the epoch of the package is
+		// ignored.
+		{">=", "3.1", "1:2.0-1", false},
+		{">=", "5", "1:1.0-1", false},
+		{"=", "1.2", "1:1.2-3", true},
+		{"<", "2.0", "2:1.9-1", true},
+		// With one, it is compared first, a missing one being 0.
+		{">=", "1:3.1", "1:2.0-1", false},
+		{">=", "1:3.1", "2:1.0-1", true},
+		{">", "0:5", "1:1.0-1", true},
+		{"=", "1:1.2", "1.2-3", false},
+		{"=", "0:1.2", "1.2-3", true},
+	}
+
+	for _, tt := range tests {
+		c := versionConstraint{Op: tt.op, Version: tt.version}
+		if got := c.satisfiedBy(tt.evr); got != tt.expected {
+			t.Errorf("%q satisfied by %q = %t, expected %t", c, tt.evr, got, tt.expected)
+		}
+	}
+}
+
+func TestParsePackageLine(t *testing.T) {
+	tests := []struct {
+		text        string
+		name        string
+		constraints []versionConstraint
+		shouldFail  bool
+	}{
+		{text: "openssl", name: "openssl"},
+		{text: "openssl = 3.0.13", name: "openssl", constraints: []versionConstraint{{Op: "=", Version: "3.0.13", Line: 1}}},
+		{text: "openssl<3.1", name: "openssl", constraints: []versionConstraint{{Op: "<", Version: "3.1", Line: 1}}},
+		{text: "openssl >= 3.0, < 3.1", name: "openssl", constraints: []versionConstraint{
+			{Op: ">=", Version: "3.0", Line: 1},
+			{Op: "<", Version: "3.1", Line: 1},
+		}},
+		{text: "foo == 1:2.0-3", name: "foo", constraints: []versionConstraint{{Op: "==", Version: "1:2.0-3", Line: 1}}},
+
+		// Error cases.
+		{text: "openssl 3.0", shouldFail: true},
+		{text: "openssl =", shouldFail: true},
+		{text: "openssl = 3.0 3.1", shouldFail: true},
+		{text: "openssl >= 3.0,", shouldFail: true},
+		{text: "= 3.0", shouldFail: true},
+		{text: "open$sl", shouldFail: true},
+	}
+
+	for _, tt := range tests {
+		name, constraints, err := parsePackageLine(tt.text, 1)
+		if tt.shouldFail {
+			if err == nil {
+				t.Errorf("unexpected success parsing %q", tt.text)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("unexpected error parsing %q: %s", tt.text, err)
+			continue
+		}
+		if name != tt.name || !reflect.DeepEqual(constraints, tt.constraints) {
+			t.Errorf("got %q %v parsing %q, expected %q %v", name, constraints, tt.text, tt.name, tt.constraints)
+		}
+	}
+}
+
+func TestPackageConstraintsInBundleSet(t *testing.T) {
+	base, err := parseBundle([]byte("# [TITLE]: base\nopenssl >= 3.0\n"))
+	if err != nil {
+		t.Fatalf("unexpected error parsing bundle: %s", err)
+	}
+	base.Name = "base"
+	top, err := parseBundle([]byte("# [TITLE]: top\ninclude(base)\n\nopenssl < 3.1\ncurl\n"))
+	if err != nil {
+		t.Fatalf("unexpected error parsing bundle: %s", err)
+	}
+	top.Name = "top"
+
+	if !top.DirectPackages["openssl"] || !top.DirectPackages["curl"] {
+		t.Errorf("got direct packages %v, expected openssl and curl", top.DirectPackages)
+	}
+	if err = validateAndFillBundleSet(bundleSet{"base": base, "top": top}); err != nil {
+		t.Fatalf("unexpected error filling bundle set: %s", err)
+	}
+	if got := top.AllConstraints["openssl"]; len(got) != 2 {
+		t.Fatalf("got constraints %v for top, expected both base and top constraints", got)
+	}
+
+	rpms := repoPkgMap{"clear": {
+		{name: "openssl", version: "3.1.2-10"},
+		{name: "curl", version: "8.0-1"},
+	}}
+	violations := checkPackageConstraints("top", top.AllConstraints, rpms)
+	if len(violations) != 1 || !strings.HasPrefix(violations[0], "line 4: ") || !strings.Contains(violations[0], "openssl < 3.1") {
+		t.Errorf("got violations %q, expected openssl < 3.1 in line 4", violations)
+	}
+}
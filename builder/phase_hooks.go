@@ -0,0 +1,147 @@
+package builder
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/clearlinux/mixer-tools/log"
+	"github.com/pkg/errors"
+)
+
+// Build phases with pre and post hooks in the [Hooks] section of builder.conf.
+const (
+	phaseBundles    = "bundles"
+	phaseManifests  = "manifests"
+	phaseSign       = "sign"
+	phaseFullfiles  = "fullfiles"
+	phaseZeroPacks  = "zero-packs"
+	phaseDeltaPacks = "delta-packs"
+)
+
+// phaseHookPaths are the paths of the mix passed to the phase hooks.
+type phaseHookPaths struct {
+	MixDir     string
+	StateDir   string
+	ImageDir   string
+	OutputDir  string
+	FullChroot string
+}
+
+// phaseHookTiming is the duration of a completed step of the build.
+type phaseHookTiming struct {
+	Name    string
+	Seconds float64
+}
+
+// phaseHookContext is the JSON document written to the stdin of a phase hook.
+type phaseHookContext struct {
+	Phase           string
+	Stage           string
+	Version         string
+	PreviousVersion string
+	Format          string
+
+	// FromVersions are the versions delta packs are created from.
+	FromVersions []uint32 `json:",omitempty"`
+
+	Paths   phaseHookPaths
+	Bundles []string
+	Timings []phaseHookTiming
+}
+
+// phaseHooks returns the hooks configured for a phase and stage.
+func (b *Builder) phaseHooks(phase string, post bool) []string {
+	h := b.Config.Hooks
+	hooks := map[string][2][]string{
+		phaseBundles:    {h.PreBundles, h.PostBundles},
+		phaseManifests:  {h.PreManifests, h.PostManifests},
+		phaseSign:       {h.PreSign, h.PostSign},
+		phaseFullfiles:  {h.PreFullfiles, h.PostFullfiles},
+		phaseZeroPacks:  {h.PreZeroPacks, h.PostZeroPacks},
+		phaseDeltaPacks: {h.PreDeltaPacks, h.PostDeltaPacks},
+	}[phase]
+	if post {
+		return hooks[1]
+	}
+	return hooks[0]
+}
+
+// builtBundleNames returns the names of the bundles built for the mix version,
+// from the bundle info files.
+func (b *Builder) builtBundleNames() []string {
+	infos, _ := filepath.Glob(filepath.Join(b.Config.Builder.ServerStateDir, "image", b.MixVer, "*-info"))
+	names := make([]string, 0, len(infos))
+	for _, info := range infos {
+		names = append(names, strings.TrimSuffix(filepath.Base(info), "-info"))
+	}
+	sort.Strings(names)
+	return names
+}
+
+// runPhaseHooks runs the hooks of a build phase, each with a JSON context on
+// its stdin. A hook exiting with non-zero status aborts the build. When bundles
+// is nil, the bundles built for the mix version are passed.
+func (b *Builder) runPhaseHooks(phase string, post bool, timer *stopWatch, bundles []string, fromVersions ...uint32) error {
+	hooks := b.phaseHooks(phase, post)
+	if len(hooks) == 0 {
+		return nil
+	}
+
+	stage := "pre"
+	if post {
+		stage = "post"
+	}
+	if bundles == nil {
+		bundles = b.builtBundleNames()
+	}
+	ctx := phaseHookContext{
+		Phase:           phase,
+		Stage:           stage,
+		Version:         b.MixVer,
+		PreviousVersion: b.State.Mix.PreviousMixVer,
+		Format:          b.State.Mix.Format,
+		FromVersions:    fromVersions,
+		Paths: phaseHookPaths{
+			MixDir:     b.Config.Builder.VersionPath,
+			StateDir:   b.Config.Builder.ServerStateDir,
+			ImageDir:   filepath.Join(b.Config.Builder.ServerStateDir, "image", b.MixVer),
+			OutputDir:  filepath.Join(b.Config.Builder.ServerStateDir, "www", b.MixVer),
+			FullChroot: filepath.Join(b.Config.Builder.ServerStateDir, "image", b.MixVer, "full"),
+		},
+		Bundles: bundles,
+		Timings: timer.timings(),
+	}
+	input, err := json.MarshalIndent(ctx, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	for _, hook := range hooks {
+		log.Info(log.Mixer, "Running %s-%s hook %s", stage, phase, hook)
+		start := time.Now()
+		var outBuf, errBuf bytes.Buffer
+		cmd := exec.Command(hook)
+		cmd.Stdin = bytes.NewReader(input)
+		cmd.Stdout = &outBuf
+		cmd.Stderr = &errBuf
+		cmd.Env = append(os.Environ(), "MIXER_PHASE="+phase, "MIXER_HOOK_STAGE="+stage)
+		err = cmd.Run()
+		if outBuf.Len() > 0 {
+			log.Info(log.Mixer, "%s", strings.TrimSpace(outBuf.String()))
+		}
+		if err != nil {
+			if errBuf.Len() > 0 {
+				log.Error(log.Mixer, "%s", strings.TrimSpace(errBuf.String()))
+			}
+			return errors.Wrapf(err, "%s-%s hook %s failed", stage, phase, hook)
+		}
+		log.Debug(log.Mixer, "%s-%s hook %s took %s", stage, phase, hook, time.Since(start).Truncate(time.Millisecond))
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+package builder
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestRunPhaseHooks(t *testing.T) {
+	testDir, err := ioutil.TempDir("", "phase-hooks-test-")
+	if err != nil {
+		t.Fatalf("couldn't create temporary directory: %s", err)
+	}
+	defer cleanup(testDir)
+
+	out := filepath.Join(testDir, "context.json")
+	hook := filepath.Join(testDir, "hook")
+	script := "#!/bin/sh\ncat > " + out + " && echo \"$MIXER_HOOK_STAGE $MIXER_PHASE\" >> " + out + ".env\n"
+	if err = ioutil.WriteFile(hook, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	var b Builder
+	b.MixVer = "20"
+	b.State.Mix.PreviousMixVer = "10"
+	b.State.Mix.Format = "1"
+	b.Config.Builder.ServerStateDir = filepath.Join(testDir, "update")
+	b.Config.Hooks.PostManifests = []string{hook}
+	b.Config.Hooks.PreSign = []string{"/bin/false"}
+
+	// Phases without hooks do nothing.
+	if err = b.runPhaseHooks(phaseManifests, false, nil, nil); err != nil {
+		t.Fatalf("unexpected error running phase without hooks: %s", err)
+	}
+
+	timer := &stopWatch{}
+	timer.Start("CREATE MANIFESTS")
+	timer.Stop()
+	if err = b.runPhaseHooks(phaseManifests, true, timer, []string{"os-core", "editors"}); err != nil {
+		t.Fatalf("unexpected error running hook: %s", err)
+	}
+
+	content, err := ioutil.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ctx phaseHookContext
+	if err = json.Unmarshal(content, &ctx); err != nil {
+		t.Fatalf("couldn't parse hook context %q: %s", content, err)
+	}
+	if ctx.Phase != phaseManifests || ctx.Stage != "post" || ctx.Version != "20" || ctx.PreviousVersion != "10" {
+		t.Errorf("got context %+v, expected post manifests of version 20", ctx)
+	}
+	if expected := []string{"os-core", "editors"}; !reflect.DeepEqual(ctx.Bundles, expected) {
+		t.Errorf("got bundles %q, expected %q", ctx.Bundles, expected)
+	}
+	if ctx.Paths.ImageDir != filepath.Join(testDir, "update/image/20") {
+		t.Errorf("got image dir %s", ctx.Paths.ImageDir)
+	}
+	if len(ctx.Timings) != 1 || ctx.Timings[0].Name != "CREATE MANIFESTS" {
+		t.Errorf("got timings %+v, expected CREATE MANIFESTS", ctx.Timings)
+	}
+	env, err := ioutil.ReadFile(out + ".env")
+	if err != nil || string(env) != "post manifests\n" {
+		t.Errorf("got hook environment %q (%v)", env, err)
+	}
+
+	if err = b.runPhaseHooks(phaseSign, false, timer, nil); err == nil {
+		t.Errorf("unexpected success running a failing hook")
+	}
+}
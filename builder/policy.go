@@ -0,0 +1,310 @@
+package builder
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/clearlinux/mixer-tools/log"
+	"github.com/clearlinux/mixer-tools/swupd"
+	"github.com/pkg/errors"
+)
+
+// Severity levels of the content policy rules. Violations of rules with error
+// severity fail the build, warnings are only reported and disabled rules are
+// not evaluated.
+const (
+	policySeverityError    = "error"
+	policySeverityWarning  = "warning"
+	policySeverityDisabled = "disabled"
+)
+
+// policyWaiver exempts the paths matching the Path glob, optionally only in a
+// given bundle, from a policy rule.
+type policyWaiver struct {
+	Path   string `toml:"PATH"`
+	Bundle string `toml:"BUNDLE"`
+	Reason string `toml:"REASON"`
+}
+
+// policyRule is a single rule of the content policy. Besides the severity and
+// waivers, each rule only uses the fields relevant to it.
+type policyRule struct {
+	Severity string         `toml:"SEVERITY"`
+	Allow    []string       `toml:"ALLOW"`
+	Paths    []string       `toml:"PATHS"`
+	Max      int64          `toml:"MAX"`
+	Waivers  []policyWaiver `toml:"WAIVERS"`
+}
+
+// contentPolicy describes the rules enforced on the content of every bundle.
+// It is read from the TOML file set in the POLICY_FILE field of the Mixer
+// section in builder.conf, for example:
+//
+//	[WORLD_WRITABLE]
+//	SEVERITY = "error"
+//
+//	[SETUID]
+//	SEVERITY = "error"
+//	ALLOW = ["/usr/bin/sudo"]
+//	WAIVERS = [{PATH = "/usr/bin/ping", BUNDLE = "network-basic", REASON = "needs raw sockets"}]
+//
+//	[STATELESS]
+//	SEVERITY = "warning"
+//	PATHS = ["/etc", "/var"]
+//
+//	[PREFIXES]
+//	ALLOW = ["/usr"]
+//
+//	[MAX_SIZE]
+//	MAX = 104857600
+type contentPolicy struct {
+	WorldWritable policyRule `toml:"WORLD_WRITABLE"`
+	Setuid        policyRule `toml:"SETUID"`
+	Stateless     policyRule `toml:"STATELESS"`
+	Prefixes      policyRule `toml:"PREFIXES"`
+	MaxSize       policyRule `toml:"MAX_SIZE"`
+}
+
+// tables returns the rules of the policy keyed by their table in the policy
+// file.
+func (p *contentPolicy) tables() map[string]*policyRule {
+	return map[string]*policyRule{
+		"WORLD_WRITABLE": &p.WorldWritable,
+		"SETUID":         &p.Setuid,
+		"STATELESS":      &p.Stateless,
+		"PREFIXES":       &p.Prefixes,
+		"MAX_SIZE":       &p.MaxSize,
+	}
+}
+
+// rules returns the rules of the policy keyed by the name used in reports.
+func (p *contentPolicy) rules() map[string]*policyRule {
+	return map[string]*policyRule{
+		"world-writable": &p.WorldWritable,
+		"setuid":         &p.Setuid,
+		"stateless":      &p.Stateless,
+		"prefixes":       &p.Prefixes,
+		"max-size":       &p.MaxSize,
+	}
+}
+
+// readContentPolicy parses and validates a policy file. Rules not configured
+// in the file are disabled, and configured rules without an explicit severity
+// default to error.
+func readContentPolicy(filename string) (*contentPolicy, error) {
+	policy := &contentPolicy{}
+	md, err := toml.DecodeFile(filename, policy)
+	if err != nil {
+		return nil, errors.Wrapf(err, "couldn't parse policy file %s", filename)
+	}
+	if undecoded := md.Undecoded(); len(undecoded) > 0 {
+		return nil, errors.Errorf("unknown key %s in policy file %s", undecoded[0], filename)
+	}
+
+	for key, rule := range policy.tables() {
+		switch rule.Severity {
+		case "":
+			if md.IsDefined(key) {
+				rule.Severity = policySeverityError
+			} else {
+				rule.Severity = policySeverityDisabled
+			}
+		case policySeverityError, policySeverityWarning, policySeverityDisabled:
+		default:
+			return nil, errors.Errorf("invalid severity %q for rule %s in policy file %s", rule.Severity, key, filename)
+		}
+		for _, w := range rule.Waivers {
+			if _, err = filepath.Match(w.Path, "/"); err != nil || w.Path == "" {
+				return nil, errors.Errorf("invalid waiver path %q for rule %s in policy file %s", w.Path, key, filename)
+			}
+		}
+	}
+	if md.IsDefined("STATELESS") && len(policy.Stateless.Paths) == 0 {
+		policy.Stateless.Paths = []string{"/etc", "/var"}
+	}
+	return policy, nil
+}
+
+// waiver returns the waiver of the rule covering path in bundle, if any.
+func (r *policyRule) waiver(bundle, path string) *policyWaiver {
+	for i := range r.Waivers {
+		w := &r.Waivers[i]
+		if w.Bundle != "" && w.Bundle != bundle {
+			continue
+		}
+		if ok, _ := filepath.Match(w.Path, path); ok {
+			return w
+		}
+	}
+	return nil
+}
+
+// underPath reports whether path is dir or inside of it.
+func underPath(path, dir string) bool {
+	dir = strings.TrimSuffix(dir, "/")
+	return path == dir || strings.HasPrefix(path, dir+"/")
+}
+
+// evaluate checks a single file against every enabled rule of the policy and
+// returns the names of the violated rules with a description.
+func (p *contentPolicy) evaluate(path string, fi os.FileInfo) map[string]string {
+	violations := make(map[string]string)
+	mode := fi.Mode()
+
+	if mode&os.ModeSymlink == 0 && mode.Perm()&0002 != 0 && mode&os.ModeSticky == 0 {
+		violations["world-writable"] = fmt.Sprintf("is world-writable (%s)", mode)
+	}
+
+	if mode&(os.ModeSetuid|os.ModeSetgid) != 0 {
+		allowed := false
+		for _, a := range p.Setuid.Allow {
+			if ok, _ := filepath.Match(a, path); ok {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			violations["setuid"] = fmt.Sprintf("has setuid or setgid bit set (%s)", mode)
+		}
+	}
+
+	for _, dir := range p.Stateless.Paths {
+		if path != strings.TrimSuffix(dir, "/") && underPath(path, dir) {
+			violations["stateless"] = fmt.Sprintf("is under %s, which is reserved for the system administrator", dir)
+			break
+		}
+	}
+
+	if len(p.Prefixes.Allow) > 0 {
+		allowed := false
+		for _, a := range p.Prefixes.Allow {
+			// Parent directories of the allowed prefixes are also allowed.
+			if underPath(path, a) || underPath(a, path) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			violations["prefixes"] = "is outside of the allowed prefixes"
+		}
+	}
+
+	if p.MaxSize.Max > 0 && mode.IsRegular() && fi.Size() > p.MaxSize.Max {
+		violations["max-size"] = fmt.Sprintf("is %d bytes, larger than the maximum of %d bytes", fi.Size(), p.MaxSize.Max)
+	}
+
+	return violations
+}
+
+// checkBundlePolicy evaluates the policy against the content of a bundle that
+// is not provided by its includes.
+func checkBundlePolicy(fullDir string, policy *contentPolicy, packages map[string]string, m *swupd.Manifest) ([]contentIssue, error) {
+	included := includedFiles(m)
+	rules := policy.rules()
+
+	var issues []contentIssue
+	for file := range m.BundleInfo.Files {
+		if included[file] {
+			continue
+		}
+		fi, err := os.Lstat(filepath.Join(fullDir, file))
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+
+		for name, msg := range policy.evaluate(file, fi) {
+			rule := rules[name]
+			if rule.Severity == policySeverityDisabled {
+				continue
+			}
+			issue := contentIssue{
+				Rule:     name,
+				Bundle:   m.Name,
+				Package:  packages[file],
+				Path:     file,
+				Severity: rule.Severity,
+				Message:  msg,
+			}
+			if w := rule.waiver(m.Name, file); w != nil {
+				issue.Waiver = w.Reason
+				if issue.Waiver == "" {
+					issue.Waiver = "no reason given"
+				}
+			}
+			issues = append(issues, issue)
+		}
+	}
+	return issues, nil
+}
+
+// checkPolicy evaluates the content policy set in builder.conf, if any, against
+// the bundles built for version. Violations are reported per bundle and
+// package, and any violation of a rule with error severity that is not waived
+// fails the check.
+func (b *Builder) checkPolicy(version string) error {
+	if b.Config.Mixer.PolicyFile == "" {
+		return nil
+	}
+	policy, err := readContentPolicy(b.Config.Mixer.PolicyFile)
+	if err != nil {
+		return err
+	}
+
+	bundles, err := loadBundleContents(b.Config.Builder.ServerStateDir, version)
+	if err != nil {
+		return err
+	}
+	versionDir := filepath.Join(b.Config.Builder.ServerStateDir, "image", version)
+	fullDir := filepath.Join(versionDir, "full")
+
+	lists, err := readRpmFiles(versionDir)
+	if err != nil {
+		return err
+	}
+	packages := make(map[string]string)
+	for rpm, l := range lists {
+		for _, f := range l.Files {
+			packages[f] = strings.TrimSuffix(rpm, ".rpm")
+		}
+	}
+
+	log.Info(log.Mixer, "Checking bundle content against policy %s", b.Config.Mixer.PolicyFile)
+	issues, err := checkBundles(bundles, b.NumBundleWorkers, func(m *swupd.Manifest) ([]contentIssue, error) {
+		return checkBundlePolicy(fullDir, policy, packages, m)
+	})
+	if err != nil {
+		return err
+	}
+
+	var errorCount, warningCount, waivedCount int
+	bundle := ""
+	for _, i := range issues {
+		if i.Bundle != bundle {
+			bundle = i.Bundle
+			log.Info(log.Mixer, "Bundle %s:", bundle)
+		}
+		switch {
+		case i.Waiver != "":
+			waivedCount++
+			log.Info(log.Mixer, "  [%s] %s (waived: %s)", i.Rule, i, i.Waiver)
+		case i.Severity == policySeverityError:
+			errorCount++
+			log.Error(log.Mixer, "  [%s] %s", i.Rule, i)
+		default:
+			warningCount++
+			log.Warning(log.Mixer, "  [%s] %s", i.Rule, i)
+		}
+	}
+	log.Info(log.Mixer, "Policy violations: %d errors, %d warnings, %d waived", errorCount, warningCount, waivedCount)
+
+	if errorCount > 0 {
+		return errors.Errorf("bundle content violates %d policy rules", errorCount)
+	}
+	return nil
+}
@@ -0,0 +1,221 @@
+package builder
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestReadContentPolicy(t *testing.T) {
+	testDir, err := ioutil.TempDir("", "policy-test-")
+	if err != nil {
+		t.Fatalf("couldn't create temporary directory: %s", err)
+	}
+	defer cleanup(testDir)
+
+	tests := []struct {
+		name      string
+		content   string
+		valid     bool
+		severity  map[string]string
+		stateless []string
+	}{
+		{name: "empty", valid: true},
+		{name: "severity", content: "[SETUID]\nSEVERITY = \"warning\"\n", valid: true,
+			severity: map[string]string{"setuid": policySeverityWarning}},
+		{name: "default severity", content: "[MAX_SIZE]\nMAX = 1024\n", valid: true,
+			severity: map[string]string{"max-size": policySeverityError}},
+		{name: "default stateless paths", content: "[STATELESS]\n", valid: true,
+			severity: map[string]string{"stateless": policySeverityError}, stateless: []string{"/etc", "/var"}},
+		{name: "bad severity", content: "[SETUID]\nSEVERITY = \"fatal\"\n"},
+		{name: "unknown rule", content: "[NOTHING]\nSEVERITY = \"error\"\n"},
+		{name: "bad waiver", content: "[SETUID]\nWAIVERS = [{PATH = \"[\"}]\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(testDir, "policy.toml")
+			if err := ioutil.WriteFile(path, []byte(tt.content), 0644); err != nil {
+				t.Fatal(err)
+			}
+			policy, err := readContentPolicy(path)
+			if tt.valid && err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if !tt.valid {
+				if err == nil {
+					t.Fatal("unexpected success reading invalid policy")
+				}
+				return
+			}
+			// Rules not in the policy file stay disabled.
+			for name, rule := range policy.rules() {
+				expected := tt.severity[name]
+				if expected == "" {
+					expected = policySeverityDisabled
+				}
+				if rule.Severity != expected {
+					t.Errorf("got severity %q for rule %s, expected %q", rule.Severity, name, expected)
+				}
+			}
+			if !reflect.DeepEqual(policy.Stateless.Paths, tt.stateless) {
+				t.Errorf("got stateless paths %v, expected %v", policy.Stateless.Paths, tt.stateless)
+			}
+		})
+	}
+}
+
+func TestCheckPolicy(t *testing.T) {
+	testDir, err := ioutil.TempDir("", "policy-test-")
+	if err != nil {
+		t.Fatalf("couldn't create temporary directory: %s", err)
+	}
+	defer cleanup(testDir)
+
+	b := New()
+	b.Config.Builder.ServerStateDir = testDir
+	b.MixVer = "10"
+	b.NumBundleWorkers = 2
+
+	versionDir := filepath.Join(testDir, "image", "10")
+	fullDir := filepath.Join(versionDir, "full")
+	for _, d := range []string{"usr/bin", "etc", "opt"} {
+		if err = os.MkdirAll(filepath.Join(fullDir, d), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	files := map[string]os.FileMode{
+		"usr/bin/core":   0755,
+		"usr/bin/sudo":   0755 | os.ModeSetuid,
+		"usr/bin/ping":   0755 | os.ModeSetuid,
+		"usr/bin/shared": 0777,
+		"usr/bin/big":    0644,
+		"etc/foo.conf":   0644,
+		"opt/foo":        0644,
+	}
+	for f, mode := range files {
+		path := filepath.Join(fullDir, f)
+		if err = ioutil.WriteFile(path, []byte("content"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err = os.Chmod(path, mode); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = ioutil.WriteFile(filepath.Join(fullDir, "usr/bin/big"), make([]byte, 2048), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	mustWriteBundleInfo(t, versionDir, "os-core", nil, "/usr", "/usr/bin", "/usr/bin/core", "/usr/bin/sudo")
+	mustWriteBundleInfo(t, versionDir, "foo", nil,
+		"/usr/bin/core", "/usr/bin/ping", "/usr/bin/shared", "/usr/bin/big", "/etc", "/etc/foo.conf", "/opt/foo")
+	rpms, err := json.Marshal(map[string]*rpmFileList{
+		"foo-1-1.x86_64.rpm": {Files: []string{"/etc/foo.conf", "/opt/foo"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(filepath.Join(versionDir, rpmFilesName), rpms, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	policyFile := filepath.Join(testDir, "policy.toml")
+	writePolicy := func(content string) {
+		if err := ioutil.WriteFile(policyFile, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writePolicy(`
+[WORLD_WRITABLE]
+
+[SETUID]
+ALLOW = ["/usr/bin/sudo"]
+
+[STATELESS]
+SEVERITY = "warning"
+
+[PREFIXES]
+ALLOW = ["/usr", "/etc"]
+
+[MAX_SIZE]
+MAX = 1024
+`)
+	policy, err := readContentPolicy(policyFile)
+	if err != nil {
+		t.Fatalf("couldn't read policy: %s", err)
+	}
+	bundles, err := loadBundleContents(testDir, "10")
+	if err != nil {
+		t.Fatalf("couldn't load bundle contents: %s", err)
+	}
+	var got []string
+	for _, m := range bundles {
+		issues, err := checkBundlePolicy(fullDir, policy, map[string]string{"/opt/foo": "foo-1-1.x86_64"}, m)
+		if err != nil {
+			t.Fatalf("unexpected error checking policy: %s", err)
+		}
+		for _, i := range issues {
+			got = append(got, i.Bundle+" "+i.Rule+" "+i.Severity+" "+i.Path+" "+i.Package)
+		}
+	}
+	sort.Strings(got)
+	expected := []string{
+		"foo max-size error /usr/bin/big ",
+		"foo prefixes error /opt/foo foo-1-1.x86_64",
+		"foo setuid error /usr/bin/ping ",
+		"foo stateless warning /etc/foo.conf ",
+		"foo world-writable error /usr/bin/shared ",
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("got issues %q, expected %q", got, expected)
+	}
+
+	// Without a policy file nothing is checked.
+	if err = b.checkPolicy("10"); err != nil {
+		t.Errorf("unexpected error without policy: %s", err)
+	}
+
+	b.Config.Mixer.PolicyFile = policyFile
+	if err = b.checkPolicy("10"); err == nil {
+		t.Error("unexpected success with policy violations")
+	}
+
+	// The update isn't built from bundles violating the policy, which are
+	// kept as is.
+	if err = b.BuildUpdate(UpdateParameters{}); err == nil || !strings.Contains(err.Error(), "policy") {
+		t.Errorf("expected policy error building the update, got %v", err)
+	}
+	if _, err = os.Lstat(b.transactionDir()); !os.IsNotExist(err) {
+		t.Error("the update failing the policy check shouldn't start a build transaction")
+	}
+	if _, err = os.Stat(filepath.Join(fullDir, "usr/bin/ping")); err != nil {
+		t.Errorf("the chroot violating the policy should be kept: %s", err)
+	}
+
+	writePolicy(`
+[WORLD_WRITABLE]
+SEVERITY = "disabled"
+
+[SETUID]
+ALLOW = ["/usr/bin/sudo"]
+WAIVERS = [{PATH = "/usr/bin/ping", BUNDLE = "foo", REASON = "needs raw sockets"}]
+
+[STATELESS]
+SEVERITY = "warning"
+
+[PREFIXES]
+ALLOW = ["/usr", "/etc"]
+WAIVERS = [{PATH = "/opt/*", REASON = "third party"}]
+
+[MAX_SIZE]
+SEVERITY = "warning"
+MAX = 1024
+`)
+	if err = b.checkPolicy("10"); err != nil {
+		t.Errorf("unexpected error with waived violations: %s", err)
+	}
+}
@@ -0,0 +1,524 @@
+package builder
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/clearlinux/mixer-tools/helpers"
+	"github.com/clearlinux/mixer-tools/log"
+	"github.com/clearlinux/mixer-tools/swupd"
+	"github.com/pkg/errors"
+)
+
+// publishDest is a destination tree the update content is published to. Paths
+// are relative to the www directory of the mix and to the root of the
+// destination.
+type publishDest interface {
+	// upload copies the files missing or different in the destination, each
+	// replacing its destination atomically, and returns how many were
+	// copied. Immutable files are only copied when missing.
+	upload(src string, paths []string, immutable bool) (int, error)
+
+	// verify returns the files missing or different in the destination.
+	verify(src string, paths []string) ([]string, error)
+
+	String() string
+}
+
+// newPublishDest parses a destination: "rsync:<target>" runs rsync to the
+// target, "object:<dir>" stores the files in a directory standing in for an
+// object store, and anything else, optionally prefixed with "file:", is a
+// local directory.
+func newPublishDest(dest string) (publishDest, error) {
+	kind, target := "file", dest
+	if i := strings.Index(dest, ":"); i > 0 {
+		switch dest[:i] {
+		case "file", "rsync", "object":
+			kind, target = dest[:i], dest[i+1:]
+		}
+	}
+	if target == "" {
+		return nil, errors.Errorf("invalid publish destination %q", dest)
+	}
+	switch kind {
+	case "rsync":
+		return &rsyncDest{target: strings.TrimSuffix(target, "/")}, nil
+	case "object":
+		return &objectDest{root: target}, nil
+	}
+	return &localDest{root: target}, nil
+}
+
+func fileSha256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	h := sha256.New()
+	if _, err = io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// copyAtomic copies src to a temporary file next to dest and renames it.
+func copyAtomic(dest, src string) error {
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return err
+	}
+	tmp := filepath.Join(filepath.Dir(dest), "."+filepath.Base(dest)+".tmp")
+	if err := helpers.CopyFile(tmp, src); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, dest)
+}
+
+// localDest is a local directory, typically the web root.
+type localDest struct {
+	root string
+}
+
+func (d *localDest) String() string {
+	return d.root
+}
+
+// same reports whether the destination file has the content of the source.
+func (d *localDest) same(src, path string, immutable bool) (bool, error) {
+	dfi, err := os.Stat(filepath.Join(d.root, path))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil || immutable {
+		return err == nil, err
+	}
+	sfi, err := os.Stat(filepath.Join(src, path))
+	if err != nil || sfi.Size() != dfi.Size() {
+		return false, err
+	}
+	srcSum, err := fileSha256(filepath.Join(src, path))
+	if err != nil {
+		return false, err
+	}
+	destSum, err := fileSha256(filepath.Join(d.root, path))
+	return srcSum == destSum, err
+}
+
+func (d *localDest) upload(src string, paths []string, immutable bool) (int, error) {
+	count := 0
+	for _, path := range paths {
+		same, err := d.same(src, path, immutable)
+		if err != nil {
+			return count, err
+		}
+		if same {
+			continue
+		}
+		if err = copyAtomic(filepath.Join(d.root, path), filepath.Join(src, path)); err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, nil
+}
+
+func (d *localDest) verify(src string, paths []string) ([]string, error) {
+	var bad []string
+	for _, path := range paths {
+		same, err := d.same(src, path, false)
+		if err != nil {
+			return nil, err
+		}
+		if !same {
+			bad = append(bad, path)
+		}
+	}
+	return bad, nil
+}
+
+// objectDest is a directory standing in for an object store. Each object is
+// written whole, and its checksum is kept in the .checksums directory, like the
+// ETag of a stored object, so unchanged objects aren't read again.
+type objectDest struct {
+	root string
+}
+
+func (d *objectDest) String() string {
+	return "object:" + d.root
+}
+
+func (d *objectDest) checksumPath(path string) string {
+	return filepath.Join(d.root, ".checksums", path)
+}
+
+func (d *objectDest) stored(path string) (string, error) {
+	content, err := ioutil.ReadFile(d.checksumPath(path))
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	return strings.TrimSpace(string(content)), err
+}
+
+func (d *objectDest) upload(src string, paths []string, immutable bool) (int, error) {
+	count := 0
+	for _, path := range paths {
+		stored, err := d.stored(path)
+		if err != nil {
+			return count, err
+		}
+		if stored != "" && immutable {
+			continue
+		}
+		sum, err := fileSha256(filepath.Join(src, path))
+		if err != nil {
+			return count, err
+		}
+		if stored == sum {
+			continue
+		}
+		if err = copyAtomic(filepath.Join(d.root, path), filepath.Join(src, path)); err != nil {
+			return count, err
+		}
+		if err = os.MkdirAll(filepath.Dir(d.checksumPath(path)), 0755); err != nil {
+			return count, err
+		}
+		if err = ioutil.WriteFile(d.checksumPath(path), []byte(sum+"\n"), 0644); err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, nil
+}
+
+func (d *objectDest) verify(src string, paths []string) ([]string, error) {
+	var bad []string
+	for _, path := range paths {
+		sum, err := fileSha256(filepath.Join(src, path))
+		if err != nil {
+			return nil, err
+		}
+		stored, err := d.stored(path)
+		if err != nil {
+			return nil, err
+		}
+		content, err := fileSha256(filepath.Join(d.root, path))
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		if stored != sum || content != sum {
+			bad = append(bad, path)
+		}
+	}
+	return bad, nil
+}
+
+// rsyncDest is a local or remote target of rsync, which replaces each file
+// atomically.
+type rsyncDest struct {
+	target string
+}
+
+func (d *rsyncDest) String() string {
+	return "rsync:" + d.target
+}
+
+// rsync runs rsync over the paths and returns the files it lists.
+func (d *rsyncDest) rsync(src string, paths []string, args ...string) ([]string, error) {
+	args = append([]string{"-a", "--files-from=-", "--out-format=%n"}, args...)
+	args = append(args, src+"/", d.target+"/")
+	cmd := exec.Command("rsync", args...)
+	cmd.Stdin = strings.NewReader(strings.Join(paths, "\n") + "\n")
+	var errBuf bytes.Buffer
+	cmd.Stderr = &errBuf
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to run rsync to %s: %s", d.target, strings.TrimSpace(errBuf.String()))
+	}
+	var files []string
+	for _, line := range strings.Split(string(out), "\n") {
+		if line != "" && !strings.HasSuffix(line, "/") {
+			files = append(files, line)
+		}
+	}
+	return files, nil
+}
+
+func (d *rsyncDest) upload(src string, paths []string, immutable bool) (int, error) {
+	var args []string
+	if immutable {
+		args = append(args, "--ignore-existing")
+	} else {
+		args = append(args, "--checksum")
+	}
+	files, err := d.rsync(src, paths, args...)
+	return len(files), err
+}
+
+func (d *rsyncDest) verify(src string, paths []string) ([]string, error) {
+	return d.rsync(src, paths, "--dry-run", "--checksum")
+}
+
+// publishSet lists the files of a version to publish, in the order they are
+// published: the fullfiles and deltas, then the packs, the bundle manifests
+// and other files of the version, Manifest.MoM, and finally the files pointing
+// to the latest version.
+type publishSet struct {
+	fullfiles []string
+	packs     []string
+	manifests []string
+	mom       []string
+	latest    []string
+}
+
+func (s *publishSet) all() []string {
+	var all []string
+	for _, list := range [][]string{s.fullfiles, s.packs, s.manifests, s.mom, s.latest} {
+		all = append(all, list...)
+	}
+	return all
+}
+
+// publishFiles returns the files of a version, with the bundle manifests, zero
+// packs and fullfiles of previous versions it refers to, failing when any of
+// them is missing so nothing is published. The latest files of
+// the version directory of the channel, or of the mix, are included when they
+// point to the version.
+func (b *Builder) publishFiles(version, channel string) (*publishSet, error) {
+	wwwDir := filepath.Join(b.Config.Builder.ServerStateDir, "www")
+	files := make(map[string]bool)
+	s := &publishSet{}
+	add := func(list *[]string, path string) {
+		if !files[path] {
+			files[path] = true
+			*list = append(*list, path)
+		}
+	}
+
+	err := filepath.Walk(filepath.Join(wwwDir, version), func(path string, fi os.FileInfo, err error) error {
+		if err != nil || fi.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(wwwDir, path)
+		if err != nil {
+			return err
+		}
+		parts := strings.Split(rel, string(filepath.Separator))
+		name := filepath.Base(rel)
+		switch {
+		case len(parts) > 2 && (parts[1] == "files" || parts[1] == "delta"):
+			add(&s.fullfiles, rel)
+		case strings.HasPrefix(name, "pack-"):
+			add(&s.packs, rel)
+		case strings.HasPrefix(name, "Manifest.MoM"):
+			add(&s.mom, rel)
+		default:
+			add(&s.manifests, rel)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Content of previous versions still used by the version
+	var missing []string
+	addPrevious := func(list *[]string, path string) {
+		if files[path] {
+			return
+		}
+		if _, err := os.Stat(filepath.Join(wwwDir, path)); err != nil {
+			missing = append(missing, path)
+			return
+		}
+		add(list, path)
+	}
+	mom, err := swupd.ParseManifestFile(filepath.Join(wwwDir, version, "Manifest.MoM"))
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range mom.Files {
+		if f.Status == swupd.StatusDeleted {
+			continue
+		}
+		ver := fmt.Sprint(f.Version)
+		addPrevious(&s.packs, filepath.Join(ver, swupd.GetPackFilename(f.Name, 0)))
+		addPrevious(&s.manifests, filepath.Join(ver, "Manifest."+f.Name))
+		addPrevious(&s.manifests, filepath.Join(ver, "Manifest."+f.Name+".tar"))
+	}
+	full, err := swupd.ParseManifestFile(filepath.Join(wwwDir, version, "Manifest.full"))
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range full.Files {
+		if f.Status == swupd.StatusDeleted || f.Status == swupd.StatusGhosted {
+			continue
+		}
+		addPrevious(&s.fullfiles, filepath.Join(fmt.Sprint(f.Version), "files", f.Hash.String()+".tar"))
+	}
+	if len(missing) > 0 {
+		for _, path := range missing {
+			log.Error(log.Mixer, "Missing %s", filepath.Join(wwwDir, path))
+		}
+		return nil, errors.Errorf("%d update files used by version %s are missing", len(missing), version)
+	}
+
+	// The format latest file is published before latest_version
+	format, err := b.getFormatForVersion(version)
+	if err != nil {
+		return nil, errors.Wrapf(err, "couldn't read the format of version %s", version)
+	}
+	versionDir := "version"
+	if channel != "" {
+		versionDir = filepath.Join(channelsDir, channel, "version")
+	}
+	for _, path := range []string{filepath.Join(versionDir, "format"+format, "latest"), filepath.Join(versionDir, "latest_version")} {
+		content, err := ioutil.ReadFile(filepath.Join(wwwDir, path))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if strings.TrimSpace(string(content)) != version {
+			log.Info(log.Mixer, "Skipping %s, it doesn't point to version %s", path, version)
+			continue
+		}
+		if _, err = os.Stat(filepath.Join(wwwDir, path+".sig")); err == nil {
+			add(&s.latest, path+".sig")
+		}
+		add(&s.latest, path)
+	}
+
+	for _, list := range [][]string{s.fullfiles, s.packs, s.manifests, s.mom} {
+		sort.Strings(list)
+	}
+	return s, nil
+}
+
+// Publish copies a version to the destination, in an order that never lets
+// clients see a file before the files it refers to: fullfiles, packs, bundle
+// manifests, Manifest.MoM and its signature, then the latest files. It ends
+// with a verification of the files published. With verifyOnly, it only
+// verifies them.
+func (b *Builder) Publish(version, channel, dest string, verifyOnly bool) error {
+	if channel != "" {
+		if err := b.checkChannel(channel); err != nil {
+			return err
+		}
+	}
+	if version == "" {
+		var err error
+		if channel != "" {
+			version, _, err = b.readChannelLatest(channel)
+		} else {
+			var content []byte
+			content, err = ioutil.ReadFile(filepath.Join(b.Config.Builder.ServerStateDir, "www", "version", "latest_version"))
+			version = strings.TrimSpace(string(content))
+		}
+		if err != nil || version == "" {
+			return errors.New("no version to publish, supply one")
+		}
+	}
+
+	d, err := newPublishDest(dest)
+	if err != nil {
+		return err
+	}
+	if err = b.checkFullyBuilt(version); err != nil {
+		return err
+	}
+	s, err := b.publishFiles(version, channel)
+	if err != nil {
+		return err
+	}
+	src := filepath.Join(b.Config.Builder.ServerStateDir, "www")
+
+	if !verifyOnly {
+		log.Info(log.Mixer, "Publishing version %s to %s", version, d)
+		steps := []struct {
+			name      string
+			paths     []string
+			immutable bool
+		}{
+			{"fullfiles and deltas", s.fullfiles, true},
+			{"packs", s.packs, true},
+			{"manifests", s.manifests, false},
+			{"Manifest.MoM", s.mom, false},
+			{"latest files", s.latest, false},
+		}
+		for _, step := range steps {
+			if len(step.paths) == 0 {
+				continue
+			}
+			count, err := d.upload(src, step.paths, step.immutable)
+			if err != nil {
+				return errors.Wrapf(err, "couldn't publish the %s of version %s", step.name, version)
+			}
+			log.Info(log.Mixer, "- %s: %d of %d files copied", step.name, count, len(step.paths))
+		}
+	}
+
+	log.Info(log.Mixer, "Verifying version %s in %s", version, d)
+	bad, err := d.verify(src, s.all())
+	if err != nil {
+		return err
+	}
+	for _, path := range bad {
+		log.Error(log.Mixer, "%s is missing or different in %s", path, d)
+	}
+	if len(bad) > 0 {
+		return errors.Errorf("%d files of version %s are missing or different in %s", len(bad), version, d)
+	}
+	if err = b.recordPublished(version, d.String()); err != nil {
+		return err
+	}
+	log.Info(log.Mixer, "Version %s is published in %s", version, d)
+	return nil
+}
+
+// publishedDir is the directory of the state dir recording the destinations
+// each version was published to.
+const publishedDir = ".published"
+
+func (b *Builder) publishedPath(version string) string {
+	return filepath.Join(b.Config.Builder.ServerStateDir, publishedDir, version)
+}
+
+// recordPublished records that the version was published to dest, so it is
+// never rolled back.
+func (b *Builder) recordPublished(version, dest string) error {
+	path := b.publishedPath(version)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = fmt.Fprintln(f, dest); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// versionPublished reports whether the version was published.
+func (b *Builder) versionPublished(version string) (bool, error) {
+	_, err := os.Stat(b.publishedPath(version))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
@@ -0,0 +1,115 @@
+package builder
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestNewPublishDest(t *testing.T) {
+	tests := []struct {
+		dest, expected string
+	}{
+		{"/srv/www", "/srv/www"},
+		{"file:/srv/www", "/srv/www"},
+		{"rsync:host:/srv/www/", "rsync:host:/srv/www"},
+		{"object:/srv/bucket", "object:/srv/bucket"},
+	}
+	for _, tt := range tests {
+		d, err := newPublishDest(tt.dest)
+		if err != nil {
+			t.Errorf("couldn't parse destination %s: %s", tt.dest, err)
+			continue
+		}
+		if d.String() != tt.expected {
+			t.Errorf("destination %s parsed as %s, expected %s", tt.dest, d, tt.expected)
+		}
+	}
+	if _, err := newPublishDest("rsync:"); err == nil {
+		t.Errorf("expected error parsing an empty rsync target")
+	}
+}
+
+func TestPublish(t *testing.T) {
+	testDir, err := ioutil.TempDir("", "publish-test-")
+	if err != nil {
+		t.Fatalf("couldn't create temporary directory: %s", err)
+	}
+	defer cleanup(testDir)
+
+	b := newTransactionTestBuilder(testDir)
+	wwwDir := filepath.Join(b.Config.Builder.ServerStateDir, "www")
+	writeTestVersion(t, wwwDir, 10, "1")
+	writeTestVersion(t, wwwDir, 20, "1")
+	hash1 := strings.Repeat("1", 64)
+	hash2 := strings.Repeat("2", 64)
+
+	// Version 20 still uses the foo bundle and a file of version 10
+	mustWriteTestManifest(t, filepath.Join(wwwDir, "20", "Manifest.MoM"), 20, []string{"contentsize:\t0"},
+		"M...\t"+hash2+"\t20\tos-core",
+		"M...\t"+hash1+"\t10\tfoo",
+	)
+	mustWriteTestManifest(t, filepath.Join(wwwDir, "20", "Manifest.full"), 20, []string{"contentsize:\t0"},
+		"F...\t"+hash2+"\t20\t/usr/bin/core",
+		"F...\t"+hash1+"\t10\t/usr/bin/foo",
+	)
+	for _, f := range []string{"Manifest.foo", "Manifest.foo.tar", "pack-foo-from-0.tar"} {
+		writeTestFile(t, filepath.Join(wwwDir, "10", f), f)
+	}
+	writeTestFile(t, filepath.Join(wwwDir, "20", "Manifest.os-core"), "")
+	writeTestFile(t, filepath.Join(wwwDir, "version", "latest_version"), "20")
+	writeTestFile(t, filepath.Join(wwwDir, "version", "format1", "latest"), "20")
+
+	s, err := b.publishFiles("20", "")
+	if err != nil {
+		t.Fatalf("couldn't list the files to publish: %s", err)
+	}
+	if strings.Join(s.latest, ",") != "version/format1/latest,version/latest_version" {
+		t.Errorf("got latest files %v", s.latest)
+	}
+	if len(s.mom) != 2 || !strings.HasPrefix(s.fullfiles[0], "10/files/") || len(s.fullfiles) != 2 {
+		t.Errorf("unexpected files %+v", s)
+	}
+
+	for _, dest := range []string{filepath.Join(testDir, "web"), "object:" + filepath.Join(testDir, "bucket")} {
+		if err = b.Publish("", "", dest, true); err == nil {
+			t.Errorf("expected verification of an empty destination %s to fail", dest)
+		}
+		if err = b.Publish("", "", dest, false); err != nil {
+			t.Fatalf("couldn't publish to %s: %s", dest, err)
+		}
+
+		root := strings.TrimPrefix(dest, "object:")
+		for _, f := range []string{"20/Manifest.MoM.tar", "10/Manifest.foo.tar", "10/pack-foo-from-0.tar", "10/files/" + hash1 + ".tar"} {
+			if _, err = os.Stat(filepath.Join(root, f)); err != nil {
+				t.Errorf("%s not published to %s", f, dest)
+			}
+		}
+		checkTestFile(t, filepath.Join(root, "version", "latest_version"), "20")
+
+		// A changed file fails the verification until published again
+		writeTestFile(t, filepath.Join(wwwDir, "version", "format1", "latest"), "20\n")
+		if err = b.Publish("20", "", dest, true); err == nil {
+			t.Errorf("expected verification of a changed file in %s to fail", dest)
+		}
+		if err = b.Publish("20", "", dest, false); err != nil {
+			t.Errorf("couldn't publish again to %s: %s", dest, err)
+		}
+		checkTestFile(t, filepath.Join(root, "version", "format1", "latest"), "20\n")
+		writeTestFile(t, filepath.Join(wwwDir, "version", "format1", "latest"), "20")
+	}
+
+	// Nothing is published when content of a previous version is missing
+	if err = os.Remove(filepath.Join(wwwDir, "10", "Manifest.foo")); err != nil {
+		t.Fatal(err)
+	}
+	dest := filepath.Join(testDir, "incomplete")
+	if err = b.Publish("20", "", dest, false); err == nil {
+		t.Errorf("expected error publishing with content of a previous version missing")
+	}
+	if _, err = os.Stat(dest); !os.IsNotExist(err) {
+		t.Errorf("files were published to %s with content missing", dest)
+	}
+}
@@ -0,0 +1,222 @@
+package builder
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/clearlinux/mixer-tools/helpers"
+	"github.com/clearlinux/mixer-tools/log"
+	"github.com/pkg/errors"
+)
+
+// rpmFilesName is the name of the file in the image version directory that
+// records which rpm provided each file in the full chroot.
+const rpmFilesName = "rpm-files"
+
+// rpmFileList describes the content extracted from a single rpm.
+type rpmFileList struct {
+	SourceRPM string
+	Files     []string
+
+	// Metadata is the snapshot of the files of the rpm used to validate the
+	// manifests offline. Versions built by older mixers don't have it.
+	Metadata []rpmFileMetadata `json:",omitempty"`
+}
+
+// rpmFileMetadata is the metadata of a file as listed in the rpm, before
+// resolving the symlinks of its path.
+type rpmFileMetadata struct {
+	Name   string
+	Size   string
+	Digest string `json:",omitempty"`
+	Mode   string
+	Link   string `json:",omitempty"`
+	User   string
+	Group  string
+}
+
+// fields returns the metadata in the order of pkgFilesQuery.
+func (m rpmFileMetadata) fields() []string {
+	return []string{m.Name, m.Size, m.Digest, m.Mode, m.Link, m.User, m.Group}
+}
+
+// rpmFiles collects the rpmFileList of every rpm extracted to the full chroot,
+// keyed by rpm filename. Extraction runs in parallel, so access is guarded.
+// The rpms are queried in batches once extracted, pending holding the rpms not
+// queried yet.
+var rpmFiles = struct {
+	sync.Mutex
+	m       map[string]*rpmFileList
+	pending []pendingRpm
+}{}
+
+// pendingRpm is an rpm extracted to the full chroot, with the files extracted
+// when not all of them were.
+type pendingRpm struct {
+	path      string
+	extracted []string
+}
+
+// rpmQueryBatch is the number of rpms queried by each rpm command.
+const rpmQueryBatch = 200
+
+// rpmRecordSeparator starts the query output of each rpm of a batch.
+const rpmRecordSeparator = "\x1e"
+
+func resetRpmFiles() {
+	rpmFiles.Lock()
+	rpmFiles.m = make(map[string]*rpmFileList)
+	rpmFiles.pending = nil
+	rpmFiles.Unlock()
+}
+
+// recordRpmFiles records an rpm that was extracted to the full chroot, whose
+// source rpm and file list are queried by queryRpmFiles. When only some files
+// of the rpm were extracted, only those are recorded.
+func recordRpmFiles(rpm string, extracted []string) {
+	rpmFiles.Lock()
+	rpmFiles.pending = append(rpmFiles.pending, pendingRpm{path: rpm, extracted: extracted})
+	rpmFiles.Unlock()
+}
+
+// queryRpmFiles queries the source rpm and file list of the recorded rpms,
+// running one rpm command per batch of rpms. The information is only used for
+// reporting and validation, so failures are logged and otherwise ignored.
+func queryRpmFiles() {
+	rpmFiles.Lock()
+	pending := rpmFiles.pending
+	rpmFiles.pending = nil
+	rpmFiles.Unlock()
+
+	for len(pending) > 0 {
+		n := len(pending)
+		if n > rpmQueryBatch {
+			n = rpmQueryBatch
+		}
+		queryRpmBatch(pending[:n])
+		pending = pending[n:]
+	}
+}
+
+// queryRpmBatch queries a batch of rpms, falling back to querying them one by
+// one when some of them can't be queried, so the output of the others can't
+// be attributed to the wrong rpm.
+func queryRpmBatch(batch []pendingRpm) {
+	queryCmd := rpmRecordSeparator + "%{sourcerpm}\n" + pkgFilesQuery
+	args := []string{"-qp", "--qf=" + queryCmd}
+	for _, p := range batch {
+		args = append(args, p.path)
+	}
+	out, err := helpers.RunCommandOutputEnv(log.Dnf, "rpm", args, []string{"LC_ALL=en_US.UTF-8"})
+	var records []string
+	if err == nil {
+		if records = strings.Split(out.String(), rpmRecordSeparator)[1:]; len(records) != len(batch) {
+			err = errors.Errorf("got %d records for %d rpms", len(records), len(batch))
+		}
+	}
+	if err != nil {
+		if len(batch) == 1 {
+			log.Warning(log.Mixer, "Couldn't query file list of %s: %s", filepath.Base(batch[0].path), err)
+			return
+		}
+		for _, p := range batch {
+			queryRpmBatch([]pendingRpm{p})
+		}
+		return
+	}
+
+	rpmFiles.Lock()
+	defer rpmFiles.Unlock()
+	for i, p := range batch {
+		if rpmFiles.m != nil {
+			rpmFiles.m[filepath.Base(p.path)] = parseRpmFileList(records[i], p.extracted)
+		}
+	}
+}
+
+// parseRpmFileList parses the query output of an rpm, keeping only the
+// extracted files if not nil.
+func parseRpmFileList(record string, extracted []string) *rpmFileList {
+	var only map[string]bool
+	if extracted != nil {
+		only = make(map[string]bool, len(extracted))
+		for _, f := range extracted {
+			only[f] = true
+		}
+	}
+
+	lines := strings.Split(strings.TrimSuffix(record, "\n"), "\n")
+	list := &rpmFileList{SourceRPM: lines[0]}
+	for _, line := range lines[1:] {
+		fields := strings.Split(line, "\a")
+		if fields[0] == "" || (only != nil && !only[fields[0]]) {
+			continue
+		}
+		list.Files = append(list.Files, resolveFileName(fields[0]))
+		if len(fields) == 7 {
+			list.Metadata = append(list.Metadata, rpmFileMetadata{
+				Name:   fields[0],
+				Size:   fields[1],
+				Digest: fields[2],
+				Mode:   fields[3],
+				Link:   fields[4],
+				User:   fields[5],
+				Group:  fields[6],
+			})
+		}
+	}
+	return list
+}
+
+// rpmFileProviders returns the names of the packages providing each file
+// extracted to the full chroot.
+func rpmFileProviders() map[string][]string {
+	rpmFiles.Lock()
+	defer rpmFiles.Unlock()
+
+	providers := make(map[string][]string)
+	for rpm, list := range rpmFiles.m {
+		name, _, ok := splitRpmFilename(rpm)
+		if !ok {
+			continue
+		}
+		for _, f := range list.Files {
+			providers[f] = append(providers[f], name)
+		}
+	}
+	return providers
+}
+
+// writeRpmFiles saves the rpm file lists collected while building the full chroot.
+func writeRpmFiles(path string) error {
+	rpmFiles.Lock()
+	defer rpmFiles.Unlock()
+
+	b, err := json.Marshal(rpmFiles.m)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, b, 0644)
+}
+
+// readRpmFiles loads the rpm file lists saved in the image version directory
+// versionDir. A missing file results in an empty map, since older versions
+// were built without it.
+func readRpmFiles(versionDir string) (map[string]*rpmFileList, error) {
+	lists := make(map[string]*rpmFileList)
+	b, err := ioutil.ReadFile(filepath.Join(versionDir, rpmFilesName))
+	if os.IsNotExist(err) {
+		return lists, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(b, &lists); err != nil {
+		return nil, errors.Wrapf(err, "couldn't parse %s", rpmFilesName)
+	}
+	return lists, nil
+}
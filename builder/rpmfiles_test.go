@@ -0,0 +1,34 @@
+package builder
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseRpmFileList(t *testing.T) {
+	// The query output of a batch of two rpms, the second partially extracted
+	out := rpmRecordSeparator + "foo-1-1.src.rpm\n" +
+		"/usr/bin/foo\a10\aabc\a-rwxr-xr-x\a\aroot\aroot\n" +
+		"/bin/foo-link\a7\a\alrwxrwxrwx\afoo\aroot\aroot\n" +
+		rpmRecordSeparator + "bar-2-1.src.rpm\n" +
+		"/usr/share/bar/a\a1\adef\a-rw-r--r--\a\aroot\aroot\n" +
+		"/usr/share/bar/b\a1\aghi\a-rw-r--r--\a\aroot\aroot\n"
+	records := strings.Split(out, rpmRecordSeparator)[1:]
+	if len(records) != 2 {
+		t.Fatalf("got %d records, expected 2", len(records))
+	}
+
+	foo := parseRpmFileList(records[0], nil)
+	if foo.SourceRPM != "foo-1-1.src.rpm" || !reflect.DeepEqual(foo.Files, []string{"/usr/bin/foo", "/usr/bin/foo-link"}) {
+		t.Errorf("got %+v for foo", foo)
+	}
+	if len(foo.Metadata) != 2 || foo.Metadata[1].Name != "/bin/foo-link" || foo.Metadata[1].Link != "foo" {
+		t.Errorf("got metadata %+v for foo", foo.Metadata)
+	}
+
+	bar := parseRpmFileList(records[1], []string{"/usr/share/bar/b"})
+	if bar.SourceRPM != "bar-2-1.src.rpm" || !reflect.DeepEqual(bar.Files, []string{"/usr/share/bar/b"}) {
+		t.Errorf("got %+v for bar", bar)
+	}
+}
@@ -70,3 +70,18 @@ func (sw *stopWatch) WriteSummary(_ io.Writer) {
 	}
 	log.Info(log.Mixer, "TOTAL: %s", sum.Truncate(time.Millisecond))
 }
+
+// timings returns the durations of the completed sections. It is safe to call
+// on a nil stopWatch.
+func (sw *stopWatch) timings() []phaseHookTiming {
+	if sw == nil {
+		return nil
+	}
+	var timings []phaseHookTiming
+	for _, e := range sw.entries {
+		if e.used {
+			timings = append(timings, phaseHookTiming{Name: e.name, Seconds: e.d.Seconds()})
+		}
+	}
+	return timings
+}
@@ -0,0 +1,540 @@
+package builder
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/clearlinux/mixer-tools/helpers"
+	"github.com/clearlinux/mixer-tools/log"
+	"github.com/pkg/errors"
+)
+
+// transactionDirName is the directory of the state dir holding the journal of
+// the current build transaction, the backups of the state files and the staged
+// files published when the update is complete.
+const transactionDirName = ".transaction"
+
+// transactionVersion is a version built in a transaction.
+type transactionVersion struct {
+	Version string
+}
+
+// transactionDir is an image or www directory of a version staged by the
+// transaction. Until the transaction is committed, the directory is built in
+// Staging, under the versions directory of the transaction, and Path is a
+// symlink to it.
+type transactionDir struct {
+	Path    string
+	Staging string
+	// Command is the build command that staged the directory.
+	Command int
+
+	// Linked is set when the command created the symlink at Path, and
+	// Adopted when it moved the existing directory at Path to Staging to
+	// update it. Replaced is the backup of the directory the command replaced
+	// with an empty one: the directory at Path, or the staged directory when
+	// Path was already linked.
+	Linked   bool
+	Adopted  bool
+	Replaced string `json:",omitempty"`
+}
+
+// transactionFile is a state file backed up before the transaction changed it.
+type transactionFile struct {
+	Path    string
+	Existed bool
+	Backup  string `json:",omitempty"`
+}
+
+// transactionCommand is the build command running in the transaction. When it
+// fails, only what it changed is rolled back, so a failed "mixer build update"
+// keeps the bundles built by a previous "mixer build bundles".
+type transactionCommand struct {
+	Version string
+	Files   []transactionFile
+}
+
+// buildTransaction is the journal of a build. It starts when building the
+// bundles of a version, and is committed once its update content is complete.
+// The directories of the versions are built in the transaction directory, and
+// only moved into place with the files pointing to the latest version when the
+// transaction is committed. Until then, a failed build command rolls back the
+// directories it staged and restores the state files, and "mixer build
+// rollback" rolls back the whole transaction.
+type buildTransaction struct {
+	Started   time.Time
+	Committed bool
+	Versions  []transactionVersion
+	Files     []transactionFile
+	Dirs      []transactionDir    `json:",omitempty"`
+	Command   *transactionCommand `json:",omitempty"`
+	// Commands counts the build commands run in the transaction.
+	Commands int
+
+	// Committing is set once the commit started moving Dirs and the Staged
+	// files, mapping staged files to their destination, into place. An
+	// interrupted commit is completed by the next build command.
+	Committing bool              `json:",omitempty"`
+	Staged     map[string]string `json:",omitempty"`
+
+	dir string
+}
+
+func (b *Builder) transactionDir() string {
+	return filepath.Join(b.Config.Builder.ServerStateDir, transactionDirName)
+}
+
+// transactionFiles are the state files restored by a rollback: the mix
+// version files, mixer.state, the files pointing to the latest version, the
+// build history and the checkpoint of the version.
+func (b *Builder) transactionFiles() []string {
+	stateDir := b.Config.Builder.ServerStateDir
+	latest := filepath.Join(stateDir, "www", "version", "latest_version")
+	formatLatest := filepath.Join(stateDir, "www", "version", "format"+b.State.Mix.Format, "latest")
+	return []string{
+		filepath.Join(b.Config.Builder.VersionPath, b.MixVerFile),
+		filepath.Join(b.Config.Builder.VersionPath, b.UpstreamVerFile),
+		filepath.Join(b.Config.Builder.VersionPath, "mixer.state"),
+		filepath.Join(stateDir, "image", "LAST_VER"),
+		latest,
+		latest + ".sig",
+		formatLatest,
+		formatLatest + ".sig",
+		b.historyPath(),
+		b.checkpointPath(b.MixVer),
+	}
+}
+
+func readTransaction(dir string) (*buildTransaction, error) {
+	content, err := ioutil.ReadFile(filepath.Join(dir, "journal"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var t buildTransaction
+	if err = json.Unmarshal(content, &t); err != nil {
+		return nil, errors.Wrapf(err, "couldn't parse build transaction journal in %s", dir)
+	}
+	t.dir = dir
+	return &t, nil
+}
+
+// save writes the journal, replacing the previous one atomically.
+func (t *buildTransaction) save() error {
+	content, err := json.MarshalIndent(t, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(t.dir, "journal.tmp")
+	if err = ioutil.WriteFile(tmp, content, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(t.dir, "journal"))
+}
+
+func (t *buildTransaction) hasVersion(version string) bool {
+	for _, v := range t.Versions {
+		if v.Version == version {
+			return true
+		}
+	}
+	return false
+}
+
+// versionCommitted reports whether the update content of a version was built
+// and its build transaction committed.
+func (b *Builder) versionCommitted(version string) (bool, error) {
+	_, err := os.Stat(filepath.Join(b.Config.Builder.ServerStateDir, "www", version, "Manifest.MoM"))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	t, err := readTransaction(b.transactionDir())
+	if err != nil {
+		return false, err
+	}
+	return t == nil || t.Committed || !t.hasVersion(version), nil
+}
+
+// beginTransaction starts a build command for the mix version. A new
+// transaction is started unless an uncommitted one exists, completing the
+// commit of the previous one if it was interrupted. State files not yet in the
+// journal are backed up, and the state files are recorded for the command.
+func (b *Builder) beginTransaction() (*buildTransaction, error) {
+	dir := b.transactionDir()
+	t, err := readTransaction(dir)
+	if err != nil {
+		return nil, err
+	}
+	if t != nil && t.Committing {
+		log.Warning(log.Mixer, "Completing the interrupted commit of the last build")
+		if err = t.finishCommit(); err != nil {
+			return nil, err
+		}
+	}
+
+	if t == nil || t.Committed {
+		if err = os.RemoveAll(dir); err != nil {
+			return nil, err
+		}
+		if err = os.MkdirAll(filepath.Join(dir, "backup"), 0755); err != nil {
+			return nil, err
+		}
+		t = &buildTransaction{Started: time.Now().UTC(), dir: dir}
+		log.Debug(log.Mixer, "Started build transaction in %s", dir)
+	}
+
+	paths := b.transactionFiles()
+	if t.Files, err = backupFiles(filepath.Join(dir, "backup"), t.Files, paths); err != nil {
+		return nil, err
+	}
+	if !t.hasVersion(b.MixVer) {
+		t.Versions = append(t.Versions, transactionVersion{Version: b.MixVer})
+	}
+
+	if err = os.RemoveAll(filepath.Join(dir, "command")); err != nil {
+		return nil, err
+	}
+	if err = os.MkdirAll(filepath.Join(dir, "command"), 0755); err != nil {
+		return nil, err
+	}
+	t.Commands++
+	t.Command = &transactionCommand{Version: b.MixVer}
+	if t.Command.Files, err = backupFiles(filepath.Join(dir, "command"), nil, paths); err != nil {
+		return nil, err
+	}
+	return t, t.save()
+}
+
+// backupFiles copies the files not yet in the known ones to the backup
+// directory, returning the files with the new ones.
+func backupFiles(dir string, known []transactionFile, paths []string) ([]transactionFile, error) {
+	files := known
+	seen := make(map[string]bool)
+	for _, f := range known {
+		seen[f.Path] = true
+	}
+	for _, path := range paths {
+		if seen[path] {
+			continue
+		}
+		f := transactionFile{Path: path}
+		if _, err := os.Stat(path); err == nil {
+			f.Existed = true
+			f.Backup = fmt.Sprint(len(files))
+			if err = helpers.CopyFile(filepath.Join(dir, f.Backup), path); err != nil {
+				return nil, errors.Wrapf(err, "couldn't back up %s", path)
+			}
+		} else if !os.IsNotExist(err) {
+			return nil, err
+		}
+		files = append(files, f)
+	}
+	return files, nil
+}
+
+// restoreFiles restores the backed up files, and removes the files that didn't
+// exist when they were backed up.
+func restoreFiles(dir string, files []transactionFile) error {
+	for _, f := range files {
+		if !f.Existed {
+			if err := os.Remove(f.Path); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			continue
+		}
+		log.Info(log.Mixer, "Restoring %s", f.Path)
+		if err := helpers.CopyFile(f.Path, filepath.Join(dir, f.Backup)); err != nil {
+			return errors.Wrapf(err, "couldn't restore %s", f.Path)
+		}
+	}
+	return nil
+}
+
+// isSymlink reports whether path is a symlink.
+func isSymlink(path string) bool {
+	fi, err := os.Lstat(path)
+	return err == nil && fi.Mode()&os.ModeSymlink != 0
+}
+
+// stageDir stages the image or www directory of a version at path, so the
+// command builds it in the transaction directory. With fresh, the command
+// starts from an empty directory, and the existing one is kept aside to be
+// restored by a rollback. Otherwise the existing directory is moved to the
+// transaction directory, or kept there when already staged.
+func (t *buildTransaction) stageDir(path string, fresh bool) error {
+	staging := filepath.Join(t.dir, "versions", filepath.Base(filepath.Dir(path)), filepath.Base(path))
+	linked := isSymlink(path)
+	if linked {
+		if target, err := os.Readlink(path); err != nil || target != staging {
+			return errors.Errorf("%s is a symlink outside of the build transaction, remove it to build again", path)
+		}
+		if !fresh {
+			return nil
+		}
+	}
+	_, err := os.Lstat(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	exists := err == nil
+
+	d := transactionDir{
+		Path:    path,
+		Staging: staging,
+		Command: t.Commands,
+		Linked:  !linked,
+		Adopted: exists && !linked && !fresh,
+	}
+	if exists && fresh {
+		d.Replaced = filepath.Join(t.dir, "replaced", fmt.Sprint(len(t.Dirs)))
+	}
+	// The journal is saved first, so an interrupted command is rolled back
+	t.Dirs = append(t.Dirs, d)
+	if err = t.save(); err != nil {
+		return err
+	}
+
+	if err = os.MkdirAll(filepath.Dir(staging), 0755); err != nil {
+		return err
+	}
+	if d.Replaced != "" {
+		if err = os.MkdirAll(filepath.Dir(d.Replaced), 0755); err != nil {
+			return err
+		}
+		log.Warning(log.Mixer, "Replacing existing directory %s", path)
+		src := path
+		if linked {
+			src = staging
+		}
+		if err = os.Rename(src, d.Replaced); err != nil {
+			return err
+		}
+	}
+	if d.Adopted {
+		err = os.Rename(path, staging)
+	} else {
+		err = os.Mkdir(staging, 0755)
+	}
+	if err != nil {
+		return err
+	}
+	if !d.Linked {
+		return nil
+	}
+	if err = os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return os.Symlink(staging, path)
+}
+
+// unstageDir undoes stageDir, tolerating a command interrupted while staging
+// the directory.
+func unstageDir(d transactionDir) error {
+	if d.Linked && isSymlink(d.Path) {
+		if err := os.Remove(d.Path); err != nil {
+			return err
+		}
+	}
+	exists := func(path string) bool {
+		_, err := os.Lstat(path)
+		return err == nil
+	}
+	if d.Adopted {
+		if !exists(d.Staging) {
+			return nil
+		}
+		log.Info(log.Mixer, "Restoring %s", d.Path)
+		return os.Rename(d.Staging, d.Path)
+	}
+
+	log.Info(log.Mixer, "Removing %s", d.Path)
+	if err := os.RemoveAll(d.Staging); err != nil {
+		return err
+	}
+	if d.Replaced == "" || !exists(d.Replaced) {
+		return nil
+	}
+	log.Info(log.Mixer, "Restoring %s", d.Path)
+	dst := d.Staging
+	if d.Linked {
+		dst = d.Path
+	}
+	return os.Rename(d.Replaced, dst)
+}
+
+// stagingDir returns the directory where files are prepared before being
+// published by commit.
+func (t *buildTransaction) stagingDir() (string, error) {
+	dir := filepath.Join(t.dir, "staging")
+	return dir, os.MkdirAll(dir, 0755)
+}
+
+// commit moves the staged directories of the versions and the staged files to
+// their destinations, so they are replaced atomically, and marks the
+// transaction as committed.
+func (t *buildTransaction) commit(staged map[string]string) error {
+	t.Committing = true
+	t.Staged = staged
+	if err := t.save(); err != nil {
+		return err
+	}
+	return t.finishCommit()
+}
+
+// finishCommit moves what wasn't moved yet into place, so an interrupted
+// commit can be completed.
+func (t *buildTransaction) finishCommit() error {
+	for _, d := range t.Dirs {
+		if !d.Linked {
+			continue
+		}
+		if _, err := os.Lstat(d.Staging); os.IsNotExist(err) {
+			continue
+		}
+		if isSymlink(d.Path) {
+			if err := os.Remove(d.Path); err != nil {
+				return err
+			}
+		}
+		if err := os.Rename(d.Staging, d.Path); err != nil {
+			return errors.Wrapf(err, "couldn't publish %s", d.Path)
+		}
+	}
+	for src, dst := range t.Staged {
+		if _, err := os.Stat(src); os.IsNotExist(err) {
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+			return err
+		}
+		if err := os.Rename(src, dst); err != nil {
+			return errors.Wrapf(err, "couldn't publish %s", dst)
+		}
+	}
+	t.Committed = true
+	t.Committing = false
+	t.Staged = nil
+	t.Dirs = nil
+	t.Command = nil
+	if err := t.save(); err != nil {
+		return err
+	}
+	for _, name := range []string{"command", "replaced", "versions", "staging"} {
+		if err := os.RemoveAll(filepath.Join(t.dir, name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rollbackCommand unstages the directories staged by the command, putting
+// back the directories it replaced, and restores the state files to their
+// content when it started.
+func (t *buildTransaction) rollbackCommand() error {
+	if t.Command == nil {
+		return nil
+	}
+	for len(t.Dirs) > 0 && t.Dirs[len(t.Dirs)-1].Command == t.Commands {
+		if err := unstageDir(t.Dirs[len(t.Dirs)-1]); err != nil {
+			return err
+		}
+		t.Dirs = t.Dirs[:len(t.Dirs)-1]
+		if err := t.save(); err != nil {
+			return err
+		}
+	}
+
+	if err := restoreFiles(filepath.Join(t.dir, "command"), t.Command.Files); err != nil {
+		return err
+	}
+	t.Command = nil
+	return t.save()
+}
+
+// rollback rolls back the running command, unstages the directories of the
+// versions of the transaction, restoring the ones they replaced, restores the
+// state files and removes the journal.
+func (t *buildTransaction) rollback() error {
+	if err := t.rollbackCommand(); err != nil {
+		return err
+	}
+	for i := len(t.Dirs) - 1; i >= 0; i-- {
+		if err := unstageDir(t.Dirs[i]); err != nil {
+			return err
+		}
+	}
+
+	if err := restoreFiles(filepath.Join(t.dir, "backup"), t.Files); err != nil {
+		return err
+	}
+	return os.RemoveAll(t.dir)
+}
+
+// abortTransaction rolls back the failed build command, returning the build
+// error. When the command started the transaction, the whole transaction is
+// rolled back.
+func (b *Builder) abortTransaction(t *buildTransaction, buildErr error) error {
+	log.Error(log.Mixer, "Build failed, rolling back version %s", b.MixVer)
+	var err error
+	if t.Commands == 1 {
+		err = t.rollback()
+	} else {
+		err = t.rollbackCommand()
+	}
+	if err != nil {
+		log.Error(log.Mixer, "Couldn't roll back the build: %s", err)
+	}
+	return buildErr
+}
+
+// Rollback removes the versions built by the current build transaction and
+// restores the state files to their content before the build. Committed and
+// published builds can't be rolled back, as clients may already use them.
+func (b *Builder) Rollback() error {
+	t, err := readTransaction(b.transactionDir())
+	if err != nil {
+		return err
+	}
+	if t == nil {
+		return errors.New("no build to roll back")
+	}
+	if t.Committing {
+		log.Warning(log.Mixer, "Completing the interrupted commit of the last build")
+		if err = t.finishCommit(); err != nil {
+			return err
+		}
+	}
+
+	var versions []string
+	for _, v := range t.Versions {
+		versions = append(versions, v.Version)
+	}
+	if t.Committed {
+		return errors.Errorf("the build of versions %v was committed, build a new version instead", versions)
+	}
+	for _, v := range versions {
+		published, err := b.versionPublished(v)
+		if err != nil {
+			return err
+		}
+		if published {
+			return errors.Errorf("version %s was published, build a new version instead", v)
+		}
+	}
+
+	log.Info(log.Mixer, "Rolling back versions %v built on %s", versions, t.Started.Format(time.RFC3339))
+	if err = t.rollback(); err != nil {
+		return err
+	}
+	log.Info(log.Mixer, "Rolled back, run mixer build to build again")
+	return nil
+}
@@ -0,0 +1,320 @@
+package builder
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func newTransactionTestBuilder(testDir string) *Builder {
+	var b Builder
+	b.MixVer = "20"
+	b.MixVerFile = "mixversion"
+	b.UpstreamVerFile = "upstreamversion"
+	b.State.Mix.Format = "1"
+	b.Config.Builder.VersionPath = testDir
+	b.Config.Builder.ServerStateDir = filepath.Join(testDir, "update")
+	return &b
+}
+
+func writeTestFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func checkTestFile(t *testing.T, path, expected string) {
+	t.Helper()
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Errorf("couldn't read %s: %s", path, err)
+		return
+	}
+	if string(content) != expected {
+		t.Errorf("got %q in %s, expected %q", content, path, expected)
+	}
+}
+
+// mustStageVersion stages the image and www directories of the mix version in
+// the transaction, as the build commands do.
+func mustStageVersion(t *testing.T, b *Builder, tr *buildTransaction, fresh bool) {
+	t.Helper()
+	for _, dir := range []string{"image", "www"} {
+		if err := tr.stageDir(filepath.Join(b.Config.Builder.ServerStateDir, dir, b.MixVer), fresh); err != nil {
+			t.Fatalf("couldn't stage %s/%s: %s", dir, b.MixVer, err)
+		}
+	}
+}
+
+func TestTransactionRollback(t *testing.T) {
+	testDir, err := ioutil.TempDir("", "transaction-test-")
+	if err != nil {
+		t.Fatalf("couldn't create temporary directory: %s", err)
+	}
+	defer cleanup(testDir)
+
+	b := newTransactionTestBuilder(testDir)
+	stateDir := b.Config.Builder.ServerStateDir
+	writeTestFile(t, filepath.Join(testDir, "mixversion"), "20")
+	writeTestFile(t, filepath.Join(stateDir, "image", "LAST_VER"), "10")
+	writeTestFile(t, filepath.Join(stateDir, "image", "10", "full", "file"), "")
+	writeTestFile(t, filepath.Join(stateDir, "www", "20", "Manifest.MoM"), "old")
+
+	tr, err := b.beginTransaction()
+	if err != nil {
+		t.Fatalf("couldn't begin transaction: %s", err)
+	}
+
+	// Simulate a build of version 20, followed by the bundles of version 30
+	// joining the same transaction.
+	mustStageVersion(t, b, tr, true)
+	writeTestFile(t, filepath.Join(stateDir, "image", "20", "full", "file"), "")
+	writeTestFile(t, filepath.Join(stateDir, "www", "20", "Manifest.MoM"), "new")
+	writeTestFile(t, filepath.Join(stateDir, "image", "LAST_VER"), "20")
+	writeTestFile(t, filepath.Join(testDir, "mixversion"), "30")
+	writeTestFile(t, filepath.Join(testDir, "mixer.state"), "new")
+	b.MixVer = "30"
+	if tr, err = b.beginTransaction(); err != nil {
+		t.Fatalf("couldn't join transaction: %s", err)
+	}
+	mustStageVersion(t, b, tr, true)
+	writeTestFile(t, filepath.Join(stateDir, "image", "30", "full", "file"), "")
+	if len(tr.Versions) != 2 {
+		t.Fatalf("got versions %+v, expected 20 and 30", tr.Versions)
+	}
+
+	// The versions are built in the transaction until it is committed.
+	for _, dir := range []string{"image/20", "www/20", "image/30"} {
+		if fi, err := os.Lstat(filepath.Join(stateDir, dir)); err != nil || fi.Mode()&os.ModeSymlink == 0 {
+			t.Errorf("%s should be a symlink to the transaction", dir)
+		}
+	}
+
+	if err = tr.rollback(); err != nil {
+		t.Fatalf("couldn't roll back: %s", err)
+	}
+
+	for _, dir := range []string{"image/20", "image/30", "www/30", ".transaction"} {
+		if _, err = os.Lstat(filepath.Join(stateDir, dir)); !os.IsNotExist(err) {
+			t.Errorf("%s should have been removed", dir)
+		}
+	}
+	if _, err = os.Stat(filepath.Join(stateDir, "image", "10")); err != nil {
+		t.Errorf("image/10 existed before the build and should have been kept")
+	}
+	checkTestFile(t, filepath.Join(stateDir, "www", "20", "Manifest.MoM"), "old")
+	checkTestFile(t, filepath.Join(testDir, "mixversion"), "20")
+	checkTestFile(t, filepath.Join(stateDir, "image", "LAST_VER"), "10")
+	if _, err = os.Stat(filepath.Join(testDir, "mixer.state")); !os.IsNotExist(err) {
+		t.Errorf("mixer.state didn't exist before the build and should have been removed")
+	}
+}
+
+func TestTransactionCommit(t *testing.T) {
+	testDir, err := ioutil.TempDir("", "transaction-test-")
+	if err != nil {
+		t.Fatalf("couldn't create temporary directory: %s", err)
+	}
+	defer cleanup(testDir)
+
+	b := newTransactionTestBuilder(testDir)
+	stateDir := b.Config.Builder.ServerStateDir
+	latest := filepath.Join(stateDir, "www", "version", "latest_version")
+	mom := filepath.Join(stateDir, "www", "20", "Manifest.MoM")
+	writeTestFile(t, latest, "10")
+
+	tr, err := b.beginTransaction()
+	if err != nil {
+		t.Fatalf("couldn't begin transaction: %s", err)
+	}
+	mustStageVersion(t, b, tr, true)
+	writeTestFile(t, mom, "20")
+	staging, err := tr.stagingDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeTestFile(t, filepath.Join(staging, "latest_version"), "20")
+	checkTestFile(t, latest, "10")
+	if err = tr.commit(map[string]string{filepath.Join(staging, "latest_version"): latest}); err != nil {
+		t.Fatalf("couldn't commit: %s", err)
+	}
+	checkTestFile(t, latest, "20")
+	if fi, err := os.Lstat(filepath.Join(stateDir, "www", "20")); err != nil || !fi.IsDir() {
+		t.Errorf("www/20 should have been moved into place")
+	}
+	checkTestFile(t, mom, "20")
+
+	// A committed build can't be rolled back.
+	if err = b.Rollback(); err == nil {
+		t.Errorf("expected error rolling back a committed build")
+	}
+	checkTestFile(t, mom, "20")
+
+	// Building a version again starts a new transaction, updating the
+	// existing directories.
+	if tr, err = b.beginTransaction(); err != nil {
+		t.Fatal(err)
+	}
+	if tr.Committed || tr.Commands != 1 || len(tr.Versions) != 1 {
+		t.Errorf("expected a new transaction for version 20, got %+v", tr)
+	}
+	mustStageVersion(t, b, tr, false)
+	checkTestFile(t, mom, "20")
+	if err = tr.commit(nil); err != nil {
+		t.Fatal(err)
+	}
+	checkTestFile(t, mom, "20")
+
+	// Building the next version starts a new transaction.
+	b.MixVer = "30"
+	if tr, err = b.beginTransaction(); err != nil {
+		t.Fatal(err)
+	}
+	if len(tr.Versions) != 1 || tr.Versions[0].Version != "30" {
+		t.Errorf("expected a new transaction for version 30, got %+v", tr.Versions)
+	}
+	mustStageVersion(t, b, tr, true)
+
+	if err = b.Rollback(); err != nil {
+		t.Fatalf("couldn't roll back: %s", err)
+	}
+	checkTestFile(t, latest, "20")
+	if _, err = os.Lstat(filepath.Join(stateDir, "www", "30")); !os.IsNotExist(err) {
+		t.Errorf("www/30 should have been removed")
+	}
+	if err = b.Rollback(); err == nil {
+		t.Errorf("expected error rolling back without a transaction")
+	}
+}
+
+func TestTransactionInterruptedCommit(t *testing.T) {
+	testDir, err := ioutil.TempDir("", "transaction-test-")
+	if err != nil {
+		t.Fatalf("couldn't create temporary directory: %s", err)
+	}
+	defer cleanup(testDir)
+
+	b := newTransactionTestBuilder(testDir)
+	stateDir := b.Config.Builder.ServerStateDir
+	latest := filepath.Join(stateDir, "www", "version", "latest_version")
+
+	tr, err := b.beginTransaction()
+	if err != nil {
+		t.Fatalf("couldn't begin transaction: %s", err)
+	}
+	mustStageVersion(t, b, tr, true)
+	writeTestFile(t, filepath.Join(stateDir, "www", "20", "Manifest.MoM"), "20")
+	staging, err := tr.stagingDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeTestFile(t, filepath.Join(staging, "latest_version"), "20")
+
+	// Simulate a crash after the commit started.
+	tr.Committing = true
+	tr.Staged = map[string]string{filepath.Join(staging, "latest_version"): latest}
+	if err = tr.save(); err != nil {
+		t.Fatal(err)
+	}
+
+	b.MixVer = "30"
+	if tr, err = b.beginTransaction(); err != nil {
+		t.Fatal(err)
+	}
+	if len(tr.Versions) != 1 || tr.Versions[0].Version != "30" {
+		t.Errorf("expected a new transaction for version 30, got %+v", tr.Versions)
+	}
+	checkTestFile(t, latest, "20")
+	if fi, err := os.Lstat(filepath.Join(stateDir, "www", "20")); err != nil || !fi.IsDir() {
+		t.Errorf("www/20 should have been moved into place")
+	}
+}
+
+func TestTransactionRollbackPublished(t *testing.T) {
+	testDir, err := ioutil.TempDir("", "transaction-test-")
+	if err != nil {
+		t.Fatalf("couldn't create temporary directory: %s", err)
+	}
+	defer cleanup(testDir)
+
+	b := newTransactionTestBuilder(testDir)
+	stateDir := b.Config.Builder.ServerStateDir
+
+	tr, err := b.beginTransaction()
+	if err != nil {
+		t.Fatalf("couldn't begin transaction: %s", err)
+	}
+	mustStageVersion(t, b, tr, true)
+	writeTestFile(t, filepath.Join(stateDir, "www", "20", "Manifest.MoM"), "20")
+	if err = b.recordPublished("20", filepath.Join(testDir, "mirror")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = b.Rollback(); err == nil {
+		t.Errorf("expected error rolling back a published version")
+	}
+	checkTestFile(t, filepath.Join(stateDir, "www", "20", "Manifest.MoM"), "20")
+}
+
+func TestTransactionCommandRollback(t *testing.T) {
+	testDir, err := ioutil.TempDir("", "transaction-test-")
+	if err != nil {
+		t.Fatalf("couldn't create temporary directory: %s", err)
+	}
+	defer cleanup(testDir)
+
+	b := newTransactionTestBuilder(testDir)
+	stateDir := b.Config.Builder.ServerStateDir
+	file := filepath.Join(stateDir, "image", "20", "full", "file")
+	writeTestFile(t, filepath.Join(stateDir, "image", "LAST_VER"), "10")
+	writeTestFile(t, file, "old")
+
+	// The bundles replace the existing image directory of the version.
+	tr, err := b.beginTransaction()
+	if err != nil {
+		t.Fatalf("couldn't begin transaction: %s", err)
+	}
+	mustStageVersion(t, b, tr, true)
+	writeTestFile(t, file, "new")
+	writeTestFile(t, b.checkpointPath("20"), "bundles")
+
+	// A failed update only rolls back what it changed.
+	if tr, err = b.beginTransaction(); err != nil {
+		t.Fatalf("couldn't join transaction: %s", err)
+	}
+	mustStageVersion(t, b, tr, false)
+	writeTestFile(t, filepath.Join(stateDir, "www", "20", "Manifest.MoM"), "")
+	writeTestFile(t, filepath.Join(stateDir, "image", "LAST_VER"), "20")
+	writeTestFile(t, b.checkpointPath("20"), "manifests")
+	_ = b.abortTransaction(tr, nil)
+	checkTestFile(t, b.checkpointPath("20"), "bundles")
+	checkTestFile(t, file, "new")
+	checkTestFile(t, filepath.Join(stateDir, "image", "LAST_VER"), "10")
+
+	// Bundles failing again put back the directory they replaced.
+	if tr, err = b.beginTransaction(); err != nil {
+		t.Fatal(err)
+	}
+	mustStageVersion(t, b, tr, true)
+	writeTestFile(t, file, "broken")
+	_ = b.abortTransaction(tr, nil)
+	checkTestFile(t, file, "new")
+
+	// Rolling back the transaction restores the directory replaced by its
+	// first command, which existed before it.
+	if err = b.Rollback(); err != nil {
+		t.Fatalf("couldn't roll back: %s", err)
+	}
+	checkTestFile(t, file, "old")
+	if fi, err := os.Lstat(filepath.Join(stateDir, "image", "20")); err != nil || !fi.IsDir() {
+		t.Errorf("image/20 should have been restored in place")
+	}
+	if _, err = os.Lstat(filepath.Join(stateDir, "www", "20")); !os.IsNotExist(err) {
+		t.Errorf("www/20 created by the transaction should have been removed")
+	}
+}
@@ -53,10 +53,124 @@ func (b *Builder) buildUpdateContent(params UpdateParameters, timer *stopWatch)
 		return err
 	}
 
+	checkpoint, err := b.readCheckpoint(b.MixVer)
+	if err != nil {
+		return err
+	}
+	inputs := b.updateInputs(checkpoint, params)
+
+	var mom *swupd.MoM
+	if b.resumePhase(checkpoint, phaseManifests, inputs) {
+		mom, err = b.readUpdateManifests()
+	} else {
+		mom, err = b.createUpdateManifests(params, timer, previous, minVersion, format)
+		if err == nil {
+			err = checkpoint.record(phaseManifests, inputs)
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	outputDir := filepath.Join(b.Config.Builder.ServerStateDir, "www")
+
+	if params.SkipFullfiles {
+		log.Info(log.Mixer, "=> CREATE FULLFILES - skipped")
+	} else if !b.resumePhase(checkpoint, phaseFullfiles, inputs) {
+		if err = b.runPhaseHooks(phaseFullfiles, false, timer, nil); err != nil {
+			return err
+		}
+		timer.Start("CREATE FULLFILES")
+		log.Info(log.Mixer, "Using %d workers", b.NumFullfileWorkers)
+		fullfilesDir := filepath.Join(outputDir, b.MixVer, "files")
+		fullChrootDir := filepath.Join(b.Config.Builder.ServerStateDir, "image", b.MixVer, "full")
+		var queue *swupd.JobQueue
+		if queue, err = b.jobQueue(); err != nil {
+			return err
+		}
+		var info *swupd.FullfilesInfo
+		info, err = swupd.CreateFullfilesWithQueue(mom.FullManifest, fullChrootDir, fullfilesDir, b.NumFullfileWorkers, b.Config.Swupd.Compression, queue)
+		if err != nil {
+			return err
+		}
+		// Print summary of fullfile generation.
+		{
+			total := info.Skipped + info.NotCompressed
+			log.Info(log.Mixer, "- Already created: %d", info.Skipped)
+			log.Info(log.Mixer, "- Not compressed:  %d", info.NotCompressed)
+			log.Info(log.Mixer, "- Compressed")
+			for k, v := range info.CompressedCounts {
+				total += v
+				log.Info(log.Mixer, "  - %-20s %d", k, v)
+			}
+			log.Info(log.Mixer, "Total fullfiles: %d", total)
+		}
+		timer.Stop()
+		if err = b.runPhaseHooks(phaseFullfiles, true, timer, nil); err != nil {
+			return err
+		}
+		if err = checkpoint.record(phaseFullfiles, inputs); err != nil {
+			return err
+		}
+	}
+
+	if params.SkipPacks {
+		log.Info(log.Mixer, "=> CREATE ZERO PACKS - skipped")
+	} else if !b.resumePhase(checkpoint, phaseZeroPacks, inputs) {
+		if err = b.runPhaseHooks(phaseZeroPacks, false, timer, nil); err != nil {
+			return err
+		}
+		if err = b.createZeroPack(timer, mom.Files, outputDir); err != nil {
+			return err
+		}
+		if err = b.runPhaseHooks(phaseZeroPacks, true, timer, nil); err != nil {
+			return err
+		}
+		if err = checkpoint.record(phaseZeroPacks, inputs); err != nil {
+			return err
+		}
+	}
+
+	timer.Start("CHECK SIZE BUDGETS")
+	if err = b.checkSizeBudgets(); err != nil {
+		return err
+	}
+	timer.Stop()
+
+	return nil
+}
+
+// createUpdateManifests checks the content of the mix version, then creates,
+// signs and compresses its manifests.
+func (b *Builder) createUpdateManifests(params UpdateParameters, timer *stopWatch, previous, minVersion, format uint32) (*swupd.MoM, error) {
+	var err error
+	if params.CheckLibraries {
+		timer.Start("CHECK LIBRARIES")
+		if err = b.checkLibraries(params.StrictChecks); err != nil {
+			return nil, err
+		}
+		timer.Stop()
+	}
+
+	if params.CheckLinks {
+		timer.Start("CHECK SYMLINKS")
+		if err = b.checkLinks(params.StrictChecks); err != nil {
+			return nil, err
+		}
+		timer.Stop()
+	}
+
+	if err = b.runPhaseHooks(phaseManifests, false, timer, nil); err != nil {
+		return nil, err
+	}
+
 	timer.Start("CREATE MANIFESTS")
 	mom, err := swupd.CreateManifests(b.MixVerUint32, previous, minVersion, uint(format), b.Config.Builder.ServerStateDir, b.NumBundleWorkers)
 	if err != nil {
-		return errors.Wrapf(err, "failed to create update metadata")
+		return nil, errors.Wrapf(err, "failed to create update metadata")
+	}
+	if err = b.runPhaseHooks(phaseManifests, true, timer, nil); err != nil {
+		return nil, err
 	}
 	log.Info(log.Mixer, "MoM version %d", mom.Header.Version)
 	for _, f := range mom.Files {
@@ -66,10 +180,16 @@ func (b *Builder) buildUpdateContent(params UpdateParameters, timer *stopWatch)
 	// sign the Manifest.MoM file in place based on the Mix
 	// version read from builder.conf.
 	if !params.SkipSigning {
+		if err = b.runPhaseHooks(phaseSign, false, timer, nil); err != nil {
+			return nil, err
+		}
 		log.Info(log.Mixer, "Signing manifest")
 		err = b.signFile(filepath.Join(b.Config.Builder.ServerStateDir, "www", b.MixVer, "Manifest.MoM"))
 		if err != nil {
-			return err
+			return nil, err
+		}
+		if err = b.runPhaseHooks(phaseSign, true, timer, nil); err != nil {
+			return nil, err
 		}
 	}
 
@@ -83,7 +203,7 @@ func (b *Builder) buildUpdateContent(params UpdateParameters, timer *stopWatch)
 		err = createCompressedArchive(momF+".tar", momF, momF+".sig")
 	}
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	var wg sync.WaitGroup
@@ -127,10 +247,10 @@ func (b *Builder) buildUpdateContent(params UpdateParameters, timer *stopWatch)
 	wg.Wait()
 
 	if err != nil {
-		return err
+		return nil, err
 	}
 	if len(errorChan) > 0 {
-		return <-errorChan
+		return nil, <-errorChan
 	}
 
 	// Now tar the full manifest, since it doesn't show up in the MoM
@@ -138,48 +258,27 @@ func (b *Builder) buildUpdateContent(params UpdateParameters, timer *stopWatch)
 	f := filepath.Join(thisVersionDir, "Manifest.full")
 	err = createCompressedArchive(f+".tar", f)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	// TODO: Create manifest tars for Manifest.MoM and the mom.UpdatedBundles.
 	timer.Stop()
 
-	if !params.SkipFullfiles {
-		timer.Start("CREATE FULLFILES")
-		log.Info(log.Mixer, "Using %d workers", b.NumFullfileWorkers)
-		fullfilesDir := filepath.Join(outputDir, b.MixVer, "files")
-		fullChrootDir := filepath.Join(b.Config.Builder.ServerStateDir, "image", b.MixVer, "full")
-		var info *swupd.FullfilesInfo
-		info, err = swupd.CreateFullfiles(mom.FullManifest, fullChrootDir, fullfilesDir, b.NumFullfileWorkers, b.Config.Swupd.Compression)
-		if err != nil {
-			return err
-		}
-		// Print summary of fullfile generation.
-		{
-			total := info.Skipped + info.NotCompressed
-			log.Info(log.Mixer, "- Already created: %d", info.Skipped)
-			log.Info(log.Mixer, "- Not compressed:  %d", info.NotCompressed)
-			log.Info(log.Mixer, "- Compressed")
-			for k, v := range info.CompressedCounts {
-				total += v
-				log.Info(log.Mixer, "  - %-20s %d", k, v)
-			}
-			log.Info(log.Mixer, "Total fullfiles: %d", total)
-		}
-		timer.Stop()
-	} else {
-		log.Info(log.Mixer, "=> CREATE FULLFILES - skipped")
-	}
+	return mom, nil
+}
 
-	if !params.SkipPacks {
-		if err = b.createZeroPack(timer, mom.Files, outputDir); err != nil {
-			return err
-		}
-	} else {
-		log.Info(log.Mixer, "=> CREATE ZERO PACKS - skipped")
+// readUpdateManifests reads the manifests created for the mix version.
+func (b *Builder) readUpdateManifests() (*swupd.MoM, error) {
+	versionDir := filepath.Join(b.Config.Builder.ServerStateDir, "www", b.MixVer)
+	m, err := swupd.ParseManifestFile(filepath.Join(versionDir, "Manifest.MoM"))
+	if err != nil {
+		return nil, err
 	}
-
-	return nil
+	mom := &swupd.MoM{Manifest: *m}
+	if mom.FullManifest, err = swupd.ParseManifestFile(filepath.Join(versionDir, "Manifest.full")); err != nil {
+		return nil, err
+	}
+	return mom, nil
 }
 
 func (b *Builder) createZeroPack(timer *stopWatch, bundles []*swupd.File, outputDir string) error {
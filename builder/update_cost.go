@@ -0,0 +1,283 @@
+package builder
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/clearlinux/mixer-tools/log"
+	"github.com/clearlinux/mixer-tools/swupd"
+	"github.com/olekukonko/tablewriter"
+	"github.com/pkg/errors"
+)
+
+// bundleUpdateCost holds the sizes, in bytes, a client downloads to update a
+// bundle between two versions of the mix.
+type bundleUpdateCost struct {
+	Name string
+	// FromVersion and ToVersion are the versions of the manifests of the
+	// bundle in the from and to versions of the mix.
+	FromVersion uint32
+	ToVersion   uint32
+	// Manifest is the size of the compressed manifest of the bundle.
+	Manifest uint64
+	// DeltaPack is the size of the delta pack of the bundle, if HasDeltaPack.
+	DeltaPack    uint64
+	HasDeltaPack bool
+	// Fullfiles is the size of the fullfiles of the content that changed,
+	// downloaded one by one when there is no delta pack.
+	Fullfiles uint64
+	// ZeroPack is the size of the zero pack of the bundle, the fallback of
+	// clients reinstalling the bundle.
+	ZeroPack uint64
+}
+
+// failed returns whether content of the bundle changed but no delta pack was
+// built for it.
+func (c *bundleUpdateCost) failed() bool {
+	return !c.HasDeltaPack && c.Fullfiles > 0
+}
+
+// expected returns the size a client downloads to update the bundle, using the
+// delta pack when there is one and the fullfiles otherwise.
+func (c *bundleUpdateCost) expected() uint64 {
+	if c.HasDeltaPack {
+		return c.Manifest + c.DeltaPack
+	}
+	return c.Manifest + c.Fullfiles
+}
+
+func (c *bundleUpdateCost) status() string {
+	switch {
+	case c.failed():
+		return "NO DELTA PACK"
+	case !c.HasDeltaPack:
+		return "no content change"
+	case c.Fullfiles > 0 && c.DeltaPack >= c.Fullfiles:
+		return "DELTA PACK NOT SMALLER"
+	}
+	return "delta pack"
+}
+
+// updateCost holds what a client with every bundle installed downloads to
+// update between two versions of the mix.
+type updateCost struct {
+	From uint32
+	To   uint32
+	// MoM is the size of the compressed MoM of the to version.
+	MoM     uint64
+	Bundles []*bundleUpdateCost
+}
+
+func (u *updateCost) totals() (expected, fullfiles, zeroPacks uint64, failed int) {
+	expected, fullfiles, zeroPacks = u.MoM, u.MoM, u.MoM
+	for _, c := range u.Bundles {
+		expected += c.expected()
+		fullfiles += c.Manifest + c.Fullfiles
+		zeroPacks += c.Manifest + c.ZeroPack
+		if c.failed() {
+			failed++
+		}
+	}
+	return expected, fullfiles, zeroPacks, failed
+}
+
+func fileSize(path string) (uint64, bool) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return 0, false
+	}
+	return uint64(fi.Size()), true
+}
+
+// readUpdateCost computes the cost of updating each bundle changed between two
+// versions from their manifests, packs and fullfiles. Bundles added or removed
+// in the to version are not accounted, since clients don't update them.
+func readUpdateCost(wwwDir string, fromMoM, toMoM *swupd.Manifest) (*updateCost, error) {
+	toVersion := fmt.Sprint(toMoM.Header.Version)
+	u := &updateCost{
+		From: fromMoM.Header.Version,
+		To:   toMoM.Header.Version,
+	}
+	u.MoM, _ = fileSize(filepath.Join(wwwDir, toVersion, "Manifest.MoM.tar"))
+
+	toBundles := make(map[string]*swupd.File)
+	for _, f := range toMoM.Files {
+		if f.Status != swupd.StatusDeleted {
+			toBundles[f.Name] = f
+		}
+	}
+
+	for _, from := range fromMoM.Files {
+		to, ok := toBundles[from.Name]
+		if !ok || from.Status == swupd.StatusDeleted || from.Version == to.Version {
+			continue
+		}
+		if to.Version < from.Version {
+			return nil, errors.Errorf("invalid bundle versions for bundle %s, check the MoMs", from.Name)
+		}
+
+		c := &bundleUpdateCost{
+			Name:        from.Name,
+			FromVersion: from.Version,
+			ToVersion:   to.Version,
+		}
+		dir := filepath.Join(wwwDir, fmt.Sprint(to.Version))
+		c.Manifest, _ = fileSize(filepath.Join(dir, "Manifest."+to.Name+".tar"))
+		c.DeltaPack, c.HasDeltaPack = fileSize(filepath.Join(dir, swupd.GetPackFilename(to.Name, from.Version)))
+		c.ZeroPack, _ = fileSize(filepath.Join(dir, swupd.GetPackFilename(to.Name, 0)))
+
+		fromM, err := swupd.ParseManifestFile(filepath.Join(wwwDir, fmt.Sprint(from.Version), "Manifest."+from.Name))
+		if err != nil {
+			return nil, err
+		}
+		toM, err := swupd.ParseManifestFile(filepath.Join(dir, "Manifest."+to.Name))
+		if err != nil {
+			return nil, err
+		}
+		have := make(map[swupd.Hashval]bool)
+		for _, f := range fromM.Files {
+			have[f.Hash] = true
+		}
+		for _, f := range toM.Files {
+			if f.Version <= from.Version || f.Status == swupd.StatusDeleted || f.Status == swupd.StatusGhosted || have[f.Hash] {
+				continue
+			}
+			have[f.Hash] = true
+			if size, ok := fileSize(filepath.Join(wwwDir, fmt.Sprint(f.Version), "files", f.Hash.String()+".tar")); ok {
+				c.Fullfiles += size
+			}
+		}
+		u.Bundles = append(u.Bundles, c)
+	}
+
+	sort.Slice(u.Bundles, func(i, j int) bool { return u.Bundles[i].Name < u.Bundles[j].Name })
+	return u, nil
+}
+
+// updateCostFromVersions returns the MoMs of the versions the update cost to
+// version to is reported from: version from, or up to prev previous versions
+// when from is zero. Like delta packs, previous versions in another format are
+// skipped.
+func updateCostFromVersions(wwwDir string, toMoM *swupd.Manifest, from, prev uint32) ([]*swupd.Manifest, error) {
+	if from != 0 {
+		if from >= toMoM.Header.Version {
+			return nil, errors.Errorf("the --from version must be smaller than the --to version")
+		}
+		m, err := swupd.ParseManifestFile(filepath.Join(wwwDir, fmt.Sprint(from), "Manifest.MoM"))
+		if err != nil {
+			return nil, errors.Wrapf(err, "couldn't find manifest of from version")
+		}
+		return []*swupd.Manifest{m}, nil
+	}
+
+	var moms []*swupd.Manifest
+	cur := toMoM.Header.Previous
+	for i := uint32(0); i < prev && cur != 0; i++ {
+		m, err := swupd.ParseManifestFile(filepath.Join(wwwDir, fmt.Sprint(cur), "Manifest.MoM"))
+		if err != nil {
+			log.Warning(log.Mixer, "Could not find manifest for previous version %d, skipping...", cur)
+			break
+		}
+		if m.Header.Format != toMoM.Header.Format {
+			log.Warning(log.Mixer, "Skipping previous version %d in format %d", cur, m.Header.Format)
+			break
+		}
+		moms = append(moms, m)
+		cur = m.Header.Previous
+	}
+	return moms, nil
+}
+
+// ReportUpdateCost prints, for each version clients update from, the size
+// each bundle downloads to reach version to through its delta pack, compared
+// with downloading its fullfiles or its zero pack, and highlights the bundles
+// with changed content but no delta pack. The versions updated from are
+// version from, or up to prev previous versions of to when from is zero. When
+// to is zero the current mix version is used, and when no bundles are passed
+// all bundles are reported.
+func (b *Builder) ReportUpdateCost(from, prev, to uint32, bundles []string) error {
+	if to == 0 {
+		to = b.MixVerUint32
+	} else if to > b.MixVerUint32 {
+		return errors.Errorf("--to version must be at most the latest mix version (%d)", b.MixVerUint32)
+	}
+
+	wwwDir := filepath.Join(b.Config.Builder.ServerStateDir, "www")
+	toMoM, err := swupd.ParseManifestFile(filepath.Join(wwwDir, fmt.Sprint(to), "Manifest.MoM"))
+	if err != nil {
+		return errors.Wrapf(err, "couldn't find manifest of target version")
+	}
+	moms, err := updateCostFromVersions(wwwDir, toMoM, from, prev)
+	if err != nil {
+		return err
+	}
+	if len(moms) == 0 {
+		fmt.Printf("No previous version to report the update cost to version %d from\n", to)
+		return nil
+	}
+
+	selected := make(map[string]bool)
+	for _, name := range bundles {
+		selected[name] = true
+	}
+
+	var costs []*updateCost
+	for _, fromMoM := range moms {
+		u, err := readUpdateCost(wwwDir, fromMoM, toMoM)
+		if err != nil {
+			return err
+		}
+		if len(selected) > 0 {
+			var filtered []*bundleUpdateCost
+			for _, c := range u.Bundles {
+				if selected[c.Name] {
+					filtered = append(filtered, c)
+				}
+			}
+			u.Bundles = filtered
+		}
+		costs = append(costs, u)
+
+		fmt.Printf("Update from %d to %d\n", u.From, u.To)
+		if len(u.Bundles) == 0 {
+			fmt.Printf("No bundle changed\n\n")
+			continue
+		}
+		table := tablewriter.NewWriter(os.Stdout)
+		table.SetAutoWrapText(false)
+		table.SetHeader([]string{"BUNDLE", "FROM", "MANIFEST", "DELTA PACK", "FULLFILES", "ZERO PACK", "STATUS"})
+		for _, c := range u.Bundles {
+			pack := "-"
+			if c.HasDeltaPack {
+				pack = formatSize(c.DeltaPack)
+			}
+			table.Append([]string{c.Name, fmt.Sprint(c.FromVersion), formatSize(c.Manifest), pack,
+				formatSize(c.Fullfiles), formatSize(c.ZeroPack), c.status()})
+			if c.failed() {
+				log.Warning(log.Mixer, "Bundle %s has no delta pack from %d to %d, clients download %s of fullfiles", c.Name, c.FromVersion, c.ToVersion, formatSize(c.Fullfiles))
+			}
+		}
+		table.Render()
+		fmt.Println()
+	}
+
+	fmt.Printf("Total download for a client with every reported bundle installed, including manifests\n")
+	table := tablewriter.NewWriter(os.Stdout)
+	table.SetAutoWrapText(false)
+	table.SetHeader([]string{"FROM", "BUNDLES", "EXPECTED", "FULLFILES ONLY", "ZERO PACKS ONLY", "NO DELTA PACK"})
+	failed := 0
+	for _, u := range costs {
+		expected, fullfiles, zeroPacks, count := u.totals()
+		failed += count
+		table.Append([]string{fmt.Sprint(u.From), fmt.Sprint(len(u.Bundles)), formatSize(expected),
+			formatSize(fullfiles), formatSize(zeroPacks), fmt.Sprint(count)})
+	}
+	table.Render()
+
+	if failed > 0 {
+		log.Warning(log.Mixer, "%d bundle updates have no delta pack, see 'mixer build delta-packs'", failed)
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+package builder
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/clearlinux/mixer-tools/swupd"
+)
+
+func TestReadUpdateCost(t *testing.T) {
+	testDir, err := ioutil.TempDir("", "updatecost-test-")
+	if err != nil {
+		t.Fatalf("couldn't create temporary directory: %s", err)
+	}
+	defer cleanup(testDir)
+
+	wwwDir := filepath.Join(testDir, "www")
+	hash := func(c string) string { return strings.Repeat(c, 64) }
+
+	mustWriteTestManifest(t, filepath.Join(wwwDir, "10", "Manifest.MoM"), 10, []string{"contentsize:\t0"},
+		"M...\t"+hash("1")+"\t10\tos-core",
+		"M...\t"+hash("2")+"\t10\tfoo",
+		"M...\t"+hash("3")+"\t10\tbar",
+		"M...\t"+hash("4")+"\t10\tgone",
+	)
+	mustWriteTestManifest(t, filepath.Join(wwwDir, "20", "Manifest.MoM"), 20, []string{"contentsize:\t0"},
+		"M...\t"+hash("1")+"\t10\tos-core",
+		"M...\t"+hash("5")+"\t20\tfoo",
+		"M...\t"+hash("6")+"\t20\tbar",
+		"M...\t"+hash("7")+"\t20\tnew",
+	)
+	mustWriteTestManifest(t, filepath.Join(wwwDir, "10", "Manifest.foo"), 10, []string{"contentsize:\t0"},
+		"F...\t"+hash("a")+"\t10\t/usr/bin/foo",
+	)
+	mustWriteTestManifest(t, filepath.Join(wwwDir, "20", "Manifest.foo"), 20, []string{"contentsize:\t0"},
+		"F...\t"+hash("a")+"\t10\t/usr/bin/foo",
+		"F...\t"+hash("b")+"\t20\t/usr/bin/foo-new",
+		"F...\t"+hash("a")+"\t20\t/usr/bin/foo-copy",
+		".d..\t"+hash("c")+"\t20\t/usr/bin/foo-gone",
+	)
+	mustWriteTestManifest(t, filepath.Join(wwwDir, "10", "Manifest.bar"), 10, []string{"contentsize:\t0"},
+		"F...\t"+hash("d")+"\t10\t/usr/bin/bar",
+	)
+	mustWriteTestManifest(t, filepath.Join(wwwDir, "20", "Manifest.bar"), 20, []string{"contentsize:\t0"},
+		"F...\t"+hash("e")+"\t20\t/usr/bin/bar",
+	)
+
+	files := map[string]int{
+		filepath.Join(wwwDir, "20", "Manifest.MoM.tar"):                  1,
+		filepath.Join(wwwDir, "20", "Manifest.foo.tar"):                  3,
+		filepath.Join(wwwDir, "20", "files", hash("b")+".tar"):           5,
+		filepath.Join(wwwDir, "20", "files", hash("e")+".tar"):           4,
+		filepath.Join(wwwDir, "20", swupd.GetPackFilename("foo", 10)):    2,
+		filepath.Join(wwwDir, "20", swupd.GetPackFilename("foo", 0)):     7,
+		filepath.Join(wwwDir, "20", swupd.GetPackFilename("bar", 0)):     6,
+		filepath.Join(wwwDir, "20", swupd.GetPackFilename("new", 0)):     9,
+		filepath.Join(wwwDir, "10", swupd.GetPackFilename("os-core", 0)): 8,
+	}
+	for path, size := range files {
+		if err = os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err = ioutil.WriteFile(path, make([]byte, size), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	toMoM, err := swupd.ParseManifestFile(filepath.Join(wwwDir, "20", "Manifest.MoM"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	moms, err := updateCostFromVersions(wwwDir, toMoM, 10, 0)
+	if err != nil || len(moms) != 1 {
+		t.Fatalf("couldn't read the from version: %v", err)
+	}
+	if _, err = updateCostFromVersions(wwwDir, toMoM, 20, 0); err == nil {
+		t.Errorf("unexpected success reporting the update from the target version")
+	}
+
+	u, err := readUpdateCost(wwwDir, moms[0], toMoM)
+	if err != nil {
+		t.Fatalf("unexpected error reading the update cost: %s", err)
+	}
+	expected := []*bundleUpdateCost{
+		{Name: "bar", FromVersion: 10, ToVersion: 20, Fullfiles: 4, ZeroPack: 6},
+		{Name: "foo", FromVersion: 10, ToVersion: 20, Manifest: 3, DeltaPack: 2, HasDeltaPack: true, Fullfiles: 5, ZeroPack: 7},
+	}
+	if u.From != 10 || u.To != 20 || u.MoM != 1 || !reflect.DeepEqual(u.Bundles, expected) {
+		t.Fatalf("got update cost %+v with bundles %+v", u, u.Bundles)
+	}
+	if u.Bundles[0].status() != "NO DELTA PACK" || u.Bundles[1].status() != "delta pack" {
+		t.Errorf("got statuses %q and %q", u.Bundles[0].status(), u.Bundles[1].status())
+	}
+
+	expectedTotal, fullfiles, zeroPacks, failed := u.totals()
+	if expectedTotal != 1+4+5 || fullfiles != 1+4+8 || zeroPacks != 1+6+10 || failed != 1 {
+		t.Errorf("got totals %d, %d, %d and %d failed", expectedTotal, fullfiles, zeroPacks, failed)
+	}
+}
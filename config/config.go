@@ -35,6 +35,7 @@ type MixConfig struct {
 	Swupd   swupdConf
 	Server  serverConf
 	Mixer   mixerConf
+	Hooks   hooksConf
 
 	/* hidden properties */
 	filename string
@@ -65,6 +66,7 @@ type serverConf struct {
 	DebugInfoBanned string `required:"false" toml:"DEBUG_INFO_BANNED"`
 	DebugInfoLib    string `required:"false" toml:"DEBUG_INFO_LIB"`
 	DebugInfoSrc    string `required:"false" toml:"DEBUG_INFO_SRC"`
+	DeltaCacheDir   string `required:"false" mount:"true" toml:"DELTA_CACHE_DIR"`
 }
 
 type mixerConf struct {
@@ -73,6 +75,27 @@ type mixerConf struct {
 	LocalRPMDir    string `required:"false" mount:"true" toml:"LOCAL_RPM_DIR"`
 	OSReleasePath  string `required:"false" mount:"true" toml:"OS_RELEASE_PATH"`
 	LogFilePath    string `required:"false" mount:"true" toml:"LOG"`
+	PolicyFile     string `required:"false" mount:"true" toml:"POLICY_FILE"`
+	McaWaiverFile  string `required:"false" mount:"true" toml:"MCA_WAIVER_FILE"`
+
+	PostInstallHooks []string `required:"false" toml:"POST_INSTALL_HOOKS"`
+	Channels         []string `required:"false" toml:"CHANNELS"`
+}
+
+// hooksConf lists the executables run before and after each build phase.
+type hooksConf struct {
+	PreBundles     []string `required:"false" toml:"PRE_BUNDLES"`
+	PostBundles    []string `required:"false" toml:"POST_BUNDLES"`
+	PreManifests   []string `required:"false" toml:"PRE_MANIFESTS"`
+	PostManifests  []string `required:"false" toml:"POST_MANIFESTS"`
+	PreSign        []string `required:"false" toml:"PRE_SIGN"`
+	PostSign       []string `required:"false" toml:"POST_SIGN"`
+	PreFullfiles   []string `required:"false" toml:"PRE_FULLFILES"`
+	PostFullfiles  []string `required:"false" toml:"POST_FULLFILES"`
+	PreZeroPacks   []string `required:"false" toml:"PRE_ZERO_PACKS"`
+	PostZeroPacks  []string `required:"false" toml:"POST_ZERO_PACKS"`
+	PreDeltaPacks  []string `required:"false" toml:"PRE_DELTA_PACKS"`
+	PostDeltaPacks []string `required:"false" toml:"POST_DELTA_PACKS"`
 }
 
 // LoadDefaults sets sane values for the config properties
@@ -52,10 +52,22 @@ type buildCmdFlags struct {
 	toRepoURLs      *map[string]string
 	fromRepoURLs    *map[string]string
 	skipFormatCheck bool
+	debuginfod      bool
+	checkLibraries  bool
+	checkLinks      bool
+	strictChecks    bool
+	plan            bool
+	resume          bool
+	reportFormat    string
+	output          string
+	waivers         string
+	snapshot        bool
 
 	numFullfileWorkers int
 	numDeltaWorkers    int
 	numBundleWorkers   int
+	deltaMemory        string
+	jobQueue           string
 }
 
 var buildFlags buildCmdFlags
@@ -76,6 +88,14 @@ func setWorkers(b *builder.Builder) {
 		workers = runtime.NumCPU()
 	}
 	b.NumBundleWorkers = workers
+	if buildFlags.deltaMemory != "" {
+		memory, err := builder.ParseSize(buildFlags.deltaMemory)
+		if err != nil {
+			fail(errors.Wrap(err, "invalid --delta-memory"))
+		}
+		b.DeltaMemory = memory
+	}
+	b.JobQueueDir = buildFlags.jobQueue
 }
 
 // buildCmd represents the base build command when called without any subcommands
@@ -148,6 +168,13 @@ var buildBundlesCmd = &cobra.Command{
 			fail(err)
 		}
 		setWorkers(b)
+		b.Resume = buildFlags.resume
+		if buildFlags.plan {
+			if err = b.PlanBundles(); err != nil {
+				fail(err)
+			}
+			return
+		}
 		err = buildBundles(b, buildFlags.noSigning, buildFlags.downloadRetries)
 		if err != nil {
 			fail(err)
@@ -272,6 +299,62 @@ var buildFormatBumpCmd = &cobra.Command{
 	},
 }
 
+var buildFormatPlanCmd = &cobra.Command{
+	Use:   "plan",
+	Short: "Show the builds needed to cross the upstream format boundaries",
+	Long: `Show the format bumps needed to build the upstream version of the mix on top
+of the last build: the +10 and +20 versions of each bump, their formats and
+the upstream versions they are based on. When a format bump is in progress,
+its plan is shown with the builds already completed.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		b, err := builder.NewFromConfig(configFile)
+		if err != nil {
+			fail(err)
+		}
+
+		plan, err := b.PlanFormatBump(buildFlags.newFormat)
+		if err != nil {
+			fail(err)
+		}
+		plan.Print()
+	},
+}
+
+var buildFormatRunCmd = &cobra.Command{
+	Use:   "run",
+	Short: "Run the builds needed to cross the upstream format boundaries",
+	Long: `Run the format bump builds shown by "mixer build format-bump plan". The builds
+completed are recorded, so running it again after a failure resumes from the
+failed build. Once done, the mix is set to build its upstream version.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := checkRoot(); err != nil {
+			fail(err)
+		}
+
+		b, err := builder.NewFromConfig(configFile)
+		if err != nil {
+			fail(err)
+		}
+
+		plan, err := b.PlanFormatBump(buildFlags.newFormat)
+		if err != nil {
+			fail(err)
+		}
+		plan.Print()
+
+		err = b.RunFormatBump(plan, func(stage string, step *builder.FormatBumpStep) error {
+			cmdToRun := []string{"mixer", "build", "format-bump", stage, "--new-format", step.Format, "--retries", strconv.Itoa(buildFlags.downloadRetries)}
+			if configFile != "" {
+				cmdToRun = append(cmdToRun, "--config", configFile)
+			}
+			return helpers.RunCommand(log.Mixer, cmdToRun[0], cmdToRun[1:]...)
+		})
+		if err != nil {
+			fail(err)
+		}
+	},
+}
+
 // This is the last build in the original format. At this point add ONLY the
 // content relevant to the format bump to the mash to be used. Relevant content
 // should be the only change.
@@ -362,11 +445,14 @@ var buildFormatOldCmd = &cobra.Command{
 
 		// Build the update content for the +10 build
 		params := builder.UpdateParameters{
-			MinVersion:    buildFlags.minVersion,
-			Format:        b.State.Mix.Format,
-			SkipSigning:   buildFlags.noSigning,
-			SkipFullfiles: buildFlags.skipFullfiles,
-			SkipPacks:     buildFlags.skipPacks,
+			MinVersion:     buildFlags.minVersion,
+			Format:         b.State.Mix.Format,
+			SkipSigning:    buildFlags.noSigning,
+			SkipFullfiles:  buildFlags.skipFullfiles,
+			SkipPacks:      buildFlags.skipPacks,
+			CheckLibraries: buildFlags.checkLibraries,
+			CheckLinks:     buildFlags.checkLinks,
+			StrictChecks:   buildFlags.strictChecks,
 		}
 		if err = b.BuildUpdate(params); err != nil {
 			failf("Couldn't build update: %s", err)
@@ -439,11 +525,14 @@ var buildFormatNewCmd = &cobra.Command{
 
 		// Build the +20 update so we don't have to switch tooling in between
 		params := builder.UpdateParameters{
-			MinVersion:    minver,
-			Format:        buildFlags.newFormat,
-			SkipSigning:   buildFlags.noSigning,
-			SkipFullfiles: buildFlags.skipFullfiles,
-			SkipPacks:     buildFlags.skipPacks,
+			MinVersion:     minver,
+			Format:         buildFlags.newFormat,
+			SkipSigning:    buildFlags.noSigning,
+			SkipFullfiles:  buildFlags.skipFullfiles,
+			SkipPacks:      buildFlags.skipPacks,
+			CheckLibraries: buildFlags.checkLibraries,
+			CheckLinks:     buildFlags.checkLinks,
+			StrictChecks:   buildFlags.strictChecks,
 		}
 		err = b.BuildUpdate(params)
 		if err != nil {
@@ -477,18 +566,28 @@ var buildUpdateCmd = &cobra.Command{
 			fail(err)
 		}
 		setWorkers(b)
+		b.Resume = buildFlags.resume
 		params := builder.UpdateParameters{
-			MinVersion:    buildFlags.minVersion,
-			Format:        buildFlags.format,
-			SkipSigning:   buildFlags.noSigning,
-			SkipFullfiles: buildFlags.skipFullfiles,
-			SkipPacks:     buildFlags.skipPacks,
+			MinVersion:     buildFlags.minVersion,
+			Format:         buildFlags.format,
+			SkipSigning:    buildFlags.noSigning,
+			SkipFullfiles:  buildFlags.skipFullfiles,
+			SkipPacks:      buildFlags.skipPacks,
+			CheckLibraries: buildFlags.checkLibraries,
+			CheckLinks:     buildFlags.checkLinks,
+			StrictChecks:   buildFlags.strictChecks,
 		}
 		err = b.BuildUpdate(params)
 		if err != nil {
 			failf("Couldn't build update: %s", err)
 		}
 
+		if buildFlags.debuginfod {
+			if err = b.BuildDebuginfod(b.MixVerUint32); err != nil {
+				failf("Couldn't build debuginfod tree: %s", err)
+			}
+		}
+
 		if buildFlags.increment {
 			if err = b.UpdatePreviousMixVersion(b.MixVer); err != nil {
 				fail(err)
@@ -507,7 +606,18 @@ var buildUpdateCmd = &cobra.Command{
 var buildAllCmd = &cobra.Command{
 	Use:   "all",
 	Short: "Build all content for mix with default options",
-	Long:  `Build all content for mix with default options`,
+	Long: `Build all content for mix with default options
+
+The phases completed for the mix version are recorded with a digest of
+their inputs in its checkpoint file in the state directory. If the build
+fails or is interrupted, run
+
+    mixer build all --resume
+
+to skip the phases completed with the same inputs and continue from the
+first phase that was not. Fullfiles and zero packs already created are
+reused.
+`,
 	Run: func(cmd *cobra.Command, args []string) {
 		if err := checkRoot(); err != nil {
 			fail(err)
@@ -518,6 +628,7 @@ var buildAllCmd = &cobra.Command{
 			fail(err)
 		}
 		setWorkers(b)
+		b.Resume = buildFlags.resume
 		rpms, err := helpers.ListVisibleFiles(b.Config.Mixer.LocalRPMDir)
 		if err == nil {
 			err = b.AddRPMList(rpms)
@@ -530,17 +641,26 @@ var buildAllCmd = &cobra.Command{
 			failf("Couldn't build bundles: %s", err)
 		}
 		params := builder.UpdateParameters{
-			MinVersion:    buildFlags.minVersion,
-			Format:        buildFlags.format,
-			SkipSigning:   buildFlags.noSigning,
-			SkipFullfiles: buildFlags.skipFullfiles,
-			SkipPacks:     buildFlags.skipPacks,
+			MinVersion:     buildFlags.minVersion,
+			Format:         buildFlags.format,
+			SkipSigning:    buildFlags.noSigning,
+			SkipFullfiles:  buildFlags.skipFullfiles,
+			SkipPacks:      buildFlags.skipPacks,
+			CheckLibraries: buildFlags.checkLibraries,
+			CheckLinks:     buildFlags.checkLinks,
+			StrictChecks:   buildFlags.strictChecks,
 		}
 		err = b.BuildUpdate(params)
 		if err != nil {
 			failf("Couldn't build update: %s", err)
 		}
 
+		if buildFlags.debuginfod {
+			if err = b.BuildDebuginfod(b.MixVerUint32); err != nil {
+				failf("Couldn't build debuginfod tree: %s", err)
+			}
+		}
+
 		if buildFlags.increment {
 			if err = b.UpdatePreviousMixVersion(b.MixVer); err != nil {
 				fail(err)
@@ -583,7 +703,13 @@ var buildValidateCmd = &cobra.Command{
 			tableWidth = -1
 		}
 
-		err = b.CheckManifestCorrectness(buildFlags.from, buildFlags.to, buildFlags.downloadRetries, tableWidth, *buildFlags.fromRepoURLs, *buildFlags.toRepoURLs)
+		opts := builder.McaOptions{
+			Format:     buildFlags.reportFormat,
+			Output:     buildFlags.output,
+			WaiverFile: buildFlags.waivers,
+			Snapshot:   buildFlags.snapshot,
+		}
+		err = b.CheckManifestCorrectness(buildFlags.from, buildFlags.to, buildFlags.downloadRetries, tableWidth, *buildFlags.fromRepoURLs, *buildFlags.toRepoURLs, opts)
 		if err != nil {
 			fail(err)
 		}
@@ -611,6 +737,83 @@ var buildImageCmd = &cobra.Command{
 	},
 }
 
+var buildRollbackCmd = &cobra.Command{
+	Use:   "rollback",
+	Short: "Remove the last built version and restore the state files",
+	Long: `Remove the last built version and restore the state files
+
+Builds are transactional: the image and www directories of the versions
+being built are staged in a journal under the state directory, along with
+the state files they change, and only moved into place once the update
+content is complete. When building the bundles or the update fails, the
+directories staged by the failed command are removed, the ones it replaced
+put back and the state files restored automatically.
+
+Until the update is complete, the versions being built can be removed with
+
+    mixer build rollback
+
+which also restores the mix version, upstream version, mixer.state and
+latest version files to their content before the build. Committed builds
+and published versions can't be rolled back.
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := checkRoot(); err != nil {
+			fail(err)
+		}
+
+		b, err := builder.NewFromConfig(configFile)
+		if err != nil {
+			fail(err)
+		}
+		if err = b.Rollback(); err != nil {
+			failf("Couldn't roll back the build: %s", err)
+		}
+	},
+}
+
+var buildDebuginfodCmd = &cobra.Command{
+	Use:   "debuginfod",
+	Short: "Publish the build IDs of a version in a debuginfod tree",
+	Long: `Publish the build IDs of a version in a debuginfod tree
+
+Scans the ELF files published in a version for GNU build IDs and
+publishes each of them in a debuginfod compatible tree next to the
+update content:
+
+    debuginfod/buildid/<id>/executable
+    debuginfod/buildid/<id>/debuginfo
+    debuginfod/buildid/<id>/source/<path>
+
+The debuginfo and sources are taken from the full chroot when the
+mix contains them. The file debuginfod/buildid-index.json maps each
+build ID to the version, path, swupd hash, bundles and source rpm of
+the published files carrying it.
+
+By default the current mix version is used, use --version to index
+a different version.
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		b, err := builder.NewFromConfig(configFile)
+		if err != nil {
+			fail(err)
+		}
+		setWorkers(b)
+
+		version := b.MixVerUint32
+		if buildDebuginfodFlags.version != 0 {
+			version = buildDebuginfodFlags.version
+		}
+		if err = b.BuildDebuginfod(version); err != nil {
+			fail(err)
+		}
+	},
+}
+
+var buildDebuginfodFlags struct {
+	version uint32
+}
+
 var buildDeltaPacksCmd = &cobra.Command{
 	Use:   "delta-packs",
 	Short: "Build packs used to optimize update between versions",
@@ -673,6 +876,7 @@ var buildDeltaPacksFlags struct {
 	from             uint32
 	to               uint32
 	report           bool
+	resume           bool
 }
 
 var buildDeltaManifestsFlags struct {
@@ -697,6 +901,7 @@ func runBuildDeltaPacks(cmd *cobra.Command, _ []string) error {
 		fail(err)
 	}
 	setWorkers(b)
+	b.Resume = buildDeltaPacksFlags.resume
 	if fromChanged {
 		err = b.BuildDeltaPacks(buildDeltaPacksFlags.from, buildDeltaPacksFlags.to, buildDeltaPacksFlags.report)
 	} else {
@@ -742,6 +947,9 @@ func setUpdateFlags(cmd *cobra.Command) {
 	cmd.Flags().BoolVar(&buildFlags.noSigning, "no-signing", false, "Do not generate a certificate and do not sign the Manifest.MoM")
 	cmd.Flags().BoolVar(&buildFlags.skipFullfiles, "skip-fullfiles", false, "Do not generate fullfiles")
 	cmd.Flags().BoolVar(&buildFlags.skipPacks, "skip-packs", false, "Do not generate zero packs")
+	cmd.Flags().BoolVar(&buildFlags.checkLibraries, "check-libs", false, "Report shared libraries needed by a bundle that are not in the bundle or its includes")
+	cmd.Flags().BoolVar(&buildFlags.checkLinks, "check-links", false, "Report dangling symlinks and symlinks to content outside a bundle and its includes")
+	cmd.Flags().BoolVar(&buildFlags.strictChecks, "strict-checks", false, "Fail the build when a content check finds problems")
 
 	var unusedStringFlag string
 	cmd.Flags().StringVar(&unusedStringFlag, "prefix", "", "Supply prefix for where the swupd binaries live")
@@ -760,14 +968,18 @@ var buildCmds = []*cobra.Command{
 	buildValidateCmd,
 	buildDeltaPacksCmd,
 	buildDeltaManifestsCmd,
+	buildDebuginfodCmd,
 	buildFormatBumpCmd,
 	buildUpstreamFormatCmd,
 	buildImageCmd,
+	buildRollbackCmd,
 }
 
 var bumpCmds = []*cobra.Command{
 	buildFormatNewCmd,
 	buildFormatOldCmd,
+	buildFormatPlanCmd,
+	buildFormatRunCmd,
 }
 
 func init() {
@@ -782,14 +994,19 @@ func init() {
 
 	addMarker(buildUpstreamFormatCmd, skipBumpCheck)
 	addMarker(buildValidateCmd, skipBumpCheck)
+	addMarker(buildRollbackCmd, skipBumpCheck)
 
 	buildFormatBumpCmd.Flags().StringVar(&buildFlags.newFormat, "new-format", "", "Supply the next format version to build mixes in")
 	buildFormatOldCmd.Flags().StringVar(&buildFlags.newFormat, "new-format", "", "Supply the next format version to build mixes in")
 	buildFormatNewCmd.Flags().StringVar(&buildFlags.newFormat, "new-format", "", "Supply the next format version to build mixes in")
+	buildFormatPlanCmd.Flags().StringVar(&buildFlags.newFormat, "new-format", "", "Supply the format of the first format bump, defaults to the next format")
+	buildFormatRunCmd.Flags().StringVar(&buildFlags.newFormat, "new-format", "", "Supply the format of the first format bump, defaults to the next format")
 	buildUpstreamFormatCmd.Flags().StringVar(&buildFlags.newFormat, "new-format", "", "Supply the next format version to build mixes in")
 
 	buildCmd.PersistentFlags().IntVar(&buildFlags.numFullfileWorkers, "fullfile-workers", 0, "Number of parallel workers when creating fullfiles, 0 means number of CPUs")
 	buildCmd.PersistentFlags().IntVar(&buildFlags.numDeltaWorkers, "delta-workers", 0, "Number of parallel workers when creating deltas, 0 means number of CPUs")
+	buildCmd.PersistentFlags().StringVar(&buildFlags.deltaMemory, "delta-memory", "", "Memory budget of the parallel workers creating deltas, e.g. 16G, empty means no limit")
+	buildCmd.PersistentFlags().StringVar(&buildFlags.jobQueue, "job-queue", "", "Directory of a job queue handing fullfile and delta jobs to 'mixer worker' processes")
 	buildCmd.PersistentFlags().IntVar(&buildFlags.numBundleWorkers, "bundle-workers", 0, "Number of parallel workers when building bundles, 0 means number of CPUs")
 	buildCmd.PersistentFlags().IntVar(&buildFlags.downloadRetries, "retries", retriesDefault, "Number of retry attempts to download RPMs")
 	buildCmd.PersistentFlags().BoolVar(&buildFlags.skipFormatCheck, "skip-format-check", false, "Skip format bump check")
@@ -806,6 +1023,7 @@ func init() {
 	_ = buildBundlesCmd.Flags().MarkHidden("clean")
 	_ = buildBundlesCmd.Flags().MarkDeprecated("clean", "The workspace is always cleaned when building bundles, this flag is no longer used")
 	buildBundlesCmd.Flags().BoolVar(&buildFlags.noSigning, "no-signing", false, "Do not generate a certificate to sign the Manifest.MoM")
+	buildBundlesCmd.Flags().BoolVar(&buildFlags.plan, "plan", false, "Only resolve packages and print the changes of each bundle relative to the previous version")
 
 	buildBundlesCmd.Flags().BoolVar(&unusedBoolFlag, "new-chroots", false, "")
 	_ = buildBundlesCmd.Flags().MarkHidden("new-chroots")
@@ -814,6 +1032,10 @@ func init() {
 	buildValidateCmd.Flags().IntVar(&buildFlags.to, "to", 0, "Compare manifests targeting a specific version")
 	buildValidateCmd.Flags().IntVar(&buildFlags.from, "from", 0, "Compare manifests from a specific version")
 	buildValidateCmd.Flags().IntVar(&buildFlags.tableWidth, "table-width", 0, "Max width of package statistics table, defaults to terminal width and disabled by negative numbers")
+	buildValidateCmd.Flags().StringVar(&buildFlags.reportFormat, "report-format", builder.McaFormatText, "Format of the findings report: text, json or junit")
+	buildValidateCmd.Flags().StringVar(&buildFlags.output, "output", "", "Write the json or junit report to a file instead of stdout")
+	buildValidateCmd.Flags().StringVar(&buildFlags.waivers, "waivers", "", "TOML file declaring expected discrepancies, overrides MCA_WAIVER_FILE")
+	buildValidateCmd.Flags().BoolVar(&buildFlags.snapshot, "snapshot", false, "Validate from the package snapshots recorded at build time instead of downloading packages")
 	buildFlags.toRepoURLs = buildValidateCmd.Flags().StringToString("to-repo-url", nil, "Overrides the baseurl value for the provided repo in the DNF config file for the `to` version: <repo>=<URL>")
 	buildFlags.fromRepoURLs = buildValidateCmd.Flags().StringToString("from-repo-url", nil, "Overrides the baseurl value for the provided repo in the DNF config file for the `from` version: <repo>=<URL>")
 
@@ -824,16 +1046,25 @@ func init() {
 	buildDeltaPacksCmd.Flags().Uint32Var(&buildDeltaPacksFlags.previousVersions, "previous-versions", 0, "Generate packs for multiple previous versions")
 	buildDeltaPacksCmd.Flags().Uint32Var(&buildDeltaPacksFlags.to, "to", 0, "Generate packs targeting a specific version")
 	buildDeltaPacksCmd.Flags().BoolVar(&buildDeltaPacksFlags.report, "report", false, "Report reason each file in to manifest was packed or not")
+	buildDeltaPacksCmd.Flags().BoolVar(&buildDeltaPacksFlags.resume, "resume", false, "Skip the delta packs already completed from the same versions")
 
 	buildDeltaManifestsCmd.Flags().Uint32Var(&buildDeltaManifestsFlags.from, "from", 0, "Generate delta manifests from a specific version")
 	buildDeltaManifestsCmd.Flags().Uint32Var(&buildDeltaManifestsFlags.previousVersions, "previous-versions", 0, "Generate delta manifests for multiple previous versions")
 	buildDeltaManifestsCmd.Flags().Uint32Var(&buildDeltaManifestsFlags.to, "to", 0, "Generate delta manifests targeting a specific version")
 
+	buildDebuginfodCmd.Flags().Uint32Var(&buildDebuginfodFlags.version, "version", 0, "Publish build IDs of a specific version")
+
 	setUpdateFlags(buildUpdateCmd)
 	setUpdateFlags(buildAllCmd)
 	setUpdateFlags(buildFormatNewCmd)
 	setUpdateFlags(buildFormatOldCmd)
 
+	buildUpdateCmd.Flags().BoolVar(&buildFlags.debuginfod, "debuginfod", false, "Publish the build IDs of the new version in the debuginfod tree")
+	buildBundlesCmd.Flags().BoolVar(&buildFlags.resume, "resume", false, "Skip building the bundles if already completed with the same inputs")
+	buildUpdateCmd.Flags().BoolVar(&buildFlags.resume, "resume", false, "Skip the build phases already completed with the same inputs")
+	buildAllCmd.Flags().BoolVar(&buildFlags.resume, "resume", false, "Skip the build phases already completed with the same inputs")
+	buildAllCmd.Flags().BoolVar(&buildFlags.debuginfod, "debuginfod", false, "Publish the build IDs of the new version in the debuginfod tree")
+
 	externalDeps[buildBundlesCmd] = []string{
 		"rpm",
 		"dnf",
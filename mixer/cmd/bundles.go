@@ -243,6 +243,132 @@ Passing '--all-local' will run validation on all bundles in local-bundles.`,
 	},
 }
 
+// Bundle size command ('mixer bundle size')
+type bundleSizeCmdFlags struct {
+	version uint32
+}
+
+var bundleSizeFlags bundleSizeCmdFlags
+
+var bundleSizeCmd = &cobra.Command{
+	Use:   "size [<bundle>...]",
+	Short: "Report the size of bundles",
+	Long: `Reports the size of the bundles published in a version, including their
+recursive includes: the installed size, the size of the fullfiles downloaded to
+install the bundle and the size of its zero packs, together with the growth
+from the previous version. When no bundles are passed all the bundles in the
+version are reported.
+
+Bundles can declare size budgets in their header, for example:
+
+  # [BUDGET]: installed=500M, download=200M, zeropack=150M
+
+The budget of each bundle is shown in the report, and 'mixer build update'
+fails when a bundle exceeds its budget.
+
+Passing '--version' reports a version other than the current mix version.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		b, err := builder.NewFromConfig(configFile)
+		if err != nil {
+			fail(err)
+		}
+
+		version := bundleSizeFlags.version
+		if version == 0 {
+			version = b.MixVerUint32
+		}
+		err = b.ReportBundleSizes(version, args)
+		if err != nil {
+			fail(err)
+		}
+	},
+}
+
+// Bundle update cost command ('mixer bundle update-cost')
+type bundleUpdateCostCmdFlags struct {
+	previousVersions uint32
+	from             uint32
+	to               uint32
+}
+
+var bundleUpdateCostFlags bundleUpdateCostCmdFlags
+
+var bundleUpdateCostCmd = &cobra.Command{
+	Use:   "update-cost [<bundle>...]",
+	Short: "Report the download size of updates between versions",
+	Long: `Reports, for each version clients update from, the size each changed bundle
+downloads to reach the target version. The expected download uses the delta
+pack of the bundle, and is compared with downloading the fullfiles of the
+changed content one by one, the fallback when the delta pack is missing, and
+with the zero pack of the bundle. Bundles with changed content but no delta
+pack, usually because its creation failed, are highlighted. When no bundles
+are passed all the bundles in the version are reported.
+
+To report the update from VER to the current mix version use
+
+    mixer bundle update-cost --from VER
+
+Alternatively, to report the update from a set of NUM previous versions,
+the versions 'mixer build delta-packs --previous-versions NUM' builds packs
+from, instead of --from use
+
+    mixer bundle update-cost --previous-versions NUM
+
+To change the target version (by default the current version), use the
+flag --to.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		fromChanged := cmd.Flags().Changed("from")
+		prevChanged := cmd.Flags().Changed("previous-versions")
+		if fromChanged == prevChanged {
+			return errors.Errorf("either --from or --previous-versions must be set, but not both")
+		}
+
+		b, err := builder.NewFromConfig(configFile)
+		if err != nil {
+			fail(err)
+		}
+		f := bundleUpdateCostFlags
+		err = b.ReportUpdateCost(f.from, f.previousVersions, f.to, args)
+		if err != nil {
+			fail(err)
+		}
+		return nil
+	},
+}
+
+// Bundle which command ('mixer bundle which')
+type bundleWhichCmdFlags struct {
+	version string
+}
+
+var bundleWhichFlags bundleWhichCmdFlags
+
+var bundleWhichCmd = &cobra.Command{
+	Use:   "which <path> [<path>...]",
+	Short: "Show the bundles containing a path",
+	Long: `Shows the bundles of a built version that contain each path, the package
+providing it, and the bundles that excluded it with an exclude() directive.
+The output of 'mixer build bundles' for the version is used.
+
+Passing '--version' queries a version other than the current mix version.`,
+	Args: cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		b, err := builder.NewFromConfig(configFile)
+		if err != nil {
+			fail(err)
+		}
+
+		version := bundleWhichFlags.version
+		if version == "" {
+			version = b.MixVer
+		}
+		err = b.WhichBundles(version, args)
+		if err != nil {
+			fail(err)
+		}
+	},
+}
+
 // List of all bundle commands
 var bundlesCmds = []*cobra.Command{
 	bundleAddCmd,
@@ -250,6 +376,9 @@ var bundlesCmds = []*cobra.Command{
 	bundleListCmd,
 	bundleCreateCmd,
 	bundleValidateCmd,
+	bundleSizeCmd,
+	bundleUpdateCostCmd,
+	bundleWhichCmd,
 }
 
 func init() {
@@ -279,4 +408,12 @@ func init() {
 
 	bundleValidateCmd.Flags().BoolVar(&bundleValidateFlags.allLocal, "all-local", false, "Validate all local bundles")
 	bundleValidateCmd.Flags().BoolVar(&bundleValidateFlags.strict, "strict", false, "Strict validation (see usage)")
+
+	bundleSizeCmd.Flags().Uint32Var(&bundleSizeFlags.version, "version", 0, "Version to report, defaults to the current mix version")
+
+	bundleUpdateCostCmd.Flags().Uint32Var(&bundleUpdateCostFlags.from, "from", 0, "Report the update from a specific version")
+	bundleUpdateCostCmd.Flags().Uint32Var(&bundleUpdateCostFlags.previousVersions, "previous-versions", 0, "Report the update from multiple previous versions")
+	bundleUpdateCostCmd.Flags().Uint32Var(&bundleUpdateCostFlags.to, "to", 0, "Report the update to a specific version, defaults to the current mix version")
+
+	bundleWhichCmd.Flags().StringVar(&bundleWhichFlags.version, "version", "", "Version to query, defaults to the current mix version")
 }
@@ -0,0 +1,96 @@
+// Copyright © 2018 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"github.com/clearlinux/mixer-tools/builder"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+var channelCmd = &cobra.Command{
+	Use:   "channel",
+	Short: "Manage the update channels of the mix",
+	Long: `Manage the update channels of the mix. Channels are declared with CHANNELS in
+the [Mixer] section of the configuration, and each has its own version URL
+directory, www/channels/<name>, pointing to its latest version. Builds don't
+change the channels, versions are promoted to them. By itself the command
+lists the channels.`,
+	Args: cobra.NoArgs,
+	Run:  runChannelList,
+}
+
+var channelListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List the channels and their latest versions",
+	Long:  `List the channels declared in the configuration and their latest versions.`,
+	Args:  cobra.NoArgs,
+	Run:   runChannelList,
+}
+
+var channelPromoteCmd = &cobra.Command{
+	Use:   "promote <version>",
+	Short: "Promote a version to a channel",
+	Long: `Set the latest version of the channel given with --to to the version, once
+its manifests, fullfiles and zero packs are verified to be built. With --from,
+the version must not be newer than the latest version of that channel.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		if channelFlags.to == "" {
+			fail(errors.New("Please supply the channel to promote the version to with --to"))
+		}
+
+		b, err := builder.NewFromConfig(configFile)
+		if err != nil {
+			fail(err)
+		}
+		if err = b.PromoteVersion(args[0], channelFlags.from, channelFlags.to, channelFlags.noSigning); err != nil {
+			fail(err)
+		}
+	},
+}
+
+var channelFlags struct {
+	from      string
+	to        string
+	noSigning bool
+}
+
+func runChannelList(cmd *cobra.Command, args []string) {
+	b, err := builder.NewFromConfig(configFile)
+	if err != nil {
+		fail(err)
+	}
+	if err = b.ListChannels(); err != nil {
+		fail(err)
+	}
+}
+
+var channelCmds = []*cobra.Command{
+	channelListCmd,
+	channelPromoteCmd,
+}
+
+func init() {
+	for _, cmd := range channelCmds {
+		channelCmd.AddCommand(cmd)
+	}
+
+	RootCmd.AddCommand(channelCmd)
+
+	channelPromoteCmd.Flags().StringVar(&channelFlags.from, "from", "", "Channel the version is promoted from")
+	channelPromoteCmd.Flags().StringVar(&channelFlags.to, "to", "", "Channel the version is promoted to")
+	channelPromoteCmd.Flags().BoolVar(&channelFlags.noSigning, "no-signing", false, "Do not sign the latest version files of the channel")
+}
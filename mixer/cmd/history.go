@@ -0,0 +1,96 @@
+// Copyright © 2018 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"github.com/clearlinux/mixer-tools/builder"
+	"github.com/spf13/cobra"
+)
+
+var historyCmd = &cobra.Command{
+	Use:   "history",
+	Short: "Query the history of the builds of the mix",
+	Long: `Query the history of the builds of the mix. Every successful build is
+recorded with its mix version, upstream version, format, minversion, the git
+commit of the workspace, the bundles added and removed, its timings and the
+sizes of its update content. By itself the command lists the builds.`,
+	Args: cobra.NoArgs,
+	Run:  runHistoryList,
+}
+
+var historyListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List the builds of the mix",
+	Long:  `List the builds recorded in the history of the mix, oldest first.`,
+	Args:  cobra.NoArgs,
+	Run:   runHistoryList,
+}
+
+var historyShowCmd = &cobra.Command{
+	Use:   "show <version>",
+	Short: "Show the build of a version",
+	Long:  `Show everything recorded in the history about the build of a version.`,
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		b, err := builder.NewFromConfig(configFile)
+		if err != nil {
+			fail(err)
+		}
+		if err = b.ShowHistory(args[0]); err != nil {
+			fail(err)
+		}
+	},
+}
+
+var historyDiffCmd = &cobra.Command{
+	Use:   "diff <from-version> <to-version>",
+	Short: "Compare the builds of two versions",
+	Long: `Compare the builds of two versions recorded in the history: their upstream
+versions, formats, minversions, git commits, bundles, durations and sizes.`,
+	Args: cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		b, err := builder.NewFromConfig(configFile)
+		if err != nil {
+			fail(err)
+		}
+		if err = b.DiffHistory(args[0], args[1]); err != nil {
+			fail(err)
+		}
+	},
+}
+
+func runHistoryList(cmd *cobra.Command, args []string) {
+	b, err := builder.NewFromConfig(configFile)
+	if err != nil {
+		fail(err)
+	}
+	if err = b.ListHistory(); err != nil {
+		fail(err)
+	}
+}
+
+var historyCmds = []*cobra.Command{
+	historyListCmd,
+	historyShowCmd,
+	historyDiffCmd,
+}
+
+func init() {
+	for _, cmd := range historyCmds {
+		historyCmd.AddCommand(cmd)
+	}
+
+	RootCmd.AddCommand(historyCmd)
+}
@@ -0,0 +1,68 @@
+// Copyright © 2018 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"github.com/clearlinux/mixer-tools/builder"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+var publishCmd = &cobra.Command{
+	Use:   "publish [version]",
+	Short: "Publish a version of the mix to a destination tree",
+	Long: `Publish a version of the mix, by default the latest one, to a destination
+tree. The fullfiles missing from the destination are copied first, then the
+packs, the bundle manifests, Manifest.MoM and its signature, and finally the
+latest version files, so clients never see a file before the files it refers
+to. The published files are then verified.
+
+The destination is a local directory, "rsync:<target>" to run rsync to a local
+or remote target, or "object:<directory>" for a directory standing in for an
+object store.`,
+	Args: cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		if publishFlags.dest == "" {
+			fail(errors.New("Please supply the destination to publish to with --dest"))
+		}
+
+		b, err := builder.NewFromConfig(configFile)
+		if err != nil {
+			fail(err)
+		}
+
+		var version string
+		if len(args) > 0 {
+			version = args[0]
+		}
+		if err = b.Publish(version, publishFlags.channel, publishFlags.dest, publishFlags.verify); err != nil {
+			fail(err)
+		}
+	},
+}
+
+var publishFlags struct {
+	dest    string
+	channel string
+	verify  bool
+}
+
+func init() {
+	RootCmd.AddCommand(publishCmd)
+
+	publishCmd.Flags().StringVar(&publishFlags.dest, "dest", "", "Destination to publish to: a directory, rsync:<target> or object:<directory>")
+	publishCmd.Flags().StringVar(&publishFlags.channel, "channel", "", "Publish the latest version files of a channel instead of those of the mix")
+	publishCmd.Flags().BoolVar(&publishFlags.verify, "verify", false, "Only verify the version is published in the destination")
+}
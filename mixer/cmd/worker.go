@@ -0,0 +1,126 @@
+// Copyright © 2018 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"runtime"
+	"sync"
+	"syscall"
+
+	"github.com/clearlinux/mixer-tools/builder"
+	"github.com/clearlinux/mixer-tools/swupd"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+var workerFlags struct {
+	queue       string
+	name        string
+	deltaMemory string
+	exitIdle    bool
+	workers     int
+}
+
+var workerCmd = &cobra.Command{
+	Use:   "worker",
+	Short: "Run fullfile and delta jobs handed out by mixer builds",
+	Long: `Run the fullfile and delta jobs of the job queue in the directory passed
+with --queue, written by 'mixer build' runs passed the same directory with
+--job-queue. The queue, and the inputs and outputs of the jobs, are accessed
+by path, so workers on other hosts must share the storage of the mix at the
+same paths. Builds verify the outputs of the jobs before using them.
+
+The worker runs --workers jobs at a time, admitting the delta jobs against
+the --delta-memory budget they share. It runs until interrupted, or until
+no job is pending with --exit-when-idle.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		if workerFlags.queue == "" {
+			fail(errors.New("Please supply the job queue directory with --queue"))
+		}
+		queue, err := swupd.NewJobQueue(workerFlags.queue)
+		if err != nil {
+			fail(err)
+		}
+
+		var limiter *swupd.MemoryLimiter
+		if workerFlags.deltaMemory != "" {
+			memory, err := builder.ParseSize(workerFlags.deltaMemory)
+			if err != nil {
+				fail(errors.Wrap(err, "invalid --delta-memory"))
+			}
+			limiter = swupd.NewMemoryLimiter(memory)
+		}
+
+		name := workerFlags.name
+		if name == "" {
+			host, _ := os.Hostname()
+			name = fmt.Sprintf("%s-%d", host, os.Getpid())
+		}
+
+		var stop chan struct{}
+		if !workerFlags.exitIdle {
+			stop = make(chan struct{})
+			signals := make(chan os.Signal, 1)
+			signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+			go func() {
+				<-signals
+				fmt.Println("Stopping after the running jobs")
+				close(stop)
+			}()
+		}
+
+		workers := workerFlags.workers
+		if workers < 1 {
+			workers = runtime.NumCPU()
+		}
+		fmt.Printf("Worker %s running %d jobs at a time from %s\n", name, workers, workerFlags.queue)
+		errs := make(chan error, workers)
+		var wg sync.WaitGroup
+		wg.Add(workers)
+		for i := 0; i < workers; i++ {
+			go func(i int) {
+				defer wg.Done()
+				errs <- queue.Work(fmt.Sprintf("%s-%d", name, i), limiter, stop)
+			}(i)
+		}
+		wg.Wait()
+		close(errs)
+		for err = range errs {
+			if err != nil {
+				fail(err)
+			}
+		}
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(workerCmd)
+
+	workerCmd.Flags().StringVar(&workerFlags.queue, "queue", "", "Directory of the job queue")
+	workerCmd.Flags().StringVar(&workerFlags.name, "name", "", "Name of the worker in the job results, defaults to the host name and process ID")
+	workerCmd.Flags().StringVar(&workerFlags.deltaMemory, "delta-memory", "", "Memory budget of the delta jobs, e.g. 16G, empty means no limit")
+	workerCmd.Flags().BoolVar(&workerFlags.exitIdle, "exit-when-idle", false, "Exit when no job is pending")
+	workerCmd.Flags().IntVar(&workerFlags.workers, "workers", 0, "Number of jobs run in parallel, 0 means the number of CPUs")
+
+	externalDeps[workerCmd] = []string{
+		"bsdiff",
+		"bspatch",
+		"xz",
+	}
+}
@@ -30,6 +30,7 @@ type BundleHeader struct {
 	Status       string
 	Capabilities string
 	Maintainer   string
+	Budget       string
 }
 
 // BundleInfo describes the JSON object to be read from the *-info files
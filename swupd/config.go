@@ -35,6 +35,9 @@ type config struct {
 	imageBase string
 	outputDir string
 	debuginfo dbgConfig
+
+	// deltaCacheDir is the directory of the delta cache, empty if disabled.
+	deltaCacheDir string
 }
 
 var defaultConfig = config{
@@ -89,6 +92,10 @@ func readServerINI(stateDir, path string) (config, error) {
 		userConfig.outputDir = key.Value()
 	}
 
+	if key, err := cfg.Section("Server").GetKey("deltacachedir"); err == nil {
+		userConfig.deltaCacheDir = key.Value()
+	}
+
 	if key, err := cfg.Section("Debuginfo").GetKey("banned"); err == nil {
 		userConfig.debuginfo.banned = (key.Value() == "true")
 	}
@@ -20,11 +20,12 @@ func TestReadServerINI(t *testing.T) {
 	if c.emptyDir != "/var/lib/update/emptytest/" ||
 		c.imageBase != "/var/lib/update/imagetest/" ||
 		c.outputDir != "/var/lib/update/wwwtest/" ||
+		c.deltaCacheDir != "/var/cache/deltatest/" ||
 		c.debuginfo.banned != true ||
 		c.debuginfo.lib != "/usr/lib/debugtest/" ||
 		c.debuginfo.src != "/usr/src/debugtest/" {
-		t.Errorf("%v\n%v\n%v\n%v\n%v\n",
-			c.imageBase, c.outputDir, c.debuginfo.banned, c.debuginfo.lib, c.debuginfo.src)
+		t.Errorf("%v\n%v\n%v\n%v\n%v\n%v\n",
+			c.imageBase, c.outputDir, c.deltaCacheDir, c.debuginfo.banned, c.debuginfo.lib, c.debuginfo.src)
 	}
 }
 
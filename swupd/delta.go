@@ -69,10 +69,10 @@ func CreateDeltasForManifest(manifest, statedir string, from, to uint32, numWork
 		return nil, err
 	}
 
-	return createDeltasFromManifests(&c, oldManifest, newManifest, numWorkers)
+	return createDeltasFromManifests(&c, oldManifest, newManifest, numWorkers, nil, nil)
 }
 
-func createDeltasFromManifests(c *config, oldManifest, newManifest *Manifest, numWorkers int) ([]Delta, error) {
+func createDeltasFromManifests(c *config, oldManifest, newManifest *Manifest, numWorkers int, limiter *MemoryLimiter, queue *JobQueue) ([]Delta, error) {
 	deltas, err := findDeltas(c, oldManifest, newManifest)
 	if err != nil {
 		return nil, errors.Wrapf(err, "Failed to create deltas list %s", newManifest.Name)
@@ -85,23 +85,29 @@ func createDeltasFromManifests(c *config, oldManifest, newManifest *Manifest, nu
 	if numWorkers < 1 {
 		numWorkers = 1
 	}
-	var deltaQueue = make(chan *Delta)
+	if queue != nil {
+		return deltas, createDeltasWithQueue(c, deltas, numWorkers, limiter, queue)
+	}
+	var deltaQueue = make(chan deltaJob)
 	var wg sync.WaitGroup
 	wg.Add(numWorkers)
 
-	// Delta creation takes a lot of memory, so create a limited amount of goroutines.
+	// Delta creation takes a lot of memory, so create a limited amount of
+	// goroutines, and admit the jobs against the memory budget if any.
 	for i := 0; i < numWorkers; i++ {
 		go func() {
 			defer wg.Done()
-			for delta := range deltaQueue {
-				delta.Error = createFileDelta(c, delta)
+			for job := range deltaQueue {
+				job.delta.Error = createFileDelta(c, job.delta)
+				limiter.Release(job.memory)
 			}
 		}()
 	}
 
 	// Send jobs to the queue for delta goroutines to pick up.
-	for i := range deltas {
-		deltaQueue <- &deltas[i]
+	for _, job := range scheduleFileDeltas(c, deltas, limiter) {
+		limiter.Acquire(job.memory)
+		deltaQueue <- job
 	}
 
 	// Send message that no more jobs are being sent
@@ -225,10 +231,14 @@ func deltaTooLarge(c *config, delta *Delta, newPath string) bool {
 	return deltaSize >= fcSize
 }
 
-func createFileDelta(c *config, delta *Delta) error {
+func fileDeltaPaths(c *config, delta *Delta) (string, string) {
 	oldPath := filepath.Join(c.imageBase, fmt.Sprint(delta.from.Version), "full", delta.from.Name)
 	newPath := filepath.Join(c.imageBase, fmt.Sprint(delta.to.Version), "full", delta.to.Name)
+	return oldPath, newPath
+}
 
+func createFileDelta(c *config, delta *Delta) error {
+	oldPath, newPath := fileDeltaPaths(c, delta)
 	return createDelta(c, oldPath, newPath, delta)
 }
 
@@ -244,6 +254,16 @@ func createDelta(c *config, oldPath, newPath string, delta *Delta) error {
 		// Skip existing deltas. Not verifying since client is resilient about that.
 		return nil
 	}
+	if cached, err := lookupDeltaCache(c, delta, newPath); cached {
+		// The delta was verified against a fullfile compressed with other
+		// settings
+		if err == nil && deltaTooLarge(c, delta, newPath) {
+			_ = os.Remove(delta.Path)
+			err = tooLargeError(delta, newPath)
+			log.Debug(log.BsDiff, err.Error())
+		}
+		return err
+	}
 
 	// Set timeout to 8 minutes (480 seconds) for bsdiff.
 	// The majority of all delta creations take significantly less than 8
@@ -256,8 +276,9 @@ func createDelta(c *config, oldPath, newPath string, delta *Delta) error {
 			// a delta is not worth. Give a better error message for that case.
 			if status, ok := exitErr.Sys().(syscall.WaitStatus); ok {
 				if status.ExitStatus() == 1 {
-					err = fmt.Errorf("bsdiff returned FULLDL, not using delta %s (%d-%s) -> %s (%d-%s)", delta.from.Name, delta.from.Version, delta.from.Hash, delta.to.Name, delta.to.Version, delta.to.Hash)
+					err = fulldlError(delta)
 					log.Debug(log.BsDiff, err.Error())
+					storeDeltaCache(c, delta, deltaRejectedFULLDL)
 					return err
 				}
 			}
@@ -271,12 +292,22 @@ func createDelta(c *config, oldPath, newPath string, delta *Delta) error {
 	// Check that delta is smaller than compressed full file
 	if deltaTooLarge(c, delta, newPath) {
 		_ = os.Remove(delta.Path)
-		errStr := fmt.Sprintf("Delta file larger than compressed full file %s (%d-%s) -> %s", delta.to.Name, delta.to.Version, delta.to.Hash, newPath)
-		log.Debug(log.BsDiff, errStr)
-		return errors.New(errStr)
+		err := tooLargeError(delta, newPath)
+		log.Debug(log.BsDiff, err.Error())
+		return err
 	}
 
 	// Check that the delta actually applies correctly.
+	if err := checkDelta(oldPath, newPath, delta); err != nil {
+		return err
+	}
+	storeDeltaCache(c, delta, "")
+	return nil
+}
+
+// checkDelta verifies that applying the delta to the old file gives the new
+// file, removing the delta otherwise.
+func checkDelta(oldPath, newPath string, delta *Delta) error {
 	testPath := delta.Path + ".testnewfile"
 	if err := helpers.RunCommandSilent(log.BsDiff, "bspatch", oldPath, testPath, delta.Path); err != nil {
 		_ = os.Remove(delta.Path)
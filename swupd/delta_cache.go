@@ -0,0 +1,160 @@
+// Copyright 2018 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package swupd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/clearlinux/mixer-tools/helpers"
+	"github.com/clearlinux/mixer-tools/log"
+	"github.com/pkg/errors"
+)
+
+// Outcomes of bsdiff cached as the rejection of a delta, so the same pair of
+// files isn't diffed again. Deltas larger than the compressed fullfile aren't
+// cached as rejected, since the fullfile size depends on the compression
+// settings.
+const (
+	deltaRejectedFULLDL = "FULLDL"
+
+	deltaRejectedSuffix = ".rejected"
+)
+
+// deltaCachePath returns the path of a delta in the delta cache, keyed by the
+// hashes of the files it goes from and to, or an empty string if the delta
+// cache is disabled.
+func deltaCachePath(c *config, delta *Delta) string {
+	if c.deltaCacheDir == "" {
+		return ""
+	}
+	from := delta.from.Hash.String()
+	return filepath.Join(c.deltaCacheDir, from[:2], from+"-"+delta.to.Hash.String())
+}
+
+func fulldlError(delta *Delta) error {
+	return fmt.Errorf("bsdiff returned FULLDL, not using delta %s (%d-%s) -> %s (%d-%s)", delta.from.Name, delta.from.Version, delta.from.Hash, delta.to.Name, delta.to.Version, delta.to.Hash)
+}
+
+func tooLargeError(delta *Delta, newPath string) error {
+	return errors.Errorf("Delta file larger than compressed full file %s (%d-%s) -> %s", delta.to.Name, delta.to.Version, delta.to.Hash, newPath)
+}
+
+// linkOrCopy hard links src to dest, copying it if it can't be linked, e.g.
+// across file systems. The file is moved in place atomically, through a
+// temporary file unique to the writer.
+func linkOrCopy(dest, src string) error {
+	f, err := ioutil.TempFile(filepath.Dir(dest), "."+filepath.Base(dest)+".")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	_ = f.Close()
+	// The name is reserved for this writer, replace the empty file with a link.
+	_ = os.Remove(tmp)
+	if err = os.Link(src, tmp); err != nil {
+		if err = helpers.CopyFile(tmp, src); err != nil {
+			_ = os.Remove(tmp)
+			return err
+		}
+	}
+	err = os.Rename(tmp, dest)
+	// Renaming a link to the file dest already links to does nothing, leaving
+	// tmp behind.
+	_ = os.Remove(tmp)
+	return err
+}
+
+// writeFileAtomic writes content to path through a temporary file unique to
+// the writer.
+func writeFileAtomic(path string, content []byte) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(content)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		// TempFile creates the file with mode 0600
+		err = os.Chmod(f.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		_ = os.Remove(f.Name())
+	}
+	return err
+}
+
+// lookupDeltaCache returns whether the delta cache knows the outcome of the
+// delta. For a verified delta, it is put in place and a nil error returned.
+// For a rejected delta, the error of the rejection is returned.
+func lookupDeltaCache(c *config, delta *Delta, newPath string) (bool, error) {
+	path := deltaCachePath(c, delta)
+	if path == "" {
+		return false, nil
+	}
+
+	reason, err := ioutil.ReadFile(path + deltaRejectedSuffix)
+	if err == nil {
+		switch strings.TrimSpace(string(reason)) {
+		case deltaRejectedFULLDL:
+			err = fulldlError(delta)
+		default:
+			// Including the too-large rejections cached by older versions
+			return false, nil
+		}
+		log.Debug(log.BsDiff, "Using cached rejection: %s", err)
+		return true, err
+	}
+
+	if _, err = os.Stat(path); err != nil {
+		return false, nil
+	}
+	if err = linkOrCopy(delta.Path, path); err != nil {
+		log.Debug(log.BsDiff, "Couldn't use cached delta %s: %s", path, err)
+		return false, nil
+	}
+	return true, nil
+}
+
+// storeDeltaCache adds a verified delta to the delta cache, or its rejection
+// when reason isn't empty. Failures only disable caching for the delta.
+func storeDeltaCache(c *config, delta *Delta, reason string) {
+	path := deltaCachePath(c, delta)
+	if path == "" {
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		log.Debug(log.BsDiff, "Couldn't create delta cache directory: %s", err)
+		return
+	}
+
+	var err error
+	if reason != "" {
+		err = writeFileAtomic(path+deltaRejectedSuffix, []byte(reason+"\n"))
+	} else {
+		err = linkOrCopy(path, delta.Path)
+	}
+	if err != nil {
+		log.Debug(log.BsDiff, "Couldn't cache delta %s: %s", path, err)
+	}
+}
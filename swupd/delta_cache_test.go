@@ -0,0 +1,114 @@
+package swupd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestDeltaCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "delta-cache-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+
+	newDelta := func(from, to string) *Delta {
+		return &Delta{
+			Path: filepath.Join(dir, "www", "20", "delta", "10-20-"+from+"-"+to),
+			from: &File{Name: "/foo", Version: 10, Hash: internHash(strings.Repeat(from, 64))},
+			to:   &File{Name: "/foo", Version: 20, Hash: internHash(strings.Repeat(to, 64))},
+		}
+	}
+	mustMkdir(t, filepath.Join(dir, "www", "20", "delta"))
+
+	// Without a cache directory nothing is cached.
+	delta := newDelta("a", "b")
+	if err = ioutil.WriteFile(delta.Path, []byte("delta"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	storeDeltaCache(&config{}, delta, "")
+	if cached, _ := lookupDeltaCache(&config{}, delta, "/new"); cached {
+		t.Fatal("unexpected cached delta without a cache directory")
+	}
+
+	c := &config{deltaCacheDir: filepath.Join(dir, "cache")}
+	storeDeltaCache(c, delta, "")
+	if err = os.Remove(delta.Path); err != nil {
+		t.Fatal(err)
+	}
+	cached, err := lookupDeltaCache(c, delta, "/new")
+	if !cached || err != nil {
+		t.Fatalf("delta not found in the cache: %v", err)
+	}
+	if content, _ := ioutil.ReadFile(delta.Path); string(content) != "delta" {
+		t.Errorf("got delta content %q from the cache", content)
+	}
+
+	// Rejections are cached with their reason.
+	rejected := newDelta("a", "c")
+	storeDeltaCache(c, rejected, deltaRejectedFULLDL)
+	cached, err = lookupDeltaCache(c, rejected, "/new")
+	if !cached || err == nil || !strings.Contains(err.Error(), "FULLDL") {
+		t.Errorf("got cached %v with error %v, expected a FULLDL rejection", cached, err)
+	}
+
+	// Too-large rejections depend on the compression settings, and those
+	// cached by older versions are ignored.
+	tooLarge := newDelta("b", "c")
+	storeDeltaCache(c, tooLarge, "too-large")
+	if cached, err = lookupDeltaCache(c, tooLarge, "/new"); cached {
+		t.Errorf("unexpected cached too-large rejection: %v", err)
+	}
+	mustNotExist(t, rejected.Path)
+
+	if cached, _ = lookupDeltaCache(c, newDelta("c", "d"), "/new"); cached {
+		t.Error("unexpected cache hit for an unknown delta")
+	}
+}
+
+func TestLinkOrCopyConcurrent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "delta-cache-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+
+	src := filepath.Join(dir, "src")
+	if err = ioutil.WriteFile(src, []byte("delta"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	dest := filepath.Join(dir, "dest")
+	var wg sync.WaitGroup
+	errs := make(chan error, 16)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- linkOrCopy(dest, src)
+			errs <- writeFileAtomic(dest+deltaRejectedSuffix, []byte("FULLDL\n"))
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Errorf("unexpected error from a concurrent writer: %s", err)
+		}
+	}
+
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 {
+		t.Errorf("got %d files, expected no temporary file left", len(entries))
+	}
+}
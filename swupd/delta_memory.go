@@ -0,0 +1,130 @@
+// Copyright 2018 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package swupd
+
+import (
+	"os"
+	"sort"
+	"sync"
+)
+
+// MemoryLimiter admits delta creation jobs against a memory budget, in the
+// order they ask for memory. A job estimated to need more than the whole
+// budget is admitted alone. A nil MemoryLimiter, or one with a zero budget,
+// admits every job.
+type MemoryLimiter struct {
+	mu      sync.Mutex
+	budget  uint64
+	used    uint64
+	waiters []memoryWaiter
+}
+
+type memoryWaiter struct {
+	n     uint64
+	ready chan struct{}
+}
+
+// NewMemoryLimiter returns a MemoryLimiter for a budget in bytes, zero meaning
+// no limit.
+func NewMemoryLimiter(budget uint64) *MemoryLimiter {
+	return &MemoryLimiter{budget: budget}
+}
+
+func (l *MemoryLimiter) limited() bool {
+	return l != nil && l.budget > 0
+}
+
+func (l *MemoryLimiter) clamp(n uint64) uint64 {
+	if n > l.budget {
+		return l.budget
+	}
+	return n
+}
+
+// Acquire blocks until n bytes of the budget are available and reserves them.
+func (l *MemoryLimiter) Acquire(n uint64) {
+	if !l.limited() {
+		return
+	}
+	n = l.clamp(n)
+	l.mu.Lock()
+	if len(l.waiters) == 0 && l.used+n <= l.budget {
+		l.used += n
+		l.mu.Unlock()
+		return
+	}
+	w := memoryWaiter{n: n, ready: make(chan struct{})}
+	l.waiters = append(l.waiters, w)
+	l.mu.Unlock()
+	<-w.ready
+}
+
+// Release returns n bytes acquired with Acquire to the budget.
+func (l *MemoryLimiter) Release(n uint64) {
+	if !l.limited() {
+		return
+	}
+	n = l.clamp(n)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.used -= n
+	for len(l.waiters) > 0 {
+		w := l.waiters[0]
+		if l.used+w.n > l.budget {
+			break
+		}
+		l.used += w.n
+		close(w.ready)
+		l.waiters = l.waiters[1:]
+	}
+}
+
+// deltaMemory estimates the memory bsdiff needs to create a delta from the
+// sizes of the old and new files: its suffix array takes 16 bytes per byte of
+// the old file, on top of both files being loaded.
+func deltaMemory(oldPath, newPath string) uint64 {
+	var oldSize, newSize uint64
+	if fi, err := os.Stat(oldPath); err == nil {
+		oldSize = uint64(fi.Size())
+	}
+	if fi, err := os.Stat(newPath); err == nil {
+		newSize = uint64(fi.Size())
+	}
+	return 17*oldSize + newSize
+}
+
+// deltaJob is a delta to create with its estimated memory.
+type deltaJob struct {
+	delta  *Delta
+	memory uint64
+}
+
+// scheduleFileDeltas returns the jobs to create the deltas. With a memory
+// limit, the largest jobs come first so the huge files, which run alone, don't
+// hold back the end of the run while the small files run in parallel.
+func scheduleFileDeltas(c *config, deltas []Delta, limiter *MemoryLimiter) []deltaJob {
+	jobs := make([]deltaJob, len(deltas))
+	for i := range deltas {
+		jobs[i].delta = &deltas[i]
+	}
+	if !limiter.limited() {
+		return jobs
+	}
+	for i := range jobs {
+		jobs[i].memory = deltaMemory(fileDeltaPaths(c, jobs[i].delta))
+	}
+	sort.SliceStable(jobs, func(i, j int) bool { return jobs[i].memory > jobs[j].memory })
+	return jobs
+}
@@ -0,0 +1,103 @@
+package swupd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func waitForWaiters(t *testing.T, l *MemoryLimiter, n int) {
+	t.Helper()
+	for i := 0; i < 1000; i++ {
+		l.mu.Lock()
+		count := len(l.waiters)
+		l.mu.Unlock()
+		if count == n {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("expected %d jobs waiting for memory", n)
+}
+
+func TestMemoryLimiter(t *testing.T) {
+	var unlimited *MemoryLimiter
+	unlimited.Acquire(100)
+	unlimited.Release(100)
+
+	l := NewMemoryLimiter(10)
+	l.Acquire(6)
+
+	admitted := make(chan uint64, 2)
+	go func() {
+		l.Acquire(6)
+		admitted <- 6
+	}()
+	waitForWaiters(t, l, 1)
+
+	// A job that fits the budget still waits behind the previous one.
+	go func() {
+		l.Acquire(1)
+		admitted <- 1
+	}()
+	waitForWaiters(t, l, 2)
+
+	l.Release(6)
+	if <-admitted+<-admitted != 7 {
+		t.Fatal("unexpected jobs admitted")
+	}
+	if l.used != 7 {
+		t.Fatalf("got %d bytes used, expected 7", l.used)
+	}
+	l.Release(6)
+	l.Release(1)
+
+	// Jobs larger than the budget run alone.
+	l.Acquire(100)
+	if l.used != 10 {
+		t.Fatalf("got %d bytes used, expected the whole budget", l.used)
+	}
+	l.Release(100)
+	if l.used != 0 {
+		t.Fatalf("got %d bytes used after releasing everything", l.used)
+	}
+}
+
+func TestScheduleFileDeltas(t *testing.T) {
+	dir, err := ioutil.TempDir("", "delta-memory-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+
+	sizes := map[string]int{"small": 10, "large": 1000}
+	for name, size := range sizes {
+		for _, version := range []string{"10", "20"} {
+			path := filepath.Join(dir, version, "full", name)
+			mustMkdir(t, filepath.Dir(path))
+			if err = ioutil.WriteFile(path, make([]byte, size), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	c := &config{imageBase: dir}
+	deltas := []Delta{
+		{from: &File{Name: "small", Version: 10}, to: &File{Name: "small", Version: 20}},
+		{from: &File{Name: "large", Version: 10}, to: &File{Name: "large", Version: 20}},
+	}
+
+	jobs := scheduleFileDeltas(c, deltas, nil)
+	if jobs[0].delta != &deltas[0] || jobs[0].memory != 0 {
+		t.Errorf("jobs reordered or estimated without a memory limit")
+	}
+
+	jobs = scheduleFileDeltas(c, deltas, NewMemoryLimiter(1<<20))
+	if jobs[0].delta != &deltas[1] || jobs[0].memory != 18*1000 || jobs[1].memory != 18*10 {
+		t.Errorf("got jobs %+v, expected the largest first", jobs)
+	}
+}
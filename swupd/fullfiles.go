@@ -49,6 +49,12 @@ type FullfilesInfo struct {
 // them in outputDir. It doesn't regenerate full files that already exist. If number
 // of workers is zero or less, 1 worker is used.
 func CreateFullfiles(m *Manifest, chrootDir, outputDir string, numWorkers int, compression []string) (*FullfilesInfo, error) {
+	return CreateFullfilesWithQueue(m, chrootDir, outputDir, numWorkers, compression, nil)
+}
+
+// CreateFullfilesWithQueue is CreateFullfiles handing the full files to the
+// workers of the queue, if not nil.
+func CreateFullfilesWithQueue(m *Manifest, chrootDir, outputDir string, numWorkers int, compression []string, queue *JobQueue) (*FullfilesInfo, error) {
 	var err error
 	if _, err = os.Stat(chrootDir); err != nil {
 		return nil, fmt.Errorf("couldn't access the full chroot: %s", err)
@@ -61,6 +67,9 @@ func CreateFullfiles(m *Manifest, chrootDir, outputDir string, numWorkers int, c
 	if numWorkers < 1 {
 		numWorkers = 1
 	}
+	if queue != nil {
+		return createFullfilesWithQueue(m, chrootDir, outputDir, numWorkers, compression, queue)
+	}
 	var wg sync.WaitGroup
 	wg.Add(numWorkers)
 
@@ -0,0 +1,647 @@
+// Copyright 2018 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package swupd
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/clearlinux/mixer-tools/log"
+	"github.com/pkg/errors"
+)
+
+// Kinds of jobs.
+const (
+	JobFullfile = "fullfile"
+	JobDelta    = "delta"
+)
+
+// Directories of a job queue. A job is written to pending, moved to claimed
+// by the worker running it, and its result written to results.
+const (
+	jobsPendingDir = "pending"
+	jobsClaimedDir = "claimed"
+	jobsResultsDir = "results"
+)
+
+// JobFile is a file a job reads or creates.
+type JobFile struct {
+	Path    string `json:"path"`
+	Name    string `json:"name"`
+	Version uint32 `json:"version"`
+	Hash    string `json:"hash"`
+}
+
+// Job is a fullfile or delta creation job, as serialised in a job queue. Its
+// inputs and outputs are paths, so workers on other hosts must see the
+// storage of the coordinator at the same paths.
+type Job struct {
+	ID   string `json:"id"`
+	Kind string `json:"kind"`
+	// Memory is the estimated memory of the job, in bytes.
+	Memory uint64 `json:"memory,omitempty"`
+
+	// A fullfile job creates Output from To, a file of type Type, trying
+	// each of the Compression methods.
+	Type        string   `json:"type,omitempty"`
+	Compression []string `json:"compression,omitempty"`
+
+	// A delta job creates Output, the delta from From to To, with the
+	// configuration of the StateDir.
+	StateDir string   `json:"state_dir,omitempty"`
+	From     *JobFile `json:"from,omitempty"`
+
+	To     *JobFile `json:"to"`
+	Output string   `json:"output"`
+
+	// Claim identifies the claim of the worker running the job.
+	Claim string `json:"claim,omitempty"`
+}
+
+// JobResult is the outcome of a job, as serialised in a job queue.
+type JobResult struct {
+	ID     string `json:"id"`
+	Worker string `json:"worker"`
+	Error  string `json:"error,omitempty"`
+	// Skipped is set when the output already existed.
+	Skipped bool `json:"skipped,omitempty"`
+	// Compression is the compression method picked for a fullfile, empty if
+	// it isn't compressed.
+	Compression string `json:"compression,omitempty"`
+}
+
+// JobQueue is a directory, possibly on storage shared by several hosts,
+// through which a coordinator hands fullfile and delta jobs to workers. The
+// coordinator runs workers of its own, and verifies the outputs of all the
+// jobs before using them.
+type JobQueue struct {
+	dir string
+
+	// Poll is the interval between scans of the queue for jobs and results.
+	Poll time.Duration
+	// Timeout is how long a job can stay claimed, e.g. by a worker that
+	// died, before it is handed to another worker.
+	Timeout time.Duration
+	// Expiry is the age at which a result no coordinator read, e.g. because
+	// its coordinator died, is removed.
+	Expiry time.Duration
+}
+
+var jobBatches, jobClaims uint64
+
+// NewJobQueue returns the job queue in dir, creating it if needed.
+func NewJobQueue(dir string) (*JobQueue, error) {
+	for _, d := range []string{jobsPendingDir, jobsClaimedDir, jobsResultsDir} {
+		if err := os.MkdirAll(filepath.Join(dir, d), 0755); err != nil {
+			return nil, errors.Wrap(err, "couldn't create the job queue")
+		}
+	}
+	return &JobQueue{
+		dir:     dir,
+		Poll:    100 * time.Millisecond,
+		Timeout: 30 * time.Minute,
+		Expiry:  24 * time.Hour,
+	}, nil
+}
+
+func (q *JobQueue) path(dir, id string) string {
+	return filepath.Join(q.dir, dir, id+".json")
+}
+
+// writeJSON writes v to path atomically, so readers never see a partial file.
+func writeJSON(path string, v interface{}) error {
+	content, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	if err = ioutil.WriteFile(tmp, content, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func readJSON(path string, v interface{}) error {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(content, v)
+}
+
+// listJobs returns the IDs of the jobs in a directory of the queue, in order,
+// with the time each was last modified.
+func (q *JobQueue) listJobs(dir string) ([]string, map[string]time.Time, error) {
+	infos, err := ioutil.ReadDir(filepath.Join(q.dir, dir))
+	if err != nil {
+		return nil, nil, err
+	}
+	var ids []string
+	times := make(map[string]time.Time)
+	for _, fi := range infos {
+		name := fi.Name()
+		if strings.HasPrefix(name, ".") || !strings.HasSuffix(name, ".json") {
+			continue
+		}
+		id := strings.TrimSuffix(name, ".json")
+		ids = append(ids, id)
+		times[id] = fi.ModTime()
+	}
+	sort.Strings(ids)
+	return ids, times, nil
+}
+
+// submit assigns IDs to the jobs and adds them to the queue. The IDs keep the
+// jobs of a batch in order, after the jobs of the batches submitted before.
+func (q *JobQueue) submit(jobs []*Job) error {
+	host, _ := os.Hostname()
+	batch := fmt.Sprintf("%016x-%s-%d-%d", time.Now().UnixNano(), host, os.Getpid(), atomic.AddUint64(&jobBatches, 1))
+	for i, job := range jobs {
+		job.ID = fmt.Sprintf("%s-%06d-%s", batch, i, job.Kind)
+		if err := writeJSON(q.path(jobsPendingDir, job.ID), job); err != nil {
+			return errors.Wrap(err, "couldn't submit job")
+		}
+	}
+	return nil
+}
+
+// claim moves the first pending job to claimed and returns it, or nil if no
+// job is pending. Renaming the job makes sure a single worker claims it, and
+// the job is then written again with the token of the claim.
+func (q *JobQueue) claim(token string) (*Job, error) {
+	ids, _, err := q.listJobs(jobsPendingDir)
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range ids {
+		claimed := q.path(jobsClaimedDir, id)
+		if err = os.Rename(q.path(jobsPendingDir, id), claimed); err != nil {
+			if os.IsNotExist(err) {
+				// Claimed by another worker.
+				continue
+			}
+			return nil, err
+		}
+
+		job := &Job{}
+		if err = readJSON(claimed, job); err != nil {
+			if err = q.writeResult(&JobResult{ID: id, Error: fmt.Sprintf("invalid job: %s", err)}); err != nil {
+				return nil, err
+			}
+			_ = os.Remove(claimed)
+			continue
+		}
+		job.Claim = token
+		if err = writeJSON(claimed, job); err != nil {
+			return nil, err
+		}
+		return job, nil
+	}
+	return nil, nil
+}
+
+func (q *JobQueue) writeResult(result *JobResult) error {
+	if err := writeJSON(q.path(jobsResultsDir, result.ID), result); err != nil {
+		return errors.Wrap(err, "couldn't write job result")
+	}
+	return nil
+}
+
+// keepClaim refreshes the modification time of a claimed job until the
+// returned function is called, so it isn't handed to another worker while it
+// waits for memory or runs.
+func (q *JobQueue) keepClaim(job *Job) func() {
+	interval := q.Timeout / 4
+	if interval < q.Poll {
+		interval = q.Poll
+	}
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				now := time.Now()
+				_ = os.Chtimes(q.path(jobsClaimedDir, job.ID), now, now)
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
+
+// finish records the result of a job claimed by the worker. The result of a
+// job handed to another worker, after its claim timed out, is dropped.
+func (q *JobQueue) finish(job *Job, result *JobResult) error {
+	claimed := q.path(jobsClaimedDir, job.ID)
+	// Moving the claim to a name of its own keeps it from being handed to
+	// another worker while it is checked.
+	owned := filepath.Join(q.dir, jobsClaimedDir, fmt.Sprintf(".%s-%d-%d", job.ID, os.Getpid(), atomic.AddUint64(&jobClaims, 1)))
+	if err := os.Rename(claimed, owned); os.IsNotExist(err) {
+		log.Warning(log.Mixer, "Job %s was handed to another worker, dropping its result", job.ID)
+		return nil
+	} else if err != nil {
+		return err
+	}
+	current := &Job{}
+	if err := readJSON(owned, current); err != nil || current.Claim != job.Claim {
+		log.Warning(log.Mixer, "Job %s was claimed by another worker, dropping its result", job.ID)
+		return os.Rename(owned, claimed)
+	}
+	if err := q.writeResult(result); err != nil {
+		return err
+	}
+	return os.Remove(owned)
+}
+
+// Work runs the jobs of the queue as the worker name, admitting them against
+// the memory limiter, until stop is closed. With a nil stop, it returns as
+// soon as no job is pending. Several goroutines can work on the same queue,
+// sharing the limiter.
+func (q *JobQueue) Work(name string, limiter *MemoryLimiter, stop <-chan struct{}) error {
+	host, _ := os.Hostname()
+	for {
+		select {
+		case <-stop:
+			return nil
+		default:
+		}
+		token := fmt.Sprintf("%s-%s-%d-%d", name, host, os.Getpid(), atomic.AddUint64(&jobClaims, 1))
+		job, err := q.claim(token)
+		if err != nil {
+			return err
+		}
+		if job == nil {
+			if stop == nil {
+				return nil
+			}
+			select {
+			case <-stop:
+				return nil
+			case <-time.After(q.Poll):
+			}
+			continue
+		}
+
+		log.Debug(log.Mixer, "Worker %s running job %s", name, job.ID)
+		release := q.keepClaim(job)
+		limiter.Acquire(job.Memory)
+		result := runJob(job)
+		limiter.Release(job.Memory)
+		result.Worker = name
+		err = q.finish(job, result)
+		release()
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// run submits the jobs and waits for their results, running them with
+// numWorkers local workers along with the workers of other processes. Each
+// result is passed to handle, in the coordinator, once.
+func (q *JobQueue) run(jobs []*Job, numWorkers int, limiter *MemoryLimiter, handle func(*Job, *JobResult)) error {
+	if len(jobs) == 0 {
+		return nil
+	}
+	if err := q.submit(jobs); err != nil {
+		return err
+	}
+	waiting := make(map[string]*Job, len(jobs))
+	for _, job := range jobs {
+		waiting[job.ID] = job
+	}
+
+	host, _ := os.Hostname()
+	stop := make(chan struct{})
+	workerErrors := make(chan error, numWorkers)
+	var wg sync.WaitGroup
+	wg.Add(numWorkers)
+	for i := 0; i < numWorkers; i++ {
+		name := fmt.Sprintf("%s-%d-%d", host, os.Getpid(), i)
+		go func() {
+			defer wg.Done()
+			if err := q.Work(name, limiter, stop); err != nil {
+				workerErrors <- err
+			}
+		}()
+	}
+	defer func() {
+		close(stop)
+		wg.Wait()
+		q.removeJobs(waiting)
+	}()
+
+	for len(waiting) > 0 {
+		ids, times, err := q.listJobs(jobsResultsDir)
+		if err != nil {
+			return err
+		}
+		for _, id := range ids {
+			job, ok := waiting[id]
+			if !ok {
+				q.expireResult(id, times[id])
+				continue
+			}
+			result := &JobResult{}
+			path := q.path(jobsResultsDir, id)
+			if err = readJSON(path, result); err != nil {
+				return errors.Wrapf(err, "couldn't read result of job %s", id)
+			}
+			_ = os.Remove(path)
+			delete(waiting, id)
+			handle(job, result)
+		}
+
+		if err = q.requeueStale(waiting); err != nil {
+			return err
+		}
+		if len(waiting) == 0 {
+			break
+		}
+		select {
+		case err = <-workerErrors:
+			return err
+		case <-time.After(q.Poll):
+		}
+	}
+	return nil
+}
+
+// requeueStale hands the jobs claimed for longer than the timeout back to the
+// other workers.
+func (q *JobQueue) requeueStale(waiting map[string]*Job) error {
+	ids, times, err := q.listJobs(jobsClaimedDir)
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if _, ok := waiting[id]; !ok || time.Since(times[id]) < q.Timeout {
+			continue
+		}
+		log.Warning(log.Mixer, "Job %s didn't complete in %s, handing it to another worker", id, q.Timeout)
+		if err = os.Rename(q.path(jobsClaimedDir, id), q.path(jobsPendingDir, id)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeJobs removes the files of the jobs a coordinator aborted without
+// their results, so they aren't run or kept for nothing.
+func (q *JobQueue) removeJobs(waiting map[string]*Job) {
+	for id := range waiting {
+		for _, d := range []string{jobsPendingDir, jobsClaimedDir, jobsResultsDir} {
+			_ = os.Remove(q.path(d, id))
+		}
+	}
+}
+
+// expireResult removes the result of a job of another coordinator once it is
+// older than the expiry, as its coordinator died without reading it.
+func (q *JobQueue) expireResult(id string, modified time.Time) {
+	if time.Since(modified) < q.Expiry {
+		return
+	}
+	log.Debug(log.Mixer, "Removing expired result of job %s", id)
+	_ = os.Remove(q.path(jobsResultsDir, id))
+}
+
+func jobFile(path string, f *File) *JobFile {
+	return &JobFile{Path: path, Name: f.Name, Version: f.Version, Hash: f.Hash.String()}
+}
+
+func (f *JobFile) file() *File {
+	return &File{Name: f.Name, Version: f.Version, Hash: internHash(f.Hash)}
+}
+
+// runJob runs a job in the worker and returns its result.
+func runJob(job *Job) *JobResult {
+	result := &JobResult{ID: job.ID}
+	var err error
+	switch {
+	case job.To == nil || job.Output == "":
+		err = errors.New("job without input or output")
+	case job.Kind == JobFullfile:
+		err = runFullfileJob(job, result)
+	case job.Kind == JobDelta && job.From != nil:
+		var c config
+		if c, err = getConfig(job.StateDir); err == nil {
+			delta := &Delta{Path: job.Output, from: job.From.file(), to: job.To.file()}
+			err = createDelta(&c, job.From.Path, job.To.Path, delta)
+		}
+	default:
+		err = errors.Errorf("invalid job kind %q", job.Kind)
+	}
+	if err != nil {
+		result.Error = err.Error()
+	}
+	return result
+}
+
+func runFullfileJob(job *Job, result *JobResult) error {
+	if _, err := os.Stat(job.Output); err == nil {
+		result.Skipped = true
+		return nil
+	}
+	if job.Type == "" {
+		return errors.New("fullfile job without file type")
+	}
+	t, err := typeFromFlag(job.Type[0])
+	if err != nil {
+		return err
+	}
+
+	info := &FullfilesInfo{CompressedCounts: make(map[string]uint)}
+	input, name := job.To.Path, job.To.Hash
+	switch t {
+	case TypeDirectory:
+		err = createDirectoryFullfile(input, name, job.Output, info)
+	case TypeLink:
+		err = createLinkFullfile(input, name, job.Output, info)
+	case TypeFile:
+		err = createRegularFullfile(input, name, job.Output, info, job.Compression)
+	default:
+		err = fmt.Errorf("file %s is of unsupported type %q", job.To.Name, t)
+	}
+	for k := range info.CompressedCounts {
+		result.Compression = k
+	}
+	return err
+}
+
+// createDeltasWithQueue creates the deltas through the job queue, verifying
+// each delta a worker created.
+func createDeltasWithQueue(c *config, deltas []Delta, numWorkers int, limiter *MemoryLimiter, queue *JobQueue) error {
+	scheduled := scheduleFileDeltas(c, deltas, limiter)
+	jobs := make([]*Job, len(scheduled))
+	byJob := make(map[*Job]*Delta, len(scheduled))
+	for i, s := range scheduled {
+		oldPath, newPath := fileDeltaPaths(c, s.delta)
+		// Workers of other processes may have a memory limit of their own
+		memory := s.memory
+		if !limiter.limited() {
+			memory = deltaMemory(oldPath, newPath)
+		}
+		jobs[i] = &Job{
+			Kind:     JobDelta,
+			Memory:   memory,
+			StateDir: c.stateDir,
+			From:     jobFile(oldPath, s.delta.from),
+			To:       jobFile(newPath, s.delta.to),
+			Output:   s.delta.Path,
+		}
+		byJob[jobs[i]] = s.delta
+	}
+
+	return queue.run(jobs, numWorkers, limiter, func(job *Job, result *JobResult) {
+		delta := byJob[job]
+		if result.Error != "" {
+			delta.Error = errors.New(result.Error)
+			return
+		}
+		delta.Error = checkDelta(job.From.Path, job.To.Path, delta)
+	})
+}
+
+// createFullfilesWithQueue creates the fullfiles through the job queue,
+// verifying each fullfile a worker created.
+func createFullfilesWithQueue(m *Manifest, chrootDir, outputDir string, numWorkers int, compression []string, queue *JobQueue) (*FullfilesInfo, error) {
+	info := &FullfilesInfo{CompressedCounts: make(map[string]uint)}
+	var jobs []*Job
+	done := make(map[Hashval]bool)
+	for _, f := range m.Files {
+		if done[f.Hash] || f.Version != m.Header.Version || f.Status == StatusDeleted || f.Status == StatusGhosted {
+			continue
+		}
+		done[f.Hash] = true
+
+		output := filepath.Join(outputDir, f.Hash.String()+".tar")
+		if _, err := os.Stat(output); err == nil {
+			info.Skipped++
+			continue
+		}
+		jobs = append(jobs, &Job{
+			Kind:        JobFullfile,
+			Type:        f.Type.String(),
+			Compression: compression,
+			To:          jobFile(filepath.Join(chrootDir, f.Name), f),
+			Output:      output,
+		})
+	}
+
+	var errs []string
+	err := queue.run(jobs, numWorkers, nil, func(job *Job, result *JobResult) {
+		if result.Error == "" {
+			if err := verifyFullfile(job.Output, job.To.Hash); err != nil {
+				_ = os.Remove(job.Output)
+				result.Error = err.Error()
+			}
+		}
+		switch {
+		case result.Error != "":
+			errs = append(errs, result.Error)
+		case result.Skipped:
+			info.Skipped++
+		case result.Compression == "":
+			info.NotCompressed++
+		default:
+			info.CompressedCounts[result.Compression]++
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(errs) > 0 {
+		for _, e := range errs {
+			log.Error(log.Mixer, e)
+		}
+		return nil, errors.Errorf("%d fullfiles failed to be created", len(errs))
+	}
+	return info, nil
+}
+
+// verifyFullfile checks that the content of a fullfile has the hash it is
+// named after.
+func verifyFullfile(path, hash string) (err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	r, err := NewCompressedTarReader(f)
+	if err != nil {
+		return errors.Wrapf(err, "couldn't read fullfile %s", path)
+	}
+	defer func() {
+		_ = r.Close()
+	}()
+	hdr, err := r.Next()
+	if err != nil {
+		return errors.Wrapf(err, "couldn't read fullfile %s", path)
+	}
+	if hdr.Name != hash {
+		return errors.Errorf("fullfile %s contains %s", path, hdr.Name)
+	}
+
+	info := &HashFileInfo{
+		Mode:     uint32(hdr.Mode),
+		UID:      uint32(hdr.Uid),
+		GID:      uint32(hdr.Gid),
+		Size:     hdr.Size,
+		Linkname: hdr.Linkname,
+	}
+	switch hdr.Typeflag {
+	case tar.TypeReg:
+		info.Mode |= syscall.S_IFREG
+	case tar.TypeDir:
+		info.Mode |= syscall.S_IFDIR
+	case tar.TypeSymlink:
+		info.Mode |= syscall.S_IFLNK
+	default:
+		return errors.Errorf("fullfile %s has unsupported type %q", path, hdr.Typeflag)
+	}
+	h, err := NewHash(info)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(h, r); err != nil {
+		return errors.Wrapf(err, "couldn't read fullfile %s", path)
+	}
+	if h.Sum() != hash {
+		return errors.Errorf("fullfile %s doesn't match its hash %s", path, hash)
+	}
+	return nil
+}
@@ -0,0 +1,269 @@
+package swupd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func mustCreateJobTestChroot(t *testing.T, chrootDir string) *Manifest {
+	t.Helper()
+	mustMkdir(t, filepath.Join(chrootDir, "dir"))
+	if err := ioutil.WriteFile(filepath.Join(chrootDir, "file"), []byte("content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("file", filepath.Join(chrootDir, "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	m := &Manifest{}
+	m.Header.Version = 20
+	for name, typeFlag := range map[string]TypeFlag{"dir": TypeDirectory, "file": TypeFile, "link": TypeLink} {
+		hash, err := GetHashForFile(filepath.Join(chrootDir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		m.Files = append(m.Files, &File{Name: name, Hash: internHash(hash), Type: typeFlag, Version: 20})
+	}
+	return m
+}
+
+func TestCreateFullfilesWithQueue(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jobs-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer removeAllIgnoreErr(dir)
+
+	chrootDir := filepath.Join(dir, "chroot")
+	outputDir := filepath.Join(dir, "output")
+	m := mustCreateJobTestChroot(t, chrootDir)
+
+	queue, err := NewJobQueue(filepath.Join(dir, "queue"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	queue.Poll = time.Millisecond
+
+	info, err := CreateFullfilesWithQueue(m, chrootDir, outputDir, 2, []string{"external-xz"}, queue)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Skipped != 0 || info.NotCompressed+info.CompressedCounts["gzip"]+info.CompressedCounts["external-xz"] != 3 {
+		t.Errorf("unexpected fullfiles info %+v", info)
+	}
+	for _, f := range m.Files {
+		path := filepath.Join(outputDir, f.Hash.String()+".tar")
+		mustHaveMatchingHash(t, path)
+		if err = verifyFullfile(path, f.Hash.String()); err != nil {
+			t.Errorf("fullfile of %s not verified: %s", f.Name, err)
+		}
+	}
+	for _, d := range []string{jobsPendingDir, jobsClaimedDir, jobsResultsDir} {
+		if ids, _, _ := queue.listJobs(d); len(ids) != 0 {
+			t.Errorf("jobs %v left in %s", ids, d)
+		}
+	}
+
+	// A fullfile that doesn't match its hash is rejected.
+	file := filepath.Join(outputDir, m.Files[0].Hash.String()+".tar")
+	if err = verifyFullfile(file, m.Files[1].Hash.String()); err == nil {
+		t.Error("unexpected verification of a fullfile with another hash")
+	}
+
+	info, err = CreateFullfilesWithQueue(m, chrootDir, outputDir, 1, []string{"external-xz"}, queue)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Skipped != 3 {
+		t.Errorf("got %d fullfiles skipped, expected 3", info.Skipped)
+	}
+}
+
+func TestJobQueueWorker(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jobs-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer removeAllIgnoreErr(dir)
+
+	chrootDir := filepath.Join(dir, "chroot")
+	m := mustCreateJobTestChroot(t, chrootDir)
+	queue, err := NewJobQueue(filepath.Join(dir, "queue"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var jobs []*Job
+	for _, f := range m.Files {
+		jobs = append(jobs, &Job{
+			Kind:        JobFullfile,
+			Type:        f.Type.String(),
+			Compression: []string{"external-gzip"},
+			To:          jobFile(filepath.Join(chrootDir, f.Name), f),
+			Output:      filepath.Join(dir, f.Hash.String()+".tar"),
+		})
+	}
+	jobs = append(jobs, &Job{Kind: "unknown", To: jobs[0].To, Output: "unused"})
+	if err = queue.submit(jobs); err != nil {
+		t.Fatal(err)
+	}
+
+	// A worker of another process runs the jobs until none is pending.
+	if err = queue.Work("remote", nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	for i, job := range jobs {
+		result := &JobResult{}
+		if err = readJSON(queue.path(jobsResultsDir, job.ID), result); err != nil {
+			t.Fatalf("no result for job %s: %s", job.ID, err)
+		}
+		if result.Worker != "remote" || (result.Error != "") != (i == len(jobs)-1) {
+			t.Errorf("unexpected result %+v", result)
+		}
+	}
+
+	// Jobs claimed for too long are handed to other workers.
+	stale := &Job{Kind: JobFullfile, To: jobs[0].To, Output: jobs[0].Output}
+	if err = queue.submit([]*Job{stale}); err != nil {
+		t.Fatal(err)
+	}
+	first, _ := queue.claim("first")
+	if first == nil || first.ID != stale.ID {
+		t.Fatalf("got claimed job %+v, expected %s", first, stale.ID)
+	}
+	queue.Timeout = time.Hour
+	if err = queue.requeueStale(map[string]*Job{stale.ID: stale}); err != nil {
+		t.Fatal(err)
+	}
+	mustNotExist(t, queue.path(jobsPendingDir, stale.ID))
+	queue.Timeout = 0
+	if err = queue.requeueStale(map[string]*Job{stale.ID: stale}); err != nil {
+		t.Fatal(err)
+	}
+	mustExist(t, queue.path(jobsPendingDir, stale.ID))
+
+	// The first worker's result is dropped once another worker claimed the
+	// job, and the job is left to that worker.
+	second, _ := queue.claim("second")
+	if second == nil || second.ID != stale.ID {
+		t.Fatalf("got claimed job %+v, expected %s", second, stale.ID)
+	}
+	if err = queue.finish(first, &JobResult{ID: first.ID, Worker: "first"}); err != nil {
+		t.Fatal(err)
+	}
+	mustNotExist(t, queue.path(jobsResultsDir, stale.ID))
+	mustExist(t, queue.path(jobsClaimedDir, stale.ID))
+	if err = queue.finish(second, &JobResult{ID: second.ID, Worker: "second"}); err != nil {
+		t.Fatal(err)
+	}
+	mustExist(t, queue.path(jobsResultsDir, stale.ID))
+	for _, d := range []string{jobsPendingDir, jobsClaimedDir} {
+		if infos, _ := ioutil.ReadDir(filepath.Join(queue.dir, d)); len(infos) != 0 {
+			t.Errorf("files left in %s", d)
+		}
+	}
+}
+
+func TestJobQueueKeepClaim(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jobs-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer removeAllIgnoreErr(dir)
+
+	queue, err := NewJobQueue(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	queue.Poll = time.Millisecond
+	queue.Timeout = 50 * time.Millisecond
+	job := &Job{Kind: JobFullfile, To: &JobFile{}, Output: "unused"}
+	if err = queue.submit([]*Job{job}); err != nil {
+		t.Fatal(err)
+	}
+	if job, err = queue.claim("waiting"); err != nil || job == nil {
+		t.Fatalf("couldn't claim job: %v", err)
+	}
+
+	// A job waiting for memory longer than the timeout keeps its claim.
+	release := queue.keepClaim(job)
+	time.Sleep(3 * queue.Timeout)
+	if err = queue.requeueStale(map[string]*Job{job.ID: job}); err != nil {
+		t.Fatal(err)
+	}
+	release()
+	mustExist(t, queue.path(jobsClaimedDir, job.ID))
+}
+
+func TestJobQueueCleanup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jobs-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer removeAllIgnoreErr(dir)
+
+	chrootDir := filepath.Join(dir, "chroot")
+	m := mustCreateJobTestChroot(t, chrootDir)
+	queue, err := NewJobQueue(filepath.Join(dir, "queue"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	queue.Poll = time.Millisecond
+
+	// Results left by coordinators that died are removed once expired.
+	old := &JobResult{ID: "old"}
+	recent := &JobResult{ID: "recent"}
+	for _, r := range []*JobResult{old, recent} {
+		if err = queue.writeResult(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	past := time.Now().Add(-2 * queue.Expiry)
+	if err = os.Chtimes(queue.path(jobsResultsDir, old.ID), past, past); err != nil {
+		t.Fatal(err)
+	}
+
+	f := m.Files[0]
+	job := &Job{
+		Kind:        JobFullfile,
+		Type:        f.Type.String(),
+		Compression: []string{"external-gzip"},
+		To:          jobFile(filepath.Join(chrootDir, f.Name), f),
+		Output:      filepath.Join(dir, f.Hash.String()+".tar"),
+	}
+	if err = queue.run([]*Job{job}, 1, nil, func(*Job, *JobResult) {}); err != nil {
+		t.Fatal(err)
+	}
+	mustNotExist(t, queue.path(jobsResultsDir, old.ID))
+	mustExist(t, queue.path(jobsResultsDir, recent.ID))
+	mustNotExist(t, queue.path(jobsResultsDir, job.ID))
+
+	// The files of the jobs of an aborted run are removed.
+	var jobs []*Job
+	for i := 0; i < 3; i++ {
+		jobs = append(jobs, &Job{Kind: JobFullfile, To: &JobFile{}, Output: "unused"})
+	}
+	if err = queue.submit(jobs); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = queue.claim("claimed"); err != nil {
+		t.Fatal(err)
+	}
+	if err = queue.writeResult(&JobResult{ID: jobs[2].ID}); err != nil {
+		t.Fatal(err)
+	}
+	waiting := make(map[string]*Job)
+	for _, j := range jobs {
+		waiting[j.ID] = j
+	}
+	queue.removeJobs(waiting)
+	for _, j := range jobs {
+		for _, d := range []string{jobsPendingDir, jobsClaimedDir, jobsResultsDir} {
+			mustNotExist(t, queue.path(d, j.ID))
+		}
+	}
+	mustExist(t, queue.path(jobsResultsDir, recent.ID))
+}
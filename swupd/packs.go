@@ -74,10 +74,28 @@ func (state PackState) String() string {
 	return "invalid"
 }
 
+// DeltaOptions configures how CreateAllDeltasWithOptions creates the deltas.
+type DeltaOptions struct {
+	// NumWorkers is the number of deltas created concurrently, zero meaning
+	// the number of CPUs.
+	NumWorkers int
+	// Limiter, if not nil, admits the deltas against its memory budget, and
+	// can be shared by concurrent calls.
+	Limiter *MemoryLimiter
+	// Queue, if not nil, hands the deltas to workers.
+	Queue *JobQueue
+}
+
 // CreateAllDeltas builds all of the deltas using the full manifest from one
 // version to the next. This allows better concurrency and the pack creation
 // code can just worry about adding pre-existing files to packs.
 func CreateAllDeltas(outputDir string, fromVersion, toVersion, numWorkers int) error {
+	return CreateAllDeltasWithOptions(outputDir, fromVersion, toVersion, DeltaOptions{NumWorkers: numWorkers})
+}
+
+// CreateAllDeltasWithOptions is CreateAllDeltas with the options to limit the
+// memory used by the deltas and to hand them to workers.
+func CreateAllDeltasWithOptions(outputDir string, fromVersion, toVersion int, opts DeltaOptions) error {
 	// Don't try to make deltas for zero packs
 	if fromVersion == 0 {
 		return nil
@@ -104,7 +122,7 @@ func CreateAllDeltas(outputDir string, fromVersion, toVersion, numWorkers int) e
 		return err
 	}
 
-	_, err = createDeltasFromManifests(&c, fromManifest, toManifest, numWorkers)
+	_, err = createDeltasFromManifests(&c, fromManifest, toManifest, opts.NumWorkers, opts.Limiter, opts.Queue)
 	if err != nil {
 		return err
 	}